@@ -0,0 +1,59 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/robinkb/cascade/registry/storage/driverbench"
+	"github.com/spf13/cobra"
+)
+
+var benchOpts driverbench.Options
+
+var benchCmd = &cobra.Command{
+	Use:   "bench <config>",
+	Short: "`bench` measures how NATS storage holds up while layers are pushed and pulled",
+	Long: "`bench` pushes layers to NATS storage at the same time, pulls them back, and reports the throughput, the latencies and the memory used. " +
+		"Run it against registry configuration files with different storage parameters, like the chunk size, to compare them",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		d, err := openDriver(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		result, err := driverbench.Run(context.Background(), d, benchOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to benchmark storage: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(result)
+		if result.Push.Errors > 0 || result.Pull.Errors > 0 {
+			os.Exit(2)
+		}
+	},
+}
+
+func init() {
+	benchCmd.Flags().IntVar(&benchOpts.Pushers, "pushers", 4, "amount of layers to push at the same time")
+	benchCmd.Flags().IntVar(&benchOpts.Pullers, "pullers", 4, "amount of layers to pull at the same time")
+	benchCmd.Flags().IntVarP(&benchOpts.Layers, "layers", "n", 16, "amount of layers to push and pull")
+	benchCmd.Flags().Int64Var(&benchOpts.LayerSize, "layer-size", 64*1024*1024, "size of every layer in bytes")
+	benchCmd.Flags().IntVar(&benchOpts.WriteSize, "write-size", 0, "amount of bytes to write layers in (default 1MiB)")
+	benchCmd.Flags().StringVar(&benchOpts.Prefix, "prefix", "", "directory to store the layers under, which is deleted afterwards (default /driverbench)")
+}
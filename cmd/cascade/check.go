@@ -0,0 +1,98 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/robinkb/cascade/registry/storage/driver"
+	"github.com/spf13/cobra"
+)
+
+var (
+	repair        bool
+	verifyDigests bool
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check <config>",
+	Short: "`check` verifies that the content in NATS storage is intact",
+	Long:  "`check` verifies that the content in NATS storage is intact, and optionally repairs or quarantines broken content",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		d, err := openDriver(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		problems, err := d.Check(context.Background(), driver.CheckOptions{
+			VerifyDigests: verifyDigests,
+			Repair:        repair,
+		})
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to check storage: %v\n", err)
+			os.Exit(1)
+		}
+		for _, p := range problems {
+			if !p.Repaired {
+				os.Exit(2)
+			}
+		}
+	},
+}
+
+func init() {
+	checkCmd.Flags().BoolVarP(&repair, "repair", "r", false, "repair broken content, or quarantine it if it cannot be repaired")
+	checkCmd.Flags().BoolVar(&verifyDigests, "verify-digests", false, "read all deduplicated content back to verify its digest")
+}
+
+// openDriver opens the NATS storage driver configured in the registry
+// configuration file at path.
+func openDriver(path string) (*driver.Driver, error) {
+	config, err := parseConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if config.Storage.Type() != "nats" {
+		return nil, fmt.Errorf("storage driver %q is not nats", config.Storage.Type())
+	}
+
+	d, err := driver.FromParameters(context.Background(), config.Storage.Parameters())
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct nats driver: %w", err)
+	}
+	return d, nil
+}
+
+// parseConfig parses the registry configuration file at path.
+func parseConfig(path string) (*configuration.Configuration, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	config, err := configuration.Parse(fp)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export <config> <archive>",
+	Short: "`export` backs up the content in NATS storage to a tar archive",
+	Long:  "`export` writes every file in NATS storage to a tar archive, or to standard output when the archive is -",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		d, err := openDriver(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		out := os.Stdout
+		if args[1] != "-" {
+			if out, err = os.Create(args[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+		}
+		w := bufio.NewWriter(out)
+		if err := d.Export(context.Background(), w); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export storage: %v\n", err)
+			os.Exit(1)
+		}
+		if err := w.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export storage: %v\n", err)
+			os.Exit(1)
+		}
+		if err := out.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export storage: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import <config> <archive>",
+	Short: "`import` restores the content in NATS storage from a tar archive",
+	Long:  "`import` stores every file in a tar archive written by export in NATS storage, or in the archive read from standard input when it is -. When the archive is a directory, the newest archive that scheduled backups wrote to it is imported",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		d, err := openDriver(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		archive := args[1]
+		if fi, err := os.Stat(archive); err == nil && fi.IsDir() {
+			if archive, err = d.LatestBackup(archive); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "importing %s\n", archive)
+		}
+
+		in := os.Stdin
+		if archive != "-" {
+			if in, err = os.Open(archive); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			defer in.Close()
+		}
+		if err := d.Import(context.Background(), bufio.NewReader(in)); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to import storage: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/azure"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/gcs"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/s3-aws"
+	"github.com/robinkb/cascade/registry/storage/driver"
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateFrom          string
+	migrateConcurrency   int
+	migrateVerifyDigests bool
+	migrateDryRun        bool
+	migrateVerbose       bool
+	migrateProgress      time.Duration
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate <config> [<rootdirectory>]",
+	Short: "`migrate` copies the storage of another registry into NATS storage",
+	Long: "`migrate` copies every file under the root directory of filesystem storage, or in the storage configured in the registry configuration file given with --from, into NATS storage. " +
+		"It skips the files that were copied before, so that it can be run again to resume",
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		d, err := openDriver(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		src, err := openSource(args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		var copied, skipped atomic.Int64
+		opts := driver.MigrateOptions{
+			Concurrency:   migrateConcurrency,
+			VerifyDigests: migrateVerifyDigests,
+			DryRun:        migrateDryRun,
+			Progress: func(path string, skip bool) {
+				verb := "copied"
+				if migrateDryRun {
+					verb = "would copy"
+				}
+				if skip {
+					verb = "skipped"
+					skipped.Add(1)
+				} else {
+					copied.Add(1)
+				}
+				if migrateVerbose {
+					fmt.Printf("%s %s\n", verb, path)
+				}
+			},
+		}
+		if migrateProgress > 0 {
+			ticker := time.NewTicker(migrateProgress)
+			defer ticker.Stop()
+			go func() {
+				for range ticker.C {
+					fmt.Printf("copied %d files so far, skipped %d\n", copied.Load(), skipped.Load())
+				}
+			}()
+		}
+
+		result, err := d.Migrate(context.Background(), src, opts)
+		verb := "copied"
+		if migrateDryRun {
+			verb = "would copy"
+		}
+		fmt.Printf("%s %d files (%d bytes), skipped %d, failed %d\n", verb, result.Copied, result.Bytes, result.Skipped, result.Failed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to migrate storage: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateFrom, "from", "", "registry configuration file of the storage to copy, instead of a root directory")
+	migrateCmd.Flags().IntVarP(&migrateConcurrency, "concurrency", "c", 0, "amount of files to copy at the same time (default 8)")
+	migrateCmd.Flags().BoolVar(&migrateVerifyDigests, "verify-digests", false, "hash every blob while it is copied, and fail the blobs that do not match their digest")
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "only report the files that would be copied")
+	migrateCmd.Flags().BoolVarP(&migrateVerbose, "verbose", "v", false, "print every file that is copied or skipped")
+	migrateCmd.Flags().DurationVar(&migrateProgress, "progress", 10*time.Second, "how often to print how many files were copied, or 0 to never")
+}
+
+// openSource opens the storage to migrate from: the filesystem storage at
+// the root directory in args, or the storage configured in --from. The
+// storage drivers that can be used are those built into cascade, which
+// include the s3, gcs and azure drivers of the registry.
+func openSource(args []string) (storagedriver.StorageDriver, error) {
+	if (len(args) == 0) == (migrateFrom == "") {
+		return nil, errors.New("either a root directory or --from must be given")
+	}
+	if len(args) != 0 {
+		src, err := filesystem.FromParameters(map[string]interface{}{
+			"rootdirectory": args[0],
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct filesystem driver: %w", err)
+		}
+		return src, nil
+	}
+
+	config, err := parseConfig(migrateFrom)
+	if err != nil {
+		return nil, err
+	}
+	// The gateway of a registry with nats storage is served by that
+	// registry, and must not be started for the storage to be read.
+	parameters := make(map[string]interface{})
+	for key, value := range config.Storage.Parameters() {
+		parameters[key] = value
+	}
+	if config.Storage.Type() == "nats" {
+		parameters["gatewayenabled"] = false
+	}
+	src, err := factory.Create(context.Background(), config.Storage.Type(), parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct %s driver: %w", config.Storage.Type(), err)
+	}
+	return src, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+func TestOpenSourceCloudStorage(t *testing.T) {
+	for name, test := range map[string]struct {
+		storage string
+		driver  string
+	}{
+		"s3": {
+			storage: `
+  s3:
+    region: us-east-1
+    regionendpoint: http://127.0.0.1:9000
+    bucket: registry
+    accesskey: access
+    secretkey: secret`,
+			driver: "s3aws",
+		},
+		"azure": {
+			storage: `
+  azure:
+    accountname: registry
+    accountkey: c2VjcmV0
+    container: registry`,
+			driver: "azure",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(config, []byte("version: 0.1\nstorage:"+test.storage+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			migrateFrom = config
+			t.Cleanup(func() { migrateFrom = "" })
+			src, err := openSource(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if src.Name() != test.driver {
+				t.Errorf("expected the %s driver, got: %s", test.driver, src.Name())
+			}
+		})
+	}
+}
+
+func TestOpenSourceNatsWithoutGateway(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	storage := fmt.Sprintf(`
+  nats:
+    clienturl: %s
+    gatewayenabled: true
+    gatewayaddr: %s
+    gatewayurl: http://%s
+    gatewaysecret: secret`, ns.ClientURL(), addr, addr)
+	if err := os.WriteFile(config, []byte("version: 0.1\nstorage:"+storage+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	migrateFrom = config
+	t.Cleanup(func() { migrateFrom = "" })
+	if _, err := openSource(nil); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.Get("http://" + addr); err == nil {
+		resp.Body.Close()
+		t.Error("expected the gateway of the source not to be served")
+	}
+}
@@ -21,6 +21,11 @@ import (
 
 func main() {
 	rootCmd := registry.RootCmd.Root()
+	rootCmd.AddCommand(checkCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(benchCmd)
 	rootCmd.Use = "cascade"
 	rootCmd.Short = "cascade"
 	rootCmd.Long = "cascade"
@@ -0,0 +1,260 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBackupRetain = 7
+
+	// backupTimeFormat is the time in the name of a backup archive,
+	// which sorts the archives from the oldest to the newest.
+	backupTimeFormat = "20060102T150405Z"
+	backupExt        = ".tar"
+	// partialExt is appended to the archive while it is written,
+	// so that a failed backup is never taken for a complete one.
+	partialExt = ".partial"
+)
+
+var (
+	// lastBackup is the time of the last backup that succeeded, so that
+	// alerts can fire when backups stop succeeding for too long.
+	lastBackup = prometheus.StorageNamespace.NewLabeledGauge("nats_backup_last_success_timestamp", "The time of the last scheduled backup of the NATS storage driver that succeeded", "seconds", "driver")
+	// failedBackups counts the scheduled backups that failed.
+	failedBackups = prometheus.StorageNamespace.NewLabeledCounter("nats_backup_failures", "The number of scheduled backups of the NATS storage driver that failed", "driver")
+)
+
+// Export writes every file of the registry to w as a tar archive, with
+// the paths of the files relative to the root and their modification
+// times. The archive holds the content as the registry sees it, so it
+// does not depend on how it is stored: deduplicated, compressed or
+// encrypted content is written out in full. Nothing should be written to
+// the registry while it is exported, because files that change while they
+// are read fail the export.
+func (d *Driver) Export(ctx context.Context, w io.Writer) error {
+	return d.export(ctx, w, false)
+}
+
+// export is Export, which skips uploads and the files that are
+// deleted while they are exported when the registry is live.
+func (d *Driver) export(ctx context.Context, w io.Writer, live bool) error {
+	tw := tar.NewWriter(w)
+	err := d.Walk(ctx, rootPath, func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() || (live && isUpload(fi.Path())) {
+			return nil
+		}
+		err := d.exportFile(ctx, tw, fi)
+		if live && errors.As(err, &storagedriver.PathNotFoundError{}) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (d *Driver) exportFile(ctx context.Context, tw *tar.Writer, fi storagedriver.FileInfo) error {
+	r, err := d.Reader(ctx, fi.Path(), 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     strings.TrimPrefix(fi.Path(), sep),
+		Size:     fi.Size(),
+		Mode:     0o644,
+		ModTime:  fi.ModTime(),
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return fmt.Errorf("failed to export %s: %w", fi.Path(), err)
+	}
+	if n != fi.Size() {
+		return fmt.Errorf("failed to export %s: it changed while it was read", fi.Path())
+	}
+	return nil
+}
+
+// Import stores every file in the tar archive read from r, like one written
+// by Export, at its path in the registry, and overwrites what is stored
+// there. Large files are stored in parts again, and blobs whose content does
+// not match their digest are not stored. Files that fail to be stored do
+// not stop the import, and are returned as errors once the whole archive
+// was read. Modification times are not restored, because the object stores
+// keep track of those themselves.
+func (d *Driver) Import(ctx context.Context, r io.Reader) error {
+	if d.driver.readOnly {
+		return ReadOnlyError{Op: "import"}
+	}
+	var errs []error
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return errors.Join(errs...)
+		}
+		if err != nil {
+			return errors.Join(append(errs, fmt.Errorf("failed to read archive: %w", err))...)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		path, err := normalizePath(sep + hdr.Name)
+		if err == nil {
+			err = d.storeFile(ctx, path, hdr.Size, tr, true)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to import %s: %w", hdr.Name, err))
+		}
+	}
+}
+
+// backup exports the registry to an archive in dir, named after prefix and
+// the current time, and removes the oldest archives of prefix so that no
+// more than retain are kept. It returns the path of the new archive.
+//
+// The registry is exported while it is live. Uploads are left out, because
+// they are not usable after a restore anyway, and files that are deleted
+// while they are exported are skipped. Files that are overwritten while they
+// are read still fail the backup, which is then tried again next time.
+func (d *Driver) backup(ctx context.Context, dir, prefix string, retain int) (string, error) {
+	name := filepath.Join(dir, prefix+"-"+time.Now().UTC().Format(backupTimeFormat)+backupExt)
+	f, err := os.Create(name + partialExt)
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	err = d.export(ctx, w, true)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(name+partialExt, name)
+	}
+	if err != nil {
+		os.Remove(name + partialExt)
+		return "", err
+	}
+
+	return name, pruneBackups(dir, prefix, retain)
+}
+
+// pruneBackups removes the oldest archives of prefix in dir,
+// so that no more than retain are left.
+func pruneBackups(dir, prefix string, retain int) error {
+	archives, err := listBackups(dir, prefix)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for len(archives) > retain {
+		if err := os.Remove(filepath.Join(dir, archives[0])); err != nil {
+			errs = append(errs, err)
+		}
+		archives = archives[1:]
+	}
+	return errors.Join(errs...)
+}
+
+// listBackups returns the names of the complete archives
+// of prefix in dir, from the oldest to the newest.
+func listBackups(dir, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var archives []string
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, prefix+"-")
+		if !ok || !strings.HasSuffix(stamp, backupExt) {
+			continue
+		}
+		// Prefixes may contain dashes, so the archives of another
+		// prefix are only told apart by the time after it.
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, backupExt)); err != nil {
+			continue
+		}
+		archives = append(archives, name)
+	}
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// LatestBackup returns the path of the newest archive that scheduled
+// backups of the registry wrote to dir, to restore it with Import.
+func (d *Driver) LatestBackup(dir string) (string, error) {
+	archives, err := listBackups(dir, d.driver.stores.bucketPrefix)
+	if err != nil {
+		return "", err
+	}
+	if len(archives) == 0 {
+		return "", fmt.Errorf("no backups of %s found in %s", d.driver.stores.bucketPrefix, dir)
+	}
+	return filepath.Join(dir, archives[len(archives)-1]), nil
+}
+
+// backupPeriodically backs the registry up to dir every interval,
+// for as long as the registry runs, and keeps retain archives.
+func (d *Driver) backupPeriodically(ctx context.Context, interval time.Duration, dir string, retain int) {
+	prefix := d.driver.stores.bucketPrefix
+	name := driverName + "_" + prefix
+	logger := logrus.WithField("driver", driverName)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		started := time.Now()
+		archive, err := d.backup(ctx, dir, prefix, retain)
+		if err != nil {
+			failedBackups.WithValues(name).Inc(1)
+			logger.WithError(err).Error("failed to back up storage")
+			continue
+		}
+		lastBackup.WithValues(name).Set(float64(time.Now().Unix()))
+		logger.WithField("archive", archive).WithField("duration", time.Since(started)).Info("backed up storage")
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// testBackupFiles are stored in every way the driver stores content.
+var testBackupFiles = map[string][]byte{
+	testRepositories + "/acme/app/_layers/sha256/abcd/link": []byte("sha256:abcd"),
+	testRepositories + "/acme/app/_manifests/tags/latest":   []byte("sha256:abcd"),
+	"/docker/registry/v2/blobs/sha256/ab/abcd/data":         bytes.Repeat([]byte("layer"), 2*minChunkSize),
+	"/empty": {},
+}
+
+// newBackupDriver returns a driver that deduplicates and compresses content.
+func newBackupDriver(t *testing.T) *Driver {
+	ns := newTestServer(t)
+	d, err := New(context.Background(), &Parameters{
+		ClientURL:   ns.ClientURL(),
+		ChunkSize:   minChunkSize,
+		Dedup:       true,
+		Compression: "zstd",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// readArchive returns the content of every file in the tar archive.
+func readArchive(t *testing.T, r io.Reader) map[string][]byte {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files["/"+hdr.Name] = content
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	d := newBackupDriver(t)
+
+	var archive bytes.Buffer
+	if err := d.Export(ctx, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if files := readArchive(t, &archive); len(files) != 0 {
+		t.Errorf("expected an empty registry to export an empty archive, got: %v", files)
+	}
+
+	for path, content := range testBackupFiles {
+		fw, err := d.Writer(ctx, path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive.Reset()
+	if err := d.Export(ctx, &archive); err != nil {
+		t.Fatal(err)
+	}
+	files := readArchive(t, &archive)
+	if len(files) != len(testBackupFiles) {
+		t.Errorf("expected every file to be exported, got %d files", len(files))
+	}
+	for path, content := range testBackupFiles {
+		if got, ok := files[path]; !ok || !bytes.Equal(got, content) {
+			t.Errorf("%s: expected its content to be exported, got %d bytes", path, len(got))
+		}
+	}
+}
+
+// deletingWriter deletes path from the driver on its first write.
+type deletingWriter struct {
+	bytes.Buffer
+	d    *Driver
+	path string
+}
+
+func (w *deletingWriter) Write(p []byte) (int, error) {
+	if w.path != "" {
+		if err := w.d.Delete(context.Background(), w.path); err != nil {
+			return 0, err
+		}
+		w.path = ""
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestExportDeletedFile(t *testing.T) {
+	ctx := context.Background()
+	d := newBackupDriver(t)
+
+	for _, live := range []bool{false, true} {
+		for path, content := range testBackupFiles {
+			if err := d.PutContent(ctx, path, content); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The last file of the walk is deleted while the first is exported.
+		w := &deletingWriter{d: d, path: "/empty"}
+		err := d.export(ctx, w, live)
+		if live && err != nil {
+			t.Errorf("expected a live export to skip the deleted file, got: %v", err)
+		}
+		if !live && !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			t.Errorf("expected the export to fail on the deleted file, got: %v", err)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	d := newBackupDriver(t)
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	corrupt := "docker/registry/v2/blobs/sha256/00/" + strings.Repeat("0", 64) + "/data"
+	for path, content := range testBackupFiles {
+		writeTarFile(t, tw, strings.TrimPrefix(path, "/"), content)
+	}
+	writeTarFile(t, tw, corrupt, []byte("corrupted"))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Import(ctx, &archive); err == nil || !strings.Contains(err.Error(), corrupt) {
+		t.Errorf("expected the corrupted blob to fail to be imported, got: %v", err)
+	}
+	for path, content := range testBackupFiles {
+		got, err := d.GetContent(ctx, path)
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: expected its content to be imported, got %d bytes: %v", path, len(got), err)
+		}
+	}
+	if _, err := d.Stat(ctx, "/"+corrupt); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected the corrupted blob not to be stored, got: %v", err)
+	}
+	// What is exported can be imported into another registry.
+	archive.Reset()
+	if err := d.Export(ctx, &archive); err != nil {
+		t.Fatal(err)
+	}
+	restored := newBackupDriver(t)
+	if err := restored.Import(ctx, &archive); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range testBackupFiles {
+		if got, err := restored.GetContent(ctx, path); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: expected its content to be restored, got %d bytes: %v", path, len(got), err)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	d := newBackupDriver(t)
+	dir := t.TempDir()
+
+	for path, content := range testBackupFiles {
+		if err := d.PutContent(ctx, path, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload := testRepositories + "/acme/app/_uploads/1234/data"
+	if err := d.PutContent(ctx, upload, []byte("upload")); err != nil {
+		t.Fatal(err)
+	}
+	// Archives of other registries in the same directory are left alone.
+	other := filepath.Join(dir, "other-20240101T000000Z.tar")
+	if err := os.WriteFile(other, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := d.backup(ctx, dir, "cascade", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := readArchive(t, f)
+	if len(files) != len(testBackupFiles) {
+		t.Errorf("expected every file but the upload to be backed up, got %d files", len(files))
+	}
+	for path, content := range testBackupFiles {
+		if got, ok := files[path]; !ok || !bytes.Equal(got, content) {
+			t.Errorf("%s: expected its content to be backed up, got %d bytes", path, len(got))
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected only the new and the other archive in the directory, got %d entries", len(entries))
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"cascade-20240101T000000Z.tar",
+		"cascade-20240102T000000Z.tar",
+		"cascade-20240103T000000Z.tar",
+		"cascade-20240104T000000Z.tar.partial",
+		"cascade-registry-20240101T000000Z.tar",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneBackups(dir, "cascade", 2); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	want := "cascade-20240102T000000Z.tar,cascade-20240103T000000Z.tar,cascade-20240104T000000Z.tar.partial,cascade-registry-20240101T000000Z.tar"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("expected the oldest archive of the prefix to be removed, got: %s", got)
+	}
+}
+
+func TestLatestBackup(t *testing.T) {
+	ctx := context.Background()
+	d := newBackupDriver(t)
+	dir := t.TempDir()
+
+	if _, err := d.LatestBackup(dir); err == nil {
+		t.Error("expected an error without any backups")
+	}
+
+	for path, content := range testBackupFiles {
+		if err := d.PutContent(ctx, path, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name, err := d.backup(ctx, dir, defaultBucketPrefix, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := filepath.Join(dir, defaultBucketPrefix+"-20240101T000000Z.tar")
+	if err := os.WriteFile(older, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := d.LatestBackup(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != name {
+		t.Fatalf("expected the newest backup %s, got: %s", name, latest)
+	}
+
+	// The newest backup restores the registry on another cluster.
+	f, err := os.Open(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	restored := newBackupDriver(t)
+	if err := restored.Import(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range testBackupFiles {
+		if got, err := restored.GetContent(ctx, path); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: expected its content to be restored, got %d bytes: %v", path, len(got), err)
+		}
+	}
+}
+
+func TestInvalidBackup(t *testing.T) {
+	ns := newTestServer(t)
+
+	for _, params := range []Parameters{
+		{BackupInterval: -1, BackupDir: t.TempDir()},
+		{BackupInterval: 1},
+		{BackupRetain: -1},
+	} {
+		params.ClientURL = ns.ClientURL()
+		if _, err := New(context.Background(), &params); err == nil {
+			t.Errorf("expected an error for backup interval %s, dir %q and retain %d", params.BackupInterval, params.BackupDir, params.BackupRetain)
+		}
+	}
+}
+
+func writeTarFile(t *testing.T, tw *tar.Writer, name string, content []byte) {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(content)),
+		Mode:     0o644,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var (
+	// breakerStates tracks the state of the circuit breaker of every driver.
+	breakerStates = prometheus.StorageNamespace.NewLabeledGauge("nats_breaker_state", "The state of the circuit breaker of the NATS storage driver: 0 when closed, 1 when open and 2 when half-open", "", "driver")
+	// breakerRejections counts the storage operations that failed fast while the circuit breaker was open.
+	breakerRejections = prometheus.StorageNamespace.NewLabeledCounter("nats_breaker_rejections", "The number of storage operations rejected by the open circuit breaker of the NATS storage driver", "driver", "operation")
+)
+
+// UnavailableError is returned by every storage operation while the circuit
+// breaker is open, because too many operations in a row failed with a
+// transient error. Like ReadOnlyError, it implements errcode.ErrorCoder,
+// and is served as 503 Service Unavailable wherever the registry reports
+// it as it is.
+type UnavailableError struct {
+	Op   string
+	Path string
+}
+
+func (e UnavailableError) Error() string {
+	return fmt.Sprintf("cannot %s %s: the storage is unavailable", e.Op, e.Path)
+}
+
+func (e UnavailableError) ErrorCode() errcode.ErrorCode {
+	return errcode.ErrorCodeUnavailable
+}
+
+// circuitBreaker opens after threshold storage operations in a row failed
+// with a transient error, like when a stream has no leader, so that the
+// operations that follow fail right away instead of each waiting for their
+// own timeouts. After the cooldown, the next operation is let through as a
+// probe, while the others keep failing. The breaker closes when the probe
+// reaches the storage, and opens again when it fails the same way.
+// Operations that fail otherwise did reach the storage, so they count as
+// successes.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	opened   time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	breakerStates.WithValues(name).Set(float64(breakerClosed))
+	return &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow returns an UnavailableError when the operation may not run.
+func (cb *circuitBreaker) allow(op, path string) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch {
+	case cb.state == breakerClosed:
+		return nil
+	case cb.state == breakerOpen && time.Since(cb.opened) >= cb.cooldown:
+		cb.set(breakerHalfOpen)
+		return nil
+	}
+	breakerRejections.WithValues(cb.name, op).Inc(1)
+	return UnavailableError{Op: op, Path: path}
+}
+
+// done records the result of an operation that was allowed to run.
+func (cb *circuitBreaker) done(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	// Operations that were given up on by their caller tell nothing.
+	if errors.Is(err, context.Canceled) {
+		if cb.state == breakerHalfOpen {
+			cb.set(breakerOpen)
+		}
+		return
+	}
+	if err == nil || !isTransient(err) {
+		cb.failures = 0
+		cb.set(breakerClosed)
+		return
+	}
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.opened = time.Now()
+		cb.set(breakerOpen)
+	}
+}
+
+func (cb *circuitBreaker) set(state breakerState) {
+	if cb.state != state {
+		cb.state = state
+		breakerStates.WithValues(cb.name).Set(float64(state))
+	}
+}
+
+// breakerDriver runs the storage operations through a circuit breaker. The
+// content that is streamed by readers and writers once they are opened
+// does not pass through it.
+type breakerDriver struct {
+	storagedriver.StorageDriver
+	breaker *circuitBreaker
+}
+
+func (bd *breakerDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := bd.breaker.allow("GetContent", path); err != nil {
+		return nil, err
+	}
+	content, err := bd.StorageDriver.GetContent(ctx, path)
+	bd.breaker.done(err)
+	return content, err
+}
+
+func (bd *breakerDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := bd.breaker.allow("PutContent", path); err != nil {
+		return err
+	}
+	err := bd.StorageDriver.PutContent(ctx, path, content)
+	bd.breaker.done(err)
+	return err
+}
+
+func (bd *breakerDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if err := bd.breaker.allow("Reader", path); err != nil {
+		return nil, err
+	}
+	reader, err := bd.StorageDriver.Reader(ctx, path, offset)
+	bd.breaker.done(err)
+	return reader, err
+}
+
+func (bd *breakerDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if err := bd.breaker.allow("Writer", path); err != nil {
+		return nil, err
+	}
+	fw, err := bd.StorageDriver.Writer(ctx, path, append)
+	bd.breaker.done(err)
+	return fw, err
+}
+
+func (bd *breakerDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if err := bd.breaker.allow("Stat", path); err != nil {
+		return nil, err
+	}
+	fi, err := bd.StorageDriver.Stat(ctx, path)
+	bd.breaker.done(err)
+	return fi, err
+}
+
+func (bd *breakerDriver) List(ctx context.Context, path string) ([]string, error) {
+	if err := bd.breaker.allow("List", path); err != nil {
+		return nil, err
+	}
+	files, err := bd.StorageDriver.List(ctx, path)
+	bd.breaker.done(err)
+	return files, err
+}
+
+func (bd *breakerDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := bd.breaker.allow("Move", sourcePath); err != nil {
+		return err
+	}
+	err := bd.StorageDriver.Move(ctx, sourcePath, destPath)
+	bd.breaker.done(err)
+	return err
+}
+
+func (bd *breakerDriver) Delete(ctx context.Context, path string) error {
+	if err := bd.breaker.allow("Delete", path); err != nil {
+		return err
+	}
+	err := bd.StorageDriver.Delete(ctx, path)
+	bd.breaker.done(err)
+	return err
+}
+
+func (bd *breakerDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	if err := bd.breaker.allow("Walk", path); err != nil {
+		return err
+	}
+	err := bd.StorageDriver.Walk(ctx, path, f, options...)
+	bd.breaker.done(err)
+	return err
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// statDriver fails every Stat with err, and counts the calls.
+type statDriver struct {
+	storagedriver.StorageDriver
+	err   error
+	calls int
+}
+
+func (sd *statDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	sd.calls++
+	return nil, sd.err
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	next := &statDriver{err: nats.ErrTimeout}
+	bd := &breakerDriver{StorageDriver: next, breaker: newCircuitBreaker("test", 2, 50*time.Millisecond)}
+
+	for i := 0; i < 2; i++ {
+		if _, err := bd.Stat(ctx, "/file"); !errors.Is(err, nats.ErrTimeout) {
+			t.Fatalf("expected the operation to be tried, got: %v", err)
+		}
+	}
+	_, err := bd.Stat(ctx, "/file")
+	var unavailableErr UnavailableError
+	if !errors.As(err, &unavailableErr) || next.calls != 2 {
+		t.Fatalf("expected the open breaker to fail right away, got %d calls: %v", next.calls, err)
+	}
+	if code := unavailableErr.ErrorCode().Descriptor().HTTPStatusCode; code != http.StatusServiceUnavailable {
+		t.Errorf("expected an open breaker to be served as %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	// The probe after the cooldown fails the same way, so the breaker opens again.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := bd.Stat(ctx, "/file"); !errors.Is(err, nats.ErrTimeout) || next.calls != 3 {
+		t.Fatalf("expected a probe after the cooldown, got %d calls: %v", next.calls, err)
+	}
+	if _, err := bd.Stat(ctx, "/file"); !errors.As(err, &UnavailableError{}) {
+		t.Fatalf("expected the failed probe to open the breaker, got: %v", err)
+	}
+
+	// Errors of a storage that responds close the breaker.
+	time.Sleep(50 * time.Millisecond)
+	next.err = jetstream.ErrObjectNotFound
+	if _, err := bd.Stat(ctx, "/file"); !errors.Is(err, jetstream.ErrObjectNotFound) {
+		t.Fatalf("expected a probe after the cooldown, got: %v", err)
+	}
+	next.err = nats.ErrTimeout
+	if _, err := bd.Stat(ctx, "/file"); !errors.Is(err, nats.ErrTimeout) || next.calls != 5 {
+		t.Errorf("expected the breaker to be closed, got %d calls: %v", next.calls, err)
+	}
+}
+
+func TestCircuitBreakerUnavailableServer(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:        ns.ClientURL(),
+		APITimeout:       100 * time.Millisecond,
+		MaxRetries:       -1,
+		BreakerThreshold: 3,
+		BreakerCooldown:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	ns.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		if _, err := d.Stat(ctx, "/file"); err == nil || errors.As(detailOf(err), &UnavailableError{}) {
+			t.Fatalf("expected the storage to be tried, got: %v", err)
+		}
+	}
+	start := time.Now()
+	if _, err := d.Stat(ctx, "/file"); !errors.As(detailOf(err), &UnavailableError{}) {
+		t.Fatalf("expected the storage to be unavailable, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected the open breaker to fail right away, took %s", elapsed)
+	}
+}
+
+func TestInvalidBreaker(t *testing.T) {
+	ns := newTestServer(t)
+
+	for name, params := range map[string]*Parameters{
+		"threshold": {BreakerThreshold: -1},
+		"cooldown":  {BreakerCooldown: -time.Second},
+	} {
+		t.Run(name, func(t *testing.T) {
+			params.ClientURL = ns.ClientURL()
+			if _, err := New(context.Background(), params); err == nil {
+				t.Error("expected a negative breaker setting to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// uncachedPathMarkers are path components under which the registry
+// writes far more often than it reads, so caching them only churns the cache.
+var uncachedPathMarkers = []string{
+	"/_uploads/",
+}
+
+// objectCache is an LRU cache of small objects and their FileInfo.
+//
+// Writes made through this driver invalidate the cache right away. Writes
+// made by other registry instances, like moving a tag, are picked up by
+// watching the object stores, which takes a moment. Entries also expire
+// after the TTL, in case an update was missed while reconnecting.
+//
+// A nil *objectCache is valid, and caches nothing.
+type objectCache struct {
+	mu            sync.Mutex
+	maxEntries    int
+	maxObjectSize int64
+	ttl           time.Duration
+
+	lru     *list.List
+	entries map[string]*list.Element
+	// below holds the entries below every directory that has any,
+	// so that invalidating a directory does not scan every entry.
+	below map[string]map[string]*list.Element
+
+	// gen counts invalidations, and invalidated holds the last one of every
+	// path. Content and info that were read before their path or a parent
+	// was invalidated are stale, and are not added. Fills from before floor
+	// are never added, because invalidated is cleared once it grows too big.
+	gen         uint64
+	invalidated map[string]uint64
+	floor       uint64
+
+	hits   int
+	misses int
+}
+
+type cacheEntry struct {
+	path    string
+	info    storagedriver.FileInfo
+	content []byte
+	expires time.Time
+}
+
+// newObjectCache returns a cache of up to maxEntries objects, or nil if
+// maxEntries is not positive. Entries never expire when ttl is zero.
+func newObjectCache(maxEntries int, maxObjectSize int64, ttl time.Duration) *objectCache {
+	if maxEntries <= 0 {
+		return nil
+	}
+
+	return &objectCache{
+		maxEntries:    maxEntries,
+		maxObjectSize: maxObjectSize,
+		ttl:           ttl,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+		below:         make(map[string]map[string]*list.Element),
+		invalidated:   make(map[string]uint64),
+	}
+}
+
+// parents returns the directories that path is in, up to the root.
+func parents(path string) []string {
+	dirs := make([]string, 0)
+	for path != rootPath {
+		i := strings.LastIndex(path, sep)
+		if i <= 0 {
+			path = rootPath
+		} else {
+			path = path[:i]
+		}
+		dirs = append(dirs, path)
+	}
+	return dirs
+}
+
+func cacheable(path string) bool {
+	for _, marker := range uncachedPathMarkers {
+		if strings.Contains(path, marker) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *objectCache) getContent(path string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.lookup(path); ok {
+		entry := elem.Value.(*cacheEntry)
+		if entry.content != nil {
+			c.lru.MoveToFront(elem)
+			c.hits++
+			return entry.content, true
+		}
+	}
+
+	c.misses++
+	return nil, false
+}
+
+func (c *objectCache) getInfo(path string) (storagedriver.FileInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.lookup(path); ok {
+		entry := elem.Value.(*cacheEntry)
+		if entry.info != nil {
+			c.lru.MoveToFront(elem)
+			c.hits++
+			return entry.info, true
+		}
+	}
+
+	c.misses++
+	return nil, false
+}
+
+// lookup returns the element of path, unless it has expired.
+func (c *objectCache) lookup(path string) (*list.Element, bool) {
+	elem, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	if c.ttl > 0 && time.Now().After(elem.Value.(*cacheEntry).expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	return elem, true
+}
+
+// remove evicts the entry of elem.
+func (c *objectCache) remove(elem *list.Element) {
+	path := elem.Value.(*cacheEntry).path
+	c.lru.Remove(elem)
+	delete(c.entries, path)
+	for _, dir := range parents(path) {
+		delete(c.below[dir], path)
+		if len(c.below[dir]) == 0 {
+			delete(c.below, dir)
+		}
+	}
+}
+
+// generation returns the generation that must be passed along with
+// content or info that is read after it, to tell whether it is stale.
+func (c *objectCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// stale returns whether path or a parent was invalidated
+// after content or info was read at generation gen.
+func (c *objectCache) stale(path string, gen uint64) bool {
+	if gen < c.floor || c.invalidated[path] > gen {
+		return true
+	}
+	for _, dir := range parents(path) {
+		if c.invalidated[dir] > gen {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *objectCache) addContent(path string, content []byte, gen uint64) {
+	if c == nil || !cacheable(path) || int64(len(content)) > c.maxObjectSize {
+		return
+	}
+
+	c.add(path, gen, func(entry *cacheEntry) {
+		entry.content = content
+	})
+}
+
+func (c *objectCache) addInfo(path string, info storagedriver.FileInfo, gen uint64) {
+	// Directories come and go as their children do, so only files are cached.
+	if c == nil || !cacheable(path) || info.IsDir() {
+		return
+	}
+
+	c.add(path, gen, func(entry *cacheEntry) {
+		entry.info = info
+	})
+}
+
+func (c *objectCache) add(path string, gen uint64, update func(*cacheEntry)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stale(path, gen) {
+		return
+	}
+
+	if elem, ok := c.lookup(path); ok {
+		update(elem.Value.(*cacheEntry))
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	entry := &cacheEntry{
+		path:    path,
+		expires: time.Now().Add(c.ttl),
+	}
+	update(entry)
+	elem := c.lru.PushFront(entry)
+	c.entries[path] = elem
+	for _, dir := range parents(path) {
+		if c.below[dir] == nil {
+			c.below[dir] = make(map[string]*list.Element)
+		}
+		c.below[dir][path] = elem
+	}
+
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate evicts path and everything below it.
+func (c *objectCache) invalidate(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.invalidated) >= c.maxEntries {
+		clear(c.invalidated)
+		c.floor = c.gen + 1
+	}
+	c.gen++
+	c.invalidated[path] = c.gen
+
+	if elem, ok := c.entries[path]; ok {
+		c.remove(elem)
+	}
+	for _, elem := range c.below[path] {
+		c.remove(elem)
+	}
+}
+
+// watch invalidates the paths of the objects in obs whenever they change,
+// for as long as the driver runs, or until the returned stop is called.
+func (c *objectCache) watch(ctx context.Context, obs jetstream.ObjectStore) (stop func(), err error) {
+	if c == nil {
+		return func() {}, nil
+	}
+
+	watcher, err := obs.Watch(context.WithoutCancel(ctx), jetstream.UpdatesOnly())
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		updates := watcher.Updates()
+		for {
+			select {
+			case info, ok := <-updates:
+				if !ok {
+					return
+				}
+				// Parts are only ever read through the object they belong to,
+				// which is rewritten whenever its parts change.
+				if info == nil || info.Headers.Get(headerMultipartPart) != "" {
+					continue
+				}
+				c.invalidate(objectPath(info))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		_ = watcher.Stop()
+		close(done)
+	}, nil
+}
+
+// invalidatingFileWriter evicts its path from the cache whenever the
+// content behind it may have changed.
+type invalidatingFileWriter struct {
+	storagedriver.FileWriter
+	cache *objectCache
+	path  string
+}
+
+func (fw *invalidatingFileWriter) Close() error {
+	defer fw.cache.invalidate(fw.path)
+	return fw.FileWriter.Close()
+}
+
+func (fw *invalidatingFileWriter) Cancel(ctx context.Context) error {
+	defer fw.cache.invalidate(fw.path)
+	return fw.FileWriter.Cancel(ctx)
+}
+
+func (fw *invalidatingFileWriter) Commit(ctx context.Context) error {
+	defer fw.cache.invalidate(fw.path)
+	return fw.FileWriter.Commit(ctx)
+}
@@ -0,0 +1,327 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// newTestObjectStore returns a handle on the root object store that
+// bypasses the driver, to change content behind its back.
+func newTestObjectStore(t *testing.T, ns *server.Server) jetstream.ObjectStore {
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obs, err := js.ObjectStore(context.Background(), bucketName(defaultBucketPrefix, rootStoreName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obs
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:          ns.ClientURL(),
+		CacheMaxEntries:    16,
+		CacheMaxObjectSize: defaultCacheMaxObjectSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	path := "/docker/registry/v2/blobs/sha256/ab/abcdef/data"
+	if err := d.PutContent(ctx, path, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetContent(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second read should be served from the cache.
+	hits := d.driver.cache.hits
+	content, err := d.GetContent(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Errorf("expected cached content, got: %q", content)
+	}
+	if d.driver.cache.hits != hits+1 {
+		t.Error("expected the second read to hit the cache")
+	}
+
+	// Writing through the driver invalidates the cache.
+	if err := d.PutContent(ctx, path, []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	content, err = d.GetContent(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "updated" {
+		t.Errorf("expected updated content, got: %q", content)
+	}
+
+	// Deleting through the driver evicts the cached content.
+	if err := d.Delete(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetContent(ctx, path); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected path not found after delete, got: %v", err)
+	}
+
+	// Deleting behind the driver's back is picked up by the watcher.
+	if err := d.PutContent(ctx, path, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetContent(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := obs.Delete(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 5*time.Second, func() error {
+		if _, err := d.GetContent(ctx, path); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			return fmt.Errorf("expected path not found after delete, got: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestCacheWatchesChanges(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:          ns.ClientURL(),
+		CacheMaxEntries:    16,
+		CacheMaxObjectSize: defaultCacheMaxObjectSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	path := "/docker/registry/v2/repositories/library/alpine/_manifests/tags/latest/current/link"
+	if err := d.PutContent(ctx, path, []byte("sha256:aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetContent(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another registry instance moves the tag.
+	if _, err := obs.PutBytes(ctx, path, []byte("sha256:bbbb")); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, 5*time.Second, func() error {
+		content, err := d.GetContent(ctx, path)
+		if err != nil {
+			return err
+		}
+		if string(content) != "sha256:bbbb" {
+			return fmt.Errorf("expected tag link to be read from the store, got: %q", content)
+		}
+		return nil
+	})
+}
+
+func TestObjectCacheConcurrentFills(t *testing.T) {
+	c := newObjectCache(16, defaultCacheMaxObjectSize, 0)
+	path := "/docker/registry/v2/repositories/library/alpine/_manifests/tags/latest/current/link"
+
+	// stored stands in for the object store. The writer updates it and
+	// invalidates the cache in one go, so that whatever is cached must
+	// always match it, while readers fill the cache.
+	var mu sync.Mutex
+	stored := "0"
+	read := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return stored
+	}
+	check := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if content, ok := c.getContent(path); ok && string(content) != stored {
+			return fmt.Errorf("expected %q to be cached, got: %q", stored, content)
+		}
+		return nil
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := check(); err != nil {
+					errs <- err
+					return
+				}
+				gen := c.generation()
+				content := read()
+				runtime.Gosched()
+				c.addContent(path, []byte(content), gen)
+			}
+		}()
+	}
+	for i := range 10000 {
+		mu.Lock()
+		stored = strconv.Itoa(i)
+		c.invalidate(path)
+		mu.Unlock()
+		runtime.Gosched()
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if err := check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestObjectCacheDropsStaleFills(t *testing.T) {
+	c := newObjectCache(16, defaultCacheMaxObjectSize, 0)
+
+	// Content that was read before the path was invalidated is stale.
+	gen := c.generation()
+	c.invalidate("/dir/a")
+	c.addContent("/dir/a", []byte("old"), gen)
+	if _, ok := c.getContent("/dir/a"); ok {
+		t.Error("expected content read before an invalidation to not be cached")
+	}
+
+	// The same goes for invalidating one of its parents.
+	gen = c.generation()
+	c.invalidate("/dir")
+	c.addContent("/dir/a", []byte("old"), gen)
+	if _, ok := c.getContent("/dir/a"); ok {
+		t.Error("expected content read before invalidating its parent to not be cached")
+	}
+
+	// Invalidating other paths does not make it stale.
+	gen = c.generation()
+	c.invalidate("/other")
+	c.invalidate("/dir/b")
+	c.addContent("/dir/a", []byte("new"), gen)
+	if _, ok := c.getContent("/dir/a"); !ok {
+		t.Error("expected content to be cached")
+	}
+
+	// Content that was read before invalidations are forgotten is dropped.
+	gen = c.generation()
+	for i := range 16 {
+		c.invalidate(fmt.Sprintf("/forgotten/%d", i))
+	}
+	c.addContent("/forgotten/0", []byte("old"), gen)
+	if _, ok := c.getContent("/forgotten/0"); ok {
+		t.Error("expected content read before invalidations were forgotten to not be cached")
+	}
+}
+
+func TestCacheSkipsUploads(t *testing.T) {
+	c := newObjectCache(16, defaultCacheMaxObjectSize, 0)
+
+	path := "/docker/registry/v2/repositories/library/alpine/_uploads/id/startedat"
+	c.addContent(path, []byte("2024-01-01T00:00:00Z"), c.generation())
+	if _, ok := c.getContent(path); ok {
+		t.Error("expected uploads to not be cached")
+	}
+}
+
+func TestObjectCacheExpiry(t *testing.T) {
+	c := newObjectCache(16, defaultCacheMaxObjectSize, 50*time.Millisecond)
+
+	c.addContent("/a", []byte("a"), c.generation())
+	if _, ok := c.getContent("/a"); !ok {
+		t.Fatal("expected /a to be cached")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.getContent("/a"); ok {
+		t.Error("expected /a to have expired")
+	}
+}
+
+func TestObjectCacheEviction(t *testing.T) {
+	c := newObjectCache(2, 8, 0)
+
+	c.addContent("/a", []byte("a"), c.generation())
+	c.addContent("/b", []byte("b"), c.generation())
+	c.getContent("/a")
+	c.addContent("/c", []byte("c"), c.generation())
+
+	if _, ok := c.getContent("/b"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	for _, path := range []string{"/a", "/c"} {
+		if _, ok := c.getContent(path); !ok {
+			t.Errorf("expected %s to be cached", path)
+		}
+	}
+
+	c.addContent("/large", []byte("larger than eight bytes"), c.generation())
+	if _, ok := c.getContent("/large"); ok {
+		t.Error("expected objects over the size limit to not be cached")
+	}
+
+	c.addContent("/dir/a", []byte("a"), c.generation())
+	c.addContent("/dirs", []byte("a"), c.generation())
+	c.invalidate("/dir")
+	if _, ok := c.getContent("/dir/a"); ok {
+		t.Error("expected invalidating a directory to evict its children")
+	}
+	if _, ok := c.getContent("/dirs"); !ok {
+		t.Error("expected invalidating a directory to keep paths that share its prefix")
+	}
+	if len(c.below) != 1 {
+		t.Errorf("expected only the root to hold entries, got: %v", c.below)
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// Broken objects are quarantined under this prefix, which is hidden
+	// from listings like deduplicated content, and kept until they are
+	// deleted by hand.
+	quarantineTemplate = "quarantine/%s"
+	// headerQuarantinedPath replaces the Cascade-Path header of a
+	// quarantined object, so that it no longer shows up at its path.
+	headerQuarantinedPath = "Cascade-Quarantined-Path"
+)
+
+// ProblemKind describes what is wrong with a stored object.
+type ProblemKind string
+
+const (
+	// ProblemInvalidHeader is an object whose multipart, link or
+	// deduplication headers cannot be parsed.
+	ProblemInvalidHeader ProblemKind = "invalid-header"
+	// ProblemMissingPart is multipart content that lists a part which does not exist.
+	ProblemMissingPart ProblemKind = "missing-part"
+	// ProblemSizeMismatch is multipart content whose size differs from the size of its parts.
+	ProblemSizeMismatch ProblemKind = "size-mismatch"
+	// ProblemDanglingLink is a link to deduplicated content that does not exist.
+	ProblemDanglingLink ProblemKind = "dangling-link"
+	// ProblemDigestMismatch is deduplicated content that does not match its digest.
+	ProblemDigestMismatch ProblemKind = "digest-mismatch"
+	// ProblemReferenceMismatch is deduplicated content whose reference
+	// count differs from the amount of links to it.
+	ProblemReferenceMismatch ProblemKind = "reference-mismatch"
+	// ProblemUnreferenced is deduplicated content that nothing links to.
+	ProblemUnreferenced ProblemKind = "unreferenced"
+)
+
+// Problem is an inconsistency in how content is stored, found by Check.
+type Problem struct {
+	// Store is the bucket of the object store that the object is kept in.
+	Store string
+	// Object is the name of the object.
+	Object string
+	// Path is the path that the object stores the content of, if any.
+	Path   string
+	Kind   ProblemKind
+	Detail string
+	// Repaired is set when Check repaired the problem, or
+	// quarantined the object when it could not be repaired.
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s: %s/%s", p.Kind, p.Store, p.Object)
+	if p.Path != "" && p.Path != p.Object {
+		s += fmt.Sprintf(" (%s)", p.Path)
+	}
+	s += ": " + p.Detail
+	if p.Repaired {
+		s += " [repaired]"
+	}
+	return s
+}
+
+// CheckOptions configure what Check does.
+type CheckOptions struct {
+	// VerifyDigests reads all deduplicated content back,
+	// to verify that it matches its digest.
+	VerifyDigests bool
+	// Repair fixes the problems that can be fixed without losing content.
+	// Objects whose content is broken are quarantined instead, so that
+	// the registry no longer serves them. Nothing may be written to the
+	// registry while it is repaired, because content that is being
+	// committed can look unreferenced.
+	Repair bool
+}
+
+// Check verifies that the objects in every store of the driver are
+// consistent with each other, like after a node of the NATS cluster
+// crashed, and returns the problems that it found.
+//
+// Check does not report orphaned parts, which PurgeUploads deletes.
+// Quarantining content may leave links to it dangling, which are
+// found when Check is run again.
+func (d *Driver) Check(ctx context.Context, opts CheckOptions) ([]Problem, error) {
+	if opts.Repair && d.driver.readOnly {
+		return nil, ReadOnlyError{Op: "repair"}
+	}
+	return d.driver.check(ctx, opts)
+}
+
+// storeObjects are the objects of a store, by their name.
+type storeObjects struct {
+	obs     jetstream.ObjectStore
+	bucket  string
+	objects map[string]*jetstream.ObjectInfo
+	// chunks are the names of the chunks of chunked content, by its name.
+	chunks map[string][]string
+}
+
+func (d *driver) check(ctx context.Context, opts CheckOptions) ([]Problem, error) {
+	stores, err := d.stores.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Links can be in any store, so all of them are counted before
+	// the references of deduplicated content are checked.
+	listed := make([]storeObjects, 0, len(stores))
+	links := make(map[string]int)
+	for _, obs := range stores {
+		status, err := obs.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		so := storeObjects{obs: obs, bucket: status.Bucket(), objects: make(map[string]*jetstream.ObjectInfo)}
+		err = eachStoreObject(ctx, obs, func(info *jetstream.ObjectInfo) error {
+			so.objects[info.Name] = info
+			if isLink(info) {
+				links[info.Headers.Get(headerLinkDigest)]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Chunks are referenced by the content that they are part of, like
+		// content is by links, including content that was quarantined.
+		if obs == d.dedup.obs {
+			so.chunks = make(map[string][]string)
+			for name, info := range so.objects {
+				if !isChunked(info) {
+					continue
+				}
+				chunks, err := chunkNames(ctx, obs, name)
+				if err != nil {
+					return nil, err
+				}
+				so.chunks[name] = chunks
+				for _, chunk := range chunks {
+					links[chunk]++
+				}
+			}
+		}
+		listed = append(listed, so)
+	}
+
+	problems := make([]Problem, 0)
+	for _, so := range listed {
+		for _, info := range so.objects {
+			found, err := d.checkObject(ctx, so, info, links, opts)
+			if err != nil {
+				return problems, err
+			}
+			problems = append(problems, found...)
+		}
+	}
+	return problems, nil
+}
+
+// checkObject returns the problems with the object described by info.
+func (d *driver) checkObject(ctx context.Context, so storeObjects, info *jetstream.ObjectInfo, links map[string]int, opts CheckOptions) ([]Problem, error) {
+	if strings.HasPrefix(info.Name, fmt.Sprintf(quarantineTemplate, "")) {
+		return nil, nil
+	}
+	problem := func(kind ProblemKind, format string, args ...any) Problem {
+		return Problem{
+			Store:  so.bucket,
+			Object: info.Name,
+			Path:   objectPath(info),
+			Kind:   kind,
+			Detail: fmt.Sprintf(format, args...),
+		}
+	}
+	content := so.obs == d.dedup.obs && strings.HasPrefix(info.Name, fmt.Sprintf(dedupTemplate, "")) && !isPart(info, so.objects)
+	chunk := so.obs == d.dedup.obs && strings.HasPrefix(info.Name, fmt.Sprintf(chunkTemplate, ""))
+
+	var problems []Problem
+	switch {
+	case isLink(info):
+		if _, err := linkSize(info); err != nil {
+			problems = append(problems, problem(ProblemInvalidHeader, "%v", err))
+			break
+		}
+		target := dedupName(info.Headers.Get(headerLinkDigest))
+		if _, err := d.dedup.obs.GetInfo(ctx, target); errors.Is(err, jetstream.ErrObjectNotFound) {
+			problems = append(problems, problem(ProblemDanglingLink, "links to %s, which does not exist", target))
+		} else if err != nil {
+			return nil, err
+		}
+
+	case isMultipart(info):
+		parts, err := strconv.Atoi(info.Headers.Get(headerMultipartCount))
+		if err != nil || parts < 1 {
+			problems = append(problems, problem(ProblemInvalidHeader, "invalid part count %q", info.Headers.Get(headerMultipartCount)))
+			break
+		}
+		size, err := strconv.ParseInt(info.Headers.Get(headerMultipartSize), 0, 64)
+		if err != nil {
+			problems = append(problems, problem(ProblemInvalidHeader, "invalid size %q", info.Headers.Get(headerMultipartSize)))
+			break
+		}
+
+		var stored int64
+		missing := 0
+		for i := 0; i < parts; i++ {
+			part, ok := so.objects[partName(info, i)]
+			if !ok {
+				missing++
+				continue
+			}
+			partSize, err := objectSize(part)
+			if err != nil {
+				problems = append(problems, problem(ProblemInvalidHeader, "part %d: %v", i, err))
+				continue
+			}
+			stored += partSize
+		}
+		if missing > 0 {
+			problems = append(problems, problem(ProblemMissingPart, "%d of %d parts are missing", missing, parts))
+		} else if stored != size && len(problems) == 0 {
+			p := problem(ProblemSizeMismatch, "records a size of %d bytes, but its parts hold %d", size, stored)
+			if opts.Repair {
+				if err := d.repairSize(ctx, so.obs, info, stored); err != nil {
+					return nil, err
+				}
+				p.Repaired = true
+			}
+			problems = append(problems, p)
+		}
+
+	case isChunked(info):
+		chunks := so.chunks[info.Name]
+		missing := 0
+		for _, chunk := range chunks {
+			if _, ok := so.objects[chunk]; !ok {
+				missing++
+			}
+		}
+		if missing > 0 {
+			problems = append(problems, problem(ProblemMissingPart, "%d of %d chunks are missing", missing, len(chunks)))
+		}
+	}
+
+	if (content || chunk) && len(problems) == 0 {
+		found, err := d.checkContent(ctx, so, info, links, opts, problem)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, found...)
+	}
+
+	// Whatever could not be repaired means that the content is broken.
+	if opts.Repair && !allRepaired(problems) {
+		if err := d.quarantine(ctx, so.obs, info); err != nil {
+			return nil, err
+		}
+		for i := range problems {
+			problems[i].Repaired = true
+		}
+	}
+	return problems, nil
+}
+
+// checkContent returns the problems with the deduplicated content described by info.
+func (d *driver) checkContent(ctx context.Context, so storeObjects, info *jetstream.ObjectInfo, links map[string]int, opts CheckOptions, problem func(ProblemKind, string, ...any) Problem) ([]Problem, error) {
+	dgst := digestPrefix + strings.TrimPrefix(info.Name, fmt.Sprintf(dedupTemplate, ""))
+	linked := links[dgst]
+	if strings.HasPrefix(info.Name, fmt.Sprintf(chunkTemplate, "")) {
+		dgst = digestPrefix + strings.TrimPrefix(info.Name, fmt.Sprintf(chunkTemplate, ""))
+		linked = links[info.Name]
+	}
+	if opts.VerifyDigests {
+		actual, err := d.contentDigest(ctx, info)
+		if err != nil {
+			return nil, err
+		}
+		if actual != dgst {
+			return []Problem{problem(ProblemDigestMismatch, "content has digest %s", actual)}, nil
+		}
+	}
+
+	refs, err := d.dedup.references(ctx, info.Name)
+	if errors.Is(err, errInvalidReferences) {
+		return []Problem{problem(ProblemInvalidHeader, "%v", err)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case linked == 0:
+		p := problem(ProblemUnreferenced, "records %d references, but nothing links to it", refs)
+		if opts.Repair {
+			if err := d.dedup.releaseObject(ctx, info.Name); err != nil {
+				return nil, err
+			}
+			p.Repaired = true
+		}
+		return []Problem{p}, nil
+	case linked != refs:
+		p := problem(ProblemReferenceMismatch, "records %d references, but %d links point to it", refs, linked)
+		if opts.Repair {
+			if err := d.dedup.setReferences(ctx, info.Name, linked); err != nil {
+				return nil, err
+			}
+			p.Repaired = true
+		}
+		return []Problem{p}, nil
+	}
+	return nil, nil
+}
+
+// contentDigest returns the digest of the content stored at the object described by info.
+func (d *driver) contentDigest(ctx context.Context, info *jetstream.ObjectInfo) (string, error) {
+	if isChunked(info) {
+		obr, err := newObjectReader(ctx, d.dedup.obs, d.dedup, d.encryption, info.Name, 0, 0)
+		if err != nil {
+			return "", err
+		}
+		defer obr.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, obr); err != nil {
+			return "", err
+		}
+		return digestOf(h), nil
+	}
+	if isMultipart(info) {
+		parts, err := strconv.Atoi(info.Headers.Get(headerMultipartCount))
+		if err != nil {
+			return "", err
+		}
+		return hashParts(ctx, d.dedup.obs, d.encryption, multipartName(info), parts)
+	}
+
+	rc, err := getObject(ctx, d.dedup.obs, d.encryption, info.Name)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return digestOf(h), nil
+}
+
+// repairSize records size as the size of the multipart content described by info.
+func (d *driver) repairSize(ctx context.Context, obs jetstream.ObjectStore, info *jetstream.ObjectInfo, size int64) error {
+	meta := movedMeta(info, info.Name)
+	meta.Headers.Set(headerMultipartSize, strconv.FormatInt(size, 10))
+	if err := obs.UpdateMeta(ctx, info.Name, meta); err != nil {
+		return err
+	}
+	d.cache.invalidate(objectPath(info))
+	return nil
+}
+
+// quarantine renames the object described by info and its parts, so that
+// the registry no longer finds them, but they are kept for inspection.
+func (d *driver) quarantine(ctx context.Context, obs jetstream.ObjectStore, info *jetstream.ObjectInfo) error {
+	name := fmt.Sprintf(quarantineTemplate, info.Name)
+	if isMultipart(info) {
+		parts, _ := strconv.Atoi(info.Headers.Get(headerMultipartCount))
+		for i := 0; i < parts; i++ {
+			part, err := obs.GetInfo(ctx, partName(info, i))
+			if errors.Is(err, jetstream.ErrObjectNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := obs.UpdateMeta(ctx, part.Name, movedMeta(part, fmt.Sprintf(multipartTemplate, name, i))); err != nil {
+				return err
+			}
+		}
+	}
+
+	meta := movedMeta(info, name)
+	path := objectPath(info)
+	meta.Headers.Del(headerPath)
+	meta.Headers.Del(headerMultipartName)
+	meta.Headers.Set(headerQuarantinedPath, path)
+	if err := obs.UpdateMeta(ctx, info.Name, meta); err != nil {
+		return err
+	}
+	if obs == d.dedup.obs && (strings.HasPrefix(info.Name, fmt.Sprintf(dedupTemplate, "")) || strings.HasPrefix(info.Name, fmt.Sprintf(chunkTemplate, ""))) {
+		// Content that is referenced again is stored again,
+		// instead of being linked to what was quarantined.
+		if err := d.dedup.forget(ctx, info.Name); err != nil {
+			return err
+		}
+	}
+	d.cache.invalidate(path)
+	return nil
+}
+
+func allRepaired(problems []Problem) bool {
+	for _, p := range problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// isPart reports whether info is a part of multipart content in objects.
+func isPart(info *jetstream.ObjectInfo, objects map[string]*jetstream.ObjectInfo) bool {
+	_, _, _, ok := partOf(info, objects)
+	return ok
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func problemKinds(problems []Problem) map[string]ProblemKind {
+	kinds := make(map[string]ProblemKind, len(problems))
+	for _, p := range problems {
+		kinds[p.Object] = p.Kind
+	}
+	return kinds
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	// Content that is intact.
+	writeParts(t, obs, "/intact", bytes.Repeat([]byte("a"), 32), false, true)
+	if err := d.PutContent(ctx, "/deduplicated", []byte("deduplicated")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A node crashed before it stored the last part.
+	writeParts(t, obs, "/missing", bytes.Repeat([]byte("b"), 32), false, true)
+	if err := obs.Delete(ctx, "/missing/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recorded size does not match the parts.
+	writeParts(t, obs, "/sized", bytes.Repeat([]byte("c"), 32), false, true)
+	info, err := obs.GetInfo(ctx, "/sized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := movedMeta(info, info.Name)
+	meta.Headers.Set(headerMultipartSize, "64")
+	if err := obs.UpdateMeta(ctx, info.Name, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deduplicated content of a link is gone.
+	if err := d.PutContent(ctx, "/dangling", []byte("dangling")); err != nil {
+		t.Fatal(err)
+	}
+	info, err = obs.GetInfo(ctx, "/dangling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := obs.Delete(ctx, dedupName(info.Headers.Get(headerLinkDigest))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deduplicated content records more references than there are links.
+	if err := d.PutContent(ctx, "/referenced", []byte("referenced")); err != nil {
+		t.Fatal(err)
+	}
+	info, err = obs.GetInfo(ctx, "/referenced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	referenced := dedupName(info.Headers.Get(headerLinkDigest))
+	if err := d.driver.dedup.setReferences(ctx, referenced, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deduplicated content that does not match its digest.
+	h := sha256.New()
+	h.Write([]byte("original"))
+	original := digestOf(h)
+	forged := dedupName(original)
+	headers := nats.Header{}
+	headers.Set(headerDedupReferences, "1")
+	if _, err := obs.Put(ctx, jetstream.ObjectMeta{Name: forged, Headers: headers}, strings.NewReader("forged")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.driver.dedup.link(ctx, obs, "/forged", "/forged", original, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := d.Check(ctx, CheckOptions{VerifyDigests: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ProblemKind{
+		"/missing":  ProblemMissingPart,
+		"/sized":    ProblemSizeMismatch,
+		"/dangling": ProblemDanglingLink,
+		referenced:  ProblemReferenceMismatch,
+		forged:      ProblemDigestMismatch,
+	}
+	got := problemKinds(problems)
+	if len(got) != len(want) {
+		t.Errorf("expected %d problems, got: %v", len(want), problems)
+	}
+	for object, kind := range want {
+		if got[object] != kind {
+			t.Errorf("%s: expected a %s problem, got %q", object, kind, got[object])
+		}
+	}
+	for _, p := range problems {
+		if p.Repaired {
+			t.Errorf("%s: expected nothing to be repaired without Repair", p.Object)
+		}
+	}
+
+	problems, err = d.Check(ctx, CheckOptions{VerifyDigests: true, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		if !p.Repaired {
+			t.Errorf("expected %s to be repaired", p)
+		}
+	}
+
+	// The link to the forged content was left dangling by quarantining it,
+	// unless the link was checked after the content in the same pass.
+	problems, err = d.Check(ctx, CheckOptions{VerifyDigests: true, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		if p.Object != "/forged" || p.Kind != ProblemDanglingLink {
+			t.Errorf("expected only the link to the forged content to be dangling, got: %v", p)
+		}
+	}
+	if problems, err = d.Check(ctx, CheckOptions{VerifyDigests: true}); err != nil || len(problems) > 0 {
+		t.Errorf("expected no problems after repairing, got: %v, %v", problems, err)
+	}
+
+	// Repaired content is served again, and broken content no longer is.
+	fi, err := d.Stat(ctx, "/sized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 32 {
+		t.Errorf("expected the repaired size to be 32, got %d", fi.Size())
+	}
+	for _, path := range []string{"/missing", "/dangling", "/forged"} {
+		if _, err := d.Stat(ctx, path); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			t.Errorf("%s: expected broken content to be quarantined, got: %v", path, err)
+		}
+	}
+	files, err := d.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if strings.Join(files, ",") != "/deduplicated,/intact,/referenced,/sized" {
+		t.Errorf("expected quarantined objects to be hidden, got: %v", files)
+	}
+}
+
+func TestCheckUnreferenced(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	// The link was deleted without releasing its content.
+	if err := obs.Delete(ctx, "/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := d.Check(ctx, CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Kind != ProblemUnreferenced || !problems[0].Repaired {
+		t.Fatalf("expected unreferenced content to be repaired, got: %v", problems)
+	}
+	if names := objectNames(t, obs); names != nil {
+		t.Errorf("expected unreferenced content to be deleted, got: %v", names)
+	}
+}
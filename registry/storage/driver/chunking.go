@@ -0,0 +1,278 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// headerDedupChunks is the amount of chunks that chunked content
+	// is split into. The content object lists the names of their objects.
+	headerDedupChunks = "Cascade-Dedup-Chunks"
+
+	// Chunks are stored apart from whole content, so that a chunk is
+	// always a single object, even when whole content of the same
+	// digest was stored as multipart content.
+	chunkTemplate = "chunks/sha256/%s"
+
+	minDedupChunkSize = 16 * 1024
+	maxDedupChunkSize = 16 * 1024 * 1024
+)
+
+// gear holds the random values that the rolling hash of a chunker adds
+// up for every byte. They must never change, because chunks are only
+// found again when content is split at the same boundaries.
+var gear = func() (table [256]uint64) {
+	// splitmix64, with a fixed seed.
+	seed := uint64(0x6361736361646521)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits content into content-defined chunks. Boundaries are found
+// with a rolling hash over the last 64 bytes, so they only depend on the
+// content around them. Content that only differs in a few places is split
+// into mostly the same chunks, even when content was inserted or removed.
+//
+// Chunks are between a quarter and four times the average size.
+type chunker struct {
+	r    io.Reader
+	min  int
+	max  int
+	mask uint64
+
+	buf []byte
+	// start and end delimit the content in buf that is not split off yet.
+	start, end int
+	eof        bool
+}
+
+func newChunker(r io.Reader, avg int) *chunker {
+	min, max := avg/4, avg*4
+	// Boundaries are looked for after the minimum size,
+	// and found once every 2^n bytes on average.
+	n := bits.Len(uint(avg-min)) - 1
+	return &chunker{
+		r:    r,
+		min:  min,
+		max:  max,
+		mask: ^uint64(0) << (64 - n),
+		buf:  make([]byte, max),
+	}
+}
+
+// next returns the next chunk, or io.EOF once all content is split.
+// The chunk is only valid until the next call.
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < c.max && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	chunk := c.buf[c.start:c.end]
+	chunk = chunk[:c.cut(chunk)]
+	c.start += len(chunk)
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *chunker) cut(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+	var h uint64
+	for i := c.min; i < len(data); i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// chunkName returns the name of the object of the chunk with dgst.
+func chunkName(dgst string) string {
+	return fmt.Sprintf(chunkTemplate, strings.TrimPrefix(dgst, digestPrefix))
+}
+
+func isChunked(info *jetstream.ObjectInfo) bool {
+	return info.Headers.Get(headerDedupChunks) != ""
+}
+
+// chunks returns whether content of size is split into chunks.
+// Content that fits in the smallest chunk is always stored whole.
+func (dd *deduplicator) chunks(size int64) bool {
+	return dd.chunkSize > 0 && size > int64(dd.chunkSize/4)
+}
+
+// putChunked splits the content read from r into chunks, stores the ones
+// that are not stored yet, and stores the list of them under dgst.
+func (dd *deduplicator) putChunked(ctx context.Context, r io.Reader, dgst string, opts writerOptions) (err error) {
+	names := make([]string, 0)
+	defer func() {
+		// Chunks that nothing will list are released again.
+		if err != nil {
+			for _, name := range names {
+				err = errors.Join(err, dd.releaseObject(context.WithoutCancel(ctx), name))
+			}
+		}
+	}()
+
+	var list bytes.Buffer
+	c := newChunker(r, dd.chunkSize)
+	for {
+		chunk, err := c.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, err := dd.putChunk(ctx, chunk, opts)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		fmt.Fprintln(&list, name)
+	}
+
+	headers := nats.Header{}
+	headers.Set(headerDedupChunks, strconv.Itoa(len(names)))
+	meta := jetstream.ObjectMeta{
+		Name:    dedupName(dgst),
+		Headers: headers,
+	}
+	_, err = dd.obs.Put(ctx, meta, &list)
+	return err
+}
+
+// putChunk stores chunk, or adds a reference to it
+// when it is already stored, and returns its name.
+func (dd *deduplicator) putChunk(ctx context.Context, chunk []byte, opts writerOptions) (string, error) {
+	h := sha256.New()
+	h.Write(chunk)
+	name := chunkName(digestOf(h))
+
+	first, err := dd.referenceObject(ctx, name)
+	if err != nil || !first {
+		return name, err
+	}
+
+	meta := jetstream.ObjectMeta{
+		Name: name,
+		Opts: &jetstream.ObjectMetaOptions{
+			ChunkSize: uint32(opts.chunkSize),
+		},
+	}
+	data, err := compress(opts.compression, &meta, chunk)
+	if err == nil {
+		data, err = opts.encryption.encrypt(&meta, data)
+	}
+	if err == nil {
+		_, err = dd.obs.Put(ctx, meta, bytes.NewReader(data))
+	}
+	if err != nil {
+		return "", errors.Join(err, dd.releaseObject(context.WithoutCancel(ctx), name))
+	}
+	return name, nil
+}
+
+// chunkNames returns the names of the chunks of the chunked content
+// stored at name in obs, in order.
+func chunkNames(ctx context.Context, obs jetstream.ObjectStore, name string) ([]string, error) {
+	list, err := obs.GetBytes(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		names = append(names, scanner.Text())
+	}
+	return names, scanner.Err()
+}
+
+// partsReader reads the content of the parts of multipart content in order.
+type partsReader struct {
+	ctx   context.Context
+	obs   jetstream.ObjectStore
+	enc   *encryptor
+	name  string
+	parts int
+
+	index   int
+	current io.ReadCloser
+}
+
+func (pr *partsReader) Read(p []byte) (int, error) {
+	for {
+		if pr.current == nil {
+			if pr.index == pr.parts {
+				return 0, io.EOF
+			}
+			var err error
+			pr.current, err = getObject(pr.ctx, pr.obs, pr.enc, fmt.Sprintf(multipartTemplate, pr.name, pr.index))
+			if err != nil {
+				return 0, err
+			}
+			pr.index++
+		}
+		n, err := pr.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			pr.current.Close()
+			pr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (pr *partsReader) Close() error {
+	if pr.current == nil {
+		return nil
+	}
+	return pr.current.Close()
+}
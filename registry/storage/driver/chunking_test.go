@@ -0,0 +1,194 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// split returns the digests of the chunks that content is split into.
+func split(t *testing.T, content []byte, avg int) [][32]byte {
+	c := newChunker(bytes.NewReader(content), avg)
+	sums := make([][32]byte, 0)
+	total := 0
+	for {
+		chunk, err := c.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > 4*avg {
+			t.Errorf("expected chunks of at most %d bytes, got %d", 4*avg, len(chunk))
+		}
+		total += len(chunk)
+		sums = append(sums, sha256.Sum256(chunk))
+	}
+	if total != len(content) {
+		t.Errorf("expected chunks to add up to %d bytes, got %d", len(content), total)
+	}
+	return sums
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	content := make([]byte, 4*1024*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	before := split(t, content, minDedupChunkSize)
+
+	// Inserting content shifts everything after it, but boundaries are
+	// found again right after the chunk that the content was inserted in.
+	edited := append(append(bytes.Clone(content[:1000]), []byte("inserted")...), content[1000:]...)
+	after := split(t, edited, minDedupChunkSize)
+
+	seen := make(map[[32]byte]bool)
+	for _, sum := range before {
+		seen[sum] = true
+	}
+	shared := 0
+	for _, sum := range after {
+		if seen[sum] {
+			shared++
+		}
+	}
+	if shared < len(before)-2 {
+		t.Errorf("expected all but the edited chunks to be shared, got %d of %d", shared, len(before))
+	}
+}
+
+// chunkObjects returns the chunks of chunked content.
+func chunkObjects(t *testing.T, obs jetstream.ObjectStore) []*jetstream.ObjectInfo {
+	objects, err := obs.List(context.Background())
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make([]*jetstream.ObjectInfo, 0)
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Name, "chunks/sha256/") {
+			found = append(found, obj)
+		}
+	}
+	return found
+}
+
+func TestDedupChunks(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:      ns.ClientURL(),
+		Dedup:          true,
+		DedupChunkSize: minDedupChunkSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	content := make([]byte, 2*1024*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	edited := bytes.Clone(content)
+	copy(edited[1024*1024:], "edited")
+
+	if err := d.PutContent(ctx, "/a/data", content); err != nil {
+		t.Fatal(err)
+	}
+	stored := len(chunkObjects(t, obs))
+	writeFile(t, d, "/b/data", edited, false, true)
+
+	// Only the chunk with the edit is stored again.
+	if chunks := len(chunkObjects(t, obs)); chunks > stored+2 {
+		t.Errorf("expected nearly identical content to share its chunks, got %d chunks after %d", chunks, stored)
+	}
+	if objects := dedupObjects(t, obs); len(objects) != 2 {
+		t.Errorf("expected both contents to be stored, found %d objects", len(objects))
+	}
+
+	for path, want := range map[string][]byte{"/a/data": content, "/b/data": edited} {
+		got, err := d.GetContent(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("expected %s to be read back from its chunks", path)
+		}
+
+		offset := int64(len(want) - 100)
+		reader, err := d.Reader(ctx, path, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want[offset:], got) {
+			t.Errorf("expected %s to be read from an offset", path)
+		}
+	}
+
+	problems, err := d.Check(ctx, CheckOptions{VerifyDigests: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected chunked content to be consistent, got: %v", problems)
+	}
+
+	if err := d.Delete(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := chunkObjects(t, obs); len(chunks) != 0 {
+		t.Errorf("expected chunks to be deleted with the last content, found %d", len(chunks))
+	}
+	if objects := dedupObjects(t, obs); len(objects) != 0 {
+		t.Errorf("expected content to be deleted with its last reference, found %d objects", len(objects))
+	}
+}
+
+func TestInvalidDedupChunkSize(t *testing.T) {
+	ns := newTestServer(t)
+
+	for _, params := range []Parameters{
+		{DedupChunkSize: minDedupChunkSize},
+		{Dedup: true, DedupChunkSize: minDedupChunkSize - 1},
+		{Dedup: true, DedupChunkSize: maxDedupChunkSize + 1},
+	} {
+		params.ClientURL = ns.ClientURL()
+		if _, err := New(context.Background(), &params); err == nil {
+			t.Errorf("expected an error for dedup %t and chunk size %d", params.Dedup, params.DedupChunkSize)
+		}
+	}
+}
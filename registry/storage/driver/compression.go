@@ -0,0 +1,168 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	headerCompression      = "Cascade-Compression"
+	headerUncompressedSize = "Cascade-Uncompressed-Size"
+)
+
+type compression string
+
+const (
+	compressionNone compression = "none"
+	compressionGzip compression = "gzip"
+	compressionZstd compression = "zstd"
+)
+
+func parseCompression(s string) (compression, error) {
+	switch c := compression(s); c {
+	case "", compressionNone:
+		return compressionNone, nil
+	case compressionGzip, compressionZstd:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q, must be one of: none, gzip, zstd", s)
+	}
+}
+
+// The zstd encoder is safe for concurrent use with EncodeAll.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// compress returns the encoded object content, and sets the headers that
+// are needed to decode it on meta. Content that does not get smaller by
+// compressing it is returned as-is.
+func compress(c compression, meta *jetstream.ObjectMeta, data []byte) ([]byte, error) {
+	var compressed []byte
+	switch c {
+	case compressionGzip:
+		buf := new(bytes.Buffer)
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		compressed = buf.Bytes()
+	case compressionZstd:
+		compressed = zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)))
+	default:
+		return data, nil
+	}
+
+	if len(compressed) >= len(data) {
+		return data, nil
+	}
+
+	if meta.Headers == nil {
+		meta.Headers = nats.Header{}
+	}
+	meta.Headers.Set(headerCompression, string(c))
+	meta.Headers.Set(headerUncompressedSize, strconv.Itoa(len(data)))
+
+	return compressed, nil
+}
+
+// decompress wraps the stored content of an object in a reader that
+// returns its original content.
+func decompress(info *jetstream.ObjectInfo, rc io.ReadCloser) (io.ReadCloser, error) {
+	switch c := compression(info.Headers.Get(headerCompression)); c {
+	case "":
+		return rc, nil
+	case compressionGzip:
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			return nil, err
+		}
+		return &decompressReader{Reader: zr, close: zr.Close, rc: rc}, nil
+	case compressionZstd:
+		zr, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &decompressReader{Reader: zr, close: func() error { zr.Close(); return nil }, rc: rc}, nil
+	default:
+		return nil, fmt.Errorf("object '%s' uses unsupported compression %q", info.Name, c)
+	}
+}
+
+type decompressReader struct {
+	io.Reader
+	close func() error
+	rc    io.ReadCloser
+}
+
+func (dr *decompressReader) Close() error {
+	err := dr.close()
+	if err := dr.rc.Close(); err != nil {
+		return err
+	}
+	return err
+}
+
+// objectSize returns the size of the original content of a single object.
+func objectSize(info *jetstream.ObjectInfo) (int64, error) {
+	if info.Headers.Get(headerCompression) == "" {
+		if info.Headers.Get(headerEncryption) != "" {
+			return int64(info.Size) - encryptionOverhead, nil
+		}
+		return int64(info.Size), nil
+	}
+
+	size, err := strconv.ParseInt(info.Headers.Get(headerUncompressedSize), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse compression header: %w", err)
+	}
+	return size, nil
+}
+
+// getObject opens a single object for reading its original content.
+func getObject(ctx context.Context, obs jetstream.ObjectStore, enc *encryptor, name string) (io.ReadCloser, error) {
+	result, err := obs.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := result.Info()
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
+
+	decrypted, err := enc.decrypt(info, &idleReader{ObjectResult: result, ctx: ctx})
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
+	rc, err := decompress(info, decrypted)
+	if err != nil {
+		decrypted.Close()
+		return nil, err
+	}
+	return rc, nil
+}
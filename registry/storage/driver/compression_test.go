@@ -0,0 +1,148 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	// Compressible, but not trivially so.
+	content := make([]byte, 0, 3*defaultChunkSize)
+	for i := 0; len(content) < 3*defaultChunkSize; i++ {
+		content = fmt.Appendf(content, "line %d of some very compressible content\n", i)
+	}
+
+	for _, c := range []compression{compressionGzip, compressionZstd} {
+		t.Run(string(c), func(t *testing.T) {
+			d, err := New(ctx, &Parameters{
+				ClientURL:   ns.ClientURL(),
+				Compression: string(c),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			obs := newTestObjectStore(t, ns)
+
+			small := fmt.Sprintf("/%s/small", c)
+			if err := d.PutContent(ctx, small, content[:4096]); err != nil {
+				t.Fatal(err)
+			}
+			multipart := fmt.Sprintf("/%s/multipart", c)
+			writeFile(t, d, multipart, content, false, true)
+
+			for path, want := range map[string][]byte{small: content[:4096], multipart: content} {
+				got, err := d.GetContent(ctx, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(want, got) {
+					t.Errorf("%s: content does not match after round trip", path)
+				}
+
+				// The registry validates digests against the size that Stat reports,
+				// so it must be the original length, not the stored one.
+				fi, err := d.Stat(ctx, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size() != int64(len(want)) {
+					t.Errorf("%s: expected size %d, got %d", path, len(want), fi.Size())
+				}
+			}
+
+			info, err := obs.GetInfo(ctx, small)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Headers.Get(headerCompression) != string(c) {
+				t.Errorf("expected content to be stored with %s compression", c)
+			}
+			if info.Size >= 4096 {
+				t.Errorf("expected stored content to be smaller than the original, got %d bytes", info.Size)
+			}
+
+			offset := int64(len(content) - 100)
+			reader, err := d.Reader(ctx, multipart, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content[offset:], got) {
+				t.Error("content does not match when reading from an offset")
+			}
+		})
+	}
+}
+
+func TestCompressionSkipsIncompressibleContent(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:   ns.ClientURL(),
+		Compression: string(compressionZstd),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	content := make([]byte, 4096)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/random", content); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := obs.GetInfo(ctx, "/random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Headers.Get(headerCompression) != "" {
+		t.Error("expected incompressible content to be stored as-is")
+	}
+
+	got, err := d.GetContent(ctx, "/random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("content does not match after round trip")
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for _, s := range []string{"", "none", "gzip", "zstd"} {
+		if _, err := parseCompression(s); err != nil {
+			t.Errorf("expected %q to be valid, got: %v", s, err)
+		}
+	}
+	if _, err := parseCompression("lz4"); err == nil {
+		t.Error("expected unsupported compression to be rejected")
+	}
+}
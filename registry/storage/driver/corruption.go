@@ -0,0 +1,94 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// CorruptionError is returned by the reads of content that does not match
+// its digest, which means that it was corrupted after it was stored. It is
+// returned as it is by the reads of a Reader, but like any other error of a
+// storage driver, GetContent returns it as the Detail of a
+// storagedriver.Error.
+type CorruptionError struct {
+	Path   string
+	Detail string
+}
+
+func (e CorruptionError) Error() string {
+	return fmt.Sprintf("content of %s is corrupted: %s", e.Path, e.Detail)
+}
+
+// verifyingReader returns the reads of content that does not match its
+// digest as a CorruptionError.
+//
+// The object store verifies the digest of every object that it streams
+// from its start once it was read to the end, and the registry addresses
+// blobs by the digest of their content. Blobs are only verified against the
+// digest in their path when want is set, which needs them to be read from
+// the start.
+type verifyingReader struct {
+	io.ReadCloser
+	path string
+	want string
+	hash hash.Hash
+	err  error
+}
+
+func newVerifyingReader(rc io.ReadCloser, path string, verifyBlobs bool, offset int64) *verifyingReader {
+	vr := &verifyingReader{ReadCloser: rc, path: path}
+	if m := blobDataPath.FindStringSubmatch(path); verifyBlobs && offset == 0 && m != nil {
+		vr.want = m[1]
+		vr.hash = sha256.New()
+	}
+	return vr
+}
+
+// Seek seeks in the content, which is no longer verified
+// against the digest in its path once it was seeked in.
+func (vr *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	vr.hash = nil
+	return seek(vr.ReadCloser, offset, whence)
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	if vr.err != nil {
+		return 0, vr.err
+	}
+	n, err := vr.ReadCloser.Read(p)
+	if errors.Is(err, jetstream.ErrDigestMismatch) {
+		vr.err = CorruptionError{Path: vr.path, Detail: "an object does not match the digest that it was stored with"}
+		return n, vr.err
+	}
+	if vr.hash == nil {
+		return n, err
+	}
+
+	vr.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		if verr := verifyDigest(vr.want, vr.hash); verr != nil {
+			vr.err = CorruptionError{Path: vr.path, Detail: verr.Error()}
+			return n, vr.err
+		}
+		vr.err = err
+	}
+	return n, err
+}
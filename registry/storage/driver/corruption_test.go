@@ -0,0 +1,116 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestVerifyReads(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), VerifyReads: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("original"))
+	dgst := hex.EncodeToString(sum[:])
+	blob := fmt.Sprintf("/docker/registry/v2/blobs/sha256/%s/%s/data", dgst[:2], dgst)
+	if err := d.PutContent(ctx, blob, []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := d.GetContent(ctx, blob); err != nil || string(content) != "original" {
+		t.Errorf("expected a blob that matches its digest to be read, got: %q, %v", content, err)
+	}
+
+	corrupt := "/docker/registry/v2/blobs/sha256/00/" + dgst[:62] + "00/data"
+	if err := d.PutContent(ctx, corrupt, []byte("corrupted")); err != nil {
+		t.Fatal(err)
+	}
+	var corruption CorruptionError
+	if _, err := d.GetContent(ctx, corrupt); !errors.As(detailOf(err), &corruption) || corruption.Path != corrupt {
+		t.Errorf("expected a blob that does not match its digest to fail, got: %v", err)
+	}
+	r, err := d.Reader(ctx, corrupt, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := io.ReadAll(r); err != nil || string(content) != "orrupted" {
+		t.Errorf("expected reads from an offset not to be verified, got: %q, %v", content, err)
+	}
+
+	unverified, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unverified.GetContent(ctx, corrupt); err != nil {
+		t.Errorf("expected blobs not to be verified by default, got: %v", err)
+	}
+}
+
+func TestCorruptedObject(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("a"), 64)
+	if err := d.PutContent(ctx, "/file", content); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the only chunk of the object with one of the same size.
+	info, err := d.driver.root.GetInfo(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := bucketName(defaultBucketPrefix, rootStoreName)
+	stream, err := d.driver.js.Stream(ctx, "OBJ_"+bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := fmt.Sprintf("$O.%s.C.%s", bucket, info.NUID)
+	chunk, err := stream.GetLastMsgForSubject(ctx, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.DeleteMsg(ctx, chunk.Sequence); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.driver.js.PublishMsg(ctx, &nats.Msg{Subject: subject, Data: bytes.Repeat([]byte("b"), 64)}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := d.Reader(ctx, "/file", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	if !errors.As(err, &CorruptionError{}) || errors.Is(err, jetstream.ErrDigestMismatch) {
+		t.Errorf("expected a corruption error, got: %v", err)
+	}
+}
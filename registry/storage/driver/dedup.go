@@ -0,0 +1,610 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	headerLinkDigest      = "Cascade-Link-Digest"
+	headerLinkSize        = "Cascade-Link-Size"
+	headerDedupReferences = "Cascade-Dedup-References"
+	headerHashState       = "Cascade-Hash-State"
+
+	// Deduplicated content is stored in the root store under its digest.
+	// Registry paths always start with a slash, so these names can never
+	// collide with, or show up in listings of, regular paths.
+	dedupTemplate = "sha256/%s"
+	digestPrefix  = "sha256:"
+
+	referencesStoreName = "references"
+
+	// releaseTimeout is how long content may take to be deleted after its
+	// last reference was released. Registries that reference it again in
+	// the meantime wait for it every releaseInterval, and take the deletion
+	// over once it took longer.
+	releaseTimeout  = time.Minute
+	releaseInterval = 50 * time.Millisecond
+)
+
+// deduplicator stores content once per digest, and replaces the logical
+// path with a link object pointing at it. A KV bucket counts how many links
+// point at every content object and chunk, which is deleted when the last
+// one goes away. The counts are updated at the revision they were read at,
+// so that registries that share the stores never lose a reference.
+//
+// Links are followed regardless of whether deduplication is enabled,
+// so that content written while it was enabled remains readable.
+type deduplicator struct {
+	js      jetstream.JetStream
+	obs     jetstream.ObjectStore
+	enabled bool
+	// chunkSize is the average size of the chunks that content is split
+	// into, so that content that is nearly identical shares most of them.
+	// Content is stored whole when it is zero.
+	chunkSize int
+
+	// refsConfig is the config of the KV bucket of the counts, which is
+	// only created once deduplication is enabled, or content that was
+	// deduplicated before has to be released.
+	refsConfig jetstream.KeyValueConfig
+	// mu guards refs, which is nil until the bucket is created.
+	mu   sync.Mutex
+	refs jetstream.KeyValue
+}
+
+func newDeduplicator(ctx context.Context, js jetstream.JetStream, root jetstream.ObjectStore, bucketPrefix string, replicas int, placement *jetstream.Placement, storage jetstream.StorageType, enabled bool, chunkSize int) (*deduplicator, error) {
+	dd := &deduplicator{
+		js:        js,
+		obs:       root,
+		enabled:   enabled,
+		chunkSize: chunkSize,
+		refsConfig: jetstream.KeyValueConfig{
+			Bucket:      bucketName(bucketPrefix, referencesStoreName),
+			Description: "References to the deduplicated content of the registry",
+			Replicas:    replicas,
+			Placement:   placement,
+			Storage:     storage,
+		},
+	}
+	if enabled {
+		if _, err := dd.bucket(ctx, true); err != nil {
+			return nil, err
+		}
+	}
+	return dd, nil
+}
+
+// bucket returns the KV bucket of the counts, which is created when create
+// is set. It is nil when the bucket does not exist and create is not set.
+func (dd *deduplicator) bucket(ctx context.Context, create bool) (jetstream.KeyValue, error) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	if dd.refs != nil {
+		return dd.refs, nil
+	}
+
+	kv, err := dd.js.KeyValue(ctx, dd.refsConfig.Bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) && create {
+		kv, err = dd.js.CreateOrUpdateKeyValue(ctx, dd.refsConfig)
+	}
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure references store exists: %w", err)
+	}
+	dd.refs = kv
+	return kv, nil
+}
+
+// errInvalidReferences is returned for a reference count that cannot be parsed.
+var errInvalidReferences = errors.New("invalid reference count")
+
+func isLink(info *jetstream.ObjectInfo) bool {
+	return info.Size == 0 && info.Headers.Get(headerLinkDigest) != ""
+}
+
+func linkSize(info *jetstream.ObjectInfo) (int64, error) {
+	size, err := strconv.ParseInt(info.Headers.Get(headerLinkSize), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse link header: %w", err)
+	}
+	return size, nil
+}
+
+// dedupName returns the name of the content object for dgst.
+func dedupName(dgst string) string {
+	return fmt.Sprintf(dedupTemplate, strings.TrimPrefix(dgst, digestPrefix))
+}
+
+func digestOf(h hash.Hash) string {
+	return digestPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// putBytes stores content under its digest, and links the object
+// at name in obs to it, which stores the content of path.
+func (dd *deduplicator) putBytes(ctx context.Context, obs jetstream.ObjectStore, name, path string, content []byte, opts writerOptions) error {
+	h := sha256.New()
+	h.Write(content)
+	dgst := digestOf(h)
+
+	first, err := dd.reference(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	if first {
+		if err := dd.putContent(ctx, content, dgst, opts); err != nil {
+			return errors.Join(err, dd.release(context.WithoutCancel(ctx), dgst))
+		}
+	}
+
+	if err := dd.link(ctx, obs, name, path, dgst, int64(len(content))); err != nil {
+		return errors.Join(err, dd.release(context.WithoutCancel(ctx), dgst))
+	}
+	return nil
+}
+
+// putContent stores content under dgst, whole or split into chunks.
+func (dd *deduplicator) putContent(ctx context.Context, content []byte, dgst string, opts writerOptions) error {
+	if dd.chunks(int64(len(content))) {
+		return dd.putChunked(ctx, bytes.NewReader(content), dgst, opts)
+	}
+
+	meta := jetstream.ObjectMeta{
+		Name: dedupName(dgst),
+		Opts: &jetstream.ObjectMetaOptions{
+			ChunkSize: uint32(opts.chunkSize),
+		},
+	}
+	data, err := compress(opts.compression, &meta, content)
+	if err != nil {
+		return err
+	}
+	if data, err = opts.encryption.encrypt(&meta, data); err != nil {
+		return err
+	}
+	_, err = dd.obs.Put(ctx, meta, bytes.NewReader(data))
+	return err
+}
+
+// commitParts moves the multipart content whose parts were written under
+// partsName in obs to its digest, or discards it if that content is already
+// stored, and links filename to it. Content that is split into chunks is
+// read back from its parts, which are discarded afterwards.
+func (dd *deduplicator) commitParts(ctx context.Context, obs jetstream.ObjectStore, filename, partsName, path string, parts int, size int64, dgst string, opts writerOptions) error {
+	first, err := dd.reference(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	if err := dd.storeParts(ctx, obs, partsName, parts, size, dgst, first, opts); err != nil {
+		return errors.Join(err, dd.release(context.WithoutCancel(ctx), dgst))
+	}
+
+	if err := dd.link(ctx, obs, filename, path, dgst, size); err != nil {
+		return errors.Join(err, dd.release(context.WithoutCancel(ctx), dgst))
+	}
+	return nil
+}
+
+// storeParts stores the content in the parts under partsName in obs under
+// dgst when it is the first reference to it, and discards the parts that
+// are not moved there.
+func (dd *deduplicator) storeParts(ctx context.Context, obs jetstream.ObjectStore, partsName string, parts int, size int64, dgst string, first bool, opts writerOptions) error {
+	chunked := first && dd.chunks(size)
+	if chunked {
+		pr := &partsReader{ctx: ctx, obs: obs, enc: opts.encryption, name: partsName, parts: parts}
+		err := dd.putChunked(ctx, pr, dgst, opts)
+		pr.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	name := dedupName(dgst)
+	for i := 0; i < parts; i++ {
+		part := fmt.Sprintf(multipartTemplate, partsName, i)
+		if !first || chunked {
+			if err := obs.Delete(ctx, part); err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := obs.GetInfo(ctx, part)
+		if err != nil {
+			return err
+		}
+		meta := jetstream.ObjectMeta{
+			Name:        fmt.Sprintf(multipartTemplate, name, i),
+			Description: info.Description,
+			Headers:     info.Headers,
+			Metadata:    info.Metadata,
+		}
+		if obs == dd.obs {
+			// Renaming only rewrites the object's metadata, the chunks stay where they are.
+			if err := dd.obs.UpdateMeta(ctx, part, meta); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Content is always stored in the root store, so parts written
+		// to a shard store have to be copied over.
+		meta.Opts = info.Opts
+		if err := copyObject(ctx, obs, dd.obs, part, meta); err != nil {
+			return err
+		}
+		if err := obs.Delete(ctx, part); err != nil {
+			return err
+		}
+	}
+	if !first || chunked {
+		return nil
+	}
+
+	headers := nats.Header{}
+	headers.Set(headerMultipartCount, strconv.Itoa(parts))
+	headers.Set(headerMultipartSize, strconv.FormatInt(size, 10))
+	meta := jetstream.ObjectMeta{
+		Name:    name,
+		Headers: headers,
+	}
+	_, err := dd.obs.Put(ctx, meta, bytes.NewReader(nil))
+	return err
+}
+
+// reference adds a reference to the content stored for dgst, and reports
+// whether it is the first, in which case the caller stores the content.
+func (dd *deduplicator) reference(ctx context.Context, dgst string) (bool, error) {
+	return dd.referenceObject(ctx, dedupName(dgst))
+}
+
+// referenceObject adds a reference to the content or chunk stored at name,
+// and reports whether it is the first, in which case the caller stores it.
+// Content whose last reference is being released is waited for, so that it
+// is stored again once it was deleted.
+func (dd *deduplicator) referenceObject(ctx context.Context, name string) (bool, error) {
+	kv, err := dd.bucket(ctx, true)
+	if err != nil {
+		return false, err
+	}
+	for {
+		entry, err := kv.Get(ctx, name)
+		var refs int
+		switch {
+		case errors.Is(err, jetstream.ErrKeyNotFound):
+			if refs, err = dd.legacyReferences(ctx, name); err != nil {
+				return false, err
+			}
+			_, err = kv.Create(ctx, name, formatReferences(refs+1))
+		case err != nil:
+			return false, fmt.Errorf("failed to get references of %s: %w", name, err)
+		default:
+			if refs, err = parseReferences(entry); err != nil {
+				return false, err
+			}
+			if refs == 0 {
+				if err := dd.awaitRelease(ctx, kv, entry); err != nil {
+					return false, err
+				}
+				continue
+			}
+			_, err = kv.Update(ctx, name, formatReferences(refs+1), entry.Revision())
+		}
+
+		if revisionConflict(err) {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to reference %s: %w", name, err)
+		}
+		return refs == 0, nil
+	}
+}
+
+// release removes a reference to the content stored for dgst,
+// and deletes the content once nothing references it anymore.
+func (dd *deduplicator) release(ctx context.Context, dgst string) error {
+	return dd.releaseObject(ctx, dedupName(dgst))
+}
+
+// releaseObject removes a reference to the content or chunk stored at name,
+// and deletes it once nothing references it anymore.
+func (dd *deduplicator) releaseObject(ctx context.Context, name string) error {
+	kv, err := dd.bucket(ctx, true)
+	if err != nil {
+		return err
+	}
+	for {
+		entry, err := kv.Get(ctx, name)
+		var refs int
+		var rev uint64
+		switch {
+		case errors.Is(err, jetstream.ErrKeyNotFound):
+			if refs, err = dd.legacyReferences(ctx, name); err != nil {
+				return err
+			}
+			if refs == 0 {
+				return nil
+			}
+			rev, err = kv.Create(ctx, name, formatReferences(refs-1))
+		case err != nil:
+			return fmt.Errorf("failed to get references of %s: %w", name, err)
+		default:
+			if refs, err = parseReferences(entry); err != nil {
+				return err
+			}
+			if refs == 0 {
+				// The last reference was released already.
+				return nil
+			}
+			rev, err = kv.Update(ctx, name, formatReferences(refs-1), entry.Revision())
+		}
+
+		if revisionConflict(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to release %s: %w", name, err)
+		}
+		if refs > 1 {
+			return nil
+		}
+		return dd.deleteContent(ctx, kv, name, rev)
+	}
+}
+
+// setReferences overwrites the amount of references to the content or
+// chunk stored at name, which is only done to repair it.
+func (dd *deduplicator) setReferences(ctx context.Context, name string, refs int) error {
+	kv, err := dd.bucket(ctx, true)
+	if err != nil {
+		return err
+	}
+	if _, err := kv.Put(ctx, name, formatReferences(refs)); err != nil {
+		return fmt.Errorf("failed to set references of %s: %w", name, err)
+	}
+	return nil
+}
+
+// forget drops the count of the content or chunk that was stored at name,
+// so that it is stored again when it is referenced next.
+func (dd *deduplicator) forget(ctx context.Context, name string) error {
+	kv, err := dd.bucket(ctx, false)
+	if err != nil || kv == nil {
+		return err
+	}
+	if err := kv.Delete(ctx, name); err != nil {
+		return fmt.Errorf("failed to drop references of %s: %w", name, err)
+	}
+	return nil
+}
+
+// references returns the amount of references to the content or chunk
+// stored at name.
+func (dd *deduplicator) references(ctx context.Context, name string) (int, error) {
+	kv, err := dd.bucket(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	if kv == nil {
+		return dd.legacyReferences(ctx, name)
+	}
+	entry, err := kv.Get(ctx, name)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return dd.legacyReferences(ctx, name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get references of %s: %w", name, err)
+	}
+	return parseReferences(entry)
+}
+
+// legacyReferences returns the amount of references recorded in the header
+// of the content or chunk stored at name, where they were counted before
+// they were kept in the references bucket. It is zero when nothing is
+// stored at name.
+func (dd *deduplicator) legacyReferences(ctx context.Context, name string) (int, error) {
+	info, err := dd.obs.GetInfo(ctx, name)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	header := info.Headers.Get(headerDedupReferences)
+	if header == "" {
+		return 0, nil
+	}
+	refs, err := strconv.Atoi(header)
+	if err != nil {
+		return 0, fmt.Errorf("%w %q in the header of %s", errInvalidReferences, header, name)
+	}
+	return refs, nil
+}
+
+// awaitRelease waits a moment for the content whose last reference was
+// released in entry to be deleted. It takes the deletion over when it
+// took longer than releaseTimeout, because whoever released it is gone.
+func (dd *deduplicator) awaitRelease(ctx context.Context, kv jetstream.KeyValue, entry jetstream.KeyValueEntry) error {
+	if time.Since(entry.Created()) < releaseTimeout {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(releaseInterval):
+			return nil
+		}
+	}
+
+	// Releasing it again restarts the timeout, so that nobody else takes it over.
+	rev, err := kv.Update(ctx, entry.Key(), formatReferences(0), entry.Revision())
+	if revisionConflict(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release %s: %w", entry.Key(), err)
+	}
+	return dd.deleteContent(ctx, kv, entry.Key(), rev)
+}
+
+// deleteContent deletes the content or chunk stored at name, whose last
+// reference was released at revision rev of its count, and then the count.
+// It gives up after half of releaseTimeout, so that it never deletes
+// content that was stored again after somebody else took it over.
+func (dd *deduplicator) deleteContent(ctx context.Context, kv jetstream.KeyValue, name string, rev uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, releaseTimeout/2)
+	defer cancel()
+
+	info, err := dd.obs.GetInfo(ctx, name)
+	if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+		return err
+	}
+	if err == nil {
+		if err := dd.deleteObject(ctx, info); err != nil {
+			return err
+		}
+	}
+
+	err = kv.Delete(ctx, name, jetstream.LastRevision(rev))
+	if revisionConflict(err) {
+		// Somebody else took the deletion over.
+		return nil
+	}
+	return err
+}
+
+// deleteObject deletes the content or chunk described by info,
+// along with its parts, and releases its chunks.
+func (dd *deduplicator) deleteObject(ctx context.Context, info *jetstream.ObjectInfo) error {
+	if isMultipart(info) {
+		parts, err := strconv.Atoi(info.Headers.Get(headerMultipartCount))
+		if err != nil {
+			return fmt.Errorf("failed to parse multipart header: %w", err)
+		}
+		for i := 0; i < parts; i++ {
+			err := dd.obs.Delete(ctx, fmt.Sprintf(multipartTemplate, info.Name, i))
+			if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+				return err
+			}
+		}
+	}
+	if isChunked(info) {
+		chunks, err := chunkNames(ctx, dd.obs, info.Name)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			if err := dd.releaseObject(ctx, chunk); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := dd.obs.Delete(ctx, info.Name)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+// released releases the content that info linked to, if it is a link.
+// It is used after info's object was overwritten or deleted.
+func (dd *deduplicator) released(ctx context.Context, info *jetstream.ObjectInfo) error {
+	if info == nil || !isLink(info) {
+		return nil
+	}
+	return dd.release(ctx, info.Headers.Get(headerLinkDigest))
+}
+
+func parseReferences(entry jetstream.KeyValueEntry) (int, error) {
+	refs, err := strconv.Atoi(string(entry.Value()))
+	if err != nil {
+		return 0, fmt.Errorf("%w %q for %s", errInvalidReferences, entry.Value(), entry.Key())
+	}
+	return refs, nil
+}
+
+func formatReferences(refs int) []byte {
+	return []byte(strconv.Itoa(refs))
+}
+
+func (dd *deduplicator) link(ctx context.Context, obs jetstream.ObjectStore, name, path, dgst string, size int64) error {
+	headers := nats.Header{}
+	headers.Set(headerLinkDigest, dgst)
+	headers.Set(headerLinkSize, strconv.FormatInt(size, 10))
+	meta := jetstream.ObjectMeta{
+		Name:    name,
+		Headers: headers,
+	}
+	setPath(&meta, path)
+	_, err := obs.Put(ctx, meta, bytes.NewReader(nil))
+	return err
+}
+
+// copyObject copies the object at name in src to dst as it is stored,
+// without decompressing it.
+func copyObject(ctx context.Context, src, dst jetstream.ObjectStore, name string, meta jetstream.ObjectMeta) error {
+	obj, err := src.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	_, err = dst.Put(ctx, meta, obj)
+	return err
+}
+
+// currentInfo returns the info of the object at path, or nil if there is none.
+func currentInfo(ctx context.Context, obs jetstream.ObjectStore, path string) (*jetstream.ObjectInfo, error) {
+	info, err := obs.GetInfo(ctx, path)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// hashParts computes the digest of multipart content by reading it back.
+// This is only needed when appending to content that was written without
+// its hash state, for example while deduplication was disabled.
+func hashParts(ctx context.Context, obs jetstream.ObjectStore, enc *encryptor, filename string, parts int) (string, error) {
+	h := sha256.New()
+	for i := 0; i < parts; i++ {
+		part, err := getObject(ctx, obs, enc, fmt.Sprintf(multipartTemplate, filename, i))
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, part)
+		part.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return digestOf(h), nil
+}
@@ -0,0 +1,311 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func newDedupDriver(t *testing.T) (*Driver, jetstream.ObjectStore) {
+	ns := newTestServer(t)
+
+	d, err := New(context.Background(), &Parameters{
+		ClientURL: ns.ClientURL(),
+		Dedup:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, newTestObjectStore(t, ns)
+}
+
+// dedupObjects returns the deduplicated content objects, excluding their parts.
+func dedupObjects(t *testing.T, obs jetstream.ObjectStore) []*jetstream.ObjectInfo {
+	objects, err := obs.List(context.Background())
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make([]*jetstream.ObjectInfo, 0)
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Name, "sha256/") && strings.Count(obj.Name, sep) == 1 {
+			found = append(found, obj)
+		}
+	}
+	return found
+}
+
+func writeFile(t *testing.T, d *Driver, path string, content []byte, append, commit bool) {
+	ctx := context.Background()
+
+	fw, err := d.Writer(ctx, path, append)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if commit {
+		if err := fw.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDedupPutContent(t *testing.T) {
+	ctx := context.Background()
+	d, obs := newDedupDriver(t)
+
+	content := []byte("identical content")
+	for _, path := range []string{"/a/data", "/b/data"} {
+		if err := d.PutContent(ctx, path, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects := dedupObjects(t, obs)
+	if len(objects) != 1 {
+		t.Fatalf("expected identical content to be stored once, found %d objects", len(objects))
+	}
+	if refs, err := d.driver.dedup.references(ctx, objects[0].Name); err != nil || refs != 2 {
+		t.Errorf("expected 2 references, got: %d, %v", refs, err)
+	}
+
+	if err := d.Delete(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetContent(ctx, "/b/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Errorf("expected remaining reference to be readable, got: %q", got)
+	}
+	fi, err := d.Stat(ctx, "/b/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Errorf("expected size %d, got %d", len(content), fi.Size())
+	}
+
+	if err := d.Delete(ctx, "/b/data"); err != nil {
+		t.Fatal(err)
+	}
+	if objects := dedupObjects(t, obs); len(objects) != 0 {
+		t.Errorf("expected content to be deleted with its last reference, found %d objects", len(objects))
+	}
+}
+
+func TestDedupReferencesAcrossRegistries(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	// Registries that share the stores count references together.
+	registries := make([]*Driver, 2)
+	for i := range registries {
+		d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), Dedup: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		registries[i] = d
+	}
+	obs := newTestObjectStore(t, ns)
+	dd := registries[0].driver.dedup
+
+	content := []byte("shared content")
+	run := func(f func(d *Driver, path string) error) {
+		var wg sync.WaitGroup
+		for i := range 16 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := f(registries[i%len(registries)], fmt.Sprintf("/%d/data", i)); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	run(func(d *Driver, path string) error {
+		return d.PutContent(ctx, path, content)
+	})
+	objects := dedupObjects(t, obs)
+	if len(objects) != 1 {
+		t.Fatalf("expected identical content to be stored once, found %d objects", len(objects))
+	}
+	if refs, err := dd.references(ctx, objects[0].Name); err != nil || refs != 16 {
+		t.Errorf("expected 16 references, got: %d, %v", refs, err)
+	}
+
+	run(func(d *Driver, path string) error {
+		return d.Delete(ctx, path)
+	})
+	if objects := dedupObjects(t, obs); len(objects) != 0 {
+		t.Errorf("expected content to be deleted with its last reference, found %d objects", len(objects))
+	}
+	if refs, err := dd.references(ctx, objects[0].Name); err != nil || refs != 0 {
+		t.Errorf("expected no references, got: %d, %v", refs, err)
+	}
+}
+
+func TestDedupLinkFailureReleasesReference(t *testing.T) {
+	ctx := context.Background()
+	d, obs := newDedupDriver(t)
+	dd := d.driver.dedup
+
+	content := []byte("content")
+	h := sha256.New()
+	h.Write(content)
+	name := dedupName(digestOf(h))
+
+	failing := &failingObjectStore{ObjectStore: obs}
+	for _, stored := range []bool{false, true} {
+		if stored {
+			// The content is also referenced by another link.
+			if err := d.PutContent(ctx, "/b/data", content); err != nil {
+				t.Fatal(err)
+			}
+		}
+		failing.fail = failOnce("Put", func(name string) bool { return name == "/a/data" })
+		if err := dd.putBytes(ctx, failing, "/a/data", "/a/data", content, d.driver.writerOptions("/a/data")); err == nil {
+			t.Fatal("expected the link to fail")
+		}
+
+		want := 0
+		if stored {
+			want = 1
+		}
+		if refs, err := dd.references(ctx, name); err != nil || refs != want {
+			t.Errorf("expected %d references after the link failed, got: %d, %v", want, refs, err)
+		}
+		if objects := dedupObjects(t, obs); len(objects) != want {
+			t.Errorf("expected %d content objects after the link failed, found %d", want, len(objects))
+		}
+	}
+}
+
+func TestDedupLegacyReferences(t *testing.T) {
+	ctx := context.Background()
+	d, obs := newDedupDriver(t)
+	dd := d.driver.dedup
+
+	// Content stored before the references were kept in their bucket
+	// records them in a header, which the count starts from.
+	content := []byte("legacy content")
+	h := sha256.New()
+	h.Write(content)
+	dgst := digestOf(h)
+	headers := nats.Header{}
+	headers.Set(headerDedupReferences, "1")
+	if _, err := obs.Put(ctx, jetstream.ObjectMeta{Name: dedupName(dgst), Headers: headers}, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dd.link(ctx, obs, "/a/data", "/a/data", dgst, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.PutContent(ctx, "/b/data", content); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := dd.references(ctx, dedupName(dgst)); err != nil || refs != 2 {
+		t.Errorf("expected 2 references, got: %d, %v", refs, err)
+	}
+
+	for _, path := range []string{"/a/data", "/b/data"} {
+		if objects := dedupObjects(t, obs); len(objects) != 1 {
+			t.Errorf("expected content to be kept until its last reference is deleted, found %d objects", len(objects))
+		}
+		if err := d.Delete(ctx, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if objects := dedupObjects(t, obs); len(objects) != 0 {
+		t.Errorf("expected content to be deleted with its last reference, found %d objects", len(objects))
+	}
+}
+
+func TestDedupWriter(t *testing.T) {
+	ctx := context.Background()
+	d, obs := newDedupDriver(t)
+
+	content := make([]byte, 3*defaultChunkSize)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, d, "/a/data", content, false, true)
+	// Write the second copy in two sessions, to make sure that
+	// appending picks up the hash of what was written before.
+	writeFile(t, d, "/b/data", content[:defaultChunkSize], false, false)
+	writeFile(t, d, "/b/data", content[defaultChunkSize:], true, true)
+
+	objects := dedupObjects(t, obs)
+	if len(objects) != 1 {
+		t.Fatalf("expected identical content to be stored once, found %d objects", len(objects))
+	}
+	sum := sha256.Sum256(content)
+	if want := "sha256/" + hex.EncodeToString(sum[:]); objects[0].Name != want {
+		t.Errorf("expected content to be stored under %s, got: %s", want, objects[0].Name)
+	}
+
+	// Moving a link must not affect the content that it points to.
+	if err := d.Move(ctx, "/a/data", "/c/data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "/b/data"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetContent(ctx, "/c/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("expected moved reference to be readable")
+	}
+
+	reader, err := d.Reader(ctx, "/c/data", int64(len(content)-10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(reader); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[len(content)-10:], buf.Bytes()) {
+		t.Error("expected reading from an offset to follow the link")
+	}
+}
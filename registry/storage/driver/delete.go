@@ -0,0 +1,191 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const defaultDeleteConcurrency = 16
+
+// deleteObject deletes the object described by info, along with its parts.
+func (d *driver) deleteObject(ctx context.Context, obs jetstream.ObjectStore, info *jetstream.ObjectInfo) error {
+	return d.deleteObjects(ctx, obs, []*jetstream.ObjectInfo{info})
+}
+
+// deleteObjects deletes the objects in obs, along with their parts. The
+// objects are deleted before their parts, so that they never list parts
+// that are gone.
+func (d *driver) deleteObjects(ctx context.Context, obs jetstream.ObjectStore, objects []*jetstream.ObjectInfo) error {
+	var (
+		mu    sync.Mutex
+		parts []string
+	)
+	err := d.concurrently(len(objects), func(i int) error {
+		info := objects[i]
+		count := 0
+		if isMultipart(info) {
+			var err error
+			if count, err = strconv.Atoi(info.Headers.Get(headerMultipartCount)); err != nil {
+				return fmt.Errorf("failed to parse multipart header: %w", err)
+			}
+			// The parts and the charge of an object that was left behind
+			// by a failed move belong to the object that it moved to.
+			if moved := info.Headers.Get(headerMovedParts); moved != "" {
+				dest, err := currentInfo(ctx, obs, stagedOwner(moved))
+				if err != nil {
+					return err
+				}
+				if dest != nil && movedTo(info, dest) {
+					return d.deleteStored(ctx, obs, info.Name)
+				}
+			}
+		}
+		if err := d.deleteStored(ctx, obs, info.Name); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		for j := 0; j < count; j++ {
+			parts = append(parts, partName(info, j))
+			// Some parts may have been staged by a move that failed halfway.
+			if moved := info.Headers.Get(headerMovedParts); moved != "" {
+				parts = append(parts, fmt.Sprintf(multipartTemplate, moved, j))
+			}
+		}
+		mu.Unlock()
+		if err := d.quotas.released(ctx, info); err != nil {
+			return err
+		}
+		return d.dedup.released(ctx, info)
+	})
+
+	// The parts of the objects that were deleted are deleted even if
+	// others failed to be, because nothing refers to them anymore.
+	partsErr := d.concurrently(len(parts), func(i int) error {
+		err := d.deleteStored(ctx, obs, parts[i])
+		if errors.Is(err, jetstream.ErrObjectNotFound) {
+			return nil
+		}
+		return err
+	})
+	return errors.Join(err, partsErr)
+}
+
+// deleteStored deletes the object name from obs. Deleting an object again
+// only purges its chunks once more, so it is retried like a request: a
+// large multipart object has many parts to purge, and one of them timing
+// out would otherwise leave the object halfway deleted.
+func (d *driver) deleteStored(ctx context.Context, obs jetstream.ObjectStore, name string) error {
+	return d.retry.request(ctx, "Delete.object", func(ctx context.Context) error {
+		return obs.Delete(ctx, name)
+	})
+}
+
+// concurrently calls f for every index up to n, with up to deleteConcurrency
+// calls at the same time. After the first error, no more calls are started,
+// and the errors of the calls that were still running are returned with it.
+func (d *driver) concurrently(n int, f func(int) error) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errs   []error
+		failed = make(chan struct{})
+	)
+	indexes := make(chan int)
+	for w := 0; w < min(d.deleteConcurrency, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := f(i); err != nil {
+					mu.Lock()
+					if len(errs) == 0 {
+						close(failed)
+					}
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-failed:
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// purgeStore empties obs when everything that it holds is below path,
+// after releasing the deduplicated content that it links to. Purging the
+// stream at once is much faster than deleting its objects one by one, but
+// leaves no trace for the watchers of other registries to evict their
+// caches with, so it is only done when the cache is disabled. It reports
+// whether obs was purged, and whether it held any objects.
+func (d *driver) purgeStore(ctx context.Context, obs jetstream.ObjectStore, path string) (purged, deleted bool, err error) {
+	if obs == d.root || d.cache != nil {
+		return false, false, nil
+	}
+	status, err := obs.Status(ctx)
+	if err != nil {
+		return false, false, err
+	}
+	key := status.Description()
+	if key != path && !isUnder(key, path) {
+		return false, false, nil
+	}
+
+	// The usage of every quota key is only updated once, after the purge.
+	released := make(map[string]int64)
+	err = eachStoreObject(ctx, obs, func(info *jetstream.ObjectInfo) error {
+		deleted = true
+		key, size, err := d.quotas.charge(info)
+		if err != nil {
+			return err
+		}
+		released[key] += size
+		return d.dedup.released(ctx, info)
+	})
+	if err != nil {
+		return false, false, err
+	}
+
+	stream, err := d.stores.jsOf(key).Stream(ctx, streamPrefix+status.Bucket())
+	if err != nil {
+		return false, false, err
+	}
+	if err := stream.Purge(ctx); err != nil {
+		return false, false, err
+	}
+	for key, size := range released {
+		if err := d.quotas.add(ctx, key, -size); err != nil {
+			return true, deleted, err
+		}
+	}
+	return true, deleted, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go"
+)
+
+func TestDeleteDirectoryConcurrently(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:         ns.ClientURL(),
+		Dedup:             true,
+		DeleteConcurrency: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	for i := 0; i < 20; i++ {
+		writeParts(t, obs, fmt.Sprintf("/dir/multipart-%d", i), bytes.Repeat([]byte("a"), 64), false, true)
+		// Every link refers to the same deduplicated content.
+		if err := d.PutContent(ctx, fmt.Sprintf("/dir/link-%d", i), []byte("deduplicated")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.PutContent(ctx, "/kept", []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Delete(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the file outside of the directory, and its own deduplicated content, are left.
+	if names := objectNames(t, obs); len(names) != 2 {
+		t.Errorf("expected the directory, its parts and its content to be deleted, got: %v", names)
+	}
+	if _, err := d.Stat(ctx, "/kept"); err != nil {
+		t.Errorf("expected the file outside of the directory to be kept, got: %v", err)
+	}
+}
+
+func TestConcurrentlyStopsAtFirstError(t *testing.T) {
+	d := &driver{deleteConcurrency: 2}
+
+	var calls atomic.Int32
+	failure := errors.New("failure")
+	err := d.concurrently(100, func(i int) error {
+		calls.Add(1)
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("expected the failure to be returned, got: %v", err)
+	}
+	// Each worker may have picked up one more index before the failure was seen.
+	if n := calls.Load(); n > 4 {
+		t.Errorf("expected no more calls to be started after the first failure, got %d", n)
+	}
+
+	calls.Store(0)
+	if err := d.concurrently(100, func(int) error { calls.Add(1); return nil }); err != nil || calls.Load() != 100 {
+		t.Errorf("expected every index to be called once, got %d calls: %v", calls.Load(), err)
+	}
+}
+
+func TestDeletePurgesShardStores(t *testing.T) {
+	ctx := context.Background()
+	d, js := newShardedDriver(t, true)
+
+	repository := testRepositories + "/acme"
+	for _, path := range []string{repository + "/app/_layers/link", repository + "/web/_layers/link"} {
+		if err := d.PutContent(ctx, path, []byte("layer")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Delete(ctx, repository); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := js.Stream(ctx, streamPrefix+bucketName(defaultBucketPrefix, shardStoreName(repository)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 0 {
+		t.Errorf("expected the store of the repository to be purged, got %d messages", info.State.Msgs)
+	}
+	// The deduplicated content that the repository linked to is released.
+	if names := objectNames(t, d.driver.root); names != nil {
+		t.Errorf("expected the layer to be released, got: %v", names)
+	}
+
+	if err := d.Delete(ctx, repository); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected a purged repository to be gone, got: %v", err)
+	}
+	// The store is kept, so that it can be written to again.
+	if err := d.PutContent(ctx, repository+"/app/_layers/link", []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := d.GetContent(ctx, repository+"/app/_layers/link"); err != nil || string(content) != "layer" {
+		t.Errorf("expected to read back the layer, got: %q, %v", content, err)
+	}
+}
+
+func TestDeleteRetriesTimedOutParts(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:       ns.ClientURL(),
+		WriteBufferSize: defaultChunkSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &failingObjectStore{ObjectStore: d.driver.root, fail: func(string, string) error { return nil }}
+	d.driver.root = root
+	d.driver.stores.root = root
+	writeFile(t, d, "/multipart", make([]byte, 3*defaultChunkSize+42), false, true)
+
+	timedOut := false
+	root.fail = func(op, name string) error {
+		if op != "Delete" || name != "/multipart/1" || timedOut {
+			return nil
+		}
+		timedOut = true
+		return nats.ErrTimeout
+	}
+	if err := d.Delete(ctx, "/multipart"); err != nil {
+		t.Fatalf("expected the part that timed out to be deleted again, got: %v", err)
+	}
+	if !timedOut {
+		t.Fatal("expected the deletion of the part to time out")
+	}
+	if names := objectNames(t, root); names != nil {
+		t.Errorf("expected the object and its parts to be deleted, got: %v", names)
+	}
+}
@@ -14,14 +14,19 @@
 package driver
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"path/filepath"
+	pathpkg "path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/base"
@@ -29,6 +34,9 @@ import (
 
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
@@ -36,16 +44,108 @@ const (
 
 	sep = "/"
 
-	rootStoreName = "cascade-registry-root"
+	rootStoreName = "root"
 	rootPath      = "/"
+
+	// JetStream does not allow more replicas than this.
+	maxReplicas = 5
 )
 
+// validBucketPrefix matches the characters that NATS allows in bucket names.
+var validBucketPrefix = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// bucketName returns the name of the bucket for the given store,
+// which is namespaced by the prefix to allow hosting multiple
+// registries in a single NATS cluster.
+func bucketName(prefix, store string) string {
+	return prefix + "-" + store
+}
+
+// storeConfig returns the configuration of an object store
+// that is created by the driver.
+func storeConfig(prefix, store, description string, replicas int, placement *jetstream.Placement, storage jetstream.StorageType) jetstream.ObjectStoreConfig {
+	return jetstream.ObjectStoreConfig{
+		Bucket:      bucketName(prefix, store),
+		Description: description,
+		Replicas:    replicas,
+		Placement:   placement,
+		Storage:     storage,
+	}
+}
+
+// parseStorage returns the storage type that the buckets of the driver
+// are kept in, which is on disk unless it is memory.
+func parseStorage(s string) (jetstream.StorageType, error) {
+	switch s {
+	case "", "file":
+		return jetstream.FileStorage, nil
+	case "memory":
+		return jetstream.MemoryStorage, nil
+	default:
+		return 0, fmt.Errorf("unsupported storage %q, must be one of: file, memory", s)
+	}
+}
+
+// placementOf returns where the stores of the driver are placed,
+// or nil if they may be placed anywhere.
+func placementOf(params *Parameters) *jetstream.Placement {
+	if params.PlacementCluster == "" && len(params.PlacementTags) == 0 {
+		return nil
+	}
+	return &jetstream.Placement{
+		Cluster: params.PlacementCluster,
+		Tags:    params.PlacementTags,
+	}
+}
+
+// normalizePath cleans redundant separators from path, and rejects paths
+// that are not absolute or that contain relative components. Everything
+// that is stored outside of the registry's paths, like deduplicated
+// content, relies on registry paths always starting with a slash.
+func normalizePath(path string) (string, error) {
+	if !strings.HasPrefix(path, sep) {
+		return "", storagedriver.InvalidPathError{Path: path, DriverName: driverName}
+	}
+	for _, component := range strings.Split(path, sep) {
+		if component == "." || component == ".." {
+			return "", storagedriver.InvalidPathError{Path: path, DriverName: driverName}
+		}
+	}
+	return pathpkg.Clean(path), nil
+}
+
 // Ensure that we satisfy the interface.
 var _ storagedriver.StorageDriver = &driver{}
 
 type driver struct {
-	js   jetstream.JetStream
-	root jetstream.ObjectStore
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	root   jetstream.ObjectStore
+	stores *stores
+
+	// signer is only set when the gateway is enabled.
+	signer      *urlSigner
+	cache       *objectCache
+	dedup       *deduplicator
+	compression compression
+	encryption  *encryptor
+	quotas      *quotas
+	links       *linkStore
+	locks       *writeLocks
+	chunkSize   int
+	hashedNames bool
+	readOnly    bool
+	verifyReads bool
+
+	writeBufferSize int
+	buffers         *bufferPool
+
+	uploadConcurrency int
+	deleteConcurrency int
+	readAhead         int
+	retry             *retryPolicy
+
+	healthCheckMaxLatency time.Duration
 }
 
 type baseEmbed struct {
@@ -55,6 +155,12 @@ type baseEmbed struct {
 // Driver is a storagedriver.Storagedriver implementation backed by NATS JetStream.
 type Driver struct {
 	baseEmbed
+
+	// driver is the unwrapped driver, for operations
+	// that are not part of the StorageDriver interface.
+	driver *driver
+	// gateway is only set when the gateway is enabled.
+	gateway *gateway
 }
 
 func init() {
@@ -64,36 +170,373 @@ func init() {
 type natsDriverFactory struct{}
 
 func (factory *natsDriverFactory) Create(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
-	return FromParameters(ctx, parameters)
+	d, err := FromParameters(ctx, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	// The registry creates its storage driver through the factory,
+	// so this is where the gateway starts serving.
+	if err := d.ServeGateway(); err != nil {
+		d.driver.nc.Close()
+		return nil, err
+	}
+	context.AfterFunc(ctx, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), gatewayShutdownTimeout)
+		defer cancel()
+		_ = d.ShutdownGateway(ctx)
+	})
+
+	return d, nil
 }
 
 // New constructs a new Driver
-func New(ctx context.Context, params *Parameters) (*Driver, error) {
-	js, err := newJetStream(params)
+func New(ctx context.Context, params *Parameters) (_ *Driver, err error) {
+	bucketPrefix := params.BucketPrefix
+	if bucketPrefix == "" {
+		bucketPrefix = defaultBucketPrefix
+	}
+	if !validBucketPrefix.MatchString(bucketPrefix) {
+		return nil, fmt.Errorf("invalid bucket prefix %q: may only contain letters, digits, '-' and '_'", bucketPrefix)
+	}
+
+	replicas := params.Replicas
+	if replicas == 0 {
+		replicas = 1
+	}
+	if replicas < 1 || replicas > maxReplicas {
+		return nil, fmt.Errorf("invalid replica count %d: must be between 1 and %d", replicas, maxReplicas)
+	}
+
+	maxConcurrency := params.MaxConcurrency
+	if maxConcurrency == 0 {
+		maxConcurrency = defaultMaxConcurrency
+	}
+	if maxConcurrency < 1 {
+		return nil, fmt.Errorf("invalid max concurrency %d: must be at least 1", maxConcurrency)
+	}
+
+	chunkSize := params.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = defaultChunkSize
+	}
+	if chunkSize < minChunkSize || chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d: must be between %d and %d bytes", chunkSize, minChunkSize, maxChunkSize)
+	}
+
+	writeBufferSize := params.WriteBufferSize
+	if writeBufferSize == 0 {
+		writeBufferSize = defaultWriteBufferSize
+	}
+	if writeBufferSize < chunkSize {
+		return nil, fmt.Errorf("invalid write buffer size %d: must be at least the chunk size of %d bytes", writeBufferSize, chunkSize)
+	}
+
+	uploadConcurrency := params.UploadConcurrency
+	if uploadConcurrency == 0 {
+		uploadConcurrency = 1
+	}
+	if uploadConcurrency < 1 {
+		return nil, fmt.Errorf("invalid upload concurrency %d: must be at least 1", uploadConcurrency)
+	}
+
+	if params.DedupChunkSize != 0 && !params.Dedup {
+		return nil, fmt.Errorf("invalid dedup chunk size %d: requires dedup to be enabled", params.DedupChunkSize)
+	}
+	if params.DedupChunkSize != 0 && (params.DedupChunkSize < minDedupChunkSize || params.DedupChunkSize > maxDedupChunkSize) {
+		return nil, fmt.Errorf("invalid dedup chunk size %d: must be between %d and %d bytes", params.DedupChunkSize, minDedupChunkSize, maxDedupChunkSize)
+	}
+
+	if params.ReadAhead < 0 {
+		return nil, fmt.Errorf("invalid read ahead %d: must not be negative", params.ReadAhead)
+	}
+
+	purgeAge := params.PurgeAge
+	if purgeAge == 0 {
+		purgeAge = defaultPurgeAge
+	}
+	if params.PurgeInterval < 0 || purgeAge < 0 {
+		return nil, fmt.Errorf("invalid purge interval %s or age %s: must not be negative", params.PurgeInterval, purgeAge)
+	}
+	if params.ScrubInterval < 0 || params.ScrubRate < 0 {
+		return nil, fmt.Errorf("invalid scrub interval %s or rate %d: must not be negative", params.ScrubInterval, params.ScrubRate)
+	}
+	backupRetain := params.BackupRetain
+	if backupRetain == 0 {
+		backupRetain = defaultBackupRetain
+	}
+	if params.BackupInterval < 0 || backupRetain < 1 {
+		return nil, fmt.Errorf("invalid backup interval %s or retain %d: the interval must not be negative, and at least one backup must be kept", params.BackupInterval, params.BackupRetain)
+	}
+	if params.BackupInterval > 0 && params.BackupDir == "" {
+		return nil, errors.New("invalid backup interval: requires a backup directory")
+	}
+	if params.UploadTTL < 0 {
+		return nil, fmt.Errorf("invalid upload TTL %s: must not be negative", params.UploadTTL)
+	}
+	if params.StoreMaxBytes < 0 || params.StoreMaxAge < 0 {
+		return nil, fmt.Errorf("invalid store max bytes %d or max age %s: must not be negative", params.StoreMaxBytes, params.StoreMaxAge)
+	}
+	if params.WriteLockTTL < 0 || params.WriteLockWait < 0 {
+		return nil, fmt.Errorf("invalid write lock TTL %s or wait %s: must not be negative", params.WriteLockTTL, params.WriteLockWait)
+	}
+
+	deleteConcurrency := params.DeleteConcurrency
+	if deleteConcurrency == 0 {
+		deleteConcurrency = defaultDeleteConcurrency
+	}
+	if deleteConcurrency < 1 {
+		return nil, fmt.Errorf("invalid delete concurrency %d: must be at least 1", deleteConcurrency)
+	}
+
+	maxRetries := params.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	retryBackoff := params.RetryBackoff
+	if retryBackoff == 0 {
+		retryBackoff = defaultRetryBackoff
+	}
+	// A negative amount of retries disables them.
+	maxRetries = max(maxRetries, 0)
+	transferTimeout := params.TransferTimeout
+	if transferTimeout == 0 {
+		transferTimeout = defaultTransferTimeout
+	}
+	if params.APITimeout < 0 || transferTimeout < 0 || retryBackoff < 0 {
+		return nil, fmt.Errorf("invalid API timeout %s, transfer timeout %s or retry backoff %s: must not be negative", params.APITimeout, transferTimeout, retryBackoff)
+	}
+	breakerCooldown := params.BreakerCooldown
+	if breakerCooldown == 0 {
+		breakerCooldown = defaultBreakerCooldown
+	}
+	if params.BreakerThreshold < 0 || breakerCooldown < 0 {
+		return nil, fmt.Errorf("invalid breaker threshold %d or cooldown %s: must not be negative", params.BreakerThreshold, breakerCooldown)
+	}
+	retry := &retryPolicy{
+		maxRetries:      maxRetries,
+		backoff:         retryBackoff,
+		apiTimeout:      params.APITimeout,
+		transferTimeout: transferTimeout,
+	}
+
+	healthCheckThreshold := params.HealthCheckThreshold
+	if healthCheckThreshold == 0 {
+		healthCheckThreshold = defaultHealthCheckThreshold
+	}
+	if healthCheckThreshold < 1 {
+		return nil, fmt.Errorf("invalid health check threshold %d: must be at least 1", healthCheckThreshold)
+	}
+	if params.HealthCheckInterval < 0 || params.HealthCheckMaxLatency < 0 {
+		return nil, fmt.Errorf("invalid health check interval %s or max latency %s: must not be negative", params.HealthCheckInterval, params.HealthCheckMaxLatency)
+	}
+	healthCheckMaxLatency := params.HealthCheckMaxLatency
+	if healthCheckMaxLatency == 0 {
+		healthCheckMaxLatency = defaultHealthCheckMaxLatency
+	}
+
+	storage, err := parseStorage(params.Storage)
 	if err != nil {
 		return nil, err
 	}
 
-	config := jetstream.ObjectStoreConfig{
-		Bucket:      rootStoreName,
-		Description: rootPath,
+	shardPrefixes := make([]string, len(params.ShardPrefixes))
+	for i, prefix := range params.ShardPrefixes {
+		normalized, err := normalizePath(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard prefix %q: %w", prefix, err)
+		}
+		shardPrefixes[i] = normalized
+	}
+
+	tenantPrefix := params.TenantPrefix
+	if tenantPrefix == "" {
+		tenantPrefix = defaultTenantPrefix
+	}
+	tenantPrefix, err = normalizePath(tenantPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant prefix %q: %w", params.TenantPrefix, err)
+	}
+
+	if params.Quota < 0 {
+		return nil, fmt.Errorf("invalid quota %d: must not be negative", params.Quota)
+	}
+	if params.Quota > 0 && len(params.QuotaPrefixes) == 0 {
+		return nil, fmt.Errorf("invalid quota %d: requires quota prefixes", params.Quota)
 	}
+	quotaPrefixes := make([]string, len(params.QuotaPrefixes))
+	for i, prefix := range params.QuotaPrefixes {
+		normalized, err := normalizePath(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota prefix %q: %w", prefix, err)
+		}
+		quotaPrefixes[i] = normalized
+	}
+
+	nc, js, err := newJetStream(params)
+	if err != nil {
+		return nil, err
+	}
+	// The connections, with their reconnect goroutines and watchers,
+	// must not outlive a driver that failed to be constructed.
+	var tenantConns []*nats.Conn
+	defer func() {
+		if err != nil {
+			nc.Close()
+			for _, tc := range tenantConns {
+				tc.Close()
+			}
+		}
+	}()
+	// Every chunk is sent as a single message.
+	if maxPayload := nc.MaxPayload(); int64(chunkSize) > maxPayload {
+		return nil, fmt.Errorf("invalid chunk size %d: the NATS server only accepts messages of up to %d bytes", chunkSize, maxPayload)
+	}
+
+	placement := placementOf(params)
+	config := storeConfig(bucketPrefix, rootStoreName, rootPath, replicas, placement, storage)
+	config.MaxBytes = params.StoreMaxBytes
+	config.TTL = params.StoreMaxAge
 	root, err := js.CreateOrUpdateObjectStore(ctx, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to ensure root store exists: %w", err)
 	}
+	pulls := semaphore.NewWeighted(maxPulledBytes)
+	root = &pullingStore{ObjectStore: root, js: js, pulls: pulls}
+
+	compression, err := parseCompression(params.Compression)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := loadEncryptor(ctx, js, params, bucketPrefix, replicas, storage)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := newQuotas(ctx, js, bucketPrefix, replicas, placement, storage, quotaPrefixes, params.Quota)
+	if err != nil {
+		return nil, err
+	}
+	locks, err := newWriteLocks(ctx, js, bucketPrefix, replicas, placement, storage, params.WriteLockTTL, params.WriteLockWait)
+	if err != nil {
+		return nil, err
+	}
+	dedup, err := newDeduplicator(ctx, js, root, bucketPrefix, replicas, placement, storage, params.Dedup, params.DedupChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	var links *linkStore
+	if params.KVLinks {
+		links, err = newLinkStore(ctx, js, bucketPrefix, replicas, placement, storage, encryption)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cache := newObjectCache(params.CacheMaxEntries, params.CacheMaxObjectSize, params.CacheTTL)
+	if _, err := cache.watch(ctx, root); err != nil {
+		return nil, fmt.Errorf("failed to watch root store: %w", err)
+	}
+	if err := links.watch(ctx, cache); err != nil {
+		return nil, fmt.Errorf("failed to watch link store: %w", err)
+	}
+	stores := newStores(js, root, bucketPrefix, replicas, placement, storage, shardPrefixes)
+	stores.watch = cache.watch
+	stores.pulls = pulls
+	stores.uploadTTL = params.UploadTTL
+	if stores.tenants, tenantConns, err = connectTenants(ctx, params, tenantPrefix); err != nil {
+		return nil, err
+	}
+	stores.maxBytes = params.StoreMaxBytes
+	stores.maxAge = params.StoreMaxAge
+
+	d := &driver{
+		nc:          nc,
+		js:          js,
+		root:        root,
+		stores:      stores,
+		cache:       cache,
+		dedup:       dedup,
+		compression: compression,
+		encryption:  encryption,
+		quotas:      quotas,
+		links:       links,
+		locks:       locks,
+		chunkSize:   chunkSize,
+		hashedNames: params.HashedNames,
+		readOnly:    params.ReadOnly,
+		verifyReads: params.VerifyReads,
 
-	d := &driver{js, root}
+		writeBufferSize:   writeBufferSize,
+		buffers:           newBufferPool(writeBufferSize),
+		uploadConcurrency: uploadConcurrency,
+		deleteConcurrency: deleteConcurrency,
+		readAhead:         params.ReadAhead,
+		retry:             retry,
+
+		healthCheckMaxLatency: healthCheckMaxLatency,
+	}
+
+	// All content is streamed over a single NATS connection, and the
+	// reads of the stores share a budget, so that however many operations
+	// run at once, the server never buffers enough for the connection to
+	// disconnect it as a slow consumer. Retries are made while holding on
+	// to the operation's turn, so that they do not add to the load of a
+	// struggling server.
+	var next storagedriver.StorageDriver = newRetryingDriver(d, retry)
+	if params.BreakerThreshold > 0 {
+		// Operations that fail right away give up their turn right away too.
+		breaker := newCircuitBreaker(driverName+"_"+bucketPrefix, params.BreakerThreshold, breakerCooldown)
+		next = &breakerDriver{StorageDriver: next, breaker: breaker}
+	}
+	if params.StoreMaxBytes > 0 {
+		next = &limitedDriver{StorageDriver: next, stores: stores, maxBytes: params.StoreMaxBytes}
+	}
+	if params.ReadOnly {
+		next = &readOnlyDriver{next}
+	}
+	regulated := base.NewRegulator(next, uint64(maxConcurrency))
+	if params.Tracing {
+		// Spans include the time spent waiting for the regulator.
+		regulated = newTracedDriver(regulated, d.stores)
+	}
 
-	return &Driver{
+	driver := &Driver{
 		baseEmbed: baseEmbed{
 			Base: base.Base{
-				// TODO: Figure out why concurrency is a problem,
-				// and probably make this configurable.
-				StorageDriver: base.NewRegulator(d, 1),
+				StorageDriver: regulated,
 			},
 		},
-	}, nil
+		driver: d,
+	}
+
+	if params.GatewayEnabled {
+		d.signer, err = newURLSigner(params.GatewayURL, params.GatewaySecret, params.GatewayExpiry)
+		if err != nil {
+			return nil, err
+		}
+
+		driver.gateway = &gateway{
+			driver: driver,
+			signer: d.signer,
+			addr:   params.GatewayAddr,
+		}
+	}
+
+	if params.PurgeInterval > 0 && !params.ReadOnly {
+		go d.purgePeriodically(context.WithoutCancel(ctx), params.PurgeInterval, purgeAge, params.PurgeDryRun)
+	}
+	if params.ScrubInterval > 0 {
+		opts := ScrubOptions{Rate: params.ScrubRate, Quarantine: params.ScrubQuarantine && !params.ReadOnly}
+		go d.scrubPeriodically(context.WithoutCancel(ctx), params.ScrubInterval, opts, registerScrubStatus(bucketPrefix))
+	}
+	if params.BackupInterval > 0 {
+		go driver.backupPeriodically(context.WithoutCancel(ctx), params.BackupInterval, params.BackupDir, backupRetain)
+	}
+	if params.HealthCheckInterval > 0 {
+		driver.registerHealthCheck(context.WithoutCancel(ctx), params.HealthCheckInterval, healthCheckThreshold)
+	}
+
+	return driver, nil
 }
 
 // Name returns the human-readable "name" of the driver, useful in error
@@ -106,6 +549,15 @@ func (d *driver) Name() string {
 // GetContent retrieves the content stored at "path" as a []byte.
 // This should primarily be used for small objects.
 func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if content, ok := d.cache.getContent(path); ok {
+		return bytes.Clone(content), nil
+	}
+	gen := d.cache.generation()
+
 	// GetContent may be used to fetch a multipart object,
 	// so we must use the objectReader to handle that,
 	// exactly like driver.Reader().
@@ -114,17 +566,86 @@ func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
 		return nil, err
 	}
 
-	return io.ReadAll(reader)
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.addContent(path, bytes.Clone(content), gen)
+
+	return content, nil
 }
 
 // PutContent stores the []byte content at a location designated by "path".
 // This should primarily be used for small objects.
 func (d *driver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := d.putContent(ctx, path, content); err != nil {
+		return err
+	}
+	d.describeManifest(ctx, path, content)
+	return nil
+}
+
+// putContent stores content at path.
+func (d *driver) putContent(ctx context.Context, path string, content []byte) error {
+	path, err := normalizePath(path)
+	if err != nil {
+		return err
+	}
+	defer d.cache.invalidate(path)
+	if d.links.holds(path) {
+		return d.putLink(ctx, path, content)
+	}
+
+	obs, err := d.stores.make(ctx, path)
+	if err != nil {
+		return err
+	}
+	name := d.objectName(path)
+	// PutContent as a whole is not retried, because it is not idempotent
+	// when it adds references or updates quotas. Its idempotent steps are.
+	var previous *jetstream.ObjectInfo
+	err = d.retry.request(ctx, "PutContent.currentInfo", func(ctx context.Context) (err error) {
+		previous, err = currentInfo(ctx, obs, name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
 	if len(content) != 0 {
-		_, err := d.root.PutBytes(ctx, path, content)
+		if err := d.quotas.check(ctx, path, int64(len(content))); err != nil {
+			return err
+		}
+	}
+
+	if len(content) != 0 && d.dedup.enabled {
+		if err := d.dedup.putBytes(ctx, obs, name, path, content, d.writerOptions(path)); err != nil {
+			return err
+		}
+	} else if len(content) != 0 {
+		meta := jetstream.ObjectMeta{
+			Name: name,
+			Opts: &jetstream.ObjectMetaOptions{
+				ChunkSize: uint32(d.chunkSize),
+			},
+		}
+		setPath(&meta, path)
+		data, err := compress(d.compression, &meta, content)
 		if err != nil {
 			return err
 		}
+		if data, err = d.encryption.encrypt(&meta, data); err != nil {
+			return err
+		}
+		var info *jetstream.ObjectInfo
+		err = d.retry.transfer(ctx, "PutContent.put", func(ctx context.Context) (err error) {
+			info, err = obs.Put(ctx, meta, bytes.NewReader(data))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		traceObject(ctx, info)
 	} else {
 		// Zero-byte content is a special case; it may be appended to later.
 		fw, err := d.Writer(ctx, path, false)
@@ -137,23 +658,52 @@ func (d *driver) PutContent(ctx context.Context, path string, content []byte) er
 		if err := fw.Close(); err != nil {
 			return err
 		}
+		// Closing the writer already took care of the previous content.
+		return nil
 	}
 
-	return nil
+	if err := d.quotas.replaced(ctx, previous, path, int64(len(content))); err != nil {
+		return err
+	}
+	return d.dedup.released(ctx, previous)
 }
 
 // Reader retrieves an io.ReadCloser for the content stored at "path"
 // with a given byte offset.
 // May be used to resume reading a stream by providing a nonzero offset.
 func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
-	obr, err := newObjectReader(ctx, d.root, path, offset)
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return d.reader(ctx, path, offset, d.verifyReads)
+}
+
+// reader returns a reader for the normalized path, which verifies blobs
+// against the digest in their path when verifyBlobs is set.
+func (d *driver) reader(ctx context.Context, path string, offset int64, verifyBlobs bool) (io.ReadCloser, error) {
+	content, _, err := d.links.get(ctx, path)
+	if err == nil {
+		return readLink(path, content, offset)
+	}
+	if !errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil, err
+	}
+	obs, err := d.stores.find(ctx, path)
+	if errors.Is(err, errStoreNotFound) {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	if err != nil {
+		return nil, err
+	}
+	obr, err := newObjectReader(ctx, obs, d.dedup, d.encryption, d.objectName(path), offset, d.readAhead)
 	if errors.Is(err, jetstream.ErrObjectNotFound) {
 		return nil, storagedriver.PathNotFoundError{Path: path}
 	}
 	if err != nil {
 		return nil, fmt.Errorf("unexpected error getting reader for path '%s': %w", path, err)
 	}
-	return obr, err
+	return newVerifyingReader(obr, path, verifyBlobs, offset), nil
 }
 
 // Writer returns a FileWriter which will store the content written to it
@@ -164,12 +714,81 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 // The behaviour of appending to paths with non-empty committed content is
 // undefined. Specific implementations may document their own behavior.
 func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
-	return newObjectWriter(ctx, d.root, path, append)
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := d.locks.acquire(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	fw, err := d.writer(ctx, path, append)
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	if lock == nil {
+		return fw, nil
+	}
+	return &lockedFileWriter{fw, lock}, nil
+}
+
+// writer returns a FileWriter for the normalized path.
+func (d *driver) writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	// Links are only stored in the KV bucket by PutContent, so the
+	// content that is written here must not be shadowed by one.
+	if !append {
+		if _, err := d.links.delete(ctx, path); err != nil {
+			return nil, err
+		}
+	}
+	obs, err := d.stores.make(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	opts := d.writerOptions(path)
+	name := d.objectName(path)
+	if d.cache == nil {
+		return newObjectWriter(ctx, obs, opts, name, append)
+	}
+
+	d.cache.invalidate(path)
+	fw, err := newObjectWriter(ctx, obs, opts, name, append)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingFileWriter{fw, d.cache, path}, nil
+}
+
+// writerOptions returns the options to write the content of path with.
+func (d *driver) writerOptions(path string) writerOptions {
+	return writerOptions{
+		dedup:       d.dedup,
+		compression: d.compression,
+		encryption:  d.encryption,
+		quotas:      d.quotas,
+		chunkSize:   d.chunkSize,
+		path:        path,
+
+		bufferSize:        d.writeBufferSize,
+		buffers:           d.buffers,
+		uploadConcurrency: d.uploadConcurrency,
+		retry:             d.retry,
+	}
 }
 
 // Stat retrieves the FileInfo for the given path, including the current
 // size in bytes and the creation time.
 func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if info, ok := d.cache.getInfo(path); ok {
+		return info, nil
+	}
+	gen := d.cache.generation()
+
 	// Root directory is a special case, because it is the only path
 	// allowed to end with a slash. We're still getting the info from
 	// the backend because the storage health check calls Stat("/"),
@@ -181,155 +800,448 @@ func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo,
 	}
 
 	if path == rootPath {
+		// Give the health check a clear reason while reconnecting,
+		// instead of waiting for the request to time out.
+		if status := d.nc.Status(); status != nats.CONNECTED {
+			return nil, fmt.Errorf("not connected to NATS: the connection is %s", status)
+		}
 		_, err := d.root.Status(ctx)
 		fi.FileInfoFields.IsDir = true
 		return fi, err
 	}
 
-	info, err := d.root.GetInfo(ctx, path)
+	content, modTime, err := d.links.get(ctx, path)
 	if err == nil {
-		fi.FileInfoFields.ModTime = info.ModTime
-
-		if !isMultipart(info) {
-			fi.FileInfoFields.Size = int64(info.Size)
-		} else {
-			fi.FileInfoFields.Size, err = strconv.ParseInt(info.Headers.Get(headerMultipartSize), 0, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse multipart header: %w", err)
-			}
-		}
-
-		return fi, nil
+		fi.FileInfoFields.Size = int64(len(content))
+		fi.FileInfoFields.ModTime = modTime
+		info := newFileInfo(fi, nil)
+		d.cache.addInfo(path, info, gen)
+		return info, nil
 	}
 	if !errors.Is(err, jetstream.ErrObjectNotFound) {
 		return nil, err
 	}
 
-	files, err := d.root.List(ctx)
-	if errors.Is(err, jetstream.ErrNoObjectsFound) {
-		return nil, storagedriver.PathNotFoundError{Path: path}
+	info, err := d.statObject(ctx, path)
+	if err == nil {
+		traceObject(ctx, info)
+		fi.FileInfoFields.ModTime = info.ModTime
+		fi.FileInfoFields.Size, err = fileSize(info)
+		if err != nil {
+			return nil, err
+		}
+
+		file := newFileInfo(fi, info.Metadata)
+		d.cache.addInfo(path, file, gen)
+		return file, nil
 	}
-	if err != nil {
+	if !errors.Is(err, jetstream.ErrObjectNotFound) {
 		return nil, err
 	}
 
-	dirName := path + sep
-	for i := range files {
-		if strings.HasPrefix(files[i].Name, dirName) {
+	// A directory exists as long as any object is stored below it, so
+	// listing stops at the first one.
+	err = d.eachObject(ctx, path, func(info *jetstream.ObjectInfo) error {
+		if isUnder(objectPath(info), path) {
 			fi.FileInfoFields.IsDir = true
-			return fi, nil
+			return errStopListing
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fi.FileInfoFields.IsDir {
+		return fi, nil
 	}
 
 	return nil, storagedriver.PathNotFoundError{Path: path}
 }
 
+// fileSize returns the size of the content stored at the object described by info.
+func fileSize(info *jetstream.ObjectInfo) (int64, error) {
+	if isLink(info) {
+		return linkSize(info)
+	}
+	if !isMultipart(info) {
+		return objectSize(info)
+	}
+	size, err := strconv.ParseInt(info.Headers.Get(headerMultipartSize), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse multipart header: %w", err)
+	}
+	return size, nil
+}
+
 // List returns a list of the objects that are direct descendants of the
 // given path.
 func (d *driver) List(ctx context.Context, path string) ([]string, error) {
-	objs, err := d.root.List(ctx)
+	path, err := normalizePath(path)
 	if err != nil {
-		if errors.Is(err, jetstream.ErrNoObjectsFound) {
-			if path == rootPath {
-				return []string{}, nil
-			}
-			return nil, storagedriver.PathNotFoundError{Path: path}
-		}
 		return nil, err
 	}
-
-	files := make([]string, 0)
-	for i := range objs {
-		if strings.HasPrefix(objs[i].Name, path) {
-			start := len(path) + 1
-			if path == rootPath {
-				start = 1
-			}
-			end := strings.Index(objs[i].Name[start:], sep)
-			if end == -1 {
-				end = len(objs[i].Name) - start
-			}
-			files = append(files, filepath.Join(path, objs[i].Name[len(path):start+end]))
+	// Only the direct descendants are listed, whether they are files
+	// or directories that files are stored in further down. Objects are
+	// listed one at a time, so only the children are held in memory,
+	// however many objects are stored below them.
+	dir := path + sep
+	if path == rootPath {
+		dir = rootPath
+	}
+	children := make(map[string]bool)
+	err = d.eachObject(ctx, path, func(info *jetstream.ObjectInfo) error {
+		name := objectPath(info)
+		if name == path {
+			// Like Stat says, a path with an object is a file.
+			clear(children)
+			return errStopListing
 		}
+		if isUnder(name, path) {
+			child, _, _ := strings.Cut(strings.TrimPrefix(name, dir), sep)
+			children[dir+child] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if len(files) == 0 {
+	if len(children) == 0 {
+		if path == rootPath {
+			return []string{}, nil
+		}
 		return nil, storagedriver.PathNotFoundError{Path: path}
 	}
 
-	keys := make(map[string]bool)
-	distinct := make([]string, 0)
-	for i := range files {
-		if _, v := keys[files[i]]; !v {
-			keys[files[i]] = true
-			distinct = append(distinct, files[i])
-		}
+	files := make([]string, 0, len(children))
+	for child := range children {
+		files = append(files, child)
 	}
+	sort.Strings(files)
 
-	return distinct, nil
+	return files, nil
 }
 
 // Move moves an object stored at sourcePath to destPath, removing the
 // original object.
-// Note: This may be no more efficient than a copy followed by a delete for
-// many implementations.
+//
+// Objects are renamed in place when both paths are kept in the same store,
+// so no content is copied, no matter how large it is. Otherwise, the stored
+// content is copied as-is, without decoding it.
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
-	// Have to use an ObjectReader because it can handle multi-part uploads.
-	sourceObj, err := newObjectReader(ctx, d.root, sourcePath, 0)
+	sourcePath, err := normalizePath(sourcePath)
+	if err != nil {
+		return err
+	}
+	destPath, err = normalizePath(destPath)
+	if err != nil {
+		return err
+	}
+	defer d.cache.invalidate(sourcePath)
+	defer d.cache.invalidate(destPath)
+
+	content, _, err := d.links.get(ctx, sourcePath)
+	if err == nil {
+		return d.moveLink(ctx, sourcePath, destPath, content)
+	}
+	if !errors.Is(err, jetstream.ErrObjectNotFound) {
+		return err
+	}
+
+	source, err := d.stores.find(ctx, sourcePath)
+	if errors.Is(err, errStoreNotFound) {
+		return storagedriver.PathNotFoundError{Path: sourcePath}
+	}
+	if err != nil {
+		return err
+	}
+	sourceName := d.objectName(sourcePath)
+	sourceInfo, err := source.GetInfo(ctx, sourceName)
 	if errors.Is(err, jetstream.ErrObjectNotFound) {
 		return storagedriver.PathNotFoundError{Path: sourcePath}
 	}
 	if err != nil {
-		return fmt.Errorf("unexpected error getting reader for path '%s': %w", sourcePath, err)
+		return fmt.Errorf("unexpected error getting info for path '%s': %w", sourcePath, err)
+	}
+	if sourcePath == destPath {
+		return nil
+	}
+
+	dest, err := d.stores.make(ctx, destPath)
+	if err != nil {
+		return err
 	}
+	destName := d.objectName(destPath)
 
-	meta := jetstream.ObjectMeta{Name: destPath}
-	_, err = d.root.Put(ctx, meta, sourceObj)
+	// Content that is moved out of the paths of its quota key stays charged
+	// to it, but content that is moved to another quota key is charged to that.
+	sourceKey, size, err := d.quotas.charge(sourceInfo)
 	if err != nil {
 		return err
 	}
+	destKey := d.quotas.keyOf(destPath)
+	if destKey != "" && destKey != sourceKey {
+		if err := d.quotas.check(ctx, destPath, size); err != nil {
+			return err
+		}
+	}
+
+	if _, err := d.links.delete(ctx, destPath); err != nil {
+		return err
+	}
+	// Objects can only be renamed to names that are not taken.
+	previous, err := currentInfo(ctx, dest, destName)
+	if err != nil {
+		return err
+	}
+	if previous != nil && source == dest && movedTo(sourceInfo, previous) {
+		// A move that failed after storing the destination is finished.
+		if err := source.Delete(ctx, sourceName); err != nil {
+			return err
+		}
+	} else {
+		if previous != nil {
+			if err := d.deleteObject(ctx, dest, previous); err != nil {
+				return err
+			}
+		}
 
-	// Likewise, need to use Driver's Delete because it can handle multi-part uploads.
-	if err := d.Delete(ctx, sourcePath); err != nil {
-		return fmt.Errorf("failed to delete source file '%s' after move operation: %w", sourcePath, err)
+		meta := movedMeta(sourceInfo, destName)
+		delete(meta.Headers, headerPath)
+		setPath(&meta, destPath)
+		delete(meta.Headers, headerQuotaKey)
+		if destKey == "" && sourceKey != "" {
+			meta.Headers.Set(headerQuotaKey, sourceKey)
+		}
+		if isMultipart(sourceInfo) {
+			err = moveMultipart(ctx, source, dest, sourceInfo, meta)
+		} else {
+			// Links are only headers, and move along with whatever they point at.
+			err = relocate(ctx, source, dest, sourceName, meta)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
+	if destKey != "" && destKey != sourceKey {
+		if err := d.quotas.add(ctx, sourceKey, -size); err != nil {
+			return err
+		}
+		return d.quotas.add(ctx, destKey, size)
+	}
 	return nil
 }
 
+// movedMeta returns the metadata of the object described by info,
+// renamed to name.
+func movedMeta(info *jetstream.ObjectInfo, name string) jetstream.ObjectMeta {
+	headers := nats.Header{}
+	for key, values := range info.Headers {
+		headers[key] = append([]string(nil), values...)
+	}
+	return jetstream.ObjectMeta{
+		Name:        name,
+		Description: info.Description,
+		Headers:     headers,
+		Metadata:    info.Metadata,
+		Opts:        info.Opts,
+	}
+}
+
+// moveMultipart moves the multipart object described by info from src to
+// dst, under meta.Name. The object at the destination is only stored once
+// all of its parts are there, and the source is only deleted after that.
+func moveMultipart(ctx context.Context, src, dst jetstream.ObjectStore, info *jetstream.ObjectInfo, meta jetstream.ObjectMeta) error {
+	parts, err := strconv.Atoi(info.Headers.Get(headerMultipartCount))
+	if err != nil {
+		return fmt.Errorf("failed to parse multipart header: %w", err)
+	}
+	delete(meta.Headers, headerMovedParts)
+	if src == dst {
+		return moveParts(ctx, src, info, parts, meta)
+	}
+
+	// Between stores, all parts are copied before anything is deleted.
+	for i := 0; i < parts; i++ {
+		part, err := src.GetInfo(ctx, partName(info, i))
+		if err != nil {
+			return err
+		}
+		if err := copyObject(ctx, src, dst, part.Name, movedMeta(part, fmt.Sprintf(multipartTemplate, meta.Name, i))); err != nil {
+			return err
+		}
+	}
+	delete(meta.Headers, headerMultipartName)
+	if _, err := dst.Put(ctx, meta, bytes.NewReader(nil)); err != nil {
+		return err
+	}
+	if err := src.Delete(ctx, info.Name); err != nil {
+		return err
+	}
+	for i := 0; i < parts; i++ {
+		err := src.Delete(ctx, partName(info, i))
+		if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveParts moves the multipart object described by info to meta.Name
+// within obs. Renaming only rewrites the metadata of the parts, but a part
+// at a time, so the parts are staged below meta.Name first, under a name
+// that the object records before any part is renamed. When the move fails
+// halfway, the object can no longer be read, but retrying the move picks
+// up the parts from where they were left and finishes it.
+func moveParts(ctx context.Context, obs jetstream.ObjectStore, info *jetstream.ObjectInfo, parts int, meta jetstream.ObjectMeta) error {
+	moved := info.Headers.Get(headerMovedParts)
+	staged := moved
+	if staged == "" || stagedOwner(staged) != meta.Name {
+		staged = meta.Name + sep + stagedPrefix + nuid.Next()
+		marked := movedMeta(info, info.Name)
+		marked.Headers.Set(headerMovedParts, staged)
+		if err := obs.UpdateMeta(ctx, info.Name, marked); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < parts; i++ {
+		name := fmt.Sprintf(multipartTemplate, staged, i)
+		part, err := currentInfo(ctx, obs, name)
+		if err != nil {
+			return err
+		}
+		if part != nil {
+			continue
+		}
+		// Parts that were not staged yet are where the object lists
+		// them, or where a move to elsewhere that failed left them.
+		from := []string{partName(info, i)}
+		if moved != "" && moved != staged {
+			from = append(from, fmt.Sprintf(multipartTemplate, moved, i))
+		}
+		for _, from := range from {
+			if part, err = currentInfo(ctx, obs, from); err != nil || part != nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if part == nil {
+			return fmt.Errorf("part %d of %s is missing", i, info.Name)
+		}
+		if err := obs.UpdateMeta(ctx, part.Name, movedMeta(part, name)); err != nil {
+			return err
+		}
+	}
+
+	meta.Headers.Set(headerMultipartName, staged)
+	if _, err := obs.Put(ctx, meta, bytes.NewReader(nil)); err != nil {
+		return err
+	}
+	return obs.Delete(ctx, info.Name)
+}
+
+// stagedOwner returns the name of the object that the parts
+// staged under name are staged for.
+func stagedOwner(name string) string {
+	return name[:max(strings.LastIndex(name, sep), 0)]
+}
+
+// movedTo reports whether the multipart object described by info was
+// moved to the one described by dest, which already lists its parts.
+func movedTo(info, dest *jetstream.ObjectInfo) bool {
+	moved := info.Headers.Get(headerMovedParts)
+	return moved != "" && isMultipart(dest) && multipartName(dest) == moved
+}
+
+// relocate moves the object at name in src to dst, under meta.Name.
+func relocate(ctx context.Context, src, dst jetstream.ObjectStore, name string, meta jetstream.ObjectMeta) error {
+	if src == dst {
+		// Renaming only rewrites the object's metadata, the chunks stay where they are.
+		return src.UpdateMeta(ctx, name, meta)
+	}
+	if err := copyObject(ctx, src, dst, name, meta); err != nil {
+		return err
+	}
+	return src.Delete(ctx, name)
+}
+
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (d *driver) Delete(ctx context.Context, path string) error {
-	info, err := d.root.GetInfo(ctx, path)
-	if err == nil {
-		return d.root.Delete(ctx, info.Name)
+	path, err := normalizePath(path)
+	if err != nil {
+		return err
 	}
-	if !errors.Is(err, jetstream.ErrObjectNotFound) {
+	defer d.cache.invalidate(path)
+
+	// A link may still be stored as an object as well,
+	// if it was written before links were kept in the KV bucket.
+	deletedLink, err := d.links.delete(ctx, path)
+	if err != nil {
+		return err
+	}
+	obs, err := d.stores.find(ctx, path)
+	if err == nil {
+		info, err := obs.GetInfo(ctx, d.objectName(path))
+		if err == nil {
+			return d.deleteObject(ctx, obs, info)
+		}
+		if !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return err
+		}
+	} else if !errors.Is(err, errStoreNotFound) {
 		return err
 	}
+	if deletedLink {
+		return nil
+	}
 
 	// Object not found, but the given path may be a directory.
-	objects, err := d.root.List(ctx)
+	stores, err := d.stores.under(ctx, path)
 	if err != nil {
-		if errors.Is(err, jetstream.ErrNoObjectsFound) {
-			if path == rootPath {
-				return nil
-			}
-			return storagedriver.PathNotFoundError{Path: path}
-		}
 		return err
 	}
 
-	deleted := false
-	for i := range objects {
-		if strings.HasPrefix(objects[i].Name, path+sep) {
-			err := d.root.Delete(ctx, objects[i].Name)
-			if err != nil {
-				return err
-			}
-			deleted = true
+	deleted, err := d.links.deleteUnder(ctx, path)
+	if err != nil {
+		return err
+	}
+	for _, obs := range stores {
+		purged, found, err := d.purgeStore(ctx, obs, path)
+		if err != nil {
+			return err
+		}
+		if purged {
+			deleted = deleted || found
+			continue
+		}
+
+		// The store is listed like Walk does, which gives up on a watcher
+		// that stalls, where ObjectStore.List would wait for it forever.
+		objects := make([]*jetstream.ObjectInfo, 0)
+		err = eachStoreObject(ctx, obs, func(info *jetstream.ObjectInfo) error {
+			objects = append(objects, info)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Parts of multipart objects are deleted along with them,
+		// so they are not deleted on their own.
+		files := descendants(path, objects)
+		if err := d.deleteObjects(ctx, obs, files); err != nil {
+			return err
 		}
+		deleted = deleted || len(files) > 0
 	}
 
+	if !deleted && path == rootPath {
+		return nil
+	}
 	if !deleted {
 		return storagedriver.PathNotFoundError{Path: path}
 	}
@@ -341,8 +1253,12 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 // to retrieve the content stored at path. Returning the empty string
 // signals that the request may not be redirected.
 func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
-	// NATS doesn't have an HTTP interface, so... doesn't make sense.
-	return "", nil
+	// NATS doesn't have an HTTP interface, so redirecting is only
+	// possible when our own gateway is serving the content.
+	if d.signer == nil {
+		return "", nil
+	}
+	return d.signer.sign(path, time.Now()), nil
 }
 
 // Walk traverses a filesystem defined within driver, starting
@@ -351,21 +1267,200 @@ func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
 // to a directory, the directory will not be entered and Walk
 // will continue the traversal.
 // If the returned error from the WalkFn is ErrFilledBuffer, processing stops.
+//
+// Unlike the fallback, which stats and lists every directory on its own,
+// the stores are listed only once, and directories are inferred from the
+// paths of the objects in them.
 func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
-	// TODO: Should I implement something custom?
-	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+	path, err := normalizePath(path)
+	if err != nil {
+		return err
+	}
+	walkOptions := &storagedriver.WalkOptions{}
+	for _, o := range options {
+		o(walkOptions)
+	}
+
+	objects, err := d.listObjects(ctx, path)
+	if err != nil {
+		return err
+	}
+	entries, err := walkEntries(path, objects)
+	if err != nil {
+		return err
+	}
+
+	hint := walkOptions.StartAfterHint
+	if len(entries) == 0 {
+		// Like the fallback, resuming a walk of a directory
+		// that has been removed in the meantime is not an error.
+		if path == rootPath || (hint != "" && isUnder(hint, path)) {
+			return nil
+		}
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+
+	skipDir := ""
+	for _, fi := range entries {
+		if hint != "" && walkKey(fi.Path()) <= walkKey(hint) {
+			continue
+		}
+		if skipDir != "" && isUnder(fi.Path(), skipDir) {
+			continue
+		}
+
+		err := f(fi)
+		switch {
+		case err == nil:
+		case errors.Is(err, storagedriver.ErrSkipDir):
+			if fi.IsDir() {
+				skipDir = fi.Path()
+			}
+		case errors.Is(err, storagedriver.ErrFilledBuffer):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	return nil
 }
 
-func newJetStream(params *Parameters) (jetstream.JetStream, error) {
-	nc, err := nats.Connect(params.ClientURL)
+func newJetStream(params *Parameters) (*nats.Conn, jetstream.JetStream, error) {
+	if params.JetStreamDomain != "" && params.JetStreamAPIPrefix != "" {
+		return nil, nil, errors.New("invalid JetStream domain and API prefix: only one of them may be configured")
+	}
+
+	opts := make([]nats.Option, 0)
+	if params.MaxReconnects != 0 {
+		opts = append(opts, nats.MaxReconnects(params.MaxReconnects))
+	}
+	if params.ReconnectWait != 0 {
+		opts = append(opts, nats.ReconnectWait(params.ReconnectWait))
+	}
+	if params.PingInterval != 0 {
+		opts = append(opts, nats.PingInterval(params.PingInterval))
+	}
+	if params.ConnectionName != "" {
+		opts = append(opts, nats.Name(params.ConnectionName))
+	}
+	opts = append(opts, connectionHandlers()...)
+	opts = append(opts, tlsOptions(params)...)
+	authOpts, err := authOptions(params)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	opts = append(opts, authOpts...)
 
-	js, err := jetstream.New(nc)
+	nc, err := nats.Connect(params.ClientURL, opts...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	var js jetstream.JetStream
+	switch {
+	case params.JetStreamDomain != "":
+		js, err = jetstream.NewWithDomain(nc, params.JetStreamDomain)
+	case params.JetStreamAPIPrefix != "":
+		js, err = jetstream.NewWithAPIPrefix(nc, params.JetStreamAPIPrefix)
+	default:
+		js, err = jetstream.New(nc)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
 	}
 
-	return js, err
+	return nc, js, err
+}
+
+// connectionHandlers returns the options that log changes in the state
+// of the NATS connection, so that failing registry operations can be
+// traced back to the connection.
+func connectionHandlers() []nats.Option {
+	logger := logrus.WithField("driver", driverName)
+	return []nats.Option{
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err != nil {
+				logger.WithError(err).Warn("disconnected from NATS, reconnecting")
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logger.WithField("server", nc.ConnectedUrlRedacted()).Info("reconnected to NATS")
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			if err := nc.LastError(); err != nil {
+				logger.WithError(err).Error("NATS connection closed, giving up on reconnecting")
+			}
+		}),
+	}
+}
+
+// authOptions returns the options to authenticate to NATS with. Only one
+// authentication method may be configured: a credentials file, a JWT and
+// seed, just an NKey seed, a username and password, or a token.
+func authOptions(params *Parameters) ([]nats.Option, error) {
+	methods := 0
+	for _, configured := range []bool{
+		params.Credentials != "",
+		params.JWT != "" || params.NKeySeed != "",
+		params.Username != "" || params.Password != "",
+		params.Token != "",
+	} {
+		if configured {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return nil, errors.New("only one of the credentials, jwt and nkeyseed, username and password, or token parameters may be used")
+	}
+
+	switch {
+	case params.Credentials != "":
+		return []nats.Option{nats.UserCredentials(params.Credentials)}, nil
+	case params.JWT != "" && params.NKeySeed == "":
+		return nil, errors.New("the jwt parameter requires the nkeyseed parameter to sign with")
+	case params.JWT != "":
+		return []nats.Option{nats.UserCredentials(params.JWT, params.NKeySeed)}, nil
+	case params.NKeySeed != "":
+		opt, err := nats.NkeyOptionFromSeed(params.NKeySeed)
+		if err != nil {
+			return nil, err
+		}
+		return []nats.Option{opt}, nil
+	case params.Username != "":
+		return []nats.Option{nats.UserInfo(params.Username, params.Password)}, nil
+	case params.Password != "":
+		return nil, errors.New("the password parameter requires the username parameter")
+	case params.Token != "":
+		return []nats.Option{nats.Token(params.Token)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// tlsOptions returns the options to secure the NATS connection with TLS.
+// Servers with a tls:// URL are always connected to with TLS, but
+// setting any of the TLS parameters enforces it for all servers.
+func tlsOptions(params *Parameters) []nats.Option {
+	if params.TLSCACert == "" && params.TLSClientCert == "" && params.TLSClientKey == "" &&
+		!params.TLSInsecureSkipVerify && params.TLSServerName == "" {
+		return nil
+	}
+
+	// The TLS config must come first, the other options add to it.
+	opts := []nats.Option{
+		nats.Secure(&tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			ServerName:         params.TLSServerName,
+			InsecureSkipVerify: params.TLSInsecureSkipVerify,
+		}),
+	}
+	if params.TLSCACert != "" {
+		opts = append(opts, nats.RootCAs(params.TLSCACert))
+	}
+	if params.TLSClientCert != "" || params.TLSClientKey != "" {
+		opts = append(opts, nats.ClientCert(params.TLSClientCert, params.TLSClientKey))
+	}
+	return opts
 }
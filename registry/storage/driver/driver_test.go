@@ -14,30 +14,70 @@
 package driver
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
 
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
 )
 
-var ns *server.Server
-
 func newDriverConstructor(tb testing.TB) testsuites.DriverConstructor {
+	ns := newTestServer(tb)
+
+	params := &Parameters{
+		ClientURL: ns.ClientURL(),
+	}
+
+	// params := &Parameters{
+	// 	ClientURL: "127.0.0.1:4222",
+	// }
+
+	return func() (storagedriver.StorageDriver, error) {
+		return New(context.Background(), params)
+	}
+}
+
+// newTestServer starts an embedded JetStream-enabled NATS server
+// that is shut down when the test finishes.
+func newTestServer(tb testing.TB) *server.Server {
+	return startTestServer(tb, &server.Options{})
+}
+
+// startTestServer is like newTestServer, but starts
+// the server with additional options.
+func startTestServer(tb testing.TB, opts *server.Options) *server.Server {
 	port, err := getFreePort()
 	if err != nil {
 		tb.Fatal(err)
 	}
-	opts := &server.Options{
-		JetStream:  true,
-		Port:       port,
-		StoreDir:   tb.TempDir(),
-		MaxPayload: defaultChunkSize,
-	}
+	opts.JetStream = true
+	opts.Port = port
+	opts.StoreDir = tb.TempDir()
+	opts.MaxPayload = defaultChunkSize
+
 	ns, err := server.NewServer(opts)
 	if err != nil {
 		tb.Fatal(err)
@@ -48,23 +88,112 @@ func newDriverConstructor(tb testing.TB) testsuites.DriverConstructor {
 	if !ns.ReadyForConnections(4 * time.Second) {
 		tb.Fatal("server not ready for connections")
 	}
+	tb.Cleanup(ns.Shutdown)
 
-	params := &Parameters{
-		ClientURL: ns.ClientURL(),
+	return ns
+}
+
+// newTestCluster starts a JetStream cluster of embedded NATS servers
+// that is shut down when the test finishes.
+func newTestCluster(tb testing.TB, size int) []*server.Server {
+	return startTestCluster(tb, size, nil)
+}
+
+// startTestCluster is like newTestCluster, but calls configure
+// with the options of every server before it is started.
+func startTestCluster(tb testing.TB, size int, configure func(i int, opts *server.Options)) []*server.Server {
+	routes := make([]string, size)
+	clusterPorts := make([]int, size)
+	for i := range routes {
+		port, err := getFreePort()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		clusterPorts[i] = port
+		routes[i] = fmt.Sprintf("nats://127.0.0.1:%d", port)
 	}
 
-	// params := &Parameters{
-	// 	ClientURL: "127.0.0.1:4222",
-	// }
+	servers := make([]*server.Server, size)
+	for i := range servers {
+		port, err := getFreePort()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		opts := &server.Options{
+			ServerName: fmt.Sprintf("node-%d", i),
+			JetStream:  true,
+			Host:       "127.0.0.1",
+			Port:       port,
+			StoreDir:   tb.TempDir(),
+			MaxPayload: defaultChunkSize,
+			Cluster: server.ClusterOpts{
+				Name: "cascade",
+				Host: "127.0.0.1",
+				Port: clusterPorts[i],
+			},
+			Routes: server.RoutesFromStr(strings.Join(routes, ",")),
+		}
+		if configure != nil {
+			configure(i, opts)
+		}
+		ns, err := server.NewServer(opts)
+		if err != nil {
+			tb.Fatal(err)
+		}
 
-	return func() (storagedriver.StorageDriver, error) {
-		return New(context.Background(), params)
+		go ns.Start()
+		tb.Cleanup(ns.Shutdown)
+		servers[i] = ns
+	}
+
+	for _, ns := range servers {
+		if !ns.ReadyForConnections(4 * time.Second) {
+			tb.Fatal("server not ready for connections")
+		}
+	}
+
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		ready := false
+		for _, ns := range servers {
+			if ns.JetStreamIsLeader() {
+				ready = true
+			}
+		}
+		for _, ns := range servers {
+			ready = ready && ns.JetStreamIsCurrent()
+		}
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			tb.Fatal("cluster did not elect a JetStream leader in time")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return servers
+}
+
+// eventually retries f until it succeeds or the timeout expires.
+func eventually(tb testing.TB, timeout time.Duration, f func() error) {
+	tb.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatal(err)
+		}
+		time.Sleep(250 * time.Millisecond)
 	}
 }
 
 func TestNATSDriverSuite(t *testing.T) {
 	testsuites.Driver(t, newDriverConstructor(t))
-	ns.Shutdown()
 }
 
 func BenchmarkNATSDriverSuite(b *testing.B) {
@@ -84,3 +213,1151 @@ func getFreePort() (int, error) {
 	defer l.Close()
 	return l.Addr().(*net.TCPAddr).Port, nil
 }
+
+func TestClientFailover(t *testing.T) {
+	ctx := context.Background()
+	servers := newTestCluster(t, 3)
+
+	// Replicate the root store, so that it survives losing a node.
+	params := &Parameters{
+		ClientURL:     servers[0].ClientURL() + "," + servers[1].ClientURL(),
+		ReconnectWait: 100 * time.Millisecond,
+		Replicas:      3,
+	}
+	d, err := New(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nc, err := nats.Connect(servers[2].ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 20*time.Second, func() error {
+		stream, err := js.Stream(ctx, "OBJ_"+bucketName(defaultBucketPrefix, rootStoreName))
+		if err != nil {
+			return err
+		}
+		info := stream.CachedInfo()
+		if info.Cluster == nil || len(info.Cluster.Replicas) != 2 {
+			return errors.New("root store is not replicated yet")
+		}
+		for _, replica := range info.Cluster.Replicas {
+			if !replica.Current {
+				return fmt.Errorf("replica %s is not current", replica.Name)
+			}
+		}
+		return nil
+	})
+
+	if err := d.PutContent(ctx, "/before", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	servers[0].Shutdown()
+
+	eventually(t, 20*time.Second, func() error {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		return d.PutContent(ctx, "/after", []byte("after"))
+	})
+
+	for path, want := range map[string]string{"/before": "before", "/after": "after"} {
+		eventually(t, 20*time.Second, func() error {
+			ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+			defer cancel()
+			content, err := d.GetContent(ctx, path)
+			if err != nil {
+				return err
+			}
+			if string(content) != want {
+				return fmt.Errorf("expected %q at %s, got: %q", want, path, content)
+			}
+			return nil
+		})
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	ctx := context.Background()
+	// Only the first two servers are meant for storage.
+	servers := startTestCluster(t, 3, func(i int, opts *server.Options) {
+		if i < 2 {
+			opts.Tags = []string{"app:cascade"}
+		}
+	})
+
+	var d *Driver
+	eventually(t, 20*time.Second, func() error {
+		var err error
+		d, err = New(ctx, &Parameters{
+			ClientURL:        servers[2].ClientURL(),
+			Replicas:         2,
+			PlacementCluster: "cascade",
+			PlacementTags:    []string{"app:cascade"},
+			ShardPrefixes:    []string{testRepositories},
+		})
+		return err
+	})
+	if err := d.PutContent(ctx, testRepositories+"/acme/app/_layers/link", []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+
+	lister := d.driver.js.ListStreams(ctx)
+	streams := 0
+	for info := range lister.Info() {
+		streams++
+		peers := []string{info.Cluster.Leader}
+		for _, replica := range info.Cluster.Replicas {
+			peers = append(peers, replica.Name)
+		}
+		for _, peer := range peers {
+			if peer == servers[2].Name() {
+				t.Errorf("expected stream %s to be kept off the untagged server, got peers: %v", info.Config.Name, peers)
+			}
+		}
+	}
+	if err := lister.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if streams != 2 {
+		t.Errorf("expected the root and shard stores, got %d streams", streams)
+	}
+
+	// There are not enough servers with the tag for three replicas.
+	if _, err := New(ctx, &Parameters{
+		ClientURL:     servers[0].ClientURL(),
+		BucketPrefix:  "unplaced",
+		Replicas:      3,
+		PlacementTags: []string{"app:cascade"},
+	}); err == nil {
+		t.Error("expected the store not to be placed on too few tagged servers")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:     ns.ClientURL(),
+		Storage:       "memory",
+		ShardPrefixes: []string{testRepositories},
+		KVLinks:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, testRepositories+"/acme/app/_layers/data", []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+
+	lister := d.driver.js.ListStreams(ctx)
+	streams := 0
+	for info := range lister.Info() {
+		streams++
+		if info.Config.Storage != jetstream.MemoryStorage {
+			t.Errorf("expected stream %s to be kept in memory, got: %s", info.Config.Name, info.Config.Storage)
+		}
+	}
+	if err := lister.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if streams != 3 {
+		t.Errorf("expected the root, link and shard stores, got %d streams", streams)
+	}
+
+	if _, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), Storage: "tape"}); err == nil {
+		t.Error("expected an unsupported storage to be rejected")
+	}
+	// The storage of existing buckets can not be changed.
+	if _, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()}); err == nil {
+		t.Error("expected the storage of the root store not to be changed")
+	}
+}
+
+func TestBucketPrefixIsolation(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	drivers := make(map[string]*Driver)
+	for _, prefix := range []string{"registry-a", "registry-b"} {
+		d, err := New(ctx, &Parameters{
+			ClientURL:    ns.ClientURL(),
+			BucketPrefix: prefix,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		drivers[prefix] = d
+
+		if err := d.PutContent(ctx, "/"+prefix, []byte(prefix)); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.PutContent(ctx, "/shared", []byte(prefix)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for prefix, d := range drivers {
+		files, err := d.List(ctx, "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Errorf("%s: expected to only list its own files, got: %v", prefix, files)
+		}
+
+		content, err := d.GetContent(ctx, "/shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != prefix {
+			t.Errorf("%s: expected its own content at the same path, got: %q", prefix, content)
+		}
+	}
+}
+
+func TestInvalidBucketPrefix(t *testing.T) {
+	ns := newTestServer(t)
+
+	_, err := New(context.Background(), &Parameters{
+		ClientURL:    ns.ClientURL(),
+		BucketPrefix: "not.valid",
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid bucket prefix") {
+		t.Errorf("expected invalid bucket prefix to be rejected, got: %v", err)
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		invalid bool
+	}{
+		{path: "/", want: "/"},
+		{path: "/a/b", want: "/a/b"},
+		{path: "/a//b", want: "/a/b"},
+		{path: "//a", want: "/a"},
+		{path: "/a/b/", want: "/a/b"},
+		{path: "", invalid: true},
+		{path: "a/b", invalid: true},
+		{path: "sha256/abc", invalid: true},
+		{path: "/a/../b", invalid: true},
+		{path: "/..", invalid: true},
+		{path: "/a/.", invalid: true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizePath(tt.path)
+		if tt.invalid {
+			if !errors.As(err, &storagedriver.InvalidPathError{}) {
+				t.Errorf("%q: expected an InvalidPathError, got: %v", tt.path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expected a valid path, got: %v", tt.path, err)
+		} else if got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestInvalidPaths(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bypass the validation of the base driver.
+	driver := d.driver
+
+	for _, path := range []string{"", "relative", "/a/../../escape"} {
+		if err := driver.PutContent(ctx, path, []byte("content")); !errors.As(err, &storagedriver.InvalidPathError{}) {
+			t.Errorf("%q: expected PutContent to reject the path, got: %v", path, err)
+		}
+		if _, err := driver.Stat(ctx, path); !errors.As(err, &storagedriver.InvalidPathError{}) {
+			t.Errorf("%q: expected Stat to reject the path, got: %v", path, err)
+		}
+		if err := driver.Move(ctx, "/source", path); !errors.As(err, &storagedriver.InvalidPathError{}) {
+			t.Errorf("%q: expected Move to reject the path, got: %v", path, err)
+		}
+	}
+
+	if err := driver.PutContent(ctx, "/a//b", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Stat(ctx, "/a/b"); err != nil {
+		t.Errorf("expected redundant separators to be cleaned, got: %v", err)
+	}
+}
+
+func TestListDirectDescendants(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/a/b", "/a/c/d/e", "/a-b/c", "/ab", "/a/c/f"} {
+		if err := d.PutContent(ctx, path, []byte(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The parts of a multipart file are not its children.
+	writeParts(t, d.driver.root, "/a/m", bytes.Repeat([]byte("m"), 32), false, true)
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/", []string{"/a", "/a-b", "/ab"}},
+		{"/a", []string{"/a/b", "/a/c", "/a/m"}},
+		{"/a/c", []string{"/a/c/d", "/a/c/f"}},
+		{"/a/c/d", []string{"/a/c/d/e"}},
+		{"/a-b", []string{"/a-b/c"}},
+		{"/a/b", nil},
+		{"/a/m", nil},
+		{"/a/c/d/e", nil},
+		{"/missing", nil},
+	}
+
+	for _, test := range tests {
+		files, err := d.List(ctx, test.path)
+		if test.want == nil {
+			if !errors.As(err, &storagedriver.PathNotFoundError{}) {
+				t.Errorf("%s: expected path not found, got: %v, %v", test.path, files, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if strings.Join(files, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: expected %v, got: %v", test.path, test.want, files)
+		}
+	}
+
+	if fi, err := d.Stat(ctx, "/a/m"); err != nil || fi.IsDir() {
+		t.Errorf("expected a multipart file to not be a directory, got: %v, %v", fi, err)
+	}
+}
+
+func TestEachObjectStopsEarly(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More objects than the watcher buffers.
+	for i := 0; i < 100; i++ {
+		if err := d.PutContent(ctx, fmt.Sprintf("/dir/%d", i), []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	calls := 0
+	err = d.driver.eachObject(ctx, rootPath, func(info *jetstream.ObjectInfo) error {
+		calls++
+		return errStopListing
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("expected listing to stop after the first object, got %d", calls)
+	}
+
+	fi, err := d.Stat(ctx, "/dir")
+	if err != nil || !fi.IsDir() {
+		t.Errorf("expected /dir to be a directory, got: %v, %v", fi, err)
+	}
+	files, err := d.List(ctx, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 100 {
+		t.Errorf("expected 100 files, got %d", len(files))
+	}
+}
+
+func TestDeleteDescendants(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{"/foo/a", "/foo/b/c", "/foo-bar", "/foo.bar/a", "/foobar", "/fo/o"}
+	for _, path := range paths {
+		if err := d.PutContent(ctx, path, []byte(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeParts(t, d.driver.root, "/foo/m", bytes.Repeat([]byte("m"), 32), false, true)
+	writeParts(t, d.driver.root, "/foo-m", bytes.Repeat([]byte("m"), 32), false, true)
+
+	if err := d.Delete(ctx, "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "/foo-m"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/fo/o", "/foo-bar", "/foo.bar/a", "/foobar"}
+	if names := objectNames(t, d.driver.root); strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v to remain, got: %v", want, names)
+	}
+
+	if err := d.Delete(ctx, "/foo"); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected path not found, got: %v", err)
+	}
+}
+
+func TestMoveRenamesInPlace(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("m"), 3*defaultChunkSize)
+	writeFile(t, d, "/uploads/data", content, false, true)
+	if err := d.PutContent(ctx, "/blobs/data", []byte("overwritten")); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := d.driver.root.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/uploads/data", "/blobs/data"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := d.driver.root.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grown := int64(after.Size()) - int64(before.Size()); grown >= defaultChunkSize {
+		t.Errorf("expected only metadata to be written, but the store grew by %d bytes", grown)
+	}
+
+	got, err := d.GetContent(ctx, "/blobs/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("expected the moved content at the destination")
+	}
+	if _, err := d.Stat(ctx, "/uploads/data"); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected the source to be gone, got: %v", err)
+	}
+
+	// Every part is renamed along with the object.
+	parts := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	writeParts(t, d.driver.root, "/uploads/parts", parts, false, true)
+	if err := d.Move(ctx, "/uploads/parts", "/blobs/parts"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = d.GetContent(ctx, "/blobs/parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parts, got) {
+		t.Error("expected the moved parts at the destination")
+	}
+
+	for _, name := range objectNames(t, d.driver.root) {
+		if isUnder(name, "/uploads") {
+			t.Errorf("expected no objects to be left at the source, got: %s", name)
+		}
+	}
+}
+
+// failingObjectStore fails the calls of its object store
+// that fail returns an error for, like a server that went away.
+type failingObjectStore struct {
+	jetstream.ObjectStore
+	fail func(op, name string) error
+}
+
+func (obs *failingObjectStore) Put(ctx context.Context, meta jetstream.ObjectMeta, r io.Reader) (*jetstream.ObjectInfo, error) {
+	if err := obs.fail("Put", meta.Name); err != nil {
+		return nil, err
+	}
+	return obs.ObjectStore.Put(ctx, meta, r)
+}
+
+func (obs *failingObjectStore) UpdateMeta(ctx context.Context, name string, meta jetstream.ObjectMeta) error {
+	if err := obs.fail("UpdateMeta", name); err != nil {
+		return err
+	}
+	return obs.ObjectStore.UpdateMeta(ctx, name, meta)
+}
+
+func (obs *failingObjectStore) Delete(ctx context.Context, name string) error {
+	if err := obs.fail("Delete", name); err != nil {
+		return err
+	}
+	return obs.ObjectStore.Delete(ctx, name)
+}
+
+// failOnce returns a function for a failingObjectStore that fails
+// the first call of op for an object whose name matches.
+func failOnce(op string, match func(name string) bool) func(string, string) error {
+	failed := false
+	return func(callOp, name string) error {
+		if failed || callOp != op || !match(name) {
+			return nil
+		}
+		failed = true
+		return nats.ErrConnectionClosed
+	}
+}
+
+func TestMoveFailsHalfway(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:       ns.ClientURL(),
+		ShardPrefixes:   []string{"/shards"},
+		WriteBufferSize: defaultChunkSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 3*defaultChunkSize+42)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	succeed := func(string, string) error { return nil }
+	root := &failingObjectStore{ObjectStore: d.driver.root, fail: succeed}
+	d.driver.root = root
+	d.driver.stores.root = root
+
+	for name, test := range map[string]struct {
+		dest string
+		op   string
+		// match matches the names of the objects whose call fails.
+		match func(name string) bool
+		// retry retries the move, instead of deleting the source.
+		retry bool
+	}{
+		"marking the source": {
+			dest: "/blobs/data", op: "UpdateMeta", retry: true,
+			match: func(name string) bool { return name == "/uploads/data" },
+		},
+		"staging a part": {
+			dest: "/blobs/data", op: "UpdateMeta", retry: true,
+			match: func(name string) bool { return name == "/uploads/data/2" },
+		},
+		"storing the destination": {
+			dest: "/blobs/data", op: "Put", retry: true,
+			match: func(name string) bool { return name == "/blobs/data" },
+		},
+		"deleting the source": {
+			dest: "/blobs/data", op: "Delete", retry: true,
+			match: func(name string) bool { return name == "/uploads/data" },
+		},
+		"deleting the source without retrying": {
+			dest: "/blobs/data", op: "Delete",
+			match: func(name string) bool { return name == "/uploads/data" },
+		},
+		"copying a part to another store": {
+			dest: "/shards/blob/data", op: "Put", retry: true,
+			match: func(name string) bool { return name == "/shards/blob/data/2" },
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			root.fail = succeed
+			writeFile(t, d, "/uploads/data", content, false, true)
+			// The store of the shard is only opened once it is written to.
+			if err := d.PutContent(ctx, "/shards/blob/opened", []byte("opened")); err != nil {
+				t.Fatal(err)
+			}
+			for key, obs := range d.driver.stores.opened {
+				if _, ok := obs.(*failingObjectStore); !ok {
+					d.driver.stores.opened[key] = &failingObjectStore{ObjectStore: obs, fail: succeed}
+				}
+			}
+			defer func() {
+				for _, path := range []string{"/uploads", "/blobs", "/shards"} {
+					_ = d.Delete(ctx, path)
+				}
+			}()
+
+			fail := failOnce(test.op, test.match)
+			root.fail = fail
+			for _, obs := range d.driver.stores.opened {
+				obs.(*failingObjectStore).fail = fail
+			}
+			if err := d.Move(ctx, "/uploads/data", test.dest); err == nil {
+				t.Fatal("expected the move to fail")
+			}
+
+			if test.retry {
+				if err := d.Move(ctx, "/uploads/data", test.dest); err != nil {
+					t.Fatalf("expected the move to be finished when it is retried, got: %v", err)
+				}
+			}
+			// The registry deletes the upload once it is done with it.
+			if err := d.Delete(ctx, "/uploads"); err != nil && !errors.As(err, &storagedriver.PathNotFoundError{}) {
+				t.Fatal(err)
+			}
+
+			got, err := d.GetContent(ctx, test.dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, got) {
+				t.Error("expected the moved content at the destination")
+			}
+			problems, err := d.Check(ctx, CheckOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != 0 {
+				t.Errorf("expected nothing to be left behind, got: %v", problems)
+			}
+			for _, name := range objectNames(t, d.driver.root) {
+				if isUnder(name, "/uploads") {
+					t.Errorf("expected no objects to be left at the source, got: %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL: ns.ClientURL(),
+		ChunkSize: 16 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	if err := d.PutContent(ctx, "/content", make([]byte, 64*1024)); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, d, "/written", make([]byte, 64*1024), false, true)
+
+	for _, name := range []string{"/content", "/written/0"} {
+		info, err := obs.GetInfo(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Chunks != 4 {
+			t.Errorf("%s: expected content to be stored in 4 chunks, got %d", name, info.Chunks)
+		}
+	}
+}
+
+func TestInvalidChunkSize(t *testing.T) {
+	ns := newTestServer(t)
+
+	// The test server only accepts messages up to the default chunk size.
+	for _, size := range []int{-1, minChunkSize - 1, maxChunkSize + 1, 2 * defaultChunkSize} {
+		_, err := New(context.Background(), &Parameters{
+			ClientURL: ns.ClientURL(),
+			ChunkSize: size,
+		})
+		if err == nil || !strings.Contains(err.Error(), "invalid chunk size") {
+			t.Errorf("%d: expected invalid chunk size to be rejected, got: %v", size, err)
+		}
+	}
+}
+
+func TestInvalidReplicas(t *testing.T) {
+	ns := newTestServer(t)
+
+	for _, replicas := range []int{-1, maxReplicas + 1} {
+		_, err := New(context.Background(), &Parameters{
+			ClientURL: ns.ClientURL(),
+			Replicas:  replicas,
+		})
+		if err == nil || !strings.Contains(err.Error(), "invalid replica count") {
+			t.Errorf("%d: expected invalid replica count to be rejected, got: %v", replicas, err)
+		}
+	}
+}
+
+func TestFailedNewClosesConnection(t *testing.T) {
+	ns := newTestServer(t)
+
+	// A single server cannot hold more than one replica of the root store,
+	// which only fails once the driver is connected.
+	_, err := New(context.Background(), &Parameters{
+		ClientURL: ns.ClientURL(),
+		Replicas:  3,
+	})
+	if err == nil {
+		t.Fatal("expected the root store to fail to be created")
+	}
+
+	// The server notices closed connections asynchronously.
+	deadline := time.Now().Add(2 * time.Second)
+	for ns.NumClients() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ns.NumClients(); n != 0 {
+		t.Errorf("expected the connection of the failed driver to be closed, %d clients are connected", n)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCertificate(t, dir, "ca", nil, nil)
+	writeCertificate(t, dir, "server", ca, caKey)
+	writeCertificate(t, dir, "client", ca, caKey)
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ns := startTestServer(t, &server.Options{
+		TLS:       true,
+		TLSVerify: true,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	})
+
+	valid := Parameters{
+		ClientURL:     ns.ClientURL(),
+		TLSCACert:     filepath.Join(dir, "ca.pem"),
+		TLSClientCert: filepath.Join(dir, "client.pem"),
+		TLSClientKey:  filepath.Join(dir, "client-key.pem"),
+		TLSServerName: "nats.test",
+	}
+	tests := []struct {
+		name    string
+		modify  func(p *Parameters)
+		invalid bool
+	}{
+		{name: "valid", modify: func(p *Parameters) {}},
+		{name: "tls scheme", modify: func(p *Parameters) {
+			p.ClientURL = strings.Replace(p.ClientURL, "nats://", "tls://", 1)
+		}},
+		{name: "skip verify", modify: func(p *Parameters) {
+			p.TLSCACert = ""
+			p.TLSServerName = ""
+			p.TLSInsecureSkipVerify = true
+		}},
+		{name: "unknown CA", invalid: true, modify: func(p *Parameters) {
+			p.TLSCACert = ""
+		}},
+		{name: "wrong server name", invalid: true, modify: func(p *Parameters) {
+			p.TLSServerName = "other.test"
+		}},
+		{name: "no client certificate", invalid: true, modify: func(p *Parameters) {
+			p.TLSClientCert = ""
+			p.TLSClientKey = ""
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := valid
+			tt.modify(&params)
+
+			d, err := New(context.Background(), &params)
+			if tt.invalid {
+				if err == nil {
+					t.Error("expected the connection to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.PutContent(context.Background(), "/secure", []byte("secure")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// writeCertificate writes a certificate and its key to dir as PEM files.
+// The certificate is a self-signed CA when parent is nil,
+// and is otherwise signed by parent for the host name nats.test.
+func writeCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	} else {
+		template.DNSNames = []string{"nats.test"}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func TestNKeyAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := user.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedFile := filepath.Join(dir, "user.nk")
+	if err := os.WriteFile(seedFile, seed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := startTestServer(t, &server.Options{
+		Nkeys: []*server.NkeyUser{{Nkey: pub}},
+	})
+
+	if _, err := New(context.Background(), &Parameters{ClientURL: ns.ClientURL()}); err == nil {
+		t.Error("expected connecting without the seed to fail")
+	}
+	d, err := New(context.Background(), &Parameters{
+		ClientURL: ns.ClientURL(),
+		NKeySeed:  seedFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(context.Background(), "/authenticated", []byte("authenticated")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	dir := t.TempDir()
+
+	operator, operatorPub := newNKey(t, nkeys.CreateOperator)
+	operatorClaims := jwt.NewOperatorClaims(operatorPub)
+	if _, err := operatorClaims.Encode(operator); err != nil {
+		t.Fatal(err)
+	}
+
+	account, accountPub := newNKey(t, nkeys.CreateAccount)
+	accountClaims := jwt.NewAccountClaims(accountPub)
+	accountClaims.Limits.JetStreamLimits = jwt.JetStreamLimits{
+		MemoryStorage: jwt.NoLimit,
+		DiskStorage:   jwt.NoLimit,
+		Streams:       jwt.NoLimit,
+		Consumer:      jwt.NoLimit,
+	}
+	accountJWT, err := accountClaims.Encode(operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, userPub := newNKey(t, nkeys.CreateUser)
+	userJWT, err := jwt.NewUserClaims(userPub).Encode(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := jwt.FormatUserConfig(userJWT, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		"user.creds": creds,
+		"user.jwt":   []byte(userJWT),
+		"user.nk":    seed,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// JetStream requires a system account in operator mode.
+	_, systemPub := newNKey(t, nkeys.CreateAccount)
+	systemJWT, err := jwt.NewAccountClaims(systemPub).Encode(operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := &server.MemAccResolver{}
+	for pub, claims := range map[string]string{accountPub: accountJWT, systemPub: systemJWT} {
+		if err := resolver.Store(pub, claims); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ns := startTestServer(t, &server.Options{
+		TrustedOperators: []*jwt.OperatorClaims{operatorClaims},
+		AccountResolver:  resolver,
+		SystemAccount:    systemPub,
+	})
+
+	tests := []struct {
+		name    string
+		params  Parameters
+		invalid bool
+	}{
+		{name: "credentials", params: Parameters{Credentials: filepath.Join(dir, "user.creds")}},
+		{name: "jwt and seed", params: Parameters{JWT: filepath.Join(dir, "user.jwt"), NKeySeed: filepath.Join(dir, "user.nk")}},
+		{name: "anonymous", invalid: true},
+		{name: "jwt without seed", params: Parameters{JWT: filepath.Join(dir, "user.jwt")}, invalid: true},
+		{name: "conflicting", params: Parameters{Credentials: filepath.Join(dir, "user.creds"), NKeySeed: filepath.Join(dir, "user.nk")}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := tt.params
+			params.ClientURL = ns.ClientURL()
+
+			d, err := New(context.Background(), &params)
+			if tt.invalid {
+				if err == nil {
+					t.Error("expected authentication to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.PutContent(context.Background(), "/authenticated", []byte("authenticated")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func newNKey(t *testing.T, create func() (nkeys.KeyPair, error)) (nkeys.KeyPair, string) {
+	kp, err := create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := kp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp, pub
+}
+
+func TestPasswordAuthentication(t *testing.T) {
+	ns := startTestServer(t, &server.Options{
+		Username: "registry",
+		Password: "secret",
+	})
+
+	tests := []struct {
+		name    string
+		params  Parameters
+		invalid bool
+	}{
+		{name: "valid", params: Parameters{Username: "registry", Password: "secret"}},
+		{name: "anonymous", invalid: true},
+		{name: "wrong password", params: Parameters{Username: "registry", Password: "wrong"}, invalid: true},
+		{name: "password without username", params: Parameters{Password: "secret"}, invalid: true},
+		{name: "conflicting", params: Parameters{Username: "registry", Password: "secret", Token: "secret"}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := tt.params
+			params.ClientURL = ns.ClientURL()
+
+			d, err := New(context.Background(), &params)
+			if tt.invalid {
+				if err == nil {
+					t.Error("expected authentication to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.PutContent(context.Background(), "/authenticated", []byte("authenticated")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	ns := startTestServer(t, &server.Options{
+		Authorization: "secret",
+	})
+
+	if _, err := New(context.Background(), &Parameters{ClientURL: ns.ClientURL(), Token: "wrong"}); err == nil {
+		t.Error("expected authenticating with the wrong token to fail")
+	}
+	d, err := New(context.Background(), &Parameters{
+		ClientURL: ns.ClientURL(),
+		Token:     "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(context.Background(), "/authenticated", []byte("authenticated")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:      ns.ClientURL(),
+		ConnectionName: "registry",
+		PingInterval:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connz, err := ns.Connz(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connz.Conns) != 1 || connz.Conns[0].Name != "registry" {
+		t.Errorf("expected the connection to be named, got: %+v", connz.Conns)
+	}
+
+	if _, err := d.Stat(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+	ns.Shutdown()
+	eventually(t, 20*time.Second, func() error {
+		_, err := d.Stat(ctx, "/")
+		if err == nil || !strings.Contains(err.Error(), "not connected to NATS") {
+			return fmt.Errorf("expected the lost connection to be reported, got: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamDomain(t *testing.T) {
+	ctx := context.Background()
+	ns := startTestServer(t, &server.Options{JetStreamDomain: "hub"})
+
+	for _, params := range []*Parameters{
+		{ClientURL: ns.ClientURL(), JetStreamDomain: "hub"},
+		{ClientURL: ns.ClientURL(), JetStreamAPIPrefix: "$JS.hub.API"},
+	} {
+		d, err := New(ctx, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), JetStreamDomain: "leaf"}); err == nil {
+		t.Error("expected a domain without JetStream to fail")
+	}
+	_, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), JetStreamDomain: "hub", JetStreamAPIPrefix: "$JS.hub.API"})
+	if err == nil || !strings.Contains(err.Error(), "only one of them") {
+		t.Errorf("expected a domain and API prefix to be rejected, got: %v", err)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, defaultMaxConcurrency)
+	for i := 0; i < defaultMaxConcurrency; i++ {
+		go func(i int) {
+			path := fmt.Sprintf("/concurrent/%d", i)
+			want := []byte(path)
+			if err := d.PutContent(ctx, path, want); err != nil {
+				errs <- err
+				return
+			}
+			got, err := d.GetContent(ctx, path)
+			if err == nil && string(got) != string(want) {
+				err = fmt.Errorf("expected %q at %s, got: %q", want, path, got)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < defaultMaxConcurrency; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), MaxConcurrency: -1}); err == nil || !strings.Contains(err.Error(), "invalid max concurrency") {
+		t.Errorf("expected invalid max concurrency to be rejected, got: %v", err)
+	}
+}
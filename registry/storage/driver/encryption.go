@@ -0,0 +1,224 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	headerEncryption = "Cascade-Encryption"
+
+	encryptionAES256GCM = "aes-256-gcm"
+	encryptionKeySize   = 32
+	// encryptionOverhead is the size of the nonce and tag that
+	// AES-GCM adds to the content of every object.
+	encryptionOverhead = 12 + 16
+
+	// The data key is kept in this bucket, under this key.
+	keysStoreName = "keys"
+	dataKeyName   = "data-key"
+)
+
+// encryptor encrypts object content with AES-256-GCM before it is stored.
+// Every object is sealed on its own with a random nonce, which is stored
+// in front of the ciphertext. Content is compressed before it is encrypted,
+// because encrypted content does not compress.
+//
+// A nil *encryptor is valid, and stores content as-is.
+type encryptor struct {
+	aead cipher.AEAD
+}
+
+func newEncryptor(key []byte) (*encryptor, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("invalid encryption key: must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptor{aead: aead}, nil
+}
+
+// loadEncryptor returns the encryptor configured by params, or nil if
+// encryption is disabled. With envelope encryption, the configured key
+// only wraps the data key that content is encrypted with.
+func loadEncryptor(ctx context.Context, js jetstream.JetStream, params *Parameters, bucketPrefix string, replicas int, storage jetstream.StorageType) (*encryptor, error) {
+	key, err := encryptionKey(params)
+	if err != nil || key == nil {
+		return nil, err
+	}
+	enc, err := newEncryptor(key)
+	if err != nil {
+		return nil, err
+	}
+	if !params.EnvelopeEncryption {
+		return enc, nil
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      bucketName(bucketPrefix, keysStoreName),
+		Description: "Data keys of the registry, wrapped by its key-encrypting key",
+		Replicas:    replicas,
+		Placement:   placementOf(params),
+		Storage:     storage,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure key store exists: %w", err)
+	}
+	dataKey, err := enc.dataKey(ctx, kv)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptor(dataKey)
+}
+
+// encryptionKey returns the key configured by params, or nil if there is none.
+// Keys are base64 encoded, so that they can be passed through the environment.
+func encryptionKey(params *Parameters) ([]byte, error) {
+	encoded := params.EncryptionKey
+	switch {
+	case params.EncryptionKey != "" && params.EncryptionKeyFile != "":
+		return nil, errors.New("only one of the encryptionkey and encryptionkeyfile parameters may be used")
+	case params.EncryptionKeyFile != "":
+		b, err := os.ReadFile(params.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+		encoded = string(b)
+	case params.EncryptionKey == "":
+		if params.EnvelopeEncryption {
+			return nil, errors.New("the envelopeencryption parameter requires an encryption key")
+		}
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: must be base64 encoded: %w", err)
+	}
+	return key, nil
+}
+
+// dataKey returns the data key stored in kv, unwrapped by enc. The data key
+// is generated the first time, and shared by every registry with the same bucket prefix.
+func (enc *encryptor) dataKey(ctx context.Context, kv jetstream.KeyValue) ([]byte, error) {
+	entry, err := kv.Get(ctx, dataKeyName)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		dataKey := make([]byte, encryptionKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+		wrapped, err := enc.seal(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		_, err = kv.Create(ctx, dataKeyName, wrapped)
+		if err == nil {
+			return dataKey, nil
+		}
+		if !errors.Is(err, jetstream.ErrKeyExists) {
+			return nil, fmt.Errorf("failed to store data key: %w", err)
+		}
+		// Another registry stored its data key first.
+		entry, err = kv.Get(ctx, dataKeyName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data key: %w", err)
+	}
+
+	dataKey, err := enc.open(entry.Value())
+	if err != nil {
+		return nil, errors.New("failed to unwrap data key: is the encryption key correct?")
+	}
+	return dataKey, nil
+}
+
+func (enc *encryptor) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, enc.aead.NonceSize(), enc.aead.NonceSize()+len(data)+enc.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return enc.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (enc *encryptor) open(data []byte) ([]byte, error) {
+	if len(data) < enc.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:enc.aead.NonceSize()], data[enc.aead.NonceSize():]
+	return enc.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// encrypt returns the encrypted object content, and marks meta as encrypted.
+func (enc *encryptor) encrypt(meta *jetstream.ObjectMeta, data []byte) ([]byte, error) {
+	if enc == nil {
+		return data, nil
+	}
+
+	sealed, err := enc.seal(data)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Headers == nil {
+		meta.Headers = nats.Header{}
+	}
+	meta.Headers.Set(headerEncryption, encryptionAES256GCM)
+	return sealed, nil
+}
+
+// decrypt wraps the stored content of an object in a reader that returns
+// its decrypted content. The whole object has to be read to authenticate it,
+// which is fine because objects are never larger than a FileWriter's buffer.
+func (enc *encryptor) decrypt(info *jetstream.ObjectInfo, rc io.ReadCloser) (io.ReadCloser, error) {
+	switch e := info.Headers.Get(headerEncryption); e {
+	case "":
+		return rc, nil
+	case encryptionAES256GCM:
+	default:
+		return nil, fmt.Errorf("object '%s' uses unsupported encryption %q", info.Name, e)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("object '%s' is encrypted, but no encryption key is configured", info.Name)
+	}
+
+	defer rc.Close()
+	sealed, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	data, err := enc.open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt object '%s': %w", info.Name, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func newEncryptionKey(t *testing.T) string {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	content := make([]byte, 0, 3*defaultChunkSize)
+	for i := 0; len(content) < 3*defaultChunkSize; i++ {
+		content = fmt.Appendf(content, "line %d of some secret content\n", i)
+	}
+
+	for _, c := range []compression{compressionNone, compressionZstd} {
+		t.Run(string(c), func(t *testing.T) {
+			d, err := New(ctx, &Parameters{
+				ClientURL:     ns.ClientURL(),
+				BucketPrefix:  string(c),
+				Compression:   string(c),
+				EncryptionKey: newEncryptionKey(t),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			small := "/small"
+			if err := d.PutContent(ctx, small, content[:4096]); err != nil {
+				t.Fatal(err)
+			}
+			multipart := "/multipart"
+			writeFile(t, d, multipart, content, false, true)
+			moved := "/moved"
+			writeFile(t, d, "/source", content, false, true)
+			if err := d.Move(ctx, "/source", moved); err != nil {
+				t.Fatal(err)
+			}
+
+			for path, want := range map[string][]byte{small: content[:4096], multipart: content, moved: content} {
+				got, err := d.GetContent(ctx, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(want, got) {
+					t.Errorf("%s: content does not match after round trip", path)
+				}
+
+				fi, err := d.Stat(ctx, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size() != int64(len(want)) {
+					t.Errorf("%s: expected size %d, got %d", path, len(want), fi.Size())
+				}
+			}
+
+			// Nothing that is stored may reveal the content.
+			obs, err := d.driver.js.ObjectStore(ctx, bucketName(string(c), rootStoreName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			objects, err := obs.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range objects {
+				if info.Size == 0 {
+					continue
+				}
+				if info.Headers.Get(headerEncryption) != encryptionAES256GCM {
+					t.Errorf("%s: expected object to be encrypted", info.Name)
+				}
+				stored, err := obs.GetBytes(ctx, info.Name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(stored, []byte("secret content")) {
+					t.Errorf("%s: stored content is not encrypted", info.Name)
+				}
+			}
+
+			offset := int64(len(content) - 100)
+			reader, err := d.Reader(ctx, multipart, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content[offset:], got) {
+				t.Error("content does not match when reading from an offset")
+			}
+		})
+	}
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:     ns.ClientURL(),
+		EncryptionKey: newEncryptionKey(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]string{"wrong": newEncryptionKey(t), "missing": ""} {
+		other, err := New(ctx, &Parameters{
+			ClientURL:     ns.ClientURL(),
+			EncryptionKey: key,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.GetContent(ctx, "/file"); err == nil {
+			t.Errorf("%s key: expected reading encrypted content to fail", name)
+		}
+	}
+}
+
+func TestEncryptionKeyFile(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	key := newEncryptionKey(t)
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, []byte(key+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:         ns.ClientURL(),
+		EncryptionKeyFile: file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same key passed directly reads the same content.
+	other, err := New(ctx, &Parameters{
+		ClientURL:     ns.ClientURL(),
+		EncryptionKey: key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := other.GetContent(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "content" {
+		t.Errorf("expected content, got %q", got)
+	}
+}
+
+func TestEnvelopeEncryption(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	params := &Parameters{
+		ClientURL:          ns.ClientURL(),
+		EncryptionKey:      newEncryptionKey(t),
+		EnvelopeEncryption: true,
+	}
+	d, err := New(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second registry unwraps the data key that the first one generated.
+	other, err := New(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := other.GetContent(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "content" {
+		t.Errorf("expected content, got %q", got)
+	}
+
+	// The key-encrypting key itself does not decrypt content.
+	direct, err := New(ctx, &Parameters{
+		ClientURL:     ns.ClientURL(),
+		EncryptionKey: params.EncryptionKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := direct.GetContent(ctx, "/file"); err == nil {
+		t.Error("expected the key-encrypting key not to decrypt content")
+	}
+
+	_, err = New(ctx, &Parameters{
+		ClientURL:          ns.ClientURL(),
+		EncryptionKey:      newEncryptionKey(t),
+		EnvelopeEncryption: true,
+	})
+	if err == nil {
+		t.Error("expected a wrong key-encrypting key to be rejected")
+	}
+}
+
+func TestInvalidEncryptionKey(t *testing.T) {
+	for name, params := range map[string]*Parameters{
+		"not base64": {EncryptionKey: "not base64!"},
+		"too short":  {EncryptionKey: base64.StdEncoding.EncodeToString([]byte("short"))},
+		"both":       {EncryptionKey: newEncryptionKey(t), EncryptionKeyFile: "/key"},
+		"no key":     {EnvelopeEncryption: true},
+	} {
+		if _, err := loadEncryptor(context.Background(), nil, params, defaultBucketPrefix, 1, jetstream.FileStorage); err == nil {
+			t.Errorf("%s: expected the encryption key to be rejected", name)
+		}
+	}
+}
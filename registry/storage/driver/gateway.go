@@ -0,0 +1,252 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+const (
+	queryExpires   = "expires"
+	querySignature = "signature"
+
+	// gatewayShutdownTimeout is how long the responses in progress may
+	// take to finish when the registry stops.
+	gatewayShutdownTimeout = 10 * time.Second
+)
+
+var (
+	errSignatureMissing = errors.New("missing signature")
+	errSignatureInvalid = errors.New("invalid signature")
+	errSignatureExpired = errors.New("signature expired")
+)
+
+// urlSigner creates and validates time-limited URLs to the gateway.
+// Signatures cover the path of the content, not the path of the URL,
+// which also includes the path of the base URL.
+type urlSigner struct {
+	baseURL *url.URL
+	secret  []byte
+	expiry  time.Duration
+}
+
+func newURLSigner(baseURL, secret string, expiry time.Duration) (*urlSigner, error) {
+	if baseURL == "" {
+		return nil, errors.New("gateway url must be set when the gateway is enabled")
+	}
+	if secret == "" {
+		return nil, errors.New("gateway secret must be set when the gateway is enabled")
+	}
+	if expiry <= 0 {
+		return nil, fmt.Errorf("gateway expiry must be positive, got: %s", expiry)
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse gateway url: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	return &urlSigner{
+		baseURL: u,
+		secret:  []byte(secret),
+		expiry:  expiry,
+	}, nil
+}
+
+// sign returns a URL to path on the gateway that is valid until now+expiry.
+func (s *urlSigner) sign(path string, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(s.expiry).Unix(), 10)
+
+	query := url.Values{}
+	query.Set(queryExpires, expires)
+	query.Set(querySignature, s.signature(path, expires))
+
+	u := *s.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// verify checks that the query parameters contain a valid,
+// unexpired signature for path.
+func (s *urlSigner) verify(path string, query url.Values, now time.Time) error {
+	expires, signature := query.Get(queryExpires), query.Get(querySignature)
+	if expires == "" || signature == "" {
+		return errSignatureMissing
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(s.signature(path, expires))) {
+		return errSignatureInvalid
+	}
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	if now.After(time.Unix(unix, 0)) {
+		return errSignatureExpired
+	}
+
+	return nil
+}
+
+func (s *urlSigner) signature(path, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(path))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// contentPath returns the path of the content that a request to the
+// gateway for urlPath is for. Proxies in front of the gateway may
+// already have stripped the path of the base URL.
+func (s *urlSigner) contentPath(urlPath string) string {
+	if s.baseURL.Path == "" {
+		return urlPath
+	}
+	if path, ok := strings.CutPrefix(urlPath, s.baseURL.Path); ok && strings.HasPrefix(path, "/") {
+		return path
+	}
+	return urlPath
+}
+
+// gateway is an http.Handler that serves object content straight from
+// the object store to clients that were redirected by RedirectURL.
+type gateway struct {
+	driver storagedriver.StorageDriver
+	signer *urlSigner
+	addr   string
+
+	mu  sync.Mutex
+	srv *http.Server
+}
+
+func (gw *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := gw.signer.contentPath(r.URL.Path)
+	if err := gw.signer.verify(path, r.URL.Query(), time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	fi, err := gw.driver.Stat(r.Context(), path)
+	if errors.As(err, &storagedriver.PathNotFoundError{}) || (err == nil && fi.IsDir()) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "application/octet-stream"
+	if fi, ok := fi.(FileInfo); ok && fi.ContentType() != "" {
+		contentType = fi.ContentType()
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	reader, err := gw.driver.Reader(r.Context(), path, 0)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	// Headers are already sent, so there is no way to report
+	// a failure to the client other than cutting the response short.
+	_, _ = io.Copy(w, reader)
+}
+
+// serve starts serving the gateway on its address in the background.
+func (gw *gateway) serve() error {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if gw.srv != nil {
+		return errors.New("gateway is already serving")
+	}
+
+	l, err := net.Listen("tcp", gw.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on gateway address '%s': %w", gw.addr, err)
+	}
+
+	gw.srv = &http.Server{
+		Handler:           gw,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go gw.srv.Serve(l)
+
+	return nil
+}
+
+// shutdown stops serving the gateway, waiting for
+// the responses in progress until ctx is done.
+func (gw *gateway) shutdown(ctx context.Context) error {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if gw.srv == nil {
+		return nil
+	}
+
+	err := gw.srv.Shutdown(ctx)
+	gw.srv = nil
+	return err
+}
+
+// ServeGateway starts serving the gateway in the background, when it is
+// enabled. Only the registry serves the gateway; tools that open the
+// driver to work on the content do not listen on the gateway address.
+func (d *Driver) ServeGateway() error {
+	if d.gateway == nil {
+		return nil
+	}
+	return d.gateway.serve()
+}
+
+// ShutdownGateway stops serving the gateway, waiting for the
+// responses in progress until ctx is done.
+func (d *Driver) ShutdownGateway(ctx context.Context) error {
+	if d.gateway == nil {
+		return nil
+	}
+	return d.gateway.shutdown(ctx)
+}
@@ -0,0 +1,263 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newGatewayDriver(t *testing.T, basePath string) *Driver {
+	ns := newTestServer(t)
+
+	port, err := getFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := &Parameters{
+		ClientURL:      ns.ClientURL(),
+		GatewayEnabled: true,
+		GatewayAddr:    fmt.Sprintf("127.0.0.1:%d", port),
+		GatewayURL:     fmt.Sprintf("http://127.0.0.1:%d%s", port, basePath),
+		GatewaySecret:  "secret",
+		GatewayExpiry:  time.Minute,
+	}
+
+	d, err := New(context.Background(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ServeGateway(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := d.ShutdownGateway(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return d
+}
+
+func TestGatewayRedirect(t *testing.T) {
+	for name, basePath := range map[string]string{
+		"no base path":       "",
+		"base path":          "/blobs",
+		"trailing separator": "/blobs/",
+	} {
+		t.Run(name, func(t *testing.T) {
+			testGatewayRedirect(t, newGatewayDriver(t, basePath))
+		})
+	}
+}
+
+func testGatewayRedirect(t *testing.T, d *Driver) {
+	ctx := context.Background()
+
+	small := []byte("small content")
+	if err := d.PutContent(ctx, "/small", small); err != nil {
+		t.Fatal(err)
+	}
+
+	// Content written through a FileWriter is always stored as a multipart object.
+	multipart := make([]byte, 3*defaultChunkSize+42)
+	if _, err := rand.Read(multipart); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := d.Writer(ctx, "/multipart", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(multipart); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string][]byte{"/small": small, "/multipart": multipart} {
+		redirect, err := d.RedirectURL(httptest.NewRequest(http.MethodGet, path, nil), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if redirect == "" {
+			t.Fatal("expected a redirect url")
+		}
+
+		resp, err := http.Get(redirect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", path, resp.StatusCode)
+		}
+		if resp.ContentLength != int64(len(want)) {
+			t.Errorf("%s: expected content length %d, got %d", path, len(want), resp.ContentLength)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("%s: content served by the gateway does not match", path)
+		}
+	}
+}
+
+func TestGatewayRejectsInvalidSignatures(t *testing.T) {
+	ctx := context.Background()
+	d := newGatewayDriver(t, "/blobs")
+
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	redirect, err := d.RedirectURL(httptest.NewRequest(http.MethodGet, "/file", nil), "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherPath := *u
+	otherPath.Path = "/blobs/other"
+
+	noSignature := *u
+	query := noSignature.Query()
+	query.Del(querySignature)
+	noSignature.RawQuery = query.Encode()
+
+	laterExpiry := *u
+	query = laterExpiry.Query()
+	query.Set(queryExpires, fmt.Sprint(time.Now().Add(time.Hour).Unix()))
+	laterExpiry.RawQuery = query.Encode()
+
+	for name, u := range map[string]*url.URL{
+		"other path":   &otherPath,
+		"no signature": &noSignature,
+		"later expiry": &laterExpiry,
+	} {
+		resp, err := http.Get(u.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: expected status 403, got %d", name, resp.StatusCode)
+		}
+	}
+}
+
+func TestGatewayServedByFactoryOnly(t *testing.T) {
+	ns := newTestServer(t)
+
+	port, err := getFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	parameters := map[string]interface{}{
+		"clienturl":      ns.ClientURL(),
+		"gatewayenabled": true,
+		"gatewayaddr":    addr,
+		"gatewayurl":     "http://" + addr,
+		"gatewaysecret":  "secret",
+	}
+
+	// Tools that open the driver must not take the gateway address.
+	for range 2 {
+		if _, err := FromParameters(context.Background(), parameters); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := http.Get("http://" + addr); err == nil {
+		t.Fatal("expected the gateway not to be served")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := (&natsDriverFactory{}).Create(ctx, parameters); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The gateway stops serving together with the registry.
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("expected the gateway to shut down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestURLSignerExpiry(t *testing.T) {
+	signer, err := newURLSigner("http://localhost:5002", "secret", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	u, err := url.Parse(signer.sign("/file", now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signer.verify(u.Path, u.Query(), now); err != nil {
+		t.Errorf("expected signature to be valid, got: %v", err)
+	}
+	if err := signer.verify(u.Path, u.Query(), now.Add(2*time.Minute)); err != errSignatureExpired {
+		t.Errorf("expected signature to be expired, got: %v", err)
+	}
+}
+
+func TestRedirectURLDisabled(t *testing.T) {
+	ns := newTestServer(t)
+
+	d, err := New(context.Background(), &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redirect, err := d.RedirectURL(httptest.NewRequest(http.MethodGet, "/file", nil), "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirect != "" {
+		t.Errorf("expected no redirect when the gateway is disabled, got: %s", redirect)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3/health"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	defaultHealthCheckThreshold  = 1
+	defaultHealthCheckMaxLatency = time.Second
+
+	// Probe objects are written under this prefix, which is hidden
+	// from listings like deduplicated content.
+	probeTemplate = "health/%s"
+	// streamPrefix is prepended by JetStream to the name of the
+	// stream that backs an object store.
+	streamPrefix = "OBJ_"
+)
+
+// probeLatency tracks how long it takes to write, read and delete the
+// probe object of the health check.
+var probeLatency = prometheus.StorageNamespace.NewTimer("nats_probe_latency", "The round-trip latency of the NATS storage driver's health probe")
+
+// HealthCheck verifies that the NATS storage is usable: that the JetStream
+// API responds, that the streams of every store have a leader and current
+// replicas, and that a probe object can be written, read and deleted within
+// the maximum latency. The probe is skipped while the driver is read-only.
+// It reports everything that is wrong at once.
+func (d *Driver) HealthCheck(ctx context.Context) error {
+	return d.driver.healthCheck(ctx)
+}
+
+func (d *driver) healthCheck(ctx context.Context) error {
+	if status := d.nc.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("not connected to NATS: the connection is %s", status)
+	}
+	if _, err := d.js.AccountInfo(ctx); err != nil {
+		return fmt.Errorf("JetStream API is not reachable: %w", err)
+	}
+
+	errs := d.checkStreams(ctx)
+	if d.readOnly {
+		return errors.Join(errs...)
+	}
+	if err := d.probe(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// checkStreams returns the problems with the streams of every store.
+// A stream that is not clustered has no leader or replicas to check.
+func (d *driver) checkStreams(ctx context.Context) []error {
+	errs := make([]error, 0)
+	prefix := streamPrefix + bucketName(d.stores.bucketPrefix, "")
+	lister := d.js.ListStreams(ctx)
+	for info := range lister.Info() {
+		if !strings.HasPrefix(info.Config.Name, prefix) || info.Cluster == nil {
+			continue
+		}
+		if info.Cluster.Leader == "" {
+			errs = append(errs, fmt.Errorf("stream %s has no leader", info.Config.Name))
+			continue
+		}
+		for _, peer := range info.Cluster.Replicas {
+			switch {
+			case peer.Offline:
+				errs = append(errs, fmt.Errorf("replica %s of stream %s is offline", peer.Name, info.Config.Name))
+			case !peer.Current:
+				errs = append(errs, fmt.Errorf("replica %s of stream %s is %d operations behind", peer.Name, info.Config.Name, peer.Lag))
+			}
+		}
+	}
+	if err := lister.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to list streams: %w", err))
+	}
+	return errs
+}
+
+// probe writes, reads back and deletes an object in the root store.
+// Every probe has a name of its own, so that registries sharing the
+// storage do not read each other's probes.
+func (d *driver) probe(ctx context.Context) error {
+	start := time.Now()
+	name := fmt.Sprintf(probeTemplate, nuid.Next())
+	content := []byte(name)
+
+	if _, err := d.root.PutBytes(ctx, name, content); err != nil {
+		return fmt.Errorf("failed to write probe object: %w", err)
+	}
+	read, err := d.root.GetBytes(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to read probe object: %w", err)
+	}
+	if !bytes.Equal(read, content) {
+		return errors.New("probe object was read back with different content")
+	}
+	if err := d.root.Delete(ctx, name); err != nil {
+		return fmt.Errorf("failed to delete probe object: %w", err)
+	}
+
+	latency := time.Since(start)
+	probeLatency.Update(latency)
+	if latency > d.healthCheckMaxLatency {
+		return fmt.Errorf("probe round trip took %s, more than the maximum of %s", latency, d.healthCheckMaxLatency)
+	}
+	return nil
+}
+
+// registerHealthCheck runs HealthCheck every interval and reports its
+// result under /debug/health, like the registry does for Stat("/") with
+// the storagedriver health check. A failure is only reported after
+// threshold checks in a row have failed.
+//
+// The health registry does not allow a name to be registered twice, so
+// drivers with the same bucket prefix, which share their storage, share
+// a reporter too, and only the last one created is checked.
+func (d *Driver) registerHealthCheck(ctx context.Context, interval time.Duration, threshold int) {
+	name := driverName + "_" + d.driver.stores.bucketPrefix
+
+	reportersMu.Lock()
+	defer reportersMu.Unlock()
+	r, ok := reporters[name]
+	if !ok {
+		r = &healthReporter{
+			updater:  health.NewThresholdStatusUpdater(threshold),
+			interval: interval,
+		}
+		health.Register(name, r.updater)
+		go health.Poll(ctx, r.updater, r, interval)
+		reporters[name] = r
+	}
+	r.driver.Store(d)
+}
+
+var (
+	reportersMu sync.Mutex
+	reporters   = make(map[string]*healthReporter)
+)
+
+// healthReporter is a health.Checker that checks the driver
+// that was last registered under its name.
+type healthReporter struct {
+	updater  health.Updater
+	interval time.Duration
+	driver   atomic.Pointer[Driver]
+}
+
+// Check runs HealthCheck, which is given until the next check to complete.
+func (r *healthReporter) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.interval)
+	defer cancel()
+	return r.driver.Load().HealthCheck(ctx)
+}
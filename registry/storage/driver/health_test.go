@@ -0,0 +1,125 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/health"
+)
+
+func TestHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	if err := d.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names := objectNames(t, obs); names != nil {
+		t.Errorf("expected the probe object to be deleted, got: %v", names)
+	}
+
+	ns.Shutdown()
+	eventually(t, 20*time.Second, func() error {
+		err := d.HealthCheck(ctx)
+		if err == nil || !strings.Contains(err.Error(), "not connected to NATS") {
+			return fmt.Errorf("expected the lost connection to be reported, got: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestHealthCheckReplicas(t *testing.T) {
+	ctx := context.Background()
+	servers := newTestCluster(t, 3)
+
+	// Placing the replicas fails until every peer is known to be online.
+	var d *Driver
+	eventually(t, 20*time.Second, func() error {
+		var err error
+		d, err = New(ctx, &Parameters{
+			ClientURL: servers[0].ClientURL() + "," + servers[1].ClientURL(),
+			Replicas:  3,
+		})
+		return err
+	})
+	eventually(t, 20*time.Second, func() error {
+		return d.HealthCheck(ctx)
+	})
+
+	// The driver is still connected, but loses one of the replicas.
+	servers[2].Shutdown()
+	eventually(t, 20*time.Second, func() error {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		err := d.HealthCheck(ctx)
+		if err == nil || !strings.Contains(err.Error(), servers[2].Name()) {
+			return fmt.Errorf("expected the lost replica to be reported, got: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestHealthCheckRegistered(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	_, err := New(ctx, &Parameters{
+		ClientURL:           ns.ClientURL(),
+		BucketPrefix:        "registered",
+		HealthCheckInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if status, ok := health.CheckStatus(ctx)["nats_registered"]; ok {
+		t.Fatalf("expected the storage to be healthy, got: %s", status)
+	}
+
+	ns.Shutdown()
+	eventually(t, 20*time.Second, func() error {
+		if _, ok := health.CheckStatus(ctx)["nats_registered"]; !ok {
+			return errors.New("expected the storage to be reported as unhealthy")
+		}
+		return nil
+	})
+}
+
+func TestInvalidHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	for _, params := range []*Parameters{
+		{ClientURL: ns.ClientURL(), HealthCheckInterval: -time.Second},
+		{ClientURL: ns.ClientURL(), HealthCheckThreshold: -1},
+		{ClientURL: ns.ClientURL(), HealthCheckMaxLatency: -time.Second},
+	} {
+		if _, err := New(ctx, params); err == nil || !strings.Contains(err.Error(), "invalid health check") {
+			t.Errorf("expected invalid health check parameters to be rejected, got: %v", err)
+		}
+	}
+}
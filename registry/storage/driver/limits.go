@@ -0,0 +1,116 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// jsErrCodeStreamStoreFailed is returned when a stream fails to store a
+// message, which it describes, like when the stream holds its max bytes.
+const jsErrCodeStreamStoreFailed jetstream.ErrorCode = 10077
+
+// ErrorCodeStoreFull is the error code of a StoreFullError.
+var ErrorCodeStoreFull = errcode.Register("cascade", errcode.ErrorDescriptor{
+	Value:          "STORE_FULL",
+	Message:        "storage is full",
+	Description:    "The object store that the content would be stored in holds as many bytes as it may.",
+	HTTPStatusCode: http.StatusInsufficientStorage,
+})
+
+// StoreFullError is returned when content is written to an object store
+// that holds the max bytes that it may. Like QuotaExceededError, it
+// implements errcode.ErrorCoder, and is served as 507 Insufficient Storage
+// wherever the registry reports it as it is.
+type StoreFullError struct {
+	Path     string
+	Bucket   string
+	MaxBytes int64
+}
+
+func (e StoreFullError) Error() string {
+	return fmt.Sprintf("cannot write %s: object store %s holds its max of %d bytes", e.Path, e.Bucket, e.MaxBytes)
+}
+
+func (e StoreFullError) ErrorCode() errcode.ErrorCode {
+	return ErrorCodeStoreFull
+}
+
+// isStoreFull reports whether err was returned by a stream that holds its max bytes.
+func isStoreFull(err error) bool {
+	var apiErr *jetstream.APIError
+	return errors.As(err, &apiErr) &&
+		apiErr.ErrorCode == jsErrCodeStreamStoreFailed &&
+		strings.Contains(apiErr.Description, "maximum bytes")
+}
+
+// limitedDriver returns the errors of the storage operations that write
+// to an object store that is full as a StoreFullError.
+type limitedDriver struct {
+	storagedriver.StorageDriver
+	stores   *stores
+	maxBytes int64
+}
+
+func (ld *limitedDriver) full(path string, err error) error {
+	if !isStoreFull(err) {
+		return err
+	}
+	return StoreFullError{Path: path, Bucket: ld.stores.bucketOf(path), MaxBytes: ld.maxBytes}
+}
+
+func (ld *limitedDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	return ld.full(path, ld.StorageDriver.PutContent(ctx, path, content))
+}
+
+func (ld *limitedDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := ld.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, ld.full(path, err)
+	}
+	return &limitedFileWriter{FileWriter: fw, driver: ld, path: path}, nil
+}
+
+func (ld *limitedDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return ld.full(destPath, ld.StorageDriver.Move(ctx, sourcePath, destPath))
+}
+
+// limitedFileWriter returns the errors of the writes to a full object store
+// as a StoreFullError.
+type limitedFileWriter struct {
+	storagedriver.FileWriter
+	driver *limitedDriver
+	path   string
+}
+
+func (fw *limitedFileWriter) Write(p []byte) (int, error) {
+	n, err := fw.FileWriter.Write(p)
+	return n, fw.driver.full(fw.path, err)
+}
+
+func (fw *limitedFileWriter) Close() error {
+	return fw.driver.full(fw.path, fw.FileWriter.Close())
+}
+
+func (fw *limitedFileWriter) Commit(ctx context.Context) error {
+	return fw.driver.full(fw.path, fw.FileWriter.Commit(ctx))
+}
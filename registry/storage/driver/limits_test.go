@@ -0,0 +1,103 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestStoreLimits(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:     ns.ClientURL(),
+		ChunkSize:     minChunkSize,
+		StoreMaxBytes: 4 * minChunkSize,
+		StoreMaxAge:   time.Hour,
+		ShardPrefixes: []string{testRepositories},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard := testRepositories + "/acme/app/_layers/data"
+	if err := d.PutContent(ctx, shard, []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{rootPath, shard} {
+		obs, err := d.driver.stores.find(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := obs.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := status.(*jetstream.ObjectBucketStatus).StreamInfo().Config
+		if config.MaxBytes != 4*minChunkSize || config.MaxAge != time.Hour {
+			t.Errorf("%s: expected the store to be limited, got max bytes %d and max age %s", status.Bucket(), config.MaxBytes, config.MaxAge)
+		}
+	}
+
+	content := bytes.Repeat([]byte("a"), 8*minChunkSize)
+	err = d.PutContent(ctx, "/large", content)
+	var fullErr StoreFullError
+	if !errors.As(detailOf(err), &fullErr) || fullErr.Bucket != bucketName(defaultBucketPrefix, rootStoreName) {
+		t.Fatalf("expected the store to be full, got: %v", err)
+	}
+	if code := fullErr.ErrorCode().Descriptor().HTTPStatusCode; code != http.StatusInsufficientStorage {
+		t.Errorf("expected a full store to be served as %d, got %d", http.StatusInsufficientStorage, code)
+	}
+
+	fw, err := d.Writer(ctx, "/large", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.Write(content)
+	if err == nil {
+		err = fw.Commit(ctx)
+	}
+	if !errors.As(err, &StoreFullError{}) {
+		t.Errorf("expected the writer to fill the store, got: %v", err)
+	}
+	_ = fw.Cancel(ctx)
+
+	// Content that fits is still stored.
+	if err := d.PutContent(ctx, "/small", []byte("small")); err != nil {
+		t.Errorf("expected content that fits to be stored, got: %v", err)
+	}
+}
+
+func TestInvalidStoreLimits(t *testing.T) {
+	ns := newTestServer(t)
+
+	for name, params := range map[string]*Parameters{
+		"max bytes": {StoreMaxBytes: -1},
+		"max age":   {StoreMaxAge: -time.Hour},
+	} {
+		t.Run(name, func(t *testing.T) {
+			params.ClientURL = ns.ClientURL()
+			if _, err := New(context.Background(), params); err == nil {
+				t.Error("expected a negative limit to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	linksStoreName = "links"
+
+	// linkFile is the name of the files that the registry points
+	// at blobs and manifests with, which only hold a digest.
+	linkFile = "link"
+)
+
+// linkStore keeps the link files of the registry in a KV bucket, which
+// takes a single request to read or write them, instead of the requests
+// for the info and the chunks of an object. Their paths are the keys,
+// with every component encoded on its own, so that the links under a
+// directory can be watched by the subject of its key.
+//
+// Links that were stored in the object stores before keep being read from
+// there, until they are written again. They are never compressed,
+// deduplicated or counted against quotas, because they are so small.
+//
+// A nil *linkStore is valid, and holds no links.
+type linkStore struct {
+	kv  jetstream.KeyValue
+	enc *encryptor
+}
+
+func newLinkStore(ctx context.Context, js jetstream.JetStream, bucketPrefix string, replicas int, placement *jetstream.Placement, storage jetstream.StorageType, enc *encryptor) (*linkStore, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      bucketName(bucketPrefix, linksStoreName),
+		Description: "Link files of the registry",
+		Replicas:    replicas,
+		Placement:   placement,
+		Storage:     storage,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure link store exists: %w", err)
+	}
+	return &linkStore{kv: kv, enc: enc}, nil
+}
+
+// holds reports whether the content at path is kept in the KV bucket.
+func (ls *linkStore) holds(path string) bool {
+	return ls != nil && pathpkg.Base(path) == linkFile
+}
+
+// linkKey returns the key of the link at path, or the subject of the keys
+// below it when it is a directory.
+func linkKey(path string) string {
+	components := strings.Split(strings.TrimPrefix(path, sep), sep)
+	for i, component := range components {
+		components[i] = base64.RawURLEncoding.EncodeToString([]byte(component))
+	}
+	return strings.Join(components, ".")
+}
+
+// linkPath returns the path of the link stored under key.
+func linkPath(key string) (string, error) {
+	components := strings.Split(key, ".")
+	for i, component := range components {
+		decoded, err := base64.RawURLEncoding.DecodeString(component)
+		if err != nil {
+			return "", fmt.Errorf("invalid link key %q: %w", key, err)
+		}
+		components[i] = string(decoded)
+	}
+	return sep + strings.Join(components, sep), nil
+}
+
+// get returns the content of the link at path, along with when it was
+// written. It returns jetstream.ErrObjectNotFound when there is none, like
+// the object stores do.
+func (ls *linkStore) get(ctx context.Context, path string) ([]byte, time.Time, error) {
+	if !ls.holds(path) {
+		return nil, time.Time{}, jetstream.ErrObjectNotFound
+	}
+	entry, err := ls.kv.Get(ctx, linkKey(path))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, time.Time{}, jetstream.ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to get link %s: %w", path, err)
+	}
+	content, err := ls.open(entry)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return content, entry.Created(), nil
+}
+
+// open returns the content of the link stored in entry.
+func (ls *linkStore) open(entry jetstream.KeyValueEntry) ([]byte, error) {
+	if ls.enc == nil {
+		return entry.Value(), nil
+	}
+	content, err := ls.enc.open(entry.Value())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt link '%s': %w", entry.Key(), err)
+	}
+	return content, nil
+}
+
+// put stores content as the link at path.
+func (ls *linkStore) put(ctx context.Context, path string, content []byte) error {
+	value := content
+	if ls.enc != nil {
+		var err error
+		if value, err = ls.enc.seal(content); err != nil {
+			return err
+		}
+	}
+	if _, err := ls.kv.Put(ctx, linkKey(path), value); err != nil {
+		return fmt.Errorf("failed to put link %s: %w", path, err)
+	}
+	return nil
+}
+
+// delete removes the link at path, and reports whether there was one.
+func (ls *linkStore) delete(ctx context.Context, path string) (bool, error) {
+	if !ls.holds(path) {
+		return false, nil
+	}
+	if _, err := ls.kv.Get(ctx, linkKey(path)); errors.Is(err, jetstream.ErrKeyNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get link %s: %w", path, err)
+	}
+	if err := ls.kv.Delete(ctx, linkKey(path)); err != nil {
+		return false, fmt.Errorf("failed to delete link %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// deleteUnder removes every link below the directory at path, and
+// reports whether there were any.
+func (ls *linkStore) deleteUnder(ctx context.Context, path string) (bool, error) {
+	var paths []string
+	err := ls.each(ctx, path, func(info *jetstream.ObjectInfo) error {
+		paths = append(paths, objectPath(info))
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, p := range paths {
+		if err := ls.kv.Delete(ctx, linkKey(p)); err != nil {
+			return false, fmt.Errorf("failed to delete link %s: %w", p, err)
+		}
+	}
+	return len(paths) > 0, nil
+}
+
+// each calls f with every link below path, described like an object so
+// that they are listed along with the objects of the stores.
+func (ls *linkStore) each(ctx context.Context, path string, f func(*jetstream.ObjectInfo) error) error {
+	if ls == nil {
+		return nil
+	}
+	keys := ">"
+	if path != rootPath {
+		keys = linkKey(path) + ".>"
+	}
+	watcher, err := ls.kv.Watch(ctx, keys, jetstream.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	updates := watcher.Updates()
+	defer func() {
+		_ = watcher.Stop()
+		// Like the watchers of the object stores, it blocks on the
+		// entry that it was about to deliver when it is stopped early,
+		// until it is received or the watcher closes the channel.
+		go func() {
+			for {
+				select {
+				case _, ok := <-updates:
+					if !ok {
+						return
+					}
+				case <-time.After(time.Second):
+					return
+				}
+			}
+		}()
+	}()
+
+	for {
+		select {
+		case entry := <-updates:
+			// The watcher marks that every key was delivered with nil.
+			if entry == nil {
+				return nil
+			}
+			info, err := ls.info(entry)
+			if err != nil {
+				return err
+			}
+			if err := f(info); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// info describes the link stored in entry like an object.
+func (ls *linkStore) info(entry jetstream.KeyValueEntry) (*jetstream.ObjectInfo, error) {
+	path, err := linkPath(entry.Key())
+	if err != nil {
+		return nil, err
+	}
+	size := len(entry.Value())
+	if ls.enc != nil {
+		size -= encryptionOverhead
+	}
+	return &jetstream.ObjectInfo{
+		ObjectMeta: jetstream.ObjectMeta{
+			Name:    path,
+			Headers: nats.Header{},
+		},
+		Size:    uint64(size),
+		ModTime: entry.Created(),
+	}, nil
+}
+
+// watch invalidates the paths of the links whenever they change,
+// for as long as the driver runs.
+func (ls *linkStore) watch(ctx context.Context, c *objectCache) error {
+	if ls == nil || c == nil {
+		return nil
+	}
+	watcher, err := ls.kv.WatchAll(context.WithoutCancel(ctx), jetstream.UpdatesOnly())
+	if err != nil {
+		return err
+	}
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry == nil {
+				continue
+			}
+			if path, err := linkPath(entry.Key()); err == nil {
+				c.invalidate(path)
+			}
+		}
+	}()
+	return nil
+}
+
+// readLink returns a reader of the content of the link at path,
+// from the given byte offset.
+func readLink(path string, content []byte, offset int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > int64(len(content)) {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: driverName}
+	}
+	return io.NopCloser(bytes.NewReader(content[offset:])), nil
+}
+
+// putLink stores content as the link at path, and deletes the object
+// that held it if it was written before links were kept in the KV bucket.
+func (d *driver) putLink(ctx context.Context, path string, content []byte) error {
+	if err := d.links.put(ctx, path, content); err != nil {
+		return err
+	}
+	obs, err := d.stores.find(ctx, path)
+	if errors.Is(err, errStoreNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	previous, err := currentInfo(ctx, obs, d.objectName(path))
+	if err != nil || previous == nil {
+		return err
+	}
+	return d.deleteObject(ctx, obs, previous)
+}
+
+// moveLink moves the link at sourcePath with the given content to destPath,
+// which is stored like any other content written to it.
+func (d *driver) moveLink(ctx context.Context, sourcePath, destPath string, content []byte) error {
+	if sourcePath == destPath {
+		return nil
+	}
+	if err := d.PutContent(ctx, destPath, content); err != nil {
+		return err
+	}
+	_, err := d.links.delete(ctx, sourcePath)
+	return err
+}
@@ -0,0 +1,185 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+func TestLinkKey(t *testing.T) {
+	for _, path := range []string{
+		testRepositories + "/acme/app/_manifests/tags/v1.0.0/current/link",
+		"/link",
+	} {
+		got, err := linkPath(linkKey(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != path {
+			t.Errorf("expected %s to be decoded from its key, got: %s", path, got)
+		}
+	}
+}
+
+func TestKVLinks(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	app := testRepositories + "/acme/app"
+	legacy := app + "/_layers/sha256/abcd/link"
+	tag := app + "/_manifests/tags/v1.0/current/link"
+	blob := "/docker/registry/v2/blobs/sha256/ab/abcd/data"
+
+	// Links that were stored before are read from the object store.
+	objects, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := objects.PutContent(ctx, legacy, []byte("sha256:abcd")); err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), KVLinks: true, CacheMaxEntries: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := d.GetContent(ctx, legacy); err != nil || string(content) != "sha256:abcd" {
+		t.Errorf("expected a link in the object store to be readable, got: %q, %v", content, err)
+	}
+
+	for path, content := range map[string]string{tag: "sha256:1234", blob: "layer"} {
+		if err := d.PutContent(ctx, path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := objectNames(t, d.driver.root); !slices.Equal(names, []string{blob, legacy}) {
+		t.Errorf("expected only the blob to be stored as an object, got: %v", names)
+	}
+	if content, err := d.GetContent(ctx, tag); err != nil || string(content) != "sha256:1234" {
+		t.Errorf("expected the link to be readable, got: %q, %v", content, err)
+	}
+	if fi, err := d.Stat(ctx, tag); err != nil || fi.Size() != int64(len("sha256:1234")) || fi.ModTime().IsZero() {
+		t.Errorf("expected the size and modification time of the link, got: %v, %v", fi, err)
+	}
+	r, err := d.Reader(ctx, tag, int64(len("sha256:")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := io.ReadAll(r); err != nil || string(content) != "1234" {
+		t.Errorf("expected the link to be read from the offset, got: %q, %v", content, err)
+	}
+	if _, err := d.Reader(ctx, tag, 64); !errors.As(err, &storagedriver.InvalidOffsetError{}) {
+		t.Errorf("expected an offset past the link to be invalid, got: %v", err)
+	}
+
+	// Links are listed along with the objects.
+	if fi, err := d.Stat(ctx, app+"/_manifests"); err != nil || !fi.IsDir() {
+		t.Errorf("expected the directory of the link to exist, got: %v, %v", fi, err)
+	}
+	if files, err := d.List(ctx, app); err != nil || !slices.Equal(files, []string{app + "/_layers", app + "/_manifests"}) {
+		t.Errorf("expected the directories of both links, got: %v, %v", files, err)
+	}
+	var walked []string
+	err = d.Walk(ctx, app, func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			walked = append(walked, fi.Path())
+		}
+		return nil
+	})
+	if err != nil || !slices.Equal(walked, []string{legacy, tag}) {
+		t.Errorf("expected to walk both links, got: %v, %v", walked, err)
+	}
+
+	// Writing a link again moves it out of the object store.
+	if err := d.PutContent(ctx, legacy, []byte("sha256:ef01")); err != nil {
+		t.Fatal(err)
+	}
+	if names := objectNames(t, d.driver.root); !slices.Equal(names, []string{blob}) {
+		t.Errorf("expected the object of the link to be deleted, got: %v", names)
+	}
+	if content, err := objects.GetContent(ctx, legacy); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected the link to be hidden without the KV bucket, got: %q, %v", content, err)
+	}
+
+	moved := app + "/_manifests/tags/latest/current/link"
+	if err := d.Move(ctx, tag, moved); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := d.GetContent(ctx, moved); err != nil || string(content) != "sha256:1234" {
+		t.Errorf("expected the link to be moved, got: %q, %v", content, err)
+	}
+	if _, err := d.GetContent(ctx, tag); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected the source of the move to be gone, got: %v", err)
+	}
+
+	if err := d.Delete(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{legacy, moved} {
+		if _, err := d.Stat(ctx, path); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			t.Errorf("%s: expected the link to be deleted with its directory, got: %v", path, err)
+		}
+	}
+	if err := d.Delete(ctx, app); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected nothing to be left to delete, got: %v", err)
+	}
+}
+
+func TestEncryptedKVLinks(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:     ns.ClientURL(),
+		KVLinks:       true,
+		EncryptionKey: newEncryptionKey(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := testRepositories + "/acme/app/_layers/sha256/abcd/link"
+	if err := d.PutContent(ctx, link, []byte("sha256:abcd")); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := d.driver.links.kv.Get(ctx, linkKey(link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Value()) == "sha256:abcd" {
+		t.Error("expected the link to be stored encrypted")
+	}
+	if content, err := d.GetContent(ctx, link); err != nil || string(content) != "sha256:abcd" {
+		t.Errorf("expected the link to be decrypted, got: %q, %v", content, err)
+	}
+	files, err := d.List(ctx, testRepositories+"/acme/app/_layers/sha256/abcd")
+	if err != nil || !slices.Equal(files, []string{link}) {
+		t.Errorf("expected the link to be listed, got: %v, %v", files, err)
+	}
+	var size int64
+	err = d.Walk(ctx, rootPath, func(fi storagedriver.FileInfo) error {
+		if fi.Path() == link {
+			size = fi.Size()
+		}
+		return nil
+	})
+	if err != nil || size != int64(len("sha256:abcd")) {
+		t.Errorf("expected to walk the link with its decrypted size, got: %d, %v", size, err)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	locksStoreName = "locks"
+	// lockPollInterval is how often a writer that waits for the write
+	// lock of a path tries to take it.
+	lockPollInterval = 50 * time.Millisecond
+)
+
+// ErrorCodeWriteConflict is the error code of a WriteConflictError.
+var ErrorCodeWriteConflict = errcode.Register("cascade", errcode.ErrorDescriptor{
+	Value:          "WRITE_CONFLICT",
+	Message:        "concurrent write",
+	Description:    "Another writer holds the write lock of the path that the content would be written to.",
+	HTTPStatusCode: http.StatusConflict,
+})
+
+// WriteConflictError is returned when a FileWriter is opened for a path
+// whose write lock is held by another writer, and it is not released in
+// time. The writes of a FileWriter return it when its lock was taken over,
+// because it was not renewed in time. Like QuotaExceededError, it
+// implements errcode.ErrorCoder, and is served as 409 Conflict wherever the
+// registry reports it as it is.
+type WriteConflictError struct {
+	Path string
+}
+
+func (e WriteConflictError) Error() string {
+	return fmt.Sprintf("cannot write %s: another writer holds its write lock", e.Path)
+}
+
+func (e WriteConflictError) ErrorCode() errcode.ErrorCode {
+	return ErrorCodeWriteConflict
+}
+
+// writeLocks hands out a lock for every path that a FileWriter is open for,
+// so that the writers of registries that share the storage do not store
+// their parts over those of each other. Locks are leases in a KV bucket,
+// whose entries expire after the TTL, so the lock of a registry that is
+// stopped while it writes is released on its own. Writers renew their lock
+// while they are open.
+//
+// A nil *writeLocks is valid, and hands out no locks.
+type writeLocks struct {
+	kv  jetstream.KeyValue
+	ttl time.Duration
+	// wait is how long a writer waits for a lock that is held by another.
+	wait time.Duration
+}
+
+func newWriteLocks(ctx context.Context, js jetstream.JetStream, bucketPrefix string, replicas int, placement *jetstream.Placement, storage jetstream.StorageType, ttl, wait time.Duration) (*writeLocks, error) {
+	if ttl == 0 {
+		return nil, nil
+	}
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      bucketName(bucketPrefix, locksStoreName),
+		Description: "Write locks of the paths that are written by the registry",
+		TTL:         ttl,
+		Replicas:    replicas,
+		Placement:   placement,
+		Storage:     storage,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure lock store exists: %w", err)
+	}
+	return &writeLocks{kv: kv, ttl: ttl, wait: wait}, nil
+}
+
+// acquire takes the write lock of path, and waits for it when another
+// writer holds it. It returns a WriteConflictError when the lock is not
+// released within the wait.
+func (wl *writeLocks) acquire(ctx context.Context, path string) (*writeLock, error) {
+	if wl == nil {
+		return nil, nil
+	}
+	lock := &writeLock{
+		kv:     wl.kv,
+		key:    linkKey(path),
+		holder: []byte(nuid.Next()),
+		path:   path,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	deadline := time.Now().Add(wl.wait)
+	for {
+		revision, err := wl.kv.Create(ctx, lock.key, lock.holder)
+		if err == nil {
+			lock.revision = revision
+			break
+		}
+		if !errors.Is(err, jetstream.ErrKeyExists) {
+			return nil, fmt.Errorf("failed to take write lock of %s: %w", path, err)
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, WriteConflictError{Path: path}
+		}
+		select {
+		case <-time.After(min(wait, lockPollInterval)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	go lock.renew(wl.ttl / 3)
+	return lock, nil
+}
+
+// writeLock is the write lock of a path, which is renewed until it is released.
+//
+// A nil *writeLock is valid, and is never lost.
+type writeLock struct {
+	kv     jetstream.KeyValue
+	key    string
+	holder []byte
+	path   string
+	// revision is the revision of the lock, which is only used by
+	// renew until it returns.
+	revision uint64
+
+	mu sync.Mutex
+	// err is the WriteConflictError of a lock that was taken over.
+	err error
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// renew renews the lock every interval, until it is released or taken
+// over. Renewals that fail otherwise are tried again, in case the lock
+// has not expired by then.
+func (l *writeLock) renew(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.stop:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		revision, err := l.kv.Update(ctx, l.key, l.holder, l.revision)
+		cancel()
+		var apiErr *jetstream.APIError
+		switch {
+		case err == nil:
+			l.revision = revision
+		case errors.As(err, &apiErr) && apiErr.ErrorCode == jsErrCodeStreamWrongLastSequence:
+			l.mu.Lock()
+			l.err = WriteConflictError{Path: l.path}
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+// lost returns a WriteConflictError when the lock was taken over.
+func (l *writeLock) lost() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// release stops renewing the lock and deletes it, unless it was taken
+// over. A lock that fails to be deleted is released when it expires.
+func (l *writeLock) release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+		if l.lost() != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lockPollInterval*10)
+		defer cancel()
+		_ = l.kv.Delete(ctx, l.key, jetstream.LastRevision(l.revision))
+	})
+}
+
+// lockedFileWriter holds the write lock of the path that it writes, and
+// fails once the lock was taken over, so that it never commits parts that
+// another writer may have stored over.
+type lockedFileWriter struct {
+	storagedriver.FileWriter
+	lock *writeLock
+}
+
+func (fw *lockedFileWriter) Write(p []byte) (int, error) {
+	if err := fw.lock.lost(); err != nil {
+		return 0, err
+	}
+	return fw.FileWriter.Write(p)
+}
+
+func (fw *lockedFileWriter) Close() error {
+	defer fw.lock.release()
+	return fw.FileWriter.Close()
+}
+
+func (fw *lockedFileWriter) Cancel(ctx context.Context) error {
+	defer fw.lock.release()
+	return fw.FileWriter.Cancel(ctx)
+}
+
+func (fw *lockedFileWriter) Commit(ctx context.Context) error {
+	if err := fw.lock.lost(); err != nil {
+		return err
+	}
+	// Writers whose commit failed may still be cancelled or closed.
+	err := fw.FileWriter.Commit(ctx)
+	if err == nil {
+		fw.lock.release()
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWriteLocks(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	newDriver := func(wait time.Duration) *Driver {
+		d, err := New(ctx, &Parameters{
+			ClientURL:     ns.ClientURL(),
+			WriteLockTTL:  500 * time.Millisecond,
+			WriteLockWait: wait,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	first, second := newDriver(0), newDriver(0)
+
+	fw, err := first.Writer(ctx, "/locked", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lock is renewed while the writer is open.
+	time.Sleep(time.Second)
+	_, err = second.Writer(ctx, "/locked", true)
+	var conflictErr WriteConflictError
+	if !errors.As(detailOf(err), &conflictErr) || conflictErr.Path != "/locked" {
+		t.Fatalf("expected the second writer to conflict, got: %v", err)
+	}
+	if code := conflictErr.ErrorCode().Descriptor().HTTPStatusCode; code != http.StatusConflict {
+		t.Errorf("expected a conflict to be served as %d, got %d", http.StatusConflict, code)
+	}
+	if _, err := fw.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer that waits gets the lock once it is released.
+	waiting := newDriver(5 * time.Second)
+	held, err := second.Writer(ctx, "/locked", true)
+	if err != nil {
+		t.Fatalf("expected the released lock to be taken, got: %v", err)
+	}
+	committed := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		committed <- held.Commit(ctx)
+		held.Close()
+	}()
+	fw, err = waiting.Writer(ctx, "/other", false)
+	if err != nil {
+		t.Fatalf("expected other paths not to be locked, got: %v", err)
+	}
+	if err := fw.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fw, err = waiting.Writer(ctx, "/locked", false)
+	if err != nil {
+		t.Fatalf("expected the writer to wait for the lock, got: %v", err)
+	}
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := first.GetContent(ctx, "/locked"); err != nil || !bytes.Equal(content, []byte("first")) {
+		t.Errorf("expected the content of the writer that held the lock, got: %q, %v", content, err)
+	}
+}
+
+func TestWriteLockTakenOver(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), WriteLockTTL: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := d.Writer(ctx, "/taken", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	// Another writer took the lock while this one could not renew it.
+	if _, err := d.driver.locks.kv.Put(ctx, linkKey("/taken"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 5*time.Second, func() error {
+		if _, err := fw.Write([]byte("content")); !errors.As(err, &WriteConflictError{}) {
+			return fmt.Errorf("expected the writer to lose its lock, got: %v", err)
+		}
+		return nil
+	})
+	if err := fw.Commit(ctx); !errors.As(err, &WriteConflictError{}) {
+		t.Errorf("expected the commit to conflict, got: %v", err)
+	}
+	if entry, err := d.driver.locks.kv.Get(ctx, linkKey("/taken")); err != nil || string(entry.Value()) != "other" {
+		t.Errorf("expected the lock of the other writer to be left alone, got: %v", err)
+	}
+}
+
+func TestInvalidWriteLocks(t *testing.T) {
+	ns := newTestServer(t)
+
+	for name, params := range map[string]*Parameters{
+		"ttl":  {WriteLockTTL: -time.Second},
+		"wait": {WriteLockWait: -time.Second},
+	} {
+		t.Run(name, func(t *testing.T) {
+			params.ClientURL = ns.ClientURL()
+			if _, err := New(context.Background(), params); err == nil {
+				t.Error("expected a negative write lock setting to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/sirupsen/logrus"
+)
+
+// metadataContentType is the key of the metadata of an object that the
+// content type of its file is kept under.
+const metadataContentType = "Content-Type"
+
+var (
+	// manifestRevisionLink matches the path of the link that the registry
+	// writes once a manifest is pushed, and captures the part of the path
+	// that blobs are stored under and the digest of the manifest.
+	manifestRevisionLink = regexp.MustCompile(`^(.*)/repositories/.+/_manifests/revisions/sha256/([0-9a-f]{64})/link$`)
+	// descriptorDigest matches the digests of descriptors of blobs
+	// that the driver can find the path of.
+	descriptorDigest = regexp.MustCompile(`^sha256:([0-9a-f]{64})$`)
+)
+
+// FileInfo is implemented by the storagedriver.FileInfo of every file that
+// Stat and Walk return, which also describes the content type and the
+// metadata that were stored for it with SetMetadata.
+type FileInfo interface {
+	storagedriver.FileInfo
+
+	// ContentType returns the media type of the content of the file,
+	// which is empty when it is not known.
+	ContentType() string
+	// Metadata returns the metadata of the file, which may be nil.
+	Metadata() map[string]string
+}
+
+type fileInfo struct {
+	storagedriver.FileInfoInternal
+	contentType string
+	metadata    map[string]string
+}
+
+func (fi fileInfo) ContentType() string {
+	return fi.contentType
+}
+
+func (fi fileInfo) Metadata() map[string]string {
+	return maps.Clone(fi.metadata)
+}
+
+// newFileInfo returns the FileInfo of the file described by fi, with the
+// metadata of the object that it is stored in.
+func newFileInfo(fi storagedriver.FileInfoInternal, metadata map[string]string) fileInfo {
+	info := fileInfo{FileInfoInternal: fi}
+	for key, value := range metadata {
+		if key == metadataContentType {
+			info.contentType = value
+			continue
+		}
+		if info.metadata == nil {
+			info.metadata = make(map[string]string, len(metadata))
+		}
+		info.metadata[key] = value
+	}
+	return info
+}
+
+// SetMetadata stores the content type and the metadata of the file at
+// path, which replace those that were stored for it before. They are
+// stored in the metadata of its object, without rewriting its content, and
+// are kept while the file is moved. Writing the file again drops them. An
+// empty content type is not stored. Links that are kept in the KV bucket
+// can not have any.
+//
+// The registry itself never calls SetMetadata. The content types of
+// manifests and of the blobs that they refer to are stored when the
+// registry links a pushed manifest into its repository.
+func (d *Driver) SetMetadata(ctx context.Context, path, contentType string, metadata map[string]string) error {
+	if d.driver.readOnly {
+		return ReadOnlyError{Op: "SetMetadata", Path: path}
+	}
+	if _, ok := metadata[metadataContentType]; ok {
+		return fmt.Errorf("invalid metadata key %s: use the content type instead", metadataContentType)
+	}
+	path, err := normalizePath(path)
+	if err != nil {
+		return err
+	}
+
+	return d.driver.updateMetadata(ctx, path, func(map[string]string) map[string]string {
+		stored := maps.Clone(metadata)
+		if contentType != "" {
+			if stored == nil {
+				stored = make(map[string]string, 1)
+			}
+			stored[metadataContentType] = contentType
+		}
+		return stored
+	})
+}
+
+// updateMetadata replaces the metadata of the object of the file at
+// path with what update returns for the metadata stored for it now.
+func (d *driver) updateMetadata(ctx context.Context, path string, update func(map[string]string) map[string]string) error {
+	if d.links.holds(path) {
+		return fmt.Errorf("cannot store metadata of link %s", path)
+	}
+	defer d.cache.invalidate(path)
+
+	obs, err := d.stores.find(ctx, path)
+	if errors.Is(err, errStoreNotFound) {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	if err != nil {
+		return err
+	}
+	name := d.objectName(path)
+	info, err := obs.GetInfo(ctx, name)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	if err != nil {
+		return err
+	}
+
+	meta := info.ObjectMeta
+	meta.Metadata = update(maps.Clone(info.Metadata))
+	if maps.Equal(meta.Metadata, info.Metadata) {
+		return nil
+	}
+	// Updating the metadata rewrites only the info, the chunks stay where they are.
+	return obs.UpdateMeta(ctx, name, meta)
+}
+
+// manifestDescriptors holds the parts of a manifest
+// that describe the content types of its blobs.
+type manifestDescriptors struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+// describeManifest stores the content types of a manifest and of the
+// blobs that it refers to, when content is the revision link that the
+// registry writes at path after the manifest was pushed. The registry
+// does not pass content types to its storage driver, so this is the only
+// place where they are known. Failing to store them does not fail the push.
+func (d *driver) describeManifest(ctx context.Context, path string, content []byte) {
+	match := manifestRevisionLink.FindStringSubmatch(path)
+	if match == nil || string(content) != digestPrefix+match[2] {
+		return
+	}
+	logger := logrus.WithField("driver", driverName).WithField("path", path)
+	blobPath := func(hex string) string {
+		return fmt.Sprintf("%s/blobs/sha256/%s/%s/data", match[1], hex[:2], hex)
+	}
+	setContentType := func(path, contentType string) error {
+		if contentType == "" {
+			return nil
+		}
+		return d.updateMetadata(ctx, path, func(metadata map[string]string) map[string]string {
+			if metadata == nil {
+				metadata = make(map[string]string, 1)
+			}
+			metadata[metadataContentType] = contentType
+			return metadata
+		})
+	}
+
+	manifestPath := blobPath(match[2])
+	data, err := d.GetContent(ctx, manifestPath)
+	if err != nil {
+		logger.WithError(err).Warn("failed to read pushed manifest to store content types")
+		return
+	}
+	var manifest manifestDescriptors
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		// Not every manifest is JSON that the driver understands.
+		return
+	}
+
+	descriptors := manifest.Layers
+	if manifest.Config != nil {
+		descriptors = append(descriptors, *manifest.Config)
+	}
+	for _, desc := range descriptors {
+		match := descriptorDigest.FindStringSubmatch(desc.Digest)
+		if match == nil {
+			continue
+		}
+		err := setContentType(blobPath(match[1]), desc.MediaType)
+		// Layers that are not stored here are pulled from elsewhere.
+		if err != nil && !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			logger.WithError(err).Warn("failed to store content type of blob")
+		}
+	}
+	if err := setContentType(manifestPath, manifest.MediaType); err != nil {
+		logger.WithError(err).Warn("failed to store content type of manifest")
+	}
+}
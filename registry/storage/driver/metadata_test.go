@@ -0,0 +1,190 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	d := newGatewayDriver(t, "")
+
+	const mediaType = "application/vnd.oci.image.manifest.v1+json"
+	metadata := map[string]string{"Origin": "push"}
+	if err := d.PutContent(ctx, "/manifest", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetMetadata(ctx, "/manifest", mediaType, metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/manifest", "/moved/manifest"); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := d.Stat(ctx, "/moved/manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, ok := fi.(FileInfo)
+	if !ok {
+		t.Fatalf("expected the file info to describe the metadata, got: %T", fi)
+	}
+	if file.ContentType() != mediaType || !reflect.DeepEqual(file.Metadata(), metadata) || file.Size() != 2 {
+		t.Errorf("expected the metadata to be kept while moving, got: %q, %v", file.ContentType(), file.Metadata())
+	}
+	if err := d.Walk(ctx, "/moved", func(fi storagedriver.FileInfo) error {
+		if file, ok := fi.(FileInfo); !ok || file.ContentType() != mediaType {
+			t.Errorf("expected the walked file to describe its content type, got: %T", fi)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := d.GetContent(ctx, "/moved/manifest"); err != nil || string(content) != "{}" {
+		t.Errorf("expected the content to be left alone, got: %q, %v", content, err)
+	}
+
+	redirect, err := d.RedirectURL(httptest.NewRequest(http.MethodGet, "/moved/manifest", nil), "/moved/manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != mediaType {
+		t.Errorf("expected the gateway to serve the content type, got: %s", contentType)
+	}
+
+	// Writing the file again drops its metadata.
+	if err := d.PutContent(ctx, "/moved/manifest", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	fi, err = d.Stat(ctx, "/moved/manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file := fi.(FileInfo); file.ContentType() != "" || file.Metadata() != nil {
+		t.Errorf("expected the metadata to be dropped, got: %q, %v", file.ContentType(), file.Metadata())
+	}
+}
+
+func TestMetadataErrors(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetMetadata(ctx, "/missing", "text/plain", nil); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected a missing file to be reported, got: %v", err)
+	}
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetMetadata(ctx, "/file", "", map[string]string{metadataContentType: "text/plain"}); err == nil {
+		t.Error("expected the content type key to be rejected")
+	}
+}
+
+func TestPushedManifestContentTypes(t *testing.T) {
+	for name, params := range map[string]Parameters{
+		"objects":      {},
+		"dedup and kv": {Dedup: true, KVLinks: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ns := newTestServer(t)
+
+			params.ClientURL = ns.ClientURL()
+			d, err := New(ctx, &params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Push an image through the storage of the registry itself.
+			registry, err := storage.NewRegistry(ctx, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			named, err := reference.WithName("library/alpine")
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo, err := registry.Repository(ctx, named)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layer, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayerGzip, []byte("layer"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			layer.MediaType = v1.MediaTypeImageLayerGzip
+			config, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, []byte("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.MediaType = v1.MediaTypeImageConfig
+			manifest, err := ocischema.FromStruct(ocischema.Manifest{
+				Versioned: ocischema.SchemaVersion,
+				Config:    config,
+				Layers:    []distribution.Descriptor{layer},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifests, err := repo.Manifests(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dgst, err := manifests.Put(ctx, manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			blobPath := func(desc distribution.Descriptor) string {
+				hex := desc.Digest.Encoded()
+				return "/docker/registry/v2/blobs/sha256/" + hex[:2] + "/" + hex + "/data"
+			}
+			for path, want := range map[string]string{
+				blobPath(layer):  v1.MediaTypeImageLayerGzip,
+				blobPath(config): v1.MediaTypeImageConfig,
+				blobPath(distribution.Descriptor{Digest: dgst}): v1.MediaTypeImageManifest,
+			} {
+				fi, err := d.Stat(ctx, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if contentType := fi.(FileInfo).ContentType(); contentType != want {
+					t.Errorf("%s: expected content type %s, got: %q", path, want, contentType)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"sync"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+const defaultMigrateConcurrency = 8
+
+// blobDataPath matches the paths that the registry stores blobs at,
+// which hold the hex of their digest.
+var blobDataPath = regexp.MustCompile(`/blobs/sha256/[0-9a-f]{2}/([0-9a-f]{64})/data$`)
+
+// MigrateOptions configure what Migrate does.
+type MigrateOptions struct {
+	// Concurrency is the amount of files that are copied at the same time.
+	// Zero means the default of eight.
+	Concurrency int
+	// VerifyDigests hashes every blob while it is copied, and fails the
+	// blobs whose content does not match their digest instead of storing them.
+	// Files that are skipped because they were copied before are not verified.
+	VerifyDigests bool
+	// DryRun only reports the files that would be copied, without reading
+	// or storing their content. They are counted as copied.
+	DryRun bool
+	// Progress is called for every file that was copied or skipped, if it is
+	// set. It is called from every goroutine that copies files.
+	Progress func(path string, skipped bool)
+}
+
+// MigrateResult counts the files that Migrate went through.
+type MigrateResult struct {
+	Copied  int
+	Skipped int
+	Failed  int
+	// Bytes is the amount of content that was copied, or would be with a dry run.
+	Bytes int64
+}
+
+// Migrate copies every file stored by src to the same path in this driver,
+// like the storage of a registry that used the filesystem or S3 driver. Files
+// that are already stored with the same size are skipped, so that a
+// migration that was interrupted can be run again to resume it. Files that
+// fail to be copied do not stop the migration, and are returned as errors
+// along with what was copied.
+func (d *Driver) Migrate(ctx context.Context, src storagedriver.StorageDriver, opts MigrateOptions) (MigrateResult, error) {
+	concurrency := opts.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultMigrateConcurrency
+	}
+	if concurrency < 1 {
+		return MigrateResult{}, fmt.Errorf("invalid concurrency %d: must be at least 1", concurrency)
+	}
+	if d.driver.readOnly && !opts.DryRun {
+		return MigrateResult{}, ReadOnlyError{Op: "migrate"}
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result MigrateResult
+		errs   []error
+	)
+	files := make(chan storagedriver.FileInfo)
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fi := range files {
+				skipped, err := d.migrateFile(ctx, src, fi, opts)
+				mu.Lock()
+				switch {
+				case err != nil:
+					result.Failed++
+					errs = append(errs, fmt.Errorf("failed to migrate %s: %w", fi.Path(), err))
+				case skipped:
+					result.Skipped++
+				default:
+					result.Copied++
+					result.Bytes += fi.Size()
+				}
+				mu.Unlock()
+				if err == nil && opts.Progress != nil {
+					opts.Progress(fi.Path(), skipped)
+				}
+			}
+		}()
+	}
+
+	err := src.Walk(ctx, rootPath, func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() {
+			return nil
+		}
+		select {
+		case files <- fi:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(files)
+	wg.Wait()
+
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to walk the source storage: %w", err))
+	}
+	return result, errors.Join(errs...)
+}
+
+// migrateFile copies the file described by fi from src, unless it is
+// already stored with the same size. Content that was partially copied is
+// never committed, so it is copied again.
+func (d *Driver) migrateFile(ctx context.Context, src storagedriver.StorageDriver, fi storagedriver.FileInfo, opts MigrateOptions) (skipped bool, err error) {
+	path := fi.Path()
+	existing, err := d.Stat(ctx, path)
+	if err == nil && !existing.IsDir() && existing.Size() == fi.Size() {
+		return true, nil
+	}
+	if err != nil && !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return false, err
+	}
+	if opts.DryRun {
+		return false, nil
+	}
+
+	r, err := src.Reader(ctx, path, 0)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	return false, d.storeFile(ctx, path, fi.Size(), r, opts.VerifyDigests)
+}
+
+// storeFile stores the size bytes of content read from r at path. With
+// verify, blobs whose content does not match their digest are not stored.
+func (d *Driver) storeFile(ctx context.Context, path string, size int64, r io.Reader, verify bool) error {
+	want := ""
+	if m := blobDataPath.FindStringSubmatch(path); verify && m != nil {
+		want = m[1]
+	}
+	h := sha256.New()
+
+	// Small files, like links, are stored in one go, like the registry does.
+	if size <= int64(d.driver.chunkSize) {
+		content, err := io.ReadAll(io.TeeReader(r, h))
+		if err != nil {
+			return err
+		}
+		if err := verifyDigest(want, h); err != nil {
+			return err
+		}
+		return d.PutContent(ctx, path, content)
+	}
+
+	fw, err := d.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+
+	if _, err := io.Copy(fw, io.TeeReader(r, h)); err != nil {
+		return errors.Join(err, fw.Cancel(ctx))
+	}
+	if err := verifyDigest(want, h); err != nil {
+		return errors.Join(err, fw.Cancel(ctx))
+	}
+	return fw.Commit(ctx)
+}
+
+// verifyDigest returns an error when the content hashed by h does not
+// match the hex of the sha256 digest in want, unless want is empty.
+func verifyDigest(want string, h hash.Hash) error {
+	if want == "" {
+		return nil
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("content does not match its digest sha256:%s, got sha256:%s", want, got)
+	}
+	return nil
+}
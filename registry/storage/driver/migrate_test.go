@@ -0,0 +1,109 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL: ns.ClientURL(),
+		ChunkSize: minChunkSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filesystem.New(filesystem.DriverParameters{RootDirectory: t.TempDir(), MaxThreads: 25})
+
+	blobPath := func(content []byte) string {
+		sum := sha256.Sum256(content)
+		dgst := hex.EncodeToString(sum[:])
+		return fmt.Sprintf("/docker/registry/v2/blobs/sha256/%s/%s/data", dgst[:2], dgst)
+	}
+	// The layer is larger than a chunk, so it is streamed.
+	layer := bytes.Repeat([]byte("layer"), minChunkSize)
+	link := testRepositories + "/acme/app/_layers/sha256/abcd/link"
+	corrupt := blobPath([]byte("original"))
+	files := map[string][]byte{
+		blobPath(layer): layer,
+		link:            []byte("sha256:abcd"),
+		corrupt:         []byte("corrupted"),
+	}
+	for path, content := range files {
+		if err := src.PutContent(ctx, path, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dry run only reports what would be copied.
+	result, err := d.Migrate(ctx, src, MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != len(files) {
+		t.Errorf("expected every file to be reported, got: %+v", result)
+	}
+	if _, err := d.Stat(ctx, link); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected a dry run to store nothing, got: %v", err)
+	}
+
+	result, err = d.Migrate(ctx, src, MigrateOptions{VerifyDigests: true})
+	if err == nil {
+		t.Error("expected the corrupted blob to fail to be migrated")
+	}
+	if result.Copied != 2 || result.Failed != 1 || result.Bytes != int64(len(layer)+len(files[link])) {
+		t.Errorf("expected to copy everything but the corrupted blob, got: %+v", result)
+	}
+	for path, content := range files {
+		got, err := d.GetContent(ctx, path)
+		if path == corrupt {
+			if !errors.As(err, &storagedriver.PathNotFoundError{}) {
+				t.Errorf("expected the corrupted blob not to be stored, got: %v", err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: expected the content of the source, got %d bytes: %v", path, len(got), err)
+		}
+	}
+
+	// Running it again resumes the migration.
+	if err := src.Delete(ctx, corrupt); err != nil {
+		t.Fatal(err)
+	}
+	result, err = d.Migrate(ctx, src, MigrateOptions{VerifyDigests: true, Concurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 0 || result.Skipped != 2 {
+		t.Errorf("expected the files that were copied before to be skipped, got: %+v", result)
+	}
+
+	if _, err := d.Migrate(ctx, src, MigrateOptions{Concurrency: -1}); err == nil {
+		t.Error("expected an invalid concurrency to be rejected")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	pathpkg "path"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	headerPath = "Cascade-Path"
+
+	// Like deduplicated content, hashed names never start with a slash,
+	// so they can not collide with regular paths.
+	hashedTemplate = "hashed/%s"
+)
+
+// hashPath returns the name that the object for path is stored under when
+// names are hashed. Object names end up in NATS subjects, so registry paths
+// that are nested deeply enough would otherwise exceed the subject limits.
+func hashPath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return fmt.Sprintf(hashedTemplate, hex.EncodeToString(sum[:]))
+}
+
+// objectName returns the name of the object that path is stored under.
+func (d *driver) objectName(path string) string {
+	if d.hashedNames {
+		return hashPath(path)
+	}
+	return path
+}
+
+// objectPath returns the path of the object described by info. Parts of
+// objects with a hashed name have none, so their name is returned instead,
+// which never matches a path.
+func objectPath(info *jetstream.ObjectInfo) string {
+	if path := info.Headers.Get(headerPath); path != "" {
+		return path
+	}
+	return info.Name
+}
+
+// setPath records path on the object described by meta,
+// if it is stored under a different name.
+func setPath(meta *jetstream.ObjectMeta, path string) {
+	if meta.Name == path {
+		return
+	}
+	if meta.Headers == nil {
+		meta.Headers = nats.Header{}
+	}
+	meta.Headers.Set(headerPath, path)
+}
+
+// descendants returns the objects of the files below dir.
+//
+// Parts of multipart objects are stored below them, but a path is a file
+// when there is an object at it, exactly like Stat says. So there are none
+// when dir is a file, and nothing below other files is included either.
+func descendants(dir string, objects []*jetstream.ObjectInfo) []*jetstream.ObjectInfo {
+	files := make(map[string]*jetstream.ObjectInfo, len(objects))
+	for _, info := range objects {
+		path := objectPath(info)
+		if path == dir {
+			return nil
+		}
+		if isUnder(path, dir) {
+			files[path] = info
+		}
+	}
+
+	below := make([]*jetstream.ObjectInfo, 0, len(files))
+	for path, info := range files {
+		if !shadowed(path, dir, files) {
+			below = append(below, info)
+		}
+	}
+	return below
+}
+
+// shadowed reports whether any of the ancestors of path below from is a file.
+func shadowed(path, from string, files map[string]*jetstream.ObjectInfo) bool {
+	for dir := pathpkg.Dir(path); dir != from; dir = pathpkg.Dir(dir) {
+		if _, ok := files[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnder reports whether path is a descendant of dir.
+func isUnder(path, dir string) bool {
+	if dir == rootPath {
+		return path != rootPath && strings.HasPrefix(path, rootPath)
+	}
+	return strings.HasPrefix(path, dir+sep)
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+func TestHashPath(t *testing.T) {
+	a, b := hashPath("/a"), hashPath("/b")
+	if a == b {
+		t.Error("expected different paths to get different names")
+	}
+	if a != hashPath("/a") {
+		t.Error("expected the same path to always get the same name")
+	}
+	if strings.HasPrefix(a, sep) {
+		t.Errorf("expected hashed names to never look like a path, got: %q", a)
+	}
+	if long := hashPath("/" + strings.Repeat("a", 4096)); len(long) != len(a) {
+		t.Errorf("expected hashed names to have a fixed length, got: %d", len(long))
+	}
+}
+
+func TestHashedNames(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:   ns.ClientURL(),
+		HashedNames: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deep enough that the object name would not fit in a NATS subject.
+	dir := "/docker/registry/v2/repositories/" + strings.Repeat("nested/", 512)
+	small := dir + "_manifests/tags/latest/current/link"
+	large := dir + "_uploads/data"
+
+	if err := d.PutContent(ctx, small, []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("a"), 64)
+	fw, err := d.Writer(ctx, large, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.(*objectWriter).partSize = 16
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range objectNames(t, d.driver.root) {
+		if !strings.HasPrefix(name, "hashed/") {
+			t.Errorf("expected only hashed names, got: %q", name)
+		}
+	}
+
+	got, err := d.GetContent(ctx, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("expected content written in parts to be readable")
+	}
+	fi, err := d.Stat(ctx, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Errorf("expected size %d, got: %d", len(content), fi.Size())
+	}
+
+	files, err := d.List(ctx, strings.TrimSuffix(dir, sep))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected to list paths kept in headers, got: %v", files)
+	}
+
+	moved := dir + "_layers/data"
+	if err := d.Move(ctx, large, moved); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.GetContent(ctx, moved); err != nil || !bytes.Equal(content, got) {
+		t.Errorf("expected moved content, got: %v", err)
+	}
+
+	if err := d.Delete(ctx, "/docker"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, small); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected path not found, got: %v", err)
+	}
+	if got := objectNames(t, d.driver.root); len(got) != 0 {
+		t.Errorf("expected parts to be deleted along with their objects, got: %v", got)
+	}
+}
@@ -16,19 +16,55 @@ package driver
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"strconv"
+	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+	"golang.org/x/sync/semaphore"
 )
 
-func newObjectReader(ctx context.Context, obs jetstream.ObjectStore, filename string, offset int64) (*objectReader, error) {
+const (
+	// chunkSubjectTemplate is the subject that the object store publishes
+	// the chunks of an object on, by its bucket and NUID.
+	chunkSubjectTemplate = "$O.%s.C.%s"
+
+	// readAheadChunks is the number of chunks that a chunkReader
+	// requests from the stream before they are read.
+	readAheadChunks = 4
+
+	// maxPulledBytes is how many bytes of chunks may be pulled over a
+	// connection without being received yet. It is half of what a NATS
+	// server buffers for a connection by default, before it disconnects
+	// it as a slow consumer.
+	maxPulledBytes = 32 * 1024 * 1024
+	// pullInactiveThreshold is how long the consumer of a chunkReader is
+	// kept when nothing is pulled, like that of an ordered consumer.
+	pullInactiveThreshold = 5 * time.Minute
+	// defaultObjectChunkSize is the size of the chunks of objects that
+	// were stored without one, which the object store defaults to.
+	defaultObjectChunkSize = 128 * 1024
+)
+
+// errNotSeekable is returned by the seeks of readers of content that
+// cannot be seeked in.
+var errNotSeekable = errors.New("reader is not seekable")
+
+// newObjectReader opens the object filename in obs for reading from offset.
+// Up to readAhead parts after the one that is read are opened ahead.
+func newObjectReader(ctx context.Context, obs jetstream.ObjectStore, dd *deduplicator, enc *encryptor, filename string, offset int64, readAhead int) (*objectReader, error) {
 	obr := &objectReader{
-		ctx:      ctx,
-		obs:      obs,
-		filename: filename,
+		ctx:        ctx,
+		obs:        obs,
+		encryption: enc,
+		filename:   filename,
+		readAhead:  readAhead,
 	}
 
 	info, err := obs.GetInfo(ctx, filename)
@@ -36,73 +72,77 @@ func newObjectReader(ctx context.Context, obs jetstream.ObjectStore, filename st
 		return nil, err
 	}
 
-	if !isMultipart(info) {
-		obr.objs = 1
-		obr.current, err = obs.Get(ctx, filename)
+	traceObject(ctx, info)
+	if isLink(info) {
+		obr.obs = dd.obs
+		obr.filename = dedupName(info.Headers.Get(headerLinkDigest))
+		info, err = obr.obs.GetInfo(ctx, obr.filename)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to follow link to deduplicated content: %w", err)
 		}
+		traceObject(ctx, info)
+	}
 
-		if offset != 0 {
-			if _, err := io.CopyN(io.Discard, obr.current, offset); err != nil {
-				return nil, err
-			}
+	if isChunked(info) {
+		obr.multipart = true
+		obr.chunks, err = chunkNames(ctx, obr.obs, info.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the chunks of deduplicated content: %w", err)
 		}
+		obr.objs = len(obr.chunks)
+	} else if !isMultipart(info) {
+		obr.objs = 1
+		obr.parts = []*jetstream.ObjectInfo{info}
 	} else {
+		obr.multipart = true
+		obr.filename = multipartName(info)
 		obr.objs, err = strconv.Atoi(info.Headers.Get(headerMultipartCount))
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse multipart header: %w", err)
 		}
-
-		if offset == 0 {
-			obr.current, err = obs.Get(ctx, fmt.Sprintf(multipartTemplate, filename, 0))
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			// An ObjectReader may consist of multiple parts.
-			// When reading from an offset, we need to find in which part
-			// the offset falls in, and start reading from there.
-			// If the offset is greater than the multipart length,
-			// this loop will ensure that len(objectReader.objs) <= objectReader.index,
-			// and reads will return (0, io.EOF) as expected.
-			var seek int64
-			for i := 0; i < obr.objs; i++ {
-				info, err := obs.GetInfo(ctx, fmt.Sprintf(multipartTemplate, filename, i))
-				if err != nil {
-					return nil, err
-				}
-
-				if seek+int64(info.Size) > offset {
-					// Offset falls within this part. Read until the offset,
-					// discarding any bytes found.
-					obr.current, err = obs.Get(ctx, filename)
-					if err != nil {
-						return nil, err
-					}
-
-					if _, err := io.CopyN(io.Discard, obr.current, offset-seek); err != nil {
-						return nil, err
-					}
-				} else {
-					seek += int64(info.Size)
-					obr.index++
-				}
-			}
-		}
 	}
 
+	if err := obr.seek(offset); err != nil {
+		return nil, err
+	}
+	obr.prefetch()
 	return obr, nil
 }
 
+// objectReader reads the content of an object, which may consist of
+// multiple parts. Reads from an offset, or after a seek, start at the part
+// and the chunk that the offset falls in, instead of reading and
+// discarding everything before it. Only parts that are compressed or
+// encrypted are read from their start, because they can only be decoded
+// as a whole, but they are never larger than a FileWriter's buffer.
+//
+// The parts after the one that is read are opened ahead of it, so that
+// their chunks are already delivered by the time that they are read,
+// instead of after a round trip to JetStream. Until then, they are held
+// by the NATS connection, which stops receiving them once it holds as
+// many as the consumer of the part may have pending.
 type objectReader struct {
-	ctx      context.Context
-	obs      jetstream.ObjectStore
-	filename string
+	ctx        context.Context
+	obs        jetstream.ObjectStore
+	encryption *encryptor
+	filename   string
+	multipart  bool
+	// chunks are the names of the parts of chunked content, which
+	// are not named after the content like those of multipart content.
+	chunks []string
 
 	objs    int
 	index   int
-	current jetstream.ObjectResult
+	current io.ReadCloser
+	offset  int64
+
+	// parts are the infos of the parts that were looked up, by their index.
+	parts []*jetstream.ObjectInfo
+
+	// readAhead is the amount of parts after the current one that are opened ahead.
+	readAhead int
+	// ahead are the parts after the current one that are being opened, in order.
+	ahead []*prefetchedPart
 
 	errs []error
 }
@@ -115,26 +155,185 @@ func (obr *objectReader) Read(p []byte) (n int, err error) {
 	}
 
 	n, err = obr.current.Read(p)
+	obr.offset += int64(n)
 
 	if err == io.EOF {
-		if err := obr.current.Close(); err != nil {
-			obr.errs = append(obr.errs, err)
-		}
+		obr.closeCurrent()
 
 		obr.index++
 		// Open the next object for reading
 		if obr.objs != obr.index {
-			obr.current, err = obr.obs.Get(obr.ctx, fmt.Sprintf(multipartTemplate, obr.filename, obr.index))
+			obr.current, err = obr.next()
 			if err != nil {
 				return n, err
 			}
+			obr.prefetch()
 		}
 	}
 
 	return n, err
 }
 
+// Seek sets the offset of the next read, and opens the part that it falls in.
+func (obr *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += obr.offset
+	case io.SeekEnd:
+		size, err := obr.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset %d: must not be negative", offset)
+	}
+	if offset == obr.offset {
+		return offset, nil
+	}
+
+	obr.closeCurrent()
+	obr.discardAhead()
+	if err := obr.seek(offset); err != nil {
+		return 0, err
+	}
+	obr.prefetch()
+	return offset, nil
+}
+
+// seek opens the part that offset falls in for reading from offset. When
+// offset is past the end of the object, every part counts as read, and
+// reads return (0, io.EOF) as expected.
+func (obr *objectReader) seek(offset int64) error {
+	obr.offset = offset
+	obr.current = nil
+	if offset == 0 {
+		obr.index = 0
+		if obr.objs == 0 {
+			return nil
+		}
+		var err error
+		obr.current, err = getObject(obr.ctx, obr.obs, obr.encryption, obr.partName(0))
+		return err
+	}
+
+	var start int64
+	for obr.index = 0; obr.index < obr.objs; obr.index++ {
+		info, err := obr.part(obr.index)
+		if err != nil {
+			return err
+		}
+		size, err := objectSize(info)
+		if err != nil {
+			return err
+		}
+		if start+size > offset {
+			obr.current, err = openObject(obr.ctx, obr.obs, obr.encryption, info, offset-start)
+			return err
+		}
+		start += size
+	}
+	return nil
+}
+
+// size returns the size of the content of every part together.
+func (obr *objectReader) size() (int64, error) {
+	var size int64
+	for i := 0; i < obr.objs; i++ {
+		info, err := obr.part(i)
+		if err != nil {
+			return 0, err
+		}
+		partSize, err := objectSize(info)
+		if err != nil {
+			return 0, err
+		}
+		size += partSize
+	}
+	return size, nil
+}
+
+// part returns the info of the part at index, which is only looked up once.
+func (obr *objectReader) part(index int) (*jetstream.ObjectInfo, error) {
+	for len(obr.parts) <= index {
+		info, err := obr.obs.GetInfo(obr.ctx, obr.partName(len(obr.parts)))
+		if err != nil {
+			return nil, err
+		}
+		obr.parts = append(obr.parts, info)
+	}
+	return obr.parts[index], nil
+}
+
+func (obr *objectReader) partName(index int) string {
+	if !obr.multipart {
+		return obr.filename
+	}
+	if obr.chunks != nil {
+		return obr.chunks[index]
+	}
+	return fmt.Sprintf(multipartTemplate, obr.filename, index)
+}
+
+func (obr *objectReader) closeCurrent() {
+	if obr.current == nil {
+		return
+	}
+	if err := obr.current.Close(); err != nil {
+		obr.errs = append(obr.errs, err)
+	}
+	obr.current = nil
+}
+
+// prefetchedPart is a part that is opened before it is read.
+type prefetchedPart struct {
+	rc  io.ReadCloser
+	err error
+	// done is closed once the part is opened, or failed to be with err.
+	done chan struct{}
+}
+
+// prefetch opens the parts after the current one, up to readAhead of them.
+func (obr *objectReader) prefetch() {
+	for index := obr.index + 1 + len(obr.ahead); len(obr.ahead) < obr.readAhead && index < obr.objs; index++ {
+		part := &prefetchedPart{done: make(chan struct{})}
+		go func(name string) {
+			defer close(part.done)
+			part.rc, part.err = getObject(obr.ctx, obr.obs, obr.encryption, name)
+		}(obr.partName(index))
+		obr.ahead = append(obr.ahead, part)
+	}
+}
+
+// next opens the part that the reader moved on to, which may have been opened ahead.
+func (obr *objectReader) next() (io.ReadCloser, error) {
+	if len(obr.ahead) == 0 {
+		return getObject(obr.ctx, obr.obs, obr.encryption, obr.partName(obr.index))
+	}
+	part := obr.ahead[0]
+	obr.ahead = obr.ahead[1:]
+	<-part.done
+	return part.rc, part.err
+}
+
+// discardAhead closes the parts that were opened ahead.
+func (obr *objectReader) discardAhead() {
+	for _, part := range obr.ahead {
+		<-part.done
+		if part.err == nil {
+			part.rc.Close()
+		}
+	}
+	obr.ahead = nil
+}
+
 func (obr *objectReader) Close() error {
+	obr.closeCurrent()
+	obr.discardAhead()
 	if len(obr.errs) > 0 {
 		obr.errs = append([]error{errors.New("failed to close object")}, obr.errs...)
 		return errors.Join(obr.errs...)
@@ -142,3 +341,328 @@ func (obr *objectReader) Close() error {
 
 	return nil
 }
+
+// openObject opens the object of info for reading its original content
+// from offset. The chunks of objects that are stored as they are, are read
+// from the chunk that offset falls in. Any other object is read from its
+// start, discarding the content before offset.
+func openObject(ctx context.Context, obs jetstream.ObjectStore, enc *encryptor, info *jetstream.ObjectInfo, offset int64) (io.ReadCloser, error) {
+	ps, ok := obs.(*pullingStore)
+	if ok && info.Opts != nil && int64(info.Opts.ChunkSize) <= offset &&
+		info.Headers.Get(headerCompression) == "" && info.Headers.Get(headerEncryption) == "" {
+		cr, err := newChunkReader(ctx, ps.js, ps.pulls, info, offset)
+		if err != nil {
+			return nil, err
+		}
+		return &idleReader{ObjectResult: cr, ctx: ctx}, nil
+	}
+
+	rc, err := getObject(ctx, obs, enc, info.Name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, rc, offset); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// chunkReader reads an object by pulling its chunks from the stream of its
+// store, readAheadChunks at a time. The object store reads objects with push
+// consumers instead, which may each have up to 32MiB in flight, so that a
+// few large reads over one connection make the server buffer more for it
+// than it may, and disconnect it as a slow consumer. The chunks that are
+// pulled over a connection but not received yet never add up to more than
+// maxPulledBytes, because every pull takes them from the budget in pulls.
+//
+// Reads from the start of an object are verified against its digest, like
+// those of the object store. Reads from the chunk that an offset falls in
+// are not, because that needs the whole object to be read.
+type chunkReader struct {
+	ctx   context.Context
+	js    jetstream.JetStream
+	pulls *semaphore.Weighted
+	info  *jetstream.ObjectInfo
+	cons  jetstream.Consumer
+	// seq is the stream sequence of the next chunk to pull, or zero
+	// to pull them from the first chunk of the object. The consumer is
+	// created again from it when a pull fails, because the chunks that
+	// it delivers after are never received.
+	seq uint64
+	// delivered is the consumer sequence of the last chunk that was
+	// received, by which chunks that went missing are detected.
+	delivered uint64
+	// chunks is the amount of chunks that were not pulled yet.
+	chunks int
+	// received are the chunks that were received, but not read yet.
+	received [][]byte
+	// chunk is what is left to read of the chunk that is read.
+	chunk []byte
+	// left is what is left to read of the object, including chunk.
+	left   int64
+	digest hash.Hash
+	err    error
+}
+
+func newChunkReader(ctx context.Context, js jetstream.JetStream, pulls *semaphore.Weighted, info *jetstream.ObjectInfo, offset int64) (*chunkReader, error) {
+	cr := &chunkReader{
+		ctx:    ctx,
+		js:     js,
+		pulls:  pulls,
+		info:   info,
+		chunks: int(info.Chunks),
+		left:   int64(info.Size),
+	}
+	if offset == 0 {
+		cr.digest = sha256.New()
+		return cr, nil
+	}
+
+	// The chunks of an object may be interleaved with those of others in
+	// the stream, and only the chunks of objects that were stored from a
+	// buffer are all of the chunk size. The chunk that offset falls in is
+	// found by adding up the sizes of the chunks without their content.
+	headers, err := js.OrderedConsumer(ctx, streamPrefix+info.Bucket, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{cr.subject()},
+		HeadersOnly:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	it, err := headers.Messages()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Stop()
+	var start int64
+	for {
+		msg, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(msg.Headers().Get(nats.MsgSize), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the size of a chunk: %w", err)
+		}
+		if start+size > offset {
+			meta, err := msg.Metadata()
+			if err != nil {
+				return nil, err
+			}
+			cr.seq = meta.Sequence.Stream
+			break
+		}
+		start += size
+		cr.chunks--
+	}
+
+	cr.left -= start
+	if err := cr.next(); err != nil {
+		cr.Close()
+		return nil, err
+	}
+	cr.chunk = cr.chunk[offset-start:]
+	cr.left -= offset - start
+	return cr, nil
+}
+
+func (cr *chunkReader) subject() string {
+	return fmt.Sprintf(chunkSubjectTemplate, cr.info.Bucket, cr.info.NUID)
+}
+
+// next moves on to the next chunk of the object, which is pulled if needed.
+func (cr *chunkReader) next() error {
+	if len(cr.received) == 0 {
+		if err := cr.pull(); err != nil {
+			return err
+		}
+	}
+	cr.chunk, cr.received = cr.received[0], cr.received[1:]
+	if int64(len(cr.chunk)) > cr.left {
+		cr.chunk = cr.chunk[:cr.left]
+	}
+	return nil
+}
+
+// pull receives the next readAheadChunks chunks of the object at most.
+func (cr *chunkReader) pull() error {
+	if cr.chunks <= 0 {
+		return io.ErrUnexpectedEOF
+	}
+	if cr.cons == nil {
+		config := jetstream.ConsumerConfig{
+			FilterSubject:     cr.subject(),
+			DeliverPolicy:     jetstream.DeliverAllPolicy,
+			AckPolicy:         jetstream.AckNonePolicy,
+			InactiveThreshold: pullInactiveThreshold,
+			MemoryStorage:     true,
+			Replicas:          1,
+		}
+		if cr.seq != 0 {
+			config.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+			config.OptStartSeq = cr.seq
+		}
+		var err error
+		if cr.cons, err = cr.js.CreateConsumer(cr.ctx, streamPrefix+cr.info.Bucket, config); err != nil {
+			return err
+		}
+		cr.delivered = 0
+	}
+
+	batch := min(readAheadChunks, cr.chunks)
+	weight := min(int64(batch)*chunkSizeOf(cr.info), maxPulledBytes)
+	if err := cr.pulls.Acquire(cr.ctx, weight); err != nil {
+		return err
+	}
+	defer cr.pulls.Release(weight)
+
+	chunks := cr.chunks
+	err := cr.fetch(batch)
+	if chunks-cr.chunks < batch {
+		// What is left of a pull that failed or expired may still be
+		// delivered, so the next pull is made by a consumer of its own.
+		_ = cr.Close()
+	}
+	if len(cr.received) > 0 {
+		return nil
+	}
+	if err == nil {
+		err = nats.ErrTimeout
+	}
+	return err
+}
+
+// fetch receives the chunks of a pull of batch chunks, until one of them
+// went missing.
+func (cr *chunkReader) fetch(batch int) error {
+	msgs, err := cr.cons.Fetch(batch)
+	if err != nil {
+		return err
+	}
+	for {
+		var msg jetstream.Msg
+		var ok bool
+		select {
+		case msg, ok = <-msgs.Messages():
+		case <-cr.ctx.Done():
+			return cr.ctx.Err()
+		}
+		if !ok {
+			return msgs.Error()
+		}
+
+		meta, err := msg.Metadata()
+		if err != nil {
+			return err
+		}
+		if meta.Sequence.Consumer != cr.delivered+1 {
+			return fmt.Errorf("failed to read %s: chunks went missing", cr.info.Name)
+		}
+		cr.delivered = meta.Sequence.Consumer
+		cr.seq = meta.Sequence.Stream + 1
+		cr.chunks--
+		if cr.digest != nil {
+			cr.digest.Write(msg.Data())
+		}
+		cr.received = append(cr.received, msg.Data())
+	}
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.left == 0 {
+		if cr.digest != nil && cr.info.Digest != "" && cr.info.Digest != objectDigest(cr.digest) {
+			cr.err = jetstream.ErrDigestMismatch
+			return 0, cr.err
+		}
+		return 0, io.EOF
+	}
+	if len(cr.chunk) == 0 {
+		if err := cr.next(); err != nil {
+			// A pull that received nothing can be made again.
+			if !isIdle(err) {
+				cr.err = err
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	cr.left -= int64(n)
+	return n, nil
+}
+
+// Info returns the info of the object, so that a chunkReader can be
+// returned by a pullingStore like the object store returns its reads.
+func (cr *chunkReader) Info() (*jetstream.ObjectInfo, error) {
+	return cr.info, nil
+}
+
+func (cr *chunkReader) Error() error {
+	return cr.err
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.cons == nil {
+		return nil
+	}
+	err := cr.js.DeleteConsumer(context.WithoutCancel(cr.ctx), streamPrefix+cr.info.Bucket, cr.cons.CachedInfo().Name)
+	cr.cons = nil
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return nil
+	}
+	return err
+}
+
+// chunkSizeOf returns the size of the chunks of the object of info.
+func chunkSizeOf(info *jetstream.ObjectInfo) int64 {
+	if info.Opts != nil && info.Opts.ChunkSize > 0 {
+		return int64(info.Opts.ChunkSize)
+	}
+	return defaultObjectChunkSize
+}
+
+// objectDigest formats the digest of an object like the object store does.
+func objectDigest(h hash.Hash) string {
+	return "SHA-256=" + base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// pullingStore reads the objects of its store with a chunkReader. Its
+// pulls are shared by every store that is read over the same connection.
+type pullingStore struct {
+	jetstream.ObjectStore
+	js    jetstream.JetStream
+	pulls *semaphore.Weighted
+}
+
+func (ps *pullingStore) Get(ctx context.Context, name string, opts ...jetstream.GetObjectOpt) (jetstream.ObjectResult, error) {
+	if len(opts) > 0 {
+		return ps.ObjectStore.Get(ctx, name, opts...)
+	}
+	info, err := ps.GetInfo(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkReader(ctx, ps.js, ps.pulls, info, 0)
+}
+
+func (ps *pullingStore) GetBytes(ctx context.Context, name string, opts ...jetstream.GetObjectOpt) ([]byte, error) {
+	result, err := ps.Get(ctx, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	return io.ReadAll(result)
+}
+
+// seek sets the offset of the next read from r, when r can be seeked in.
+func seek(r io.Reader, offset int64, whence int) (int64, error) {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return 0, errNotSeekable
+	}
+	return s.Seek(offset, whence)
+}
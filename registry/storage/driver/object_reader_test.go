@@ -0,0 +1,235 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"golang.org/x/sync/semaphore"
+)
+
+func TestRangedReads(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	// Parts of four chunks, and a last part of two and a half.
+	content := make([]byte, 10*minChunkSize+minChunkSize/2)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(content))
+	offsets := []int64{0, 1, minChunkSize, minChunkSize + 1, 4 * minChunkSize, 4*minChunkSize + 3, 9*minChunkSize + 5, size - 1, size, size + 10}
+
+	for name, params := range map[string]*Parameters{
+		"plain":      {},
+		"compressed": {Compression: string(compressionZstd)},
+		"encrypted":  {EncryptionKey: newEncryptionKey(t)},
+		"read ahead": {ReadAhead: 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			params.ClientURL = ns.ClientURL()
+			params.BucketPrefix = "ranged-" + strings.ReplaceAll(name, " ", "-")
+			params.ChunkSize = minChunkSize
+			params.WriteBufferSize = 4 * minChunkSize
+			d, err := New(ctx, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw, err := d.Writer(ctx, "/multipart", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Write in pieces that don't line up with the chunks.
+			for i := 0; i < len(content); i += 1000 {
+				if _, err := fw.Write(content[i:min(i+1000, len(content))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := fw.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := fw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, offset := range offsets {
+				r, err := d.Reader(ctx, "/multipart", offset)
+				if err != nil {
+					t.Fatalf("offset %d: %v", offset, err)
+				}
+				got, err := io.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("offset %d: %v", offset, err)
+				}
+				if !bytes.Equal(got, content[min(offset, size):]) {
+					t.Errorf("offset %d: expected %d bytes of content, got %d bytes that do not match", offset, size-min(offset, size), len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:       ns.ClientURL(),
+		ChunkSize:       minChunkSize,
+		WriteBufferSize: 2 * minChunkSize,
+		ReadAhead:       2,
+		VerifyReads:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 5*minChunkSize)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := d.Writer(ctx, "/seekable", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := d.Reader(ctx, "/seekable", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	seeker, ok := r.(io.ReadSeeker)
+	if !ok {
+		t.Fatalf("expected the reader to be seekable, got: %T", r)
+	}
+
+	size := int64(len(content))
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(seeker, head); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{offset: 3 * minChunkSize, whence: io.SeekStart, want: 3 * minChunkSize},
+		{offset: -minChunkSize - 1, whence: io.SeekCurrent, want: 2*minChunkSize + 15},
+		{offset: -10, whence: io.SeekEnd, want: size - 10},
+		{offset: 0, whence: io.SeekEnd, want: size},
+		{offset: 1, whence: io.SeekStart, want: 1},
+	}
+	for _, tt := range tests {
+		offset, err := seeker.Seek(tt.offset, tt.whence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != tt.want {
+			t.Fatalf("expected to seek to %d, got: %d", tt.want, offset)
+		}
+		got := make([]byte, 16)
+		n, err := io.ReadFull(seeker, got)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			t.Fatal(err)
+		}
+		if want := content[offset:min(offset+16, size)]; !bytes.Equal(got[:n], want) {
+			t.Errorf("offset %d: expected %d bytes of content, got %d bytes that do not match", offset, len(want), n)
+		}
+	}
+
+	if _, err := seeker.Seek(-1, io.SeekStart); err == nil {
+		t.Error("expected seeking to a negative offset to fail")
+	}
+}
+
+func TestInvalidReadAhead(t *testing.T) {
+	_, err := New(context.Background(), &Parameters{ReadAhead: -1})
+	if err == nil {
+		t.Error("expected a negative read ahead to be rejected")
+	}
+}
+
+func TestPullBudget(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs, err := js.CreateObjectStore(ctx, jetstream.ObjectStoreConfig{Bucket: "pulls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 10*defaultObjectChunkSize+42)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obs.PutBytes(ctx, "object", content); err != nil {
+		t.Fatal(err)
+	}
+
+	pulls := semaphore.NewWeighted(maxPulledBytes)
+	ps := &pullingStore{ObjectStore: obs, js: js, pulls: pulls}
+
+	// Nothing is pulled while the budget is taken by other reads.
+	if err := pulls.Acquire(ctx, maxPulledBytes-1); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	var got []byte
+	go func() {
+		var err error
+		got, err = ps.GetBytes(ctx, "object")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the read to wait for the budget, got: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pulls.Release(maxPulledBytes - 1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("expected the pulled chunks to match the content")
+	}
+	if !pulls.TryAcquire(maxPulledBytes) {
+		t.Error("expected the whole budget to be released after the read")
+	}
+}
@@ -16,67 +16,319 @@ package driver
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"strconv"
+	"sync"
+	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
 )
 
 const (
 	headerMultipartCount = "Cascade-Multipart-Count"
 	headerMultipartSize  = "Cascade-Multipart-Size"
-	multipartTemplate    = "%s/%d"
-
-	writeBufferSize  = 64 * 1024 * 1024
-	defaultChunkSize = 1 * 1024 * 1024
+	headerMultipartPart  = "Cascade-Multipart-Part"
+	// headerMultipartName is the name that the parts of a multipart object
+	// are stored under, when it is not the name of the object itself.
+	headerMultipartName = "Cascade-Multipart-Name"
+	// headerMovedParts is the name that the parts of a multipart object
+	// are staged under while it is moved within its store.
+	headerMovedParts  = "Cascade-Moved-Parts"
+	multipartTemplate = "%s/%d"
+	// stagedPrefix starts the name that the parts of content that replaces
+	// an object are staged under, below the name of the object.
+	stagedPrefix = ".staged-"
+
+	defaultWriteBufferSize = 64 * 1024 * 1024
+	defaultChunkSize       = 1 * 1024 * 1024
+	minChunkSize           = 4 * 1024
+	maxChunkSize           = 64 * 1024 * 1024
 )
 
-func newObjectWriter(ctx context.Context, obs jetstream.ObjectStore, filename string, append bool) (*objectWriter, error) {
+// bufferPool holds the buffers of FileWriters that are done, so that every
+// upload does not have to allocate a new buffer.
+//
+// A nil *bufferPool is valid, and allocates every buffer.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	bp := &bufferPool{size: size}
+	bp.pool.New = func() any {
+		return bytes.NewBuffer(make([]byte, 0, size))
+	}
+	return bp
+}
+
+// get returns an empty buffer that holds size bytes.
+func (bp *bufferPool) get(size int) *bytes.Buffer {
+	if bp == nil || size != bp.size {
+		return bytes.NewBuffer(make([]byte, 0, size))
+	}
+	return bp.pool.Get().(*bytes.Buffer)
+}
+
+func (bp *bufferPool) put(buf *bytes.Buffer) {
+	// Only buffers of the size of the pool are reused.
+	if bp == nil || buf.Cap() != bp.size {
+		return
+	}
+	buf.Reset()
+	bp.pool.Put(buf)
+}
+
+// writerOptions are the driver settings that affect how content is written.
+type writerOptions struct {
+	dedup       *deduplicator
+	compression compression
+	encryption  *encryptor
+	// quotas counts the content that is written, and rejects
+	// writes that would exceed the quota of the path.
+	quotas    *quotas
+	chunkSize int
+	// bufferSize is the size of the parts that content is written in.
+	// Zero means defaultWriteBufferSize.
+	bufferSize int
+	buffers    *bufferPool
+	// uploadConcurrency is the amount of parts that may be uploaded at the
+	// same time. Parts are uploaded one after the other when it is below 2.
+	// Streamed parts are sent one after the other, but only wait for the
+	// acknowledgements of their chunks in the background.
+	uploadConcurrency int
+	// retry is the policy that parts are stored with. Parts that are
+	// streamed while they are written cannot be retried.
+	retry *retryPolicy
+	// path is the path that is written, if it differs from the object name.
+	path string
+}
+
+func newObjectWriter(ctx context.Context, obs jetstream.ObjectStore, opts writerOptions, filename string, append bool) (*objectWriter, error) {
 	fw := &objectWriter{
-		ctx:      ctx,
-		obs:      obs,
-		filename: filename,
-		buf:      bytes.NewBuffer(make([]byte, 0, writeBufferSize)),
+		ctx:         ctx,
+		obs:         obs,
+		dedup:       opts.dedup,
+		compression: opts.compression,
+		encryption:  opts.encryption,
+		quotas:      opts.quotas,
+		chunkSize:   opts.chunkSize,
+		retry:       opts.retry,
+		filename:    filename,
+		parts:       filename,
+		path:        opts.path,
+		partSize:    opts.bufferSize,
+		buffers:     opts.buffers,
+	}
+	if fw.path == "" {
+		fw.path = filename
+	}
+	if fw.partSize == 0 {
+		fw.partSize = defaultWriteBufferSize
+	}
+	if opts.uploadConcurrency > 1 {
+		fw.uploads = make(chan struct{}, opts.uploadConcurrency)
+	}
+	if fw.compression == "" {
+		fw.compression = compressionNone
+	}
+	// Content that is stored as-is does not have to be buffered. Encoded
+	// content is, because its headers must be known before it is stored.
+	fw.streaming = fw.compression == compressionNone && fw.encryption == nil
+	if fw.dedup.enabled {
+		fw.hash = sha256.New()
 	}
 
-	if append {
-		info, err := fw.obs.GetInfo(ctx, filename)
+	if fw.quotaKey = fw.quotas.keyOf(fw.path); fw.quotaKey != "" {
+		usage, err := fw.quotas.usage(ctx, fw.quotaKey)
 		if err != nil {
+			fw.release()
 			return nil, err
 		}
-		if !isMultipart(info) {
-			return nil, errors.New("file already exists and is not a multipart file")
+		fw.quotaUsage = usage
+	}
+
+	if append {
+		if err := fw.resume(ctx); err != nil {
+			fw.release()
+			return nil, err
 		}
+	} else if err := fw.stage(ctx); err != nil {
+		fw.release()
+		return nil, err
+	}
+
+	return fw, nil
+}
+
+// stage stores the parts of content that replaces an object under a name
+// of their own, so that the parts of the object are left alone until the
+// content is committed. Committing stores the object that lists the new
+// parts in one go, so the object is never served with some of the parts
+// of either content, even when the registry is stopped halfway through.
+// Parts that were staged for content that was never committed are
+// orphaned, and purged like any other.
+func (obw *objectWriter) stage(ctx context.Context) error {
+	previous, err := currentInfo(ctx, obw.obs, obw.filename)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		obw.parts = obw.filename + sep + stagedPrefix + nuid.Next()
+	}
+	return nil
+}
+
+// resume picks up the parts that were written to the object before.
+//
+// Those are the parts listed by the object when it was last written, and
+// the parts that were flushed after that, but were never listed because
+// the registry was stopped halfway through. Every part is an object of its
+// own, so an upload can be resumed by any registry, after any restart.
+// Parts that are older than the object are left over from content that
+// it replaced, so they are not picked up.
+func (obw *objectWriter) resume(ctx context.Context) error {
+	info, err := obw.obs.GetInfo(ctx, obw.filename)
+	if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+		return err
+	}
 
-		parts, err := strconv.Atoi(info.Headers.Get(headerMultipartCount))
+	listed := 0
+	var since time.Time
+	if info != nil {
+		if isLink(info) {
+			return fmt.Errorf("cannot append to '%s': its content is deduplicated and can no longer change", obw.path)
+		}
+		if !isMultipart(info) {
+			return fmt.Errorf("cannot append to '%s': it was not written by a FileWriter", obw.path)
+		}
+		listed, err = strconv.Atoi(info.Headers.Get(headerMultipartCount))
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse multipart header: %w", err)
+			return fmt.Errorf("failed to parse multipart header: %w", err)
 		}
+		since = info.ModTime
+		obw.parts = multipartName(info)
 
-		for i := 0; i < parts; i++ {
-			info, err := fw.obs.GetInfo(ctx, fmt.Sprintf(multipartTemplate, filename, i))
+		// The committed content is already counted in the usage of the quota
+		// key, but is picked up below, so it must not be counted twice.
+		if obw.quotaKey != "" {
+			committed, err := fileSize(info)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			fw.index++
-			fw.size += int64(info.Size)
+			obw.quotaUsage -= committed
 		}
 	}
 
-	return fw, nil
+	for i := 0; ; i++ {
+		part, err := obw.obs.GetInfo(ctx, fmt.Sprintf(multipartTemplate, obw.parts, i))
+		if i < listed && err != nil {
+			return err
+		}
+		if errors.Is(err, jetstream.ErrObjectNotFound) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if i >= listed && !part.ModTime.After(since) {
+			break
+		}
+
+		size, err := objectSize(part)
+		if err != nil {
+			return err
+		}
+		obw.index++
+		obw.size += size
+	}
+	if info == nil && obw.index == 0 {
+		return storagedriver.PathNotFoundError{Path: obw.path, DriverName: driverName}
+	}
+	// Only the listed parts belong to committed content.
+	// Cancelling removes the parts that were picked up after them.
+	obw.appended = listed
+
+	if obw.hash != nil {
+		if info == nil || obw.index != listed {
+			// The hash state does not cover the parts that were picked up.
+			// The content will be hashed on commit instead.
+			obw.hash = nil
+		} else if err := restoreHash(obw.hash, info.Headers.Get(headerHashState)); err != nil {
+			obw.hash = nil
+		}
+	}
+
+	return nil
 }
 
-type objectWriter struct {
-	ctx      context.Context
-	obs      jetstream.ObjectStore
-	filename string
+func restoreHash(h hash.Hash, state string) error {
+	if state == "" {
+		return errors.New("no hash state")
+	}
+	b, err := base64.StdEncoding.DecodeString(state)
+	if err != nil {
+		return err
+	}
+	return h.(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+}
 
-	buf   *bytes.Buffer
-	index int
-	size  int64
+type objectWriter struct {
+	ctx         context.Context
+	obs         jetstream.ObjectStore
+	dedup       *deduplicator
+	compression compression
+	encryption  *encryptor
+	quotas      *quotas
+	chunkSize   int
+	retry       *retryPolicy
+	filename    string
+	// parts is the name that the parts are stored under.
+	parts string
+	path  string
+
+	// quotaKey is the quota key of the path, if it has one.
+	quotaKey string
+	// quotaUsage is the usage of the quota key when the writer was opened,
+	// without the committed content that is appended to.
+	quotaUsage int64
+
+	// partSize is the amount of content that is stored in each part.
+	partSize int
+	// streaming is set when parts are streamed to the object store as
+	// they are written, instead of buffered until they are complete.
+	streaming bool
+	// part is the part that is being streamed, if any.
+	part *partUpload
+	// buf is the buffer of the part that is being written, if any.
+	buf     *bytes.Buffer
+	buffers *bufferPool
+	index   int
+	size    int64
+	// appended is the number of parts that were already written
+	// before this writer was opened. They are owned by the committed
+	// content, so cancelling this writer must leave them alone.
+	appended int
+	// hash is the running hash of all content written so far.
+	// It is only kept when deduplicating content.
+	hash hash.Hash
+
+	// uploads holds a token for every part that is being uploaded in the
+	// background, so that writes block while too many are in flight.
+	// It is nil when parts are uploaded one after the other.
+	uploads   chan struct{}
+	inFlight  sync.WaitGroup
+	uploadMu  sync.Mutex
+	uploadErr error
 
 	committed bool
 	cancelled bool
@@ -94,75 +346,398 @@ func (obw *objectWriter) Write(data []byte) (int, error) {
 	} else if obw.cancelled {
 		return 0, fmt.Errorf("already cancelled")
 	}
+	if obw.quotaKey != "" {
+		if err := obw.quotas.exceeded(obw.path, obw.quotaKey, obw.quotaUsage+obw.size+int64(obw.pending()), int64(len(data))); err != nil {
+			return 0, err
+		}
+	}
 
 	// n is the amount of bytes written during this Write call
 	var n int
-	// w is the bytes written in a loop
-	var w int
-	for {
-		if obw.buf.Available() < len(data)-n {
-			w, _ = obw.buf.Write(data[n : n+obw.buf.Available()])
+	for n < len(data) {
+		// Only the rest of the current part is written at a time.
+		end := min(len(data), n+obw.partSize-obw.pending())
+		if obw.streaming {
+			// Stop a cancelled upload before sending
+			// another part, instead of after all of them.
+			if obw.part == nil {
+				if err := obw.ctx.Err(); err != nil {
+					return 0, obw.abort(err)
+				}
+				obw.part = obw.startPart(obw.ctx, obw.index)
+			}
+			if err := obw.part.write(data[n:end]); err != nil {
+				return 0, obw.failed(err)
+			}
 		} else {
-			w, _ = obw.buf.Write(data[n:])
+			obw.buffer().Write(data[n:end])
 		}
-		n += w
+		n = end
 
-		// Add chunk if the buffer is full
-		if obw.buf.Available() == 0 {
-			err := obw.flush()
-			if err != nil {
-				return 0, err
+		// Add the part if it is complete
+		if obw.pending() == obw.partSize {
+			if err := obw.ctx.Err(); err != nil {
+				return 0, obw.abort(err)
+			}
+			if err := obw.flush(obw.ctx); err != nil {
+				return 0, obw.failed(err)
 			}
 		}
+	}
 
-		if len(data) == n {
-			break
+	if obw.hash != nil {
+		obw.hash.Write(data)
+	}
+
+	return n, nil
+}
+
+// failed returns the error of storing a part. When it failed because the
+// context was cancelled, the upload is aborted.
+func (obw *objectWriter) failed(err error) error {
+	if ctxErr := obw.ctx.Err(); ctxErr != nil {
+		return obw.abort(ctxErr)
+	}
+	return err
+}
+
+// abort removes the parts written by this FileWriter after its context
+// was cancelled, so that they are not left behind, and returns err.
+func (obw *objectWriter) abort(err error) error {
+	obw.cancelled = true
+	// Whatever is still in flight fails with the context, but it
+	// may already have been stored, so it has to be removed as well.
+	_ = obw.wait()
+	obw.release()
+	if cleanupErr := obw.removeParts(context.WithoutCancel(obw.ctx)); cleanupErr != nil {
+		return errors.Join(err, cleanupErr)
+	}
+	return err
+}
+
+// flush stores the content in the buffer as the next part. With concurrent
+// uploads, it only waits for a free slot and uploads the part in the
+// background, and a failed upload is returned by a later flush or by wait.
+//
+// Streamed parts are already sent by the time that they are flushed, and
+// with concurrent uploads, only their acknowledgements are waited for in
+// the background. The next part is sent in the meantime, instead of after
+// a round trip to JetStream, and wait is the barrier for all of them.
+func (obw *objectWriter) flush(ctx context.Context) error {
+	if obw.streaming {
+		part := obw.part
+		if part == nil {
+			part = obw.startPart(ctx, obw.index)
 		}
+		obw.part = nil
+		if obw.uploads == nil {
+			if err := part.close(); err != nil {
+				return err
+			}
+			obw.index++
+			obw.size += int64(part.written)
+			return nil
+		}
+		if err := obw.reserve(ctx); err != nil {
+			part.discard()
+			return err
+		}
+		obw.index++
+		obw.size += int64(part.written)
+		obw.upload(part.close)
+		return nil
 	}
 
-	return w, nil
+	buf := obw.buffer()
+	if obw.uploads == nil {
+		if err := obw.putPart(ctx, obw.index, buf.Bytes()); err != nil {
+			return err
+		}
+		obw.index++
+		obw.size += int64(buf.Len())
+		buf.Reset()
+		return nil
+	}
+
+	if err := obw.reserve(ctx); err != nil {
+		return err
+	}
+	index := obw.index
+	obw.index++
+	obw.size += int64(buf.Len())
+	// The part is still being uploaded from the old buffer.
+	obw.buf = nil
+	obw.upload(func() error {
+		defer obw.buffers.put(buf)
+		return obw.putPart(ctx, index, buf.Bytes())
+	})
+	return nil
 }
 
-func (obw *objectWriter) flush() error {
-	meta := jetstream.ObjectMeta{
-		Name: fmt.Sprintf(multipartTemplate, obw.filename, obw.index),
+// reserve waits for a free slot to upload a part in. It returns the error
+// of an upload that failed before, so that no more parts are uploaded.
+func (obw *objectWriter) reserve(ctx context.Context) error {
+	if err := obw.uploadError(); err != nil {
+		return err
+	}
+	select {
+	case obw.uploads <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// upload stores a part with put in the background,
+// and frees its slot once it is done.
+func (obw *objectWriter) upload(put func() error) {
+	obw.inFlight.Add(1)
+	go func() {
+		defer obw.inFlight.Done()
+		defer func() { <-obw.uploads }()
+		if err := put(); err != nil {
+			obw.uploadMu.Lock()
+			obw.uploadErr = errors.Join(obw.uploadErr, err)
+			obw.uploadMu.Unlock()
+		}
+	}()
+}
+
+// buffer returns the buffer of the part that is being written.
+// Buffers are only taken from the pool once there is content to hold.
+func (obw *objectWriter) buffer() *bytes.Buffer {
+	if obw.buf == nil {
+		obw.buf = obw.buffers.get(obw.partSize)
+	}
+	return obw.buf
+}
+
+// pending returns the amount of content in the part that is being written.
+func (obw *objectWriter) pending() int {
+	if obw.part != nil {
+		return obw.part.written
+	}
+	if obw.buf != nil {
+		return obw.buf.Len()
+	}
+	return 0
+}
+
+func (obw *objectWriter) partMeta(index int) jetstream.ObjectMeta {
+	headers := nats.Header{}
+	headers.Set(headerMultipartPart, strconv.Itoa(index))
+	return jetstream.ObjectMeta{
+		Name:    fmt.Sprintf(multipartTemplate, obw.parts, index),
+		Headers: headers,
 		Opts: &jetstream.ObjectMetaOptions{
-			ChunkSize: defaultChunkSize,
+			ChunkSize: uint32(obw.chunkSize),
 		},
 	}
+}
 
-	info, err := obw.obs.Put(obw.ctx, meta, obw.buf)
+func (obw *objectWriter) putPart(ctx context.Context, index int, content []byte) error {
+	meta := obw.partMeta(index)
+	data, err := compress(obw.compression, &meta, content)
 	if err != nil {
 		return err
 	}
+	if data, err = obw.encryption.encrypt(&meta, data); err != nil {
+		return err
+	}
+	return obw.retry.transfer(ctx, "FileWriter.putPart", func(ctx context.Context) error {
+		_, err := obw.obs.Put(ctx, meta, bytes.NewReader(data))
+		return err
+	})
+}
 
-	obw.index++
-	obw.size += int64(info.Size)
-	obw.buf.Reset()
+// startPart starts streaming the part at index to the object store.
+func (obw *objectWriter) startPart(ctx context.Context, index int) *partUpload {
+	pr, pw := io.Pipe()
+	part := &partUpload{pw: pw, done: make(chan struct{})}
+	meta := obw.partMeta(index)
+	go func() {
+		defer close(part.done)
+		_, part.err = obw.obs.Put(ctx, meta, pr)
+		// Unblocks writes to a part that failed to be stored.
+		pr.CloseWithError(part.err)
+	}()
+	return part
+}
 
+// partUpload is a part that is streamed to the object store while it is written.
+// The object store only keeps the part once all of its content is written.
+type partUpload struct {
+	pw      *io.PipeWriter
+	written int
+	// done is closed once the part is stored, or failed to be with err.
+	done chan struct{}
+	err  error
+}
+
+func (pu *partUpload) write(data []byte) error {
+	n, err := pu.pw.Write(data)
+	pu.written += n
+	if err != nil {
+		// The error that the part failed to be stored with.
+		<-pu.done
+		return pu.err
+	}
 	return nil
 }
 
+// close stores the part with the content written so far.
+func (pu *partUpload) close() error {
+	pu.pw.Close()
+	<-pu.done
+	return pu.err
+}
+
+// discard stops streaming the part, so that it is not stored.
+func (pu *partUpload) discard() {
+	pu.pw.CloseWithError(errors.New("upload was discarded"))
+	<-pu.done
+}
+
+// release returns the buffer of a FileWriter that is done to the pool,
+// and discards the part that it was streaming.
+func (obw *objectWriter) release() {
+	if obw.part != nil {
+		obw.part.discard()
+		obw.part = nil
+	}
+	if obw.buf != nil {
+		obw.buffers.put(obw.buf)
+		obw.buf = nil
+	}
+}
+
+func (obw *objectWriter) uploadError() error {
+	obw.uploadMu.Lock()
+	defer obw.uploadMu.Unlock()
+	return obw.uploadErr
+}
+
+// wait waits for the parts that are uploaded in the background,
+// and returns the errors of the uploads that failed.
+func (obw *objectWriter) wait() error {
+	obw.inFlight.Wait()
+	return obw.uploadError()
+}
+
 func (obw *objectWriter) Close() error {
 	if obw.closed {
 		return fmt.Errorf("already closed")
 	}
 	obw.closed = true
 
-	if err := obw.flush(); err != nil {
+	// Committed content was already written out, and cancelled content
+	// must not be. Closing only finishes content that is left to append to.
+	if obw.committed || obw.cancelled {
+		return nil
+	}
+	defer obw.release()
+	return obw.finish(obw.ctx)
+}
+
+// finish writes out the remaining content, and the object that
+// ties all of its parts together.
+func (obw *objectWriter) finish(ctx context.Context) error {
+	// Every object has at least one part, even if it is empty,
+	// but there is no point in adding empty parts after that.
+	if obw.pending() > 0 || obw.index == 0 {
+		if err := obw.flush(ctx); err != nil {
+			return err
+		}
+	}
+	// The object may only list its parts once all of them are stored.
+	if err := obw.wait(); err != nil {
+		return err
+	}
+
+	// Whatever we are about to overwrite may be a link to deduplicated content.
+	previous, err := currentInfo(ctx, obw.obs, obw.filename)
+	if err != nil {
 		return err
 	}
 
+	// Empty content is left alone, because the storage driver
+	// contract allows appending to it even after it was committed.
+	if obw.committed && obw.dedup.enabled && obw.size > 0 {
+		dgst := ""
+		if obw.hash != nil {
+			dgst = digestOf(obw.hash)
+		} else if dgst, err = hashParts(ctx, obw.obs, obw.encryption, obw.parts, obw.index); err != nil {
+			return err
+		}
+
+		opts := writerOptions{compression: obw.compression, encryption: obw.encryption, chunkSize: obw.chunkSize}
+		if err := obw.dedup.commitParts(ctx, obw.obs, obw.filename, obw.parts, obw.path, obw.index, obw.size, dgst, opts); err != nil {
+			return err
+		}
+		if err := obw.quotas.replaced(ctx, previous, obw.path, obw.size); err != nil {
+			return err
+		}
+		if err := obw.dedup.released(ctx, previous); err != nil {
+			return err
+		}
+		return obw.removeReplaced(ctx, previous)
+	}
+
 	headers := nats.Header{}
 	headers.Set(headerMultipartCount, strconv.Itoa(obw.index))
 	headers.Set(headerMultipartSize, strconv.FormatInt(obw.size, 10))
+	if obw.hash != nil {
+		// Keep the hash state around, so that appending
+		// writers don't have to read everything back.
+		state, err := obw.hash.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		headers.Set(headerHashState, base64.StdEncoding.EncodeToString(state))
+	}
+	if obw.parts != obw.filename {
+		headers.Set(headerMultipartName, obw.parts)
+	}
 
 	meta := jetstream.ObjectMeta{
 		Name:    obw.filename,
 		Headers: headers,
 	}
-	_, err := obw.obs.Put(obw.ctx, meta, bytes.NewReader(nil))
-	return err
+	setPath(&meta, obw.path)
+	err = obw.retry.transfer(ctx, "FileWriter.Commit", func(ctx context.Context) error {
+		_, err := obw.obs.Put(ctx, meta, bytes.NewReader(nil))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := obw.quotas.replaced(ctx, previous, obw.path, obw.size); err != nil {
+		return err
+	}
+	if err := obw.dedup.released(ctx, previous); err != nil {
+		return err
+	}
+	return obw.removeReplaced(ctx, previous)
+}
+
+// removeReplaced deletes the parts of the content that was replaced by
+// this FileWriter, which the object no longer lists.
+func (obw *objectWriter) removeReplaced(ctx context.Context, previous *jetstream.ObjectInfo) error {
+	if previous == nil || !isMultipart(previous) || multipartName(previous) == obw.parts {
+		return nil
+	}
+	parts, err := strconv.Atoi(previous.Headers.Get(headerMultipartCount))
+	if err != nil {
+		return fmt.Errorf("failed to parse multipart header: %w", err)
+	}
+	for i := 0; i < parts; i++ {
+		err := obw.obs.Delete(ctx, partName(previous, i))
+		if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
 }
 
 // Size returns the number of bytes written to this FileWriter.
@@ -170,7 +745,8 @@ func (obw *objectWriter) Size() int64 {
 	return obw.size
 }
 
-// Cancel removes any written content from this FileWriter.
+// Cancel removes any content written by this FileWriter. When appending,
+// the content that was committed before is left as it was.
 func (obw *objectWriter) Cancel(ctx context.Context) error {
 	if obw.closed {
 		return fmt.Errorf("already closed")
@@ -179,10 +755,19 @@ func (obw *objectWriter) Cancel(ctx context.Context) error {
 	}
 	obw.cancelled = true
 
+	// Parts that are still in flight have to be removed as well.
+	_ = obw.wait()
+	obw.release()
+	return obw.removeParts(ctx)
+}
+
+// removeParts deletes the parts written by this FileWriter.
+func (obw *objectWriter) removeParts(ctx context.Context) error {
 	errs := make([]error, 0)
-	for i := 0; i < obw.index; i++ {
-		err := obw.obs.Delete(ctx, fmt.Sprintf(multipartTemplate, obw.filename, i))
-		if err != nil {
+	for i := obw.appended; i < obw.index; i++ {
+		err := obw.obs.Delete(ctx, fmt.Sprintf(multipartTemplate, obw.parts, i))
+		// Parts whose upload failed were never stored.
+		if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
 			errs = append(errs, err)
 		}
 	}
@@ -198,9 +783,7 @@ func (obw *objectWriter) Cancel(ctx context.Context) error {
 // Commit flushes all content written to this FileWriter and makes it
 // available for future calls to StorageDriver.GetContent and
 // StorageDriver.Reader.
-//
-// Having a separate commit call does not really make sense for my implementation.
-func (obw *objectWriter) Commit(context.Context) error {
+func (obw *objectWriter) Commit(ctx context.Context) error {
 	if obw.closed {
 		return fmt.Errorf("already closed")
 	} else if obw.committed {
@@ -210,9 +793,25 @@ func (obw *objectWriter) Commit(context.Context) error {
 	}
 	obw.committed = true
 
-	return nil
+	defer obw.release()
+	return obw.finish(ctx)
 }
 
 func isMultipart(info *jetstream.ObjectInfo) bool {
 	return info.Size == 0 && info.Headers.Get(headerMultipartCount) != ""
 }
+
+// multipartName returns the name that the parts of the multipart
+// object described by info are stored under.
+func multipartName(info *jetstream.ObjectInfo) string {
+	if name := info.Headers.Get(headerMultipartName); name != "" {
+		return name
+	}
+	return info.Name
+}
+
+// partName returns the name of the part at index of the multipart
+// object described by info.
+func partName(info *jetstream.ObjectInfo, index int) string {
+	return fmt.Sprintf(multipartTemplate, multipartName(info), index)
+}
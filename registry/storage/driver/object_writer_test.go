@@ -0,0 +1,533 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestWriterAppendAfterCommit(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	first := bytes.Repeat([]byte("a"), 1024)
+	second := bytes.Repeat([]byte("b"), 512)
+	writeFile(t, d, "/appended", first, false, true)
+	writeFile(t, d, "/appended", second, true, true)
+
+	want := append(first, second...)
+	got, err := d.GetContent(ctx, "/appended")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Error("expected appended content to follow the committed content")
+	}
+
+	fi, err := d.Stat(ctx, "/appended")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(want)) {
+		t.Errorf("expected size %d, got %d", len(want), fi.Size())
+	}
+
+	info, err := obs.GetInfo(ctx, "/appended")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := info.Headers.Get(headerMultipartCount); count != "2" {
+		t.Errorf("expected the header to list both parts, got: %s", count)
+	}
+}
+
+func TestWriterCancelAppend(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("committed content")
+	writeFile(t, d, "/cancelled", content, false, true)
+
+	fw, err := d.Writer(ctx, "/cancelled", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(make([]byte, defaultWriteBufferSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetContent(ctx, "/cancelled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Errorf("expected cancelling an append to keep the committed content, got %d bytes", len(got))
+	}
+}
+
+func TestWriterContextCancelled(t *testing.T) {
+	ns := newTestServer(t)
+	// The driver creates the object store.
+	if _, err := New(context.Background(), &Parameters{ClientURL: ns.ClientURL()}); err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fw, err := newObjectWriter(ctx, obs, writerOptions{dedup: &deduplicator{obs: obs}}, "/cancelled", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use small parts, so that every few bytes become a separate part.
+	fw.partSize = 16
+
+	if n, err := fw.Write(make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	} else if n != 32 {
+		t.Errorf("expected 32 bytes to be written, got %d", n)
+	}
+
+	cancel()
+	if _, err := fw.Write(make([]byte, 32)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected writing with a cancelled context to fail, got: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := obs.List(context.Background()); !errors.Is(err, jetstream.ErrNoObjectsFound) {
+		t.Errorf("expected no parts to be left behind, got: %v", err)
+	}
+}
+
+func TestWriterStreamsParts(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+	if _, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()}); err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	fw, err := newObjectWriter(ctx, obs, writerOptions{dedup: &deduplicator{obs: obs}}, "/streamed", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.partSize = 16
+
+	if _, err := fw.Write(make([]byte, 40)); err != nil {
+		t.Fatal(err)
+	}
+	if fw.buf != nil {
+		t.Error("expected content that is stored as-is not to be buffered")
+	}
+	if fw.part == nil {
+		t.Fatal("expected the last part to still be streamed")
+	}
+	// Parts are only kept once they are complete.
+	if names := objectNames(t, obs); !reflect.DeepEqual(names, []string{"/streamed/0", "/streamed/1"}) {
+		t.Errorf("expected only the complete parts to be stored, got %v", names)
+	}
+
+	if err := fw.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names := objectNames(t, obs); names != nil {
+		t.Errorf("expected no parts to be left behind, got %v", names)
+	}
+}
+
+func TestWriterResumesInterruptedUploads(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	// The registry stops before the writer is ever closed,
+	// so only its parts were stored.
+	first := bytes.Repeat([]byte("a"), 64)
+	writeParts(t, obs, "/interrupted", first, false, false)
+
+	fw, err := d.Writer(ctx, "/interrupted", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw.Size() != int64(len(first)) {
+		t.Errorf("expected to resume at %d bytes, got %d", len(first), fw.Size())
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The registry stops again, after flushing more parts.
+	second := bytes.Repeat([]byte("b"), 32)
+	writeParts(t, obs, "/interrupted", second, true, false)
+
+	writeFile(t, d, "/interrupted", []byte("c"), true, true)
+	want := append(append(first, second...), 'c')
+	got, err := d.GetContent(ctx, "/interrupted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("expected the interrupted content to be resumed, got %q", got)
+	}
+
+	// Overwriting removes the parts of the previous content once the new
+	// content is stored, so they are not resumed either.
+	writeFile(t, d, "/interrupted", []byte("d"), false, false)
+	fw, err = d.Writer(ctx, "/interrupted", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw.Size() != 1 {
+		t.Errorf("expected only the current content to be resumed, got %d bytes", fw.Size())
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterAtomicCommit(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	previous := bytes.Repeat([]byte("a"), 32)
+	writeParts(t, obs, "/atomic", previous, false, true)
+
+	fw, err := newObjectWriter(ctx, obs, writerOptions{dedup: &deduplicator{obs: obs}}, "/atomic", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.partSize = 16
+	content := bytes.Repeat([]byte("b"), 48)
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	// The parts of the new content are stored, but not committed.
+	if got, err := d.GetContent(ctx, "/atomic"); err != nil || !bytes.Equal(got, previous) {
+		t.Errorf("expected the previous content to be served until the new content is committed, got: %q, %v", got, err)
+	}
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.GetContent(ctx, "/atomic"); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("expected the new content to be served once it is committed, got: %q, %v", got, err)
+	}
+
+	info, err := obs.GetInfo(ctx, "/atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged := multipartName(info)
+	want := []string{"/atomic", staged + "/0", staged + "/1", staged + "/2"}
+	if names := objectNames(t, obs); !strings.HasPrefix(staged, "/atomic/"+stagedPrefix) || !reflect.DeepEqual(names, want) {
+		t.Errorf("expected the parts of the previous content to be replaced by %v, got: %v", want, names)
+	}
+	if orphans, err := d.OrphanedParts(ctx, 0); err != nil || len(orphans) != 0 {
+		t.Errorf("expected the staged parts of committed content not to be orphaned, got: %v, %v", orphans, err)
+	}
+
+	// The registry stops before the next content is ever committed.
+	writeParts(t, obs, "/atomic", bytes.Repeat([]byte("c"), 32), false, false)
+	if got, err := d.GetContent(ctx, "/atomic"); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("expected the committed content to be served after an interrupted write, got: %q, %v", got, err)
+	}
+	orphans, err := d.OrphanedParts(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 2 || !strings.HasPrefix(orphans[0], "/atomic/"+stagedPrefix) || strings.HasPrefix(orphans[0], staged+sep) {
+		t.Errorf("expected the parts of the interrupted write to be orphaned, got: %v", orphans)
+	}
+
+	if err := d.Move(ctx, "/atomic", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.GetContent(ctx, "/moved"); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("expected the committed content to be moved, got: %q, %v", got, err)
+	}
+}
+
+func TestWriterConcurrentUploads(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+	// The driver creates the object store.
+	if _, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()}); err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+	opts := writerOptions{
+		dedup:             &deduplicator{obs: obs},
+		uploadConcurrency: 4,
+	}
+
+	content := make([]byte, 16*64)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	fw, err := newObjectWriter(ctx, obs, opts, "/concurrent", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.partSize = 16
+	// Write in pieces that don't line up with the parts.
+	for i := 0; i < len(content); i += 100 {
+		if _, err := fw.Write(content[i:min(i+100, len(content))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := obs.GetInfo(ctx, "/concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := info.Headers.Get(headerMultipartCount); count != strconv.Itoa(len(content)/16) {
+		t.Errorf("expected the header to list %d parts, got: %s", len(content)/16, count)
+	}
+
+	reader, err := newObjectReader(ctx, obs, opts.dedup, nil, "/concurrent", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("expected the parts to be read back in the order that they were written")
+	}
+
+	// Cancelling removes the parts that are still in flight as well.
+	fw, err = newObjectWriter(ctx, obs, opts, "/cancelled", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.partSize = 16
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range objectNames(t, obs) {
+		if name != "/concurrent" && !isUnder(name, "/concurrent") {
+			t.Errorf("expected no parts to be left behind, got: %s", name)
+		}
+	}
+}
+
+func TestWriterStreamedUploads(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+	if _, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()}); err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+	opts := writerOptions{
+		dedup:             &deduplicator{obs: obs},
+		uploadConcurrency: 2,
+	}
+
+	content := make([]byte, 16*64)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := newObjectWriter(ctx, obs, opts, "/streamed", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fw.streaming {
+		t.Fatal("expected content that is stored as it is to be streamed")
+	}
+	fw.partSize = 16
+	for i := 0; i < len(content); i += 100 {
+		if _, err := fw.Write(content[i:min(i+100, len(content))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every part is acknowledged once the content is committed.
+	for i := 0; i < len(content)/16; i++ {
+		if _, err := obs.GetInfo(ctx, fmt.Sprintf(multipartTemplate, "/streamed", i)); err != nil {
+			t.Errorf("expected part %d to be stored, got: %v", i, err)
+		}
+	}
+	reader, err := newObjectReader(ctx, obs, opts.dedup, nil, "/streamed", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("expected the streamed parts to be read back in the order that they were written")
+	}
+}
+
+func TestInvalidUploadConcurrency(t *testing.T) {
+	_, err := New(context.Background(), &Parameters{UploadConcurrency: -1})
+	if err == nil {
+		t.Error("expected a negative upload concurrency to be rejected")
+	}
+}
+
+func TestWriteBufferSize(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:       ns.ClientURL(),
+		ChunkSize:       minChunkSize,
+		WriteBufferSize: 2 * minChunkSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	content := make([]byte, 5*minChunkSize)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, d, "/small-buffer", content, false, true)
+
+	info, err := obs.GetInfo(ctx, "/small-buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts := info.Headers.Get(headerMultipartCount); parts != "3" {
+		t.Errorf("expected content to be written in 3 parts, got %s", parts)
+	}
+	got, err := d.GetContent(ctx, "/small-buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("content does not match after round trip")
+	}
+}
+
+func TestInvalidWriteBufferSize(t *testing.T) {
+	_, err := New(context.Background(), &Parameters{
+		ChunkSize:       2 * minChunkSize,
+		WriteBufferSize: minChunkSize,
+	})
+	if err == nil {
+		t.Error("expected a write buffer smaller than the chunk size to be rejected")
+	}
+}
+
+func TestWriterAppendErrors(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Writer(ctx, "/missing", true); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected path not found when appending to a missing path, got: %v", err)
+	}
+
+	if err := d.PutContent(ctx, "/content", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Writer(ctx, "/content", true); err == nil {
+		t.Error("expected appending to content that was not written by a FileWriter to fail")
+	}
+}
+
+// BenchmarkWriterSmallUploads measures the allocations of uploads that are
+// much smaller than a part.
+func BenchmarkWriterSmallUploads(b *testing.B) {
+	ctx := context.Background()
+	ns := newTestServer(b)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("a"), 4096)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fw, err := d.Writer(ctx, "/small/"+strconv.Itoa(i), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := fw.Write(content); err != nil {
+			b.Fatal(err)
+		}
+		if err := fw.Commit(ctx); err != nil {
+			b.Fatal(err)
+		}
+		if err := fw.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
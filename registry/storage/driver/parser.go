@@ -1,4 +1,5 @@
 // Copyright 2024 Robin Ketelbuters
+
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
 // You may obtain a copy of the License at
@@ -16,24 +17,787 @@ package driver
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
 )
 
 const (
-	defaultClientURL = "localhost:4222"
+	defaultClientURL     = "localhost:4222"
+	defaultBucketPrefix  = "cascade-registry"
+	defaultGatewayAddr   = ":5002"
+	defaultGatewayExpiry = 20 * time.Minute
+
+	defaultCacheMaxObjectSize = 4 * 1024
+	defaultCacheTTL           = 10 * time.Minute
+
+	defaultMaxConcurrency = 64
 )
 
 type Parameters struct {
+	// ClientURL is a comma-separated list of NATS servers to connect to.
+	// The client fails over between them when a server becomes unreachable.
 	ClientURL string
+	// MaxReconnects is the amount of reconnect attempts before giving up.
+	// A negative value means that the client never gives up,
+	// and zero means the NATS client default.
+	MaxReconnects int
+	// ReconnectWait is the time to wait between reconnect attempts to the same server.
+	// Zero means the NATS client default.
+	ReconnectWait time.Duration
+	// PingInterval is the time between pings to the server, which is how
+	// the client detects a broken connection. Zero means the NATS client default.
+	PingInterval time.Duration
+	// ConnectionName identifies the registry in the monitoring of the NATS server.
+	ConnectionName string
+	// JetStreamDomain is the JetStream domain that the object stores are
+	// kept in, like the domain of a leafnode. It is empty for the default
+	// domain of the server that the driver connects to.
+	JetStreamDomain string
+	// JetStreamAPIPrefix is the subject prefix of the JetStream API, for
+	// when it is imported from another account. It cannot be combined with
+	// JetStreamDomain, which sets the prefix to that of the domain.
+	JetStreamAPIPrefix string
+
+	// TLSCACert is the file with the CA certificates used to verify the NATS servers.
+	// The system's CA certificates are used when it is empty.
+	TLSCACert string
+	// TLSClientCert and TLSClientKey are the files with the certificate
+	// and key that the driver authenticates itself with.
+	TLSClientCert string
+	TLSClientKey  string
+	// TLSInsecureSkipVerify disables verification of the server certificates.
+	// It should only be used for testing.
+	TLSInsecureSkipVerify bool
+	// TLSServerName is the name that server certificates are verified against,
+	// instead of the host name in the URL.
+	TLSServerName string
+
+	// Credentials is the file with the JWT and NKey seed of the NATS user,
+	// as used with decentralized JWT authentication.
+	Credentials string
+	// JWT is the file with the JWT of the NATS user, signed with NKeySeed.
+	// It is an alternative to Credentials for keeping both in separate files.
+	JWT string
+	// NKeySeed is the file with the NKey seed of the NATS user.
+	// Without JWT, the driver authenticates as an NKey user.
+	NKeySeed string
+	// Username and Password authenticate the driver as a NATS user.
+	Username string
+	Password string
+	// Token is the token that the driver authenticates with.
+	Token string
+
+	// BucketPrefix is prepended to the names of all object store buckets
+	// created by the driver, so that multiple registries can share a NATS cluster.
+	BucketPrefix string
+
+	// GatewayEnabled starts an HTTP gateway that serves object content
+	// directly from NATS, and makes RedirectURL return signed URLs to it.
+	GatewayEnabled bool
+	// GatewayAddr is the address that the gateway listens on.
+	GatewayAddr string
+	// GatewayURL is the base URL under which clients can reach the gateway.
+	GatewayURL string
+	// GatewaySecret is the key used to sign and validate redirect URLs.
+	GatewaySecret string
+	// GatewayExpiry is how long a redirect URL remains valid.
+	GatewayExpiry time.Duration
+
+	// CacheMaxEntries is the amount of objects kept in the in-memory cache.
+	// The cache is disabled when this is zero.
+	CacheMaxEntries int
+	// CacheMaxObjectSize is the size in bytes of the largest object
+	// whose content is kept in the cache.
+	CacheMaxObjectSize int64
+	// CacheTTL is how long objects are kept in the cache. Changes made by
+	// other registries are normally seen sooner, by watching the stores.
+	// Zero means that objects are kept until they change or are evicted.
+	CacheTTL time.Duration
+
+	// Dedup stores identical content only once, no matter how many paths it is written to.
+	Dedup bool
+	// DedupChunkSize is the average size in bytes of the content-defined
+	// chunks that deduplicated content is split into, so that content that
+	// only differs in places, like rebuilt layers, shares most of its chunks.
+	// Content is deduplicated as a whole when this is zero.
+	DedupChunkSize int
+
+	// Compression is the codec used to compress stored content: none, gzip, or zstd.
+	Compression string
+
+	// EncryptionKey is a base64 encoded 256-bit key that content is encrypted
+	// with before it is stored. Like any other parameter, it can be set through
+	// the environment with REGISTRY_STORAGE_NATS_ENCRYPTIONKEY.
+	EncryptionKey string
+	// EncryptionKeyFile is the file with the base64 encoded encryption key,
+	// as an alternative to EncryptionKey.
+	EncryptionKeyFile string
+	// EnvelopeEncryption encrypts content with a data key that is generated
+	// once and kept in a KV bucket, wrapped by the encryption key.
+	EnvelopeEncryption bool
+
+	// ChunkSize is the size in bytes of the chunks that content is stored in.
+	// It may not exceed the maximum payload of the NATS server.
+	// Zero means the default of 1MiB.
+	ChunkSize int
+
+	// WriteBufferSize is the size in bytes of the parts that a FileWriter
+	// stores content in. Content that is compressed or encrypted is buffered
+	// until a part is complete, so every such upload holds a buffer of this
+	// size, and smaller buffers trade throughput for memory. Other content
+	// is streamed as it is written. It may not be smaller than ChunkSize.
+	// Zero means the default of 64MiB.
+	WriteBufferSize int
+
+	// Replicas is the amount of JetStream servers that each object store
+	// is replicated to, between 1 and 5. Zero means a single replica.
+	Replicas int
+	// PlacementCluster is the JetStream cluster that the object stores
+	// are created in. It is empty for the cluster that the driver is
+	// connected to.
+	PlacementCluster string
+	// PlacementTags are the server tags that the servers which hold the
+	// object stores must all have, like zone:eu-1, to keep them off
+	// servers that are not meant for storage.
+	PlacementTags []string
+	// Storage is where JetStream keeps the buckets of the driver: file for
+	// on disk, which is the default, or memory. Content in memory is lost
+	// when the servers restart, so it is only meant for ephemeral
+	// registries, like in CI. Existing buckets can not be changed from one
+	// to the other.
+	Storage string
+
+	// MaxConcurrency is the amount of storage operations that may run at
+	// the same time. Zero means the default of 64.
+	MaxConcurrency int
+
+	// UploadConcurrency is the amount of parts that every FileWriter may
+	// upload at the same time. Each part of compressed or encrypted content
+	// in flight holds a buffer of WriteBufferSize, so this multiplies the
+	// memory used by uploads. Other content is still sent one part after
+	// the other, but the next part is sent while the chunks of the parts
+	// before it are still waiting to be acknowledged, and committing waits
+	// for all of them. Zero means one at a time.
+	UploadConcurrency int
+	// DeleteConcurrency is the amount of objects that are deleted at the same
+	// time when a directory is deleted. Zero means the default of 16.
+	DeleteConcurrency int
+	// ReadAhead is the amount of parts that every reader opens ahead of the
+	// part that it reads, so that their content is received while the
+	// current part is read. Every part that is read ahead may hold up to
+	// WriteBufferSize of memory until it is read. Zero disables it.
+	ReadAhead int
+
+	// APITimeout is how long every attempt of a storage operation that does
+	// not store content may take, like Stat or GetContent. Zero means that
+	// every JetStream API request of the operation times out on its own
+	// after five seconds, however many requests it makes.
+	APITimeout time.Duration
+	// TransferTimeout is how long every attempt of a storage operation that
+	// stores content may take, like PutContent or the upload of a part.
+	// Streaming content through readers and writers is not bound by it.
+	// Zero means the default of a minute.
+	TransferTimeout time.Duration
+	// MaxRetries is the amount of times that a storage operation is retried
+	// when it fails with a transient error, like a timeout or the election of
+	// a stream leader. Parts that are streamed while they are written cannot
+	// be retried, only the parts of compressed, encrypted or concurrent
+	// uploads. Zero means the default of three, and a negative value
+	// disables retries.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, which doubles after
+	// every retry, up to ten seconds. Zero means the default of 100ms.
+	RetryBackoff time.Duration
+	// BreakerThreshold is the amount of storage operations in a row that
+	// must fail with a transient error, after their retries, before every
+	// operation fails right away with an UnavailableError, so that requests
+	// do not pile up while JetStream is unavailable. Zero means that
+	// operations never fail before they are tried.
+	BreakerThreshold int
+	// BreakerCooldown is how long operations fail right away before one is
+	// tried again. Zero means the default of 30s.
+	BreakerCooldown time.Duration
+
+	// PurgeInterval is how often the parts of uploads that were never
+	// committed or cancelled are purged, like PurgeUploads does. Zero means
+	// that they are never purged in the background.
+	PurgeInterval time.Duration
+	// PurgeAge is how old orphaned parts must be before they are purged.
+	// Zero means the default of a week.
+	PurgeAge time.Duration
+	// PurgeDryRun only logs the orphaned parts that would be purged.
+	PurgeDryRun bool
+	// ScrubInterval is how often every blob is read back and verified
+	// against its digest, like Scrub does. The last scrub is reported as
+	// JSON under /debug/nats_<bucket prefix>/scrub. Zero means that blobs
+	// are never scrubbed in the background.
+	ScrubInterval time.Duration
+	// ScrubRate is the amount of bytes per second that blobs are read at
+	// while they are scrubbed. Zero means that they are not limited.
+	ScrubRate int64
+	// ScrubQuarantine quarantines the blobs that do not match their
+	// digest. It is ignored while the driver is read-only.
+	ScrubQuarantine bool
+	// BackupInterval is how often the registry is exported to an archive
+	// in BackupDir, like Export does. Zero means that it is never backed up
+	// in the background. The time of the last backup that succeeded is
+	// reported as the nats_backup_last_success_timestamp_seconds metric.
+	BackupInterval time.Duration
+	// BackupDir is the directory that backup archives are written to.
+	// They are named after the bucket prefix and the time of the backup.
+	BackupDir string
+	// BackupRetain is the amount of backup archives that are kept.
+	// Older archives are removed. Zero means the default of 7.
+	BackupRetain int
+	// UploadTTL keeps everything under the _uploads directories in an object
+	// store of its own, where JetStream deletes what is older than the TTL,
+	// so that abandoned uploads do not pile up. It must be longer than any
+	// upload takes, because the parts of an upload that is still going
+	// expire as well. Committed uploads are copied out of the store. Zero
+	// means that uploads are kept with everything else. Enabling or disabling
+	// it hides the uploads that are in progress.
+	UploadTTL time.Duration
+
+	// StoreMaxBytes is the amount of bytes that every object store may hold,
+	// so that runaway pushes can not fill the disks of the cluster. Content
+	// that is written to a full store fails with a StoreFullError. Zero means
+	// that stores are not limited.
+	StoreMaxBytes int64
+	// StoreMaxAge is how long JetStream keeps objects before deleting them,
+	// in every store but the uploads store, which uses the upload TTL if it
+	// is set. It deletes whatever is older, even if it is still referenced,
+	// so it is only meant for registries whose content is disposable. Zero
+	// means that objects are kept forever.
+	StoreMaxAge time.Duration
+
+	// WriteLockTTL locks every path that a FileWriter is open for, so that
+	// registries that share the storage can not write the same upload at
+	// the same time. Locks are kept in a KV bucket, and expire after the TTL
+	// unless the writer that holds them renews them, which it does while it
+	// is open. Zero means that paths are not locked.
+	WriteLockTTL time.Duration
+	// WriteLockWait is how long a writer waits for the lock of a path that
+	// another writer holds, before it fails with a WriteConflictError. Zero
+	// means that it fails right away.
+	WriteLockWait time.Duration
+
+	// HealthCheckInterval is how often HealthCheck runs to report the state
+	// of the storage under /debug/health. Each driver is reported under
+	// nats_ followed by its bucket prefix. Zero means that it never runs.
+	HealthCheckInterval time.Duration
+	// HealthCheckThreshold is the amount of health checks in a row that must
+	// fail before the storage is reported as unhealthy. Zero means one.
+	HealthCheckThreshold int
+	// HealthCheckMaxLatency is how long the probe of the health check may
+	// take before the storage is considered unhealthy. Zero means a second.
+	HealthCheckMaxLatency time.Duration
+
+	// ShardPrefixes are paths whose children are each kept in an object
+	// store of their own, instead of in the root store. For example, with
+	// /docker/registry/v2/repositories every repository namespace gets its
+	// own store, which can be replicated and placed independently.
+	ShardPrefixes []string
+
+	// Tenants are repository namespaces under TenantPrefix that are kept in
+	// an object store in a NATS account of their own, by their name. Their
+	// content is isolated by JetStream, and counts against the JetStream
+	// limits of their account. Only the blobs that their uploads are moved
+	// to are shared, in the root store, like with every other namespace.
+	Tenants map[string]TenantParameters
+	// TenantPrefix is the directory that the namespaces of the tenants are
+	// in. It is /docker/registry/v2/repositories when it is empty.
+	TenantPrefix string
+
+	// QuotaPrefixes are paths whose children each get a quota key, like
+	// every repository namespace under /docker/registry/v2/repositories.
+	// Content written below a child is counted against the quota of its key,
+	// and keeps being counted after it is moved out, like uploads are.
+	QuotaPrefixes []string
+	// Quota is the amount of bytes that may be stored under every quota
+	// key. Zero means that quotas are disabled.
+	Quota int64
+
+	// ReadOnly rejects every storage operation that would change the
+	// storage with a ReadOnlyError, like during a migration or maintenance,
+	// while content can still be read. Uploads are not purged meanwhile.
+	ReadOnly bool
+
+	// Tracing creates OpenTelemetry spans for every storage operation,
+	// which are exported like the spans of the registry itself.
+	Tracing bool
+
+	// HashedNames stores objects under a hash of their path, and keeps the
+	// path in their headers instead. This keeps object names short no matter
+	// how deeply paths are nested. It only applies to content written while
+	// it is enabled, so it should not be changed for existing buckets.
+	HashedNames bool
+
+	// KVLinks keeps the link files of the registry, which only hold a
+	// digest, in a KV bucket instead of the object stores, so that they are
+	// read and written with a single request. Links that were stored before
+	// it was enabled are still read from the object stores. Disabling it
+	// again hides the links that were stored in the KV bucket.
+	KVLinks bool
+
+	// VerifyReads verifies blobs against the digest in their path while
+	// they are read from the start, and fails the read with a
+	// CorruptionError when they do not match. Objects that do not match the
+	// digest that the object store keeps for them always fail with one
+	// when they are read from the start.
+	VerifyReads bool
 }
 
 func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Driver, error) {
 	params := &Parameters{
-		ClientURL: defaultClientURL,
+		ClientURL:     defaultClientURL,
+		BucketPrefix:  defaultBucketPrefix,
+		MaxReconnects: nats.DefaultMaxReconnect,
+		ReconnectWait: nats.DefaultReconnectWait,
+		PingInterval:  nats.DefaultPingInterval,
+		GatewayAddr:   defaultGatewayAddr,
+		GatewayExpiry: defaultGatewayExpiry,
+
+		CacheMaxObjectSize: defaultCacheMaxObjectSize,
+		CacheTTL:           defaultCacheTTL,
 	}
 
 	if v, ok := parameters["clienturl"]; ok {
-		params.ClientURL = fmt.Sprint(v)
+		switch v := v.(type) {
+		case []interface{}:
+			urls := make([]string, len(v))
+			for i := range v {
+				urls[i] = fmt.Sprint(v[i])
+			}
+			params.ClientURL = strings.Join(urls, ",")
+		default:
+			params.ClientURL = fmt.Sprint(v)
+		}
+	}
+
+	if v, ok := parameters["bucketprefix"]; ok {
+		params.BucketPrefix = fmt.Sprint(v)
+	}
+
+	maxReconnects, err := parseInt(parameters, "maxreconnects", nats.DefaultMaxReconnect)
+	if err != nil {
+		return nil, err
+	}
+	params.MaxReconnects = int(maxReconnects)
+	if params.ReconnectWait, err = parseDuration(parameters, "reconnectwait", nats.DefaultReconnectWait); err != nil {
+		return nil, err
+	}
+	if params.PingInterval, err = parseDuration(parameters, "pinginterval", nats.DefaultPingInterval); err != nil {
+		return nil, err
+	}
+	if v, ok := parameters["connectionname"]; ok {
+		params.ConnectionName = fmt.Sprint(v)
+	}
+	if v, ok := parameters["jetstreamdomain"]; ok {
+		params.JetStreamDomain = fmt.Sprint(v)
+	}
+	if v, ok := parameters["jetstreamapiprefix"]; ok {
+		params.JetStreamAPIPrefix = fmt.Sprint(v)
+	}
+
+	if v, ok := parameters["tlscacert"]; ok {
+		params.TLSCACert = fmt.Sprint(v)
+	}
+	if v, ok := parameters["tlsclientcert"]; ok {
+		params.TLSClientCert = fmt.Sprint(v)
+	}
+	if v, ok := parameters["tlsclientkey"]; ok {
+		params.TLSClientKey = fmt.Sprint(v)
+	}
+	if params.TLSInsecureSkipVerify, err = parseBool(parameters, "tlsinsecureskipverify", false); err != nil {
+		return nil, err
+	}
+	if v, ok := parameters["tlsservername"]; ok {
+		params.TLSServerName = fmt.Sprint(v)
+	}
+
+	if v, ok := parameters["credentials"]; ok {
+		params.Credentials = fmt.Sprint(v)
+	}
+	if v, ok := parameters["jwt"]; ok {
+		params.JWT = fmt.Sprint(v)
+	}
+	if v, ok := parameters["nkeyseed"]; ok {
+		params.NKeySeed = fmt.Sprint(v)
+	}
+	if v, ok := parameters["username"]; ok {
+		params.Username = fmt.Sprint(v)
+	}
+	if v, ok := parameters["password"]; ok {
+		params.Password = fmt.Sprint(v)
+	}
+	if v, ok := parameters["token"]; ok {
+		params.Token = fmt.Sprint(v)
+	}
+
+	if params.GatewayEnabled, err = parseBool(parameters, "gatewayenabled", false); err != nil {
+		return nil, err
+	}
+	if v, ok := parameters["gatewayaddr"]; ok {
+		params.GatewayAddr = fmt.Sprint(v)
+	}
+	if v, ok := parameters["gatewayurl"]; ok {
+		params.GatewayURL = fmt.Sprint(v)
+	}
+	if v, ok := parameters["gatewaysecret"]; ok {
+		params.GatewaySecret = fmt.Sprint(v)
+	}
+	if params.GatewayExpiry, err = parseDuration(parameters, "gatewayexpiry", defaultGatewayExpiry); err != nil {
+		return nil, err
+	}
+
+	cacheMaxEntries, err := parseInt(parameters, "cachemaxentries", 0)
+	if err != nil {
+		return nil, err
+	}
+	if cacheMaxEntries < 0 {
+		return nil, fmt.Errorf("the cachemaxentries parameter should not be negative, got: %d", cacheMaxEntries)
+	}
+	params.CacheMaxEntries = int(cacheMaxEntries)
+	if params.CacheMaxObjectSize, err = parseInt(parameters, "cachemaxobjectsize", defaultCacheMaxObjectSize); err != nil {
+		return nil, err
+	}
+	if params.CacheTTL, err = parseDuration(parameters, "cachettl", defaultCacheTTL); err != nil {
+		return nil, err
+	}
+
+	if params.Dedup, err = parseBool(parameters, "dedup", false); err != nil {
+		return nil, err
+	}
+	dedupChunkSize, err := parseInt(parameters, "dedupchunksize", 0)
+	if err != nil {
+		return nil, err
+	}
+	params.DedupChunkSize = int(dedupChunkSize)
+	if v, ok := parameters["compression"]; ok {
+		params.Compression = fmt.Sprint(v)
+	}
+
+	if v, ok := parameters["encryptionkey"]; ok {
+		params.EncryptionKey = fmt.Sprint(v)
+	}
+	if v, ok := parameters["encryptionkeyfile"]; ok {
+		params.EncryptionKeyFile = fmt.Sprint(v)
+	}
+	if params.EnvelopeEncryption, err = parseBool(parameters, "envelopeencryption", false); err != nil {
+		return nil, err
+	}
+
+	chunkSize, err := parseInt(parameters, "chunksize", defaultChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	params.ChunkSize = int(chunkSize)
+
+	writeBufferSize, err := parseInt(parameters, "writebuffersize", defaultWriteBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	params.WriteBufferSize = int(writeBufferSize)
+
+	replicas, err := parseInt(parameters, "replicas", 1)
+	if err != nil {
+		return nil, err
+	}
+	params.Replicas = int(replicas)
+	if v, ok := parameters["placementcluster"]; ok {
+		params.PlacementCluster = fmt.Sprint(v)
+	}
+	if v, ok := parameters["placementtags"]; ok {
+		switch v := v.(type) {
+		case []interface{}:
+			params.PlacementTags = make([]string, len(v))
+			for i := range v {
+				params.PlacementTags[i] = fmt.Sprint(v[i])
+			}
+		default:
+			params.PlacementTags = strings.Split(fmt.Sprint(v), ",")
+		}
+	}
+	if v, ok := parameters["storage"]; ok {
+		params.Storage = fmt.Sprint(v)
+	}
+
+	maxConcurrency, err := parseInt(parameters, "maxconcurrency", defaultMaxConcurrency)
+	if err != nil {
+		return nil, err
+	}
+	params.MaxConcurrency = int(maxConcurrency)
+
+	uploadConcurrency, err := parseInt(parameters, "uploadconcurrency", 1)
+	if err != nil {
+		return nil, err
+	}
+	params.UploadConcurrency = int(uploadConcurrency)
+
+	deleteConcurrency, err := parseInt(parameters, "deleteconcurrency", defaultDeleteConcurrency)
+	if err != nil {
+		return nil, err
+	}
+	params.DeleteConcurrency = int(deleteConcurrency)
+
+	readAhead, err := parseInt(parameters, "readahead", 0)
+	if err != nil {
+		return nil, err
+	}
+	params.ReadAhead = int(readAhead)
+
+	if params.APITimeout, err = parseDuration(parameters, "apitimeout", 0); err != nil {
+		return nil, err
+	}
+	if params.TransferTimeout, err = parseDuration(parameters, "transfertimeout", defaultTransferTimeout); err != nil {
+		return nil, err
+	}
+	maxRetries, err := parseInt(parameters, "maxretries", defaultMaxRetries)
+	if err != nil {
+		return nil, err
+	}
+	params.MaxRetries = int(maxRetries)
+	if params.RetryBackoff, err = parseDuration(parameters, "retrybackoff", defaultRetryBackoff); err != nil {
+		return nil, err
+	}
+	breakerThreshold, err := parseInt(parameters, "breakerthreshold", 0)
+	if err != nil {
+		return nil, err
+	}
+	params.BreakerThreshold = int(breakerThreshold)
+	if params.BreakerCooldown, err = parseDuration(parameters, "breakercooldown", defaultBreakerCooldown); err != nil {
+		return nil, err
+	}
+
+	if params.PurgeInterval, err = parseDuration(parameters, "purgeinterval", 0); err != nil {
+		return nil, err
+	}
+	if params.PurgeAge, err = parseDuration(parameters, "purgeage", defaultPurgeAge); err != nil {
+		return nil, err
+	}
+	if params.PurgeDryRun, err = parseBool(parameters, "purgedryrun", false); err != nil {
+		return nil, err
+	}
+	if params.ScrubInterval, err = parseDuration(parameters, "scrubinterval", 0); err != nil {
+		return nil, err
+	}
+	if params.ScrubRate, err = parseInt(parameters, "scrubrate", 0); err != nil {
+		return nil, err
+	}
+	if params.ScrubQuarantine, err = parseBool(parameters, "scrubquarantine", false); err != nil {
+		return nil, err
+	}
+	if params.BackupInterval, err = parseDuration(parameters, "backupinterval", 0); err != nil {
+		return nil, err
+	}
+	if v, ok := parameters["backupdir"]; ok {
+		params.BackupDir = fmt.Sprint(v)
+	}
+	backupRetain, err := parseInt(parameters, "backupretain", defaultBackupRetain)
+	if err != nil {
+		return nil, err
+	}
+	params.BackupRetain = int(backupRetain)
+	if params.UploadTTL, err = parseDuration(parameters, "uploadttl", 0); err != nil {
+		return nil, err
+	}
+	if params.StoreMaxBytes, err = parseInt(parameters, "storemaxbytes", 0); err != nil {
+		return nil, err
+	}
+	if params.StoreMaxAge, err = parseDuration(parameters, "storemaxage", 0); err != nil {
+		return nil, err
+	}
+	if params.WriteLockTTL, err = parseDuration(parameters, "writelockttl", 0); err != nil {
+		return nil, err
+	}
+	if params.WriteLockWait, err = parseDuration(parameters, "writelockwait", 0); err != nil {
+		return nil, err
+	}
+
+	if params.HealthCheckInterval, err = parseDuration(parameters, "healthcheckinterval", 0); err != nil {
+		return nil, err
+	}
+	healthCheckThreshold, err := parseInt(parameters, "healthcheckthreshold", defaultHealthCheckThreshold)
+	if err != nil {
+		return nil, err
+	}
+	params.HealthCheckThreshold = int(healthCheckThreshold)
+	if params.HealthCheckMaxLatency, err = parseDuration(parameters, "healthcheckmaxlatency", defaultHealthCheckMaxLatency); err != nil {
+		return nil, err
+	}
+
+	if v, ok := parameters["shardprefixes"]; ok {
+		switch v := v.(type) {
+		case []interface{}:
+			params.ShardPrefixes = make([]string, len(v))
+			for i := range v {
+				params.ShardPrefixes[i] = fmt.Sprint(v[i])
+			}
+		default:
+			params.ShardPrefixes = strings.Split(fmt.Sprint(v), ",")
+		}
+	}
+
+	if v, ok := parameters["tenants"]; ok {
+		if params.Tenants, err = parseTenants(v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := parameters["tenantprefix"]; ok {
+		params.TenantPrefix = fmt.Sprint(v)
+	}
+
+	if v, ok := parameters["quotaprefixes"]; ok {
+		switch v := v.(type) {
+		case []interface{}:
+			params.QuotaPrefixes = make([]string, len(v))
+			for i := range v {
+				params.QuotaPrefixes[i] = fmt.Sprint(v[i])
+			}
+		default:
+			params.QuotaPrefixes = strings.Split(fmt.Sprint(v), ",")
+		}
+	}
+	if params.Quota, err = parseInt(parameters, "quota", 0); err != nil {
+		return nil, err
+	}
+
+	if params.HashedNames, err = parseBool(parameters, "hashednames", false); err != nil {
+		return nil, err
+	}
+
+	if params.ReadOnly, err = parseBool(parameters, "readonly", false); err != nil {
+		return nil, err
+	}
+
+	if params.KVLinks, err = parseBool(parameters, "kvlinks", false); err != nil {
+		return nil, err
+	}
+
+	if params.VerifyReads, err = parseBool(parameters, "verifyreads", false); err != nil {
+		return nil, err
+	}
+
+	if params.Tracing, err = parseBool(parameters, "tracing", false); err != nil {
+		return nil, err
 	}
 
 	return New(ctx, params)
 }
+
+func parseInt(parameters map[string]interface{}, key string, defaultValue int64) (int64, error) {
+	v, ok := parameters[key]
+	if !ok || v == nil {
+		return defaultValue, nil
+	}
+
+	switch v := v.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint64:
+		return int64(v), nil
+	case string:
+		i, err := strconv.ParseInt(v, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("the %s parameter should be an integer, got: %q", key, v)
+		}
+		return i, nil
+	default:
+		return 0, fmt.Errorf("the %s parameter should be an integer, got: %#v", key, v)
+	}
+}
+
+func parseBool(parameters map[string]interface{}, key string, defaultValue bool) (bool, error) {
+	v, ok := parameters[key]
+	if !ok || v == nil {
+		return defaultValue, nil
+	}
+
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("the %s parameter should be a boolean, got: %q", key, v)
+		}
+		return b, nil
+	default:
+		return false, fmt.Errorf("the %s parameter should be a boolean, got: %#v", key, v)
+	}
+}
+
+// parseTenants parses the credentials of every tenant, by its name.
+func parseTenants(v interface{}) (map[string]TenantParameters, error) {
+	tenants, err := parseMap("tenants", v)
+	if err != nil {
+		return nil, err
+	}
+	parsed := make(map[string]TenantParameters, len(tenants))
+	for name, v := range tenants {
+		fields, err := parseMap("tenants."+name, v)
+		if err != nil {
+			return nil, err
+		}
+		var tenant TenantParameters
+		for key, field := range map[string]*string{
+			"credentials": &tenant.Credentials,
+			"jwt":         &tenant.JWT,
+			"nkeyseed":    &tenant.NKeySeed,
+			"username":    &tenant.Username,
+			"password":    &tenant.Password,
+			"token":       &tenant.Token,
+		} {
+			if v, ok := fields[key]; ok {
+				*field = fmt.Sprint(v)
+			}
+		}
+		parsed[name] = tenant
+	}
+	return parsed, nil
+}
+
+// parseMap accepts the maps that configuration files are decoded into,
+// whose keys may not be strings.
+func parseMap(key string, v interface{}) (map[string]interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, v := range v {
+			m[fmt.Sprint(k)] = v
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("the %s parameter should be a map, got: %#v", key, v)
+	}
+}
+
+// parseDuration accepts either a Go duration string, or an integer number of seconds.
+func parseDuration(parameters map[string]interface{}, key string, defaultValue time.Duration) (time.Duration, error) {
+	v, ok := parameters[key]
+	if !ok || v == nil {
+		return defaultValue, nil
+	}
+
+	switch v := v.(type) {
+	case time.Duration:
+		return v, nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("the %s parameter should be a duration, got: %q", key, v)
+		}
+		return d, nil
+	default:
+		return 0, fmt.Errorf("the %s parameter should be a duration, got: %#v", key, v)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultPurgeAge = 7 * 24 * time.Hour
+
+// purgedParts counts the orphaned parts that were purged, or that would
+// have been with a dry run.
+var purgedParts = prometheus.StorageNamespace.NewLabeledCounter("nats_purged_parts", "The number of orphaned parts purged by the NATS storage driver", "dry_run")
+
+// PurgeUploads deletes the parts of uploads that were never committed
+// or cancelled, for example because the registry was stopped halfway
+// through. Only parts older than olderThan are deleted, so that uploads
+// which are still in progress are left alone.
+func (d *Driver) PurgeUploads(ctx context.Context, olderThan time.Duration) error {
+	if d.driver.readOnly {
+		return ReadOnlyError{Op: "PurgeUploads"}
+	}
+	_, err := d.driver.purgeUploads(ctx, olderThan, false)
+	return err
+}
+
+// OrphanedParts returns the names of the parts that PurgeUploads would
+// delete, without deleting them.
+func (d *Driver) OrphanedParts(ctx context.Context, olderThan time.Duration) ([]string, error) {
+	return d.driver.purgeUploads(ctx, olderThan, true)
+}
+
+// purgeUploads deletes the orphaned parts older than olderThan, unless
+// dryRun is set, and returns their names.
+func (d *driver) purgeUploads(ctx context.Context, olderThan time.Duration, dryRun bool) ([]string, error) {
+	stores, err := d.stores.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	purged := make([]string, 0)
+	errs := make([]error, 0)
+	for _, obs := range stores {
+		names, storeErrs := purgeStore(ctx, obs, cutoff, dryRun)
+		purged = append(purged, names...)
+		errs = append(errs, storeErrs...)
+	}
+	purgedParts.WithValues(strconv.FormatBool(dryRun)).Inc(float64(len(purged)))
+
+	if len(errs) > 0 {
+		errs = append([]error{errors.New("failed to purge uploads")}, errs...)
+		return purged, errors.Join(errs...)
+	}
+
+	return purged, nil
+}
+
+// purgePeriodically purges the orphaned parts older than age every interval,
+// for as long as the registry runs. With dryRun, they are only logged.
+func (d *driver) purgePeriodically(ctx context.Context, interval, age time.Duration, dryRun bool) {
+	logger := logrus.WithField("driver", driverName)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := d.purgeUploads(ctx, age, dryRun)
+		if err != nil {
+			logger.WithError(err).Error("failed to purge orphaned parts")
+		}
+		if dryRun {
+			for _, name := range purged {
+				logger.WithField("part", name).Info("would purge orphaned part")
+			}
+		} else if len(purged) > 0 {
+			logger.WithField("parts", len(purged)).Info("purged orphaned parts")
+		}
+	}
+}
+
+// purgeStore deletes the orphaned parts in obs that were written before
+// cutoff, unless dryRun is set, and returns their names. Parts are always
+// kept in the same store as the object that they belong to.
+func purgeStore(ctx context.Context, obs jetstream.ObjectStore, cutoff time.Time, dryRun bool) ([]string, []error) {
+	objects, err := obs.List(ctx)
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	byName := make(map[string]*jetstream.ObjectInfo, len(objects))
+	for _, info := range objects {
+		byName[info.Name] = info
+	}
+
+	var purged []string
+	var errs []error
+	for _, info := range objects {
+		if !info.ModTime.Before(cutoff) {
+			continue
+		}
+
+		parent, parts, index, ok := partOf(info, byName)
+		if !ok || ownedBy(parent, parts, index) {
+			continue
+		}
+
+		if dryRun {
+			purged = append(purged, info.Name)
+			continue
+		}
+		if err := obs.Delete(ctx, info.Name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		purged = append(purged, info.Name)
+	}
+	return purged, errs
+}
+
+// partOf reports whether info is a part of multipart content, and returns
+// the object that it belongs to, if it still exists, the name that it is
+// stored under, and its index.
+func partOf(info *jetstream.ObjectInfo, byName map[string]*jetstream.ObjectInfo) (*jetstream.ObjectInfo, string, int, bool) {
+	i := strings.LastIndex(info.Name, sep)
+	if i == -1 {
+		return nil, "", 0, false
+	}
+	index, err := strconv.Atoi(info.Name[i+1:])
+	if err != nil || index < 0 {
+		return nil, "", 0, false
+	}
+
+	parts := info.Name[:i]
+	// Staged parts belong to the object that they were staged for.
+	owner := parts
+	if j := strings.LastIndex(parts, sep); j != -1 && strings.HasPrefix(parts[j+1:], stagedPrefix) {
+		owner = parts[:j]
+	}
+	parent := byName[owner]
+	// Parts written before they were marked can only be recognized
+	// by the multipart object that they belong to.
+	if info.Headers.Get(headerMultipartPart) == "" && (parent == nil || !isMultipart(parent)) {
+		return nil, "", 0, false
+	}
+
+	return parent, parts, index, true
+}
+
+// ownedBy reports whether the part at index of the parts stored under
+// name is listed by the multipart object parent.
+func ownedBy(parent *jetstream.ObjectInfo, name string, index int) bool {
+	if parent == nil || !isMultipart(parent) || multipartName(parent) != name {
+		return false
+	}
+	parts, err := strconv.Atoi(parent.Headers.Get(headerMultipartCount))
+	if err != nil {
+		// Better to leak a part than to delete committed content.
+		return true
+	}
+	return index < parts
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestPurgeUploads(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	committed := bytes.Repeat([]byte("a"), 32)
+	writeParts(t, obs, "/committed", committed, false, true)
+	// An upload that was abandoned halfway through.
+	writeParts(t, obs, "/abandoned", bytes.Repeat([]byte("b"), 32), false, false)
+	// An append to committed content that was abandoned.
+	writeParts(t, obs, "/appended", bytes.Repeat([]byte("c"), 16), false, true)
+	writeParts(t, obs, "/appended", bytes.Repeat([]byte("d"), 32), true, false)
+	// Regular files that happen to look like parts.
+	if err := d.PutContent(ctx, "/regular/0", []byte("regular")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is old enough to be purged yet.
+	if err := d.PurgeUploads(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := objectNames(t, obs); len(got) != 10 {
+		t.Errorf("expected recent parts to be left alone, got: %v", got)
+	}
+
+	if err := d.PurgeUploads(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"/appended", "/appended/0",
+		"/committed", "/committed/0", "/committed/1",
+		"/regular/0",
+	}
+	got := objectNames(t, obs)
+	if len(got) != len(want) {
+		t.Fatalf("expected only orphaned parts to be purged, got: %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected only orphaned parts to be purged, got: %v", got)
+		}
+	}
+
+	content, err := d.GetContent(ctx, "/committed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(committed, content) {
+		t.Error("expected committed content to be intact")
+	}
+}
+
+func TestPurgeUploadsEmpty(t *testing.T) {
+	ns := newTestServer(t)
+	d, err := New(context.Background(), &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.PurgeUploads(context.Background(), 0); err != nil {
+		t.Errorf("expected purging an empty store to succeed, got: %v", err)
+	}
+}
+
+func TestOrphanedParts(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	writeParts(t, obs, "/committed", bytes.Repeat([]byte("a"), 32), false, true)
+	writeParts(t, obs, "/abandoned", bytes.Repeat([]byte("b"), 32), false, false)
+	before := objectNames(t, obs)
+
+	orphans, err := d.OrphanedParts(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(orphans)
+	if strings.Join(orphans, ",") != "/abandoned/0,/abandoned/1" {
+		t.Errorf("expected the parts of the abandoned upload, got: %v", orphans)
+	}
+	if after := objectNames(t, obs); len(after) != len(before) {
+		t.Errorf("expected a dry run to leave every object alone, got: %v", after)
+	}
+}
+
+func TestPurgePeriodically(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	if _, err := New(ctx, &Parameters{
+		ClientURL:     ns.ClientURL(),
+		PurgeInterval: 100 * time.Millisecond,
+		PurgeAge:      time.Nanosecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	obs := newTestObjectStore(t, ns)
+
+	writeParts(t, obs, "/committed", bytes.Repeat([]byte("a"), 32), false, true)
+	writeParts(t, obs, "/abandoned", bytes.Repeat([]byte("b"), 32), false, false)
+
+	eventually(t, 5*time.Second, func() error {
+		if got := objectNames(t, obs); strings.Join(got, ",") != "/committed,/committed/0,/committed/1" {
+			return fmt.Errorf("expected orphaned parts to be purged, got: %v", got)
+		}
+		return nil
+	})
+}
+
+func TestInvalidPurgeInterval(t *testing.T) {
+	if _, err := New(context.Background(), &Parameters{PurgeInterval: -time.Second}); err == nil {
+		t.Error("expected a negative purge interval to be rejected")
+	}
+}
+
+// writeParts writes content to path in parts of 16 bytes.
+func writeParts(t *testing.T, obs jetstream.ObjectStore, path string, content []byte, append, commit bool) {
+	ctx := context.Background()
+
+	fw, err := newObjectWriter(ctx, obs, writerOptions{dedup: &deduplicator{obs: obs}}, path, append)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.partSize = 16
+
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if commit {
+		if err := fw.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func objectNames(t *testing.T, obs jetstream.ObjectStore) []string {
+	objects, err := obs.List(context.Background())
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(objects))
+	for _, info := range objects {
+		names = append(names, info.Name)
+	}
+	sort.Strings(names)
+	return names
+}
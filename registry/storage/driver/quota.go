@@ -0,0 +1,258 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	quotasStoreName = "quotas"
+	// headerQuotaKey holds the quota key that an object is charged to,
+	// when it was moved out of the paths of that key.
+	headerQuotaKey = "Cascade-Quota-Key"
+)
+
+// jsErrCodeStreamWrongLastSequence is returned when a KV entry was
+// updated by someone else since it was read.
+const jsErrCodeStreamWrongLastSequence jetstream.ErrorCode = 10071
+
+// revisionConflict reports whether err means that a KV entry was created
+// or updated by someone else since it was read, so that it is read again.
+func revisionConflict(err error) bool {
+	var apiErr *jetstream.APIError
+	return errors.Is(err, jetstream.ErrKeyExists) || errors.As(err, &apiErr) && apiErr.ErrorCode == jsErrCodeStreamWrongLastSequence
+}
+
+// ErrorCodeQuotaExceeded is the error code of a QuotaExceededError.
+var ErrorCodeQuotaExceeded = errcode.Register("cascade", errcode.ErrorDescriptor{
+	Value:          "QUOTA_EXCEEDED",
+	Message:        "storage quota exceeded",
+	Description:    "Storing the content would use more storage than the quota of the repository allows.",
+	HTTPStatusCode: http.StatusRequestEntityTooLarge,
+})
+
+// QuotaExceededError is returned when content is written to a path whose
+// quota key would then use more than the quota. It implements
+// errcode.ErrorCoder, so that it is served as 413 Request Entity Too Large
+// wherever the registry reports it as it is. Handlers that wrap it as an
+// unknown error still serve 500 Internal Server Error. Like any other error
+// of a storage driver, the operations of the Driver return it as the Detail
+// of a storagedriver.Error, except for the writes of a FileWriter.
+type QuotaExceededError struct {
+	Path  string
+	Key   string
+	Quota int64
+	Usage int64
+}
+
+func (e QuotaExceededError) Error() string {
+	return fmt.Sprintf("writing %s would exceed the quota of %d bytes of %s, which uses %d bytes", e.Path, e.Quota, e.Key, e.Usage)
+}
+
+func (e QuotaExceededError) ErrorCode() errcode.ErrorCode {
+	return ErrorCodeQuotaExceeded
+}
+
+// quotas keeps track of the bytes stored under every child of its
+// prefixes, which is the quota key of the paths below it, and rejects
+// content that would make a key use more than the quota. Usage is counted
+// in a KV bucket, so that it is shared by every registry.
+//
+// Content that is moved out of the paths of its key stays charged to it,
+// like uploads that are moved to the blobs of the registry, until it
+// is deleted. Usage is checked before content is stored and only counted
+// after, so concurrent writes to the same key may exceed the quota a bit.
+//
+// A nil *quotas is valid, and counts nothing.
+type quotas struct {
+	kv       jetstream.KeyValue
+	prefixes []string
+	quota    int64
+}
+
+func newQuotas(ctx context.Context, js jetstream.JetStream, bucketPrefix string, replicas int, placement *jetstream.Placement, storage jetstream.StorageType, prefixes []string, quota int64) (*quotas, error) {
+	if quota == 0 {
+		return nil, nil
+	}
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      bucketName(bucketPrefix, quotasStoreName),
+		Description: "Bytes stored under every quota key of the registry",
+		Replicas:    replicas,
+		Placement:   placement,
+		Storage:     storage,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure quota store exists: %w", err)
+	}
+	return &quotas{
+		kv:       kv,
+		prefixes: prefixes,
+		quota:    quota,
+	}, nil
+}
+
+// keyOf returns the quota key of path, which is empty when it has none.
+func (q *quotas) keyOf(path string) string {
+	if q == nil {
+		return ""
+	}
+	return childOf(q.prefixes, path)
+}
+
+// charge returns the quota key that the object described by info is
+// charged to, along with its size. Parts are not charged on their own,
+// the object that lists them is charged with all of their content.
+func (q *quotas) charge(info *jetstream.ObjectInfo) (string, int64, error) {
+	if q == nil || info == nil || info.Headers.Get(headerMultipartPart) != "" {
+		return "", 0, nil
+	}
+	key := info.Headers.Get(headerQuotaKey)
+	if key == "" {
+		key = q.keyOf(objectPath(info))
+	}
+	if key == "" {
+		return "", 0, nil
+	}
+	size, err := fileSize(info)
+	return key, size, err
+}
+
+// usage returns the amount of bytes stored under key.
+func (q *quotas) usage(ctx context.Context, key string) (int64, error) {
+	entry, err := q.kv.Get(ctx, quotaEntry(key))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get usage of %s: %w", key, err)
+	}
+	return strconv.ParseInt(string(entry.Value()), 10, 64)
+}
+
+// check returns a QuotaExceededError when storing size more bytes at
+// path would exceed the quota.
+func (q *quotas) check(ctx context.Context, path string, size int64) error {
+	key := q.keyOf(path)
+	if key == "" {
+		return nil
+	}
+	usage, err := q.usage(ctx, key)
+	if err != nil {
+		return err
+	}
+	return q.exceeded(path, key, usage, size)
+}
+
+// exceeded returns a QuotaExceededError when adding size bytes to the
+// usage of key would exceed the quota.
+func (q *quotas) exceeded(path, key string, usage, size int64) error {
+	if usage+size > q.quota {
+		return QuotaExceededError{Path: path, Key: key, Quota: q.quota, Usage: usage}
+	}
+	return nil
+}
+
+// add adds delta bytes to the usage of key. Concurrent updates by other
+// writers are retried, so that none of them are lost.
+func (q *quotas) add(ctx context.Context, key string, delta int64) error {
+	if q == nil || key == "" || delta == 0 {
+		return nil
+	}
+	name := quotaEntry(key)
+	for {
+		entry, err := q.kv.Get(ctx, name)
+		switch {
+		case errors.Is(err, jetstream.ErrKeyNotFound):
+			_, err = q.kv.Create(ctx, name, formatUsage(delta))
+		case err != nil:
+			return fmt.Errorf("failed to get usage of %s: %w", key, err)
+		default:
+			var usage int64
+			if usage, err = strconv.ParseInt(string(entry.Value()), 10, 64); err != nil {
+				return fmt.Errorf("failed to parse usage of %s: %w", key, err)
+			}
+			_, err = q.kv.Update(ctx, name, formatUsage(usage+delta), entry.Revision())
+		}
+
+		if revisionConflict(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update usage of %s: %w", key, err)
+		}
+		return nil
+	}
+}
+
+// replaced counts that size bytes were stored at path, in place of the
+// object described by previous, if any.
+func (q *quotas) replaced(ctx context.Context, previous *jetstream.ObjectInfo, path string, size int64) error {
+	if q == nil {
+		return nil
+	}
+	if err := q.released(ctx, previous); err != nil {
+		return err
+	}
+	return q.add(ctx, q.keyOf(path), size)
+}
+
+// released counts that the object described by info was deleted.
+func (q *quotas) released(ctx context.Context, info *jetstream.ObjectInfo) error {
+	key, size, err := q.charge(info)
+	if err != nil {
+		return err
+	}
+	return q.add(ctx, key, -size)
+}
+
+// quotaEntry returns the name of the KV entry of key. Paths may contain
+// characters that are not allowed in KV keys, so the path is hashed.
+func quotaEntry(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// formatUsage formats usage as a KV value. It never drops below zero,
+// which it can only do when content was stored before quotas were enabled.
+func formatUsage(usage int64) []byte {
+	return []byte(strconv.FormatInt(max(usage, 0), 10))
+}
+
+// QuotaUsage returns the amount of bytes stored under the quota key of
+// path, along with the key.
+func (d *Driver) QuotaUsage(ctx context.Context, path string) (key string, usage int64, err error) {
+	if d.driver.quotas == nil {
+		return "", 0, errors.New("quotas are not enabled")
+	}
+	path, err = normalizePath(path)
+	if err != nil {
+		return "", 0, err
+	}
+	key = d.driver.quotas.keyOf(path)
+	if key == "" {
+		return "", 0, fmt.Errorf("path %s is not under any of the quota prefixes", path)
+	}
+	usage, err = d.driver.quotas.usage(ctx, key)
+	return key, usage, err
+}
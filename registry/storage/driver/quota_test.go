@@ -0,0 +1,161 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:     ns.ClientURL(),
+		QuotaPrefixes: []string{testRepositories},
+		Quota:         100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme := testRepositories + "/acme"
+	other := testRepositories + "/other"
+
+	usage := func(path string, expected int64) {
+		t.Helper()
+		if _, got, err := d.QuotaUsage(ctx, path); err != nil || got != expected {
+			t.Errorf("expected a usage of %d bytes for %s, got %d: %v", expected, path, got, err)
+		}
+	}
+
+	if err := d.PutContent(ctx, acme+"/app/_manifests/link", bytes.Repeat([]byte("a"), 60)); err != nil {
+		t.Fatal(err)
+	}
+	usage(acme, 60)
+
+	err = d.PutContent(ctx, acme+"/app/_layers/link", bytes.Repeat([]byte("a"), 50))
+	quotaErr, ok := asQuotaExceeded(err)
+	if !ok || quotaErr.Key != acme || quotaErr.Usage != 60 {
+		t.Fatalf("expected the quota to be exceeded, got: %v", err)
+	}
+	if code := quotaErr.ErrorCode().Descriptor().HTTPStatusCode; code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the quota error to be served as %d, got %d", http.StatusRequestEntityTooLarge, code)
+	}
+	// Other repositories have a quota of their own.
+	if err := d.PutContent(ctx, other+"/app/_layers/link", bytes.Repeat([]byte("a"), 50)); err != nil {
+		t.Fatal(err)
+	}
+	usage(other, 50)
+
+	// Writers are stopped as soon as they exceed the quota.
+	fw, err := d.Writer(ctx, acme+"/app/_uploads/rejected/data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(bytes.Repeat([]byte("a"), 30)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(bytes.Repeat([]byte("a"), 20)); !errors.As(err, &QuotaExceededError{}) {
+		t.Errorf("expected the quota to be exceeded, got: %v", err)
+	}
+	if err := fw.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	usage(acme, 60)
+
+	// Appending only counts the appended content.
+	upload := acme + "/app/_uploads/accepted/data"
+	for i := 0; i < 2; i++ {
+		fw, err := d.Writer(ctx, upload, i > 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(bytes.Repeat([]byte("a"), 15)); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage(acme, 90)
+
+	// Uploads that are moved to the blobs stay charged to the repository,
+	// until they are deleted.
+	blob := "/docker/registry/v2/blobs/sha256/aa/aaaa/data"
+	if err := d.Move(ctx, upload, blob); err != nil {
+		t.Fatal(err)
+	}
+	usage(acme, 90)
+	if err := d.Delete(ctx, blob); err != nil {
+		t.Fatal(err)
+	}
+	usage(acme, 60)
+
+	// Content that is moved to another repository is charged to it.
+	if _, ok := asQuotaExceeded(d.Move(ctx, other+"/app/_layers/link", acme+"/app/_layers/link")); !ok {
+		t.Error("expected the quota to be exceeded")
+	}
+	if err := d.Delete(ctx, acme); err != nil {
+		t.Fatal(err)
+	}
+	usage(acme, 0)
+	if err := d.Move(ctx, other+"/app/_layers/link", acme+"/app/_layers/link"); err != nil {
+		t.Fatal(err)
+	}
+	usage(acme, 50)
+	usage(other, 0)
+
+	if _, _, err := d.QuotaUsage(ctx, "/docker/registry/v2/blobs"); err == nil {
+		t.Error("expected paths outside of the quota prefixes to have no usage")
+	}
+}
+
+// detailOf returns the error that the Driver returned err for, which it
+// wraps in a storagedriver.Error like every storage driver does.
+func detailOf(err error) error {
+	var driverErr storagedriver.Error
+	if errors.As(err, &driverErr) {
+		return driverErr.Detail
+	}
+	return err
+}
+
+// asQuotaExceeded returns the QuotaExceededError that the Driver returned err for.
+func asQuotaExceeded(err error) (QuotaExceededError, bool) {
+	var quotaErr QuotaExceededError
+	ok := errors.As(detailOf(err), &quotaErr)
+	return quotaErr, ok
+}
+
+func TestInvalidQuota(t *testing.T) {
+	ns := newTestServer(t)
+
+	for name, params := range map[string]*Parameters{
+		"negative":    {Quota: -1, QuotaPrefixes: []string{testRepositories}},
+		"no prefixes": {Quota: 100},
+	} {
+		t.Run(name, func(t *testing.T) {
+			params.ClientURL = ns.ClientURL()
+			if _, err := New(context.Background(), params); err == nil {
+				t.Error("expected an invalid quota to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// ReadOnlyError is returned by every operation that would change the
+// storage while the driver is read-only. Like QuotaExceededError, it
+// implements errcode.ErrorCoder, and is served as 503 Service Unavailable
+// wherever the registry reports it as it is.
+type ReadOnlyError struct {
+	Op   string
+	Path string
+}
+
+func (e ReadOnlyError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("cannot %s: the storage is read-only", e.Op)
+	}
+	return fmt.Sprintf("cannot %s %s: the storage is read-only", e.Op, e.Path)
+}
+
+func (e ReadOnlyError) ErrorCode() errcode.ErrorCode {
+	return errcode.ErrorCodeUnavailable
+}
+
+// readOnlyDriver rejects the storage operations that change the storage,
+// and passes the others through.
+type readOnlyDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (rd *readOnlyDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	return ReadOnlyError{Op: "PutContent", Path: path}
+}
+
+func (rd *readOnlyDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	return nil, ReadOnlyError{Op: "Writer", Path: path}
+}
+
+func (rd *readOnlyDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return ReadOnlyError{Op: "Move", Path: sourcePath}
+}
+
+func (rd *readOnlyDriver) Delete(ctx context.Context, path string) error {
+	return ReadOnlyError{Op: "Delete", Path: path}
+}
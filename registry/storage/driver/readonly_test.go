@@ -0,0 +1,73 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	rw, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := d.GetContent(ctx, "/file"); err != nil || string(content) != "content" {
+		t.Errorf("expected content to be readable, got: %q, %v", content, err)
+	}
+	if _, err := d.Stat(ctx, "/file"); err != nil {
+		t.Errorf("expected content to be stat-able, got: %v", err)
+	}
+
+	mutations := map[string]func() error{
+		"PutContent": func() error { return d.PutContent(ctx, "/file", []byte("changed")) },
+		"Writer": func() error {
+			_, err := d.Writer(ctx, "/file", true)
+			return err
+		},
+		"Move":         func() error { return d.Move(ctx, "/file", "/moved") },
+		"Delete":       func() error { return d.Delete(ctx, "/file") },
+		"PurgeUploads": func() error { return d.PurgeUploads(ctx, time.Hour) },
+		"Repair": func() error {
+			_, err := d.Check(ctx, CheckOptions{Repair: true})
+			return err
+		},
+	}
+	for name, mutate := range mutations {
+		if err := mutate(); !errors.As(detailOf(err), &ReadOnlyError{}) {
+			t.Errorf("%s: expected a read-only error, got: %v", name, err)
+		}
+	}
+	if content, err := d.GetContent(ctx, "/file"); err != nil || string(content) != "content" {
+		t.Errorf("expected content to be left as it was, got: %q, %v", content, err)
+	}
+
+	// The health check does not write its probe.
+	if err := d.HealthCheck(ctx); err != nil {
+		t.Errorf("expected the read-only storage to be healthy, got: %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	defaultTransferTimeout = time.Minute
+	defaultMaxRetries      = 3
+	defaultRetryBackoff    = 100 * time.Millisecond
+	// maxRetryBackoff caps the wait between retries, which doubles after every retry.
+	maxRetryBackoff = 10 * time.Second
+)
+
+// JetStream API errors that are returned while a stream or the
+// JetStream cluster elects a new leader, or while peers are offline.
+const (
+	jsErrCodeClusterNotAvailable jetstream.ErrorCode = 10008
+	jsErrCodeClusterNotLeader    jetstream.ErrorCode = 10009
+	jsErrCodeStreamOffline       jetstream.ErrorCode = 10118
+)
+
+// retries counts the storage operations that were retried after a transient error.
+var retries = prometheus.StorageNamespace.NewLabeledCounter("nats_retries", "The number of storage operations retried by the NATS storage driver", "operation")
+
+// retryPolicy retries storage operations that fail with a transient error,
+// like a timeout or a leader election, instead of failing the registry
+// request. A nil policy runs every operation once, without a deadline.
+type retryPolicy struct {
+	// maxRetries is the amount of times that an operation is retried.
+	maxRetries int
+	// backoff is the wait before the first retry.
+	backoff time.Duration
+	// apiTimeout is the deadline of every attempt of an operation that
+	// does not store content. Zero means none, in which case every
+	// JetStream API request times out on its own after five seconds.
+	apiTimeout time.Duration
+	// transferTimeout is the deadline of every attempt of an operation that
+	// stores content. Without one, storing an object waits forever for
+	// acknowledgements that were lost when the stream elected a new leader.
+	transferTimeout time.Duration
+}
+
+// request runs f until it succeeds, fails with an error that is not
+// transient, or runs out of retries. Every attempt is given the API timeout.
+func (p *retryPolicy) request(ctx context.Context, op string, f func(context.Context) error) error {
+	if p == nil {
+		return f(ctx)
+	}
+	return p.run(ctx, op, p.apiTimeout, f)
+}
+
+// transfer is like request, but gives every attempt the transfer timeout.
+func (p *retryPolicy) transfer(ctx context.Context, op string, f func(context.Context) error) error {
+	if p == nil {
+		return f(ctx)
+	}
+	return p.run(ctx, op, p.transferTimeout, f)
+}
+
+// retry is like request, but without a deadline for every attempt. It is
+// used for opening readers, which keep using the context after f returns.
+func (p *retryPolicy) retry(ctx context.Context, op string, f func(context.Context) error) error {
+	if p == nil {
+		return f(ctx)
+	}
+	return p.run(ctx, op, 0, f)
+}
+
+// once runs f a single time, with the API timeout. It is used for
+// operations that are not idempotent, which may have taken effect even
+// though they failed, so that running them again would not be safe.
+func (p *retryPolicy) once(ctx context.Context, f func(context.Context) error) error {
+	if p == nil {
+		return f(ctx)
+	}
+	return attempt(ctx, p.apiTimeout, f)
+}
+
+func (p *retryPolicy) run(ctx context.Context, op string, timeout time.Duration, f func(context.Context) error) error {
+	backoff := p.backoff
+	for retry := 0; ; retry++ {
+		err := attempt(ctx, timeout, f)
+		if err == nil || retry == p.maxRetries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+		retries.WithValues(op).Inc(1)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// attempt runs f once, with a deadline of timeout unless it is zero.
+func attempt(ctx context.Context, timeout time.Duration, f func(context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return f(ctx)
+}
+
+// isTransient reports whether err is likely to pass when the operation
+// that it was returned by is retried. An attempt that ran out of time
+// while the operation as a whole did not is transient as well.
+func isTransient(err error) bool {
+	var apiErr *jetstream.APIError
+	switch {
+	case errors.Is(err, nats.ErrTimeout),
+		errors.Is(err, jetstream.ErrNoHeartbeat),
+		errors.Is(err, nats.ErrNoResponders),
+		errors.Is(err, jetstream.ErrNoStreamResponse),
+		errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &apiErr):
+		switch apiErr.ErrorCode {
+		case jsErrCodeClusterNotAvailable, jsErrCodeClusterNotLeader, jsErrCodeStreamOffline:
+			return true
+		}
+	}
+	return false
+}
+
+// retryingDriver retries the storage operations that fail with a transient
+// error, as long as they are idempotent: GetContent, Reader, Stat and List.
+// The others may have taken effect even though they failed, like a Move
+// that was halfway done, so running them again is not safe. Delete is only
+// given its deadline, and retries the deletion of every object on its own.
+// PutContent and the FileWriter retry the steps that are idempotent
+// themselves, like storing the content of an object. Walk is not retried,
+// because it would call its function with the same files again, and neither
+// is the content that is streamed by readers once they are opened.
+type retryingDriver struct {
+	storagedriver.StorageDriver
+	policy *retryPolicy
+}
+
+func newRetryingDriver(next storagedriver.StorageDriver, policy *retryPolicy) *retryingDriver {
+	return &retryingDriver{
+		StorageDriver: next,
+		policy:        policy,
+	}
+}
+
+func (rd *retryingDriver) GetContent(ctx context.Context, path string) (content []byte, err error) {
+	err = rd.policy.request(ctx, "GetContent", func(ctx context.Context) error {
+		content, err = rd.StorageDriver.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+func (rd *retryingDriver) Reader(ctx context.Context, path string, offset int64) (reader io.ReadCloser, err error) {
+	err = rd.policy.retry(ctx, "Reader", func(ctx context.Context) error {
+		reader, err = rd.StorageDriver.Reader(ctx, path, offset)
+		return err
+	})
+	return reader, err
+}
+
+func (rd *retryingDriver) Stat(ctx context.Context, path string) (fi storagedriver.FileInfo, err error) {
+	err = rd.policy.request(ctx, "Stat", func(ctx context.Context) error {
+		fi, err = rd.StorageDriver.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+func (rd *retryingDriver) List(ctx context.Context, path string) (files []string, err error) {
+	err = rd.policy.request(ctx, "List", func(ctx context.Context) error {
+		files, err = rd.StorageDriver.List(ctx, path)
+		return err
+	})
+	return files, err
+}
+
+func (rd *retryingDriver) Delete(ctx context.Context, path string) error {
+	return rd.policy.once(ctx, func(ctx context.Context) error {
+		return rd.StorageDriver.Delete(ctx, path)
+	})
+}
+
+// maxIdleReads is the amount of times in a row that an idleReader
+// continues a read that received nothing.
+const maxIdleReads = 3
+
+// idleReader reads an object from its store. A read gives up when it
+// receives nothing for a while, even when the context of the read is still
+// live, for example when the server is slow to deliver chunks under load:
+// the pulls of a chunkReader expire with nats.ErrTimeout, or fail when the
+// server does not even send heartbeats, and the reads of the object store
+// time out after the JetStream API timeout. Those reads are continued a
+// few times, as long as the context is live.
+type idleReader struct {
+	jetstream.ObjectResult
+	ctx context.Context
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	for idle := 0; ; idle++ {
+		n, err := ir.ObjectResult.Read(p)
+		if isIdle(err) && ir.ctx.Err() == nil {
+			if n > 0 {
+				return n, nil
+			}
+			if idle < maxIdleReads {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+// isIdle reports whether err is returned by a read that received nothing.
+func isIdle(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, nats.ErrTimeout) || errors.Is(err, jetstream.ErrNoHeartbeat) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
@@ -0,0 +1,317 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestIsTransient(t *testing.T) {
+	for err, want := range map[error]bool{
+		nats.ErrTimeout:                                                   true,
+		jetstream.ErrNoHeartbeat:                                          true,
+		nats.ErrNoResponders:                                              true,
+		jetstream.ErrNoStreamResponse:                                     true,
+		context.DeadlineExceeded:                                          true,
+		fmt.Errorf("failed to put part: %w", nats.ErrTimeout):             true,
+		&jetstream.APIError{ErrorCode: jsErrCodeClusterNotAvailable}:      true,
+		&jetstream.APIError{ErrorCode: jsErrCodeStreamOffline}:            true,
+		&jetstream.APIError{ErrorCode: jetstream.JSErrCodeStreamNotFound}: false,
+		jetstream.ErrObjectNotFound:                                       false,
+		context.Canceled:                                                  false,
+		errors.New("invalid path"):                                        false,
+		fmt.Errorf("reading: %w", &jetstream.APIError{ErrorCode: jsErrCodeClusterNotLeader}): true,
+	} {
+		if got := isTransient(err); got != want {
+			t.Errorf("%v: expected transient to be %t, got %t", err, want, got)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	policy := &retryPolicy{
+		maxRetries: 3,
+		backoff:    time.Millisecond,
+		apiTimeout: 50 * time.Millisecond,
+	}
+
+	// failing returns a function that fails with err the first n times it is called.
+	failing := func(n int, err error) (func(context.Context) error, *int) {
+		calls := 0
+		return func(context.Context) error {
+			calls++
+			if calls <= n {
+				return err
+			}
+			return nil
+		}, &calls
+	}
+
+	f, calls := failing(2, nats.ErrTimeout)
+	if err := policy.request(ctx, "test", f); err != nil || *calls != 3 {
+		t.Errorf("expected transient errors to be retried, got %d calls: %v", *calls, err)
+	}
+
+	f, calls = failing(10, nats.ErrTimeout)
+	if err := policy.request(ctx, "test", f); !errors.Is(err, nats.ErrTimeout) || *calls != 4 {
+		t.Errorf("expected to give up after 3 retries, got %d calls: %v", *calls, err)
+	}
+
+	f, calls = failing(1, jetstream.ErrObjectNotFound)
+	if err := policy.request(ctx, "test", f); !errors.Is(err, jetstream.ErrObjectNotFound) || *calls != 1 {
+		t.Errorf("expected other errors to be returned at once, got %d calls: %v", *calls, err)
+	}
+
+	var nilPolicy *retryPolicy
+	f, calls = failing(1, nats.ErrTimeout)
+	if err := nilPolicy.request(ctx, "test", f); !errors.Is(err, nats.ErrTimeout) || *calls != 1 {
+		t.Errorf("expected a nil policy to run once, got %d calls: %v", *calls, err)
+	}
+
+	// Attempts that hang are given up on after the timeout, and retried.
+	attempts := 0
+	err := policy.request(ctx, "test", func(ctx context.Context) error {
+		attempts++
+		if attempts == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("expected a hanging attempt to be retried, got %d attempts: %v", attempts, err)
+	}
+
+	// Without a timeout, the attempt keeps using the context after it returns.
+	if err := policy.retry(ctx, "test", func(attempt context.Context) error {
+		if _, ok := attempt.Deadline(); ok {
+			return errors.New("expected no deadline")
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+
+	// Nothing is retried once the operation itself is done.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	f, calls = failing(10, nats.ErrTimeout)
+	if err := policy.request(ctx, "test", f); err == nil || *calls != 1 {
+		t.Errorf("expected a cancelled operation not to be retried, got %d calls: %v", *calls, err)
+	}
+}
+
+// flakyDriver fails every operation with a transient error the first
+// time it is called, and counts the calls of every operation.
+type flakyDriver struct {
+	storagedriver.StorageDriver
+	calls map[string]int
+}
+
+func (fd *flakyDriver) call(op string) error {
+	fd.calls[op]++
+	if fd.calls[op] == 1 {
+		return nats.ErrTimeout
+	}
+	return nil
+}
+
+func (fd *flakyDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	return nil, fd.call("GetContent")
+}
+
+func (fd *flakyDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	return fd.call("PutContent")
+}
+
+func (fd *flakyDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), fd.call("Reader")
+}
+
+func (fd *flakyDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	return nil, fd.call("Writer")
+}
+
+func (fd *flakyDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	return nil, fd.call("Stat")
+}
+
+func (fd *flakyDriver) List(ctx context.Context, path string) ([]string, error) {
+	return nil, fd.call("List")
+}
+
+func (fd *flakyDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return fd.call("Move")
+}
+
+func (fd *flakyDriver) Delete(ctx context.Context, path string) error {
+	return fd.call("Delete")
+}
+
+func TestRetryingDriver(t *testing.T) {
+	ctx := context.Background()
+	fd := &flakyDriver{calls: make(map[string]int)}
+	rd := newRetryingDriver(fd, &retryPolicy{maxRetries: 3, backoff: time.Millisecond})
+
+	ops := map[string]func() error{
+		"GetContent": func() error { _, err := rd.GetContent(ctx, "/file"); return err },
+		"PutContent": func() error { return rd.PutContent(ctx, "/file", nil) },
+		"Reader":     func() error { _, err := rd.Reader(ctx, "/file", 0); return err },
+		"Writer":     func() error { _, err := rd.Writer(ctx, "/file", false); return err },
+		"Stat":       func() error { _, err := rd.Stat(ctx, "/file"); return err },
+		"List":       func() error { _, err := rd.List(ctx, "/"); return err },
+		"Move":       func() error { return rd.Move(ctx, "/file", "/moved") },
+		"Delete":     func() error { return rd.Delete(ctx, "/file") },
+	}
+	idempotent := map[string]bool{"GetContent": true, "Reader": true, "Stat": true, "List": true}
+	for op, f := range ops {
+		err := f()
+		if idempotent[op] {
+			if err != nil || fd.calls[op] != 2 {
+				t.Errorf("%s: expected to be retried, got %d calls: %v", op, fd.calls[op], err)
+			}
+			continue
+		}
+		if !errors.Is(err, nats.ErrTimeout) || fd.calls[op] != 1 {
+			t.Errorf("%s: expected not to be retried, got %d calls: %v", op, fd.calls[op], err)
+		}
+	}
+}
+
+func TestRetryLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	servers := newTestCluster(t, 3)
+
+	var d *Driver
+	eventually(t, 20*time.Second, func() error {
+		var err error
+		d, err = New(ctx, &Parameters{
+			ClientURL:       servers[0].ClientURL(),
+			Replicas:        3,
+			TransferTimeout: 2 * time.Second,
+			MaxRetries:      10,
+		})
+		return err
+	})
+	eventually(t, 20*time.Second, func() error {
+		return d.HealthCheck(ctx)
+	})
+
+	nc, err := nats.Connect(servers[1].ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	stream := "OBJ_" + bucketName(defaultBucketPrefix, rootStoreName)
+
+	// Keep electing new stream leaders while content is pushed.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+				_, _ = nc.Request("$JS.API.STREAM.LEADER.STEPDOWN."+stream, nil, time.Second)
+			}
+		}
+	}()
+
+	for i, start := 0, time.Now(); time.Since(start) < 3*time.Second; i++ {
+		path := fmt.Sprintf("/file-%d", i)
+		content := []byte(strings.Repeat("a", i))
+		if err := d.PutContent(ctx, path, content); err != nil {
+			t.Fatalf("%s: expected the leader elections to be retried, got: %v", path, err)
+		}
+		if got, err := d.GetContent(ctx, path); err != nil || string(got) != string(content) {
+			t.Fatalf("%s: expected to read back %q, got: %q, %v", path, content, got, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestInvalidRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	for _, params := range []*Parameters{
+		{ClientURL: ns.ClientURL(), APITimeout: -time.Second},
+		{ClientURL: ns.ClientURL(), TransferTimeout: -time.Second},
+		{ClientURL: ns.ClientURL(), RetryBackoff: -time.Second},
+	} {
+		if _, err := New(ctx, params); err == nil || !strings.Contains(err.Error(), "must not be negative") {
+			t.Errorf("expected a negative timeout or backoff to be rejected, got: %v", err)
+		}
+	}
+	// Retries are disabled with a negative amount.
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.driver.retry.maxRetries != 0 || d.driver.retry.transferTimeout != defaultTransferTimeout {
+		t.Errorf("expected retries to be disabled, but not the timeout, got: %+v", d.driver.retry)
+	}
+}
+
+// stallingResult fails its reads with errs, one at a time, before it reads content.
+type stallingResult struct {
+	jetstream.ObjectResult
+	errs    []error
+	content io.Reader
+}
+
+func (sr *stallingResult) Read(p []byte) (int, error) {
+	if len(sr.errs) > 0 {
+		err := sr.errs[0]
+		sr.errs = sr.errs[1:]
+		return 0, err
+	}
+	return sr.content.Read(p)
+}
+
+func TestIdleReader(t *testing.T) {
+	ctx := context.Background()
+
+	stalled := []error{nats.ErrTimeout, jetstream.ErrNoHeartbeat, fmt.Errorf("failed to read: %w", nats.ErrTimeout)}
+	ir := &idleReader{ObjectResult: &stallingResult{errs: stalled, content: strings.NewReader("content")}, ctx: ctx}
+	got, err := io.ReadAll(ir)
+	if err != nil {
+		t.Fatalf("expected expired pulls to be continued, got: %v", err)
+	}
+	if string(got) != "content" {
+		t.Errorf("expected the content to be read, got: %q", got)
+	}
+
+	stalled = []error{nats.ErrTimeout, nats.ErrTimeout, nats.ErrTimeout, nats.ErrTimeout}
+	ir = &idleReader{ObjectResult: &stallingResult{errs: stalled, content: strings.NewReader("content")}, ctx: ctx}
+	if _, err := io.ReadAll(ir); !errors.Is(err, nats.ErrTimeout) {
+		t.Errorf("expected a read that stays idle to fail, got: %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// scrubbedBlobs counts the blobs whose content was verified by a scrub.
+	scrubbedBlobs = prometheus.StorageNamespace.NewLabeledCounter("nats_scrubbed_blobs", "The number of blobs verified against their digest by the scrubber of the NATS storage driver", "driver")
+	// scrubbedBytes counts the bytes of the blobs that were verified by a scrub.
+	scrubbedBytes = prometheus.StorageNamespace.NewLabeledCounter("nats_scrubbed_bytes", "The number of bytes of blobs verified against their digest by the scrubber of the NATS storage driver", "driver")
+	// scrubMismatches counts the blobs that were found not to match their digest.
+	scrubMismatches = prometheus.StorageNamespace.NewLabeledCounter("nats_scrub_mismatches", "The number of blobs found by the scrubber of the NATS storage driver not to match their digest", "driver", "quarantined")
+)
+
+// ScrubOptions configure what Scrub does.
+type ScrubOptions struct {
+	// Rate is the amount of bytes that are read per second, so that
+	// scrubbing does not take the bandwidth of the registry away. Zero
+	// means that blobs are read as fast as they can be.
+	Rate int64
+	// Quarantine quarantines the blobs that do not match their digest, like
+	// Check does when it repairs, so that the registry no longer serves
+	// them and they can be pushed again.
+	Quarantine bool
+}
+
+// Mismatch is a blob whose content does not match the digest in its path.
+type Mismatch struct {
+	Path   string `json:"path"`
+	Detail string `json:"detail"`
+	// Quarantined is set when the content of the blob was quarantined.
+	Quarantined bool `json:"quarantined"`
+}
+
+// ScrubResult describes a scrub of the blobs of the registry.
+type ScrubResult struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Blobs is the amount of blobs that were read.
+	Blobs int `json:"blobs"`
+	// Bytes is the amount of bytes of the blobs that were read.
+	Bytes      int64      `json:"bytes"`
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
+// Scrub reads every blob of the registry back, and verifies that its
+// content matches the digest in its path, to find content that was
+// corrupted on the disks of the cluster before it is pulled. Blobs that are
+// deleted while they are scrubbed are skipped. Blobs that fail to be read
+// otherwise do not stop the scrub, and are returned as errors once every
+// blob was read.
+//
+// Deduplicated content is read for every blob that links to it, and is
+// quarantined with all of them, which leaves their links dangling until
+// Check repairs them.
+func (d *Driver) Scrub(ctx context.Context, opts ScrubOptions) (ScrubResult, error) {
+	if opts.Quarantine && d.driver.readOnly {
+		return ScrubResult{}, ReadOnlyError{Op: "scrub"}
+	}
+	return d.driver.scrub(ctx, opts)
+}
+
+func (d *driver) scrub(ctx context.Context, opts ScrubOptions) (ScrubResult, error) {
+	result := ScrubResult{Started: time.Now(), Mismatches: make([]Mismatch, 0)}
+	name := driverName + "_" + d.stores.bucketPrefix
+
+	var paths []string
+	err := d.Walk(ctx, rootPath, func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() && blobDataPath.MatchString(fi.Path()) {
+			paths = append(paths, fi.Path())
+		}
+		return nil
+	})
+	if err != nil && !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return result, err
+	}
+
+	limit := newRateLimiter(opts.Rate)
+	var errs []error
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		n, err := d.scrubBlob(ctx, path, limit)
+		var corrupted CorruptionError
+		switch {
+		case err == nil:
+		case errors.As(err, &corrupted):
+			mismatch := Mismatch{Path: path, Detail: corrupted.Detail}
+			if opts.Quarantine {
+				if err := d.quarantineBlob(ctx, path); err != nil {
+					errs = append(errs, err)
+				} else {
+					mismatch.Quarantined = true
+				}
+			}
+			scrubMismatches.WithValues(name, strconv.FormatBool(mismatch.Quarantined)).Inc(1)
+			result.Mismatches = append(result.Mismatches, mismatch)
+		case errors.As(err, &storagedriver.PathNotFoundError{}):
+			continue
+		default:
+			errs = append(errs, err)
+			continue
+		}
+		result.Blobs++
+		result.Bytes += n
+		scrubbedBlobs.WithValues(name).Inc(1)
+		scrubbedBytes.WithValues(name).Inc(float64(n))
+	}
+	result.Finished = time.Now()
+	return result, errors.Join(errs...)
+}
+
+// scrubBlob reads the blob at path to its end, and returns how much of it was read.
+func (d *driver) scrubBlob(ctx context.Context, path string, limit *rateLimiter) (int64, error) {
+	r, err := d.reader(ctx, path, 0, true)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(io.Discard, &limitedReader{ctx: ctx, r: r, limit: limit})
+}
+
+// quarantineBlob quarantines the content of the blob at path, which is the
+// deduplicated content that it links to when it was deduplicated.
+func (d *driver) quarantineBlob(ctx context.Context, path string) error {
+	obs, err := d.stores.find(ctx, path)
+	if err != nil {
+		return err
+	}
+	info, err := obs.GetInfo(ctx, d.objectName(path))
+	if err != nil {
+		return err
+	}
+	if isLink(info) {
+		target, err := d.dedup.obs.GetInfo(ctx, dedupName(info.Headers.Get(headerLinkDigest)))
+		if err != nil {
+			return err
+		}
+		return d.quarantine(ctx, d.dedup.obs, target)
+	}
+	return d.quarantine(ctx, obs, info)
+}
+
+// scrubPeriodically scrubs the blobs every interval, for as long as the
+// registry runs, and reports the last scrub under the admin endpoint.
+func (d *driver) scrubPeriodically(ctx context.Context, interval time.Duration, opts ScrubOptions, status *scrubStatus) {
+	logger := logrus.WithField("driver", driverName)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		status.running.Store(true)
+		result, err := d.scrub(ctx, opts)
+		status.running.Store(false)
+		status.finish(result, err)
+		if err != nil {
+			logger.WithError(err).Error("failed to scrub blobs")
+		}
+		for _, m := range result.Mismatches {
+			logger.WithField("path", m.Path).WithField("quarantined", m.Quarantined).Error("blob does not match its digest: ", m.Detail)
+		}
+		logger.WithField("blobs", result.Blobs).WithField("bytes", result.Bytes).Debug("scrubbed blobs")
+	}
+}
+
+var (
+	scrubStatusesMu sync.Mutex
+	scrubStatuses   = make(map[string]*scrubStatus)
+)
+
+// registerScrubStatus serves the status of the scrubs of the driver as JSON
+// under /debug/<name>/scrub, next to /debug/health on the debug server of
+// the registry. Like health reporters, drivers with the same bucket prefix
+// share their status.
+func registerScrubStatus(bucketPrefix string) *scrubStatus {
+	name := driverName + "_" + bucketPrefix
+
+	scrubStatusesMu.Lock()
+	defer scrubStatusesMu.Unlock()
+	status, ok := scrubStatuses[name]
+	if !ok {
+		status = &scrubStatus{}
+		http.Handle("/debug/"+name+"/scrub", status)
+		scrubStatuses[name] = status
+	}
+	return status
+}
+
+// scrubStatus is the status of the scrubs of a driver.
+type scrubStatus struct {
+	running atomic.Bool
+
+	mu    sync.Mutex
+	last  *ScrubResult
+	error string
+}
+
+func (s *scrubStatus) finish(result ScrubResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = &result
+	s.error = ""
+	if err != nil {
+		s.error = err.Error()
+	}
+}
+
+func (s *scrubStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	body, err := json.Marshal(struct {
+		Running bool         `json:"running"`
+		Last    *ScrubResult `json:"last,omitempty"`
+		Error   string       `json:"error,omitempty"`
+	}{
+		Running: s.running.Load(),
+		Last:    s.last,
+		Error:   s.error,
+	})
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// rateLimiter paces the reads of a scrub to a rate in bytes per second.
+//
+// A nil *rateLimiter is valid, and does not limit anything.
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// wait records that n bytes were read, and waits until reading them
+// did not exceed the rate.
+func (rl *rateLimiter) wait(ctx context.Context, n int) error {
+	if rl == nil {
+		return nil
+	}
+	rl.read += int64(n)
+	due := rl.start.Add(time.Duration(float64(rl.read) / float64(rl.rate) * float64(time.Second)))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader reads from r at the rate of its limiter.
+type limitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit *rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if werr := lr.limit.wait(lr.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
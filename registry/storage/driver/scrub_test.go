@@ -0,0 +1,182 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// putBlobs stores a blob that matches its digest and
+// one that does not, and returns their paths.
+func putBlobs(t *testing.T, d *Driver) (string, string) {
+	t.Helper()
+	ctx := context.Background()
+	sum := sha256.Sum256([]byte("original"))
+	dgst := hex.EncodeToString(sum[:])
+	blob := fmt.Sprintf("/docker/registry/v2/blobs/sha256/%s/%s/data", dgst[:2], dgst)
+	if err := d.PutContent(ctx, blob, []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := "/docker/registry/v2/blobs/sha256/00/" + dgst[:62] + "00/data"
+	if err := d.PutContent(ctx, corrupt, []byte("corrupted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/docker/registry/v2/repositories/foo/_layers/sha256/"+dgst+"/link", []byte("sha256:"+dgst)); err != nil {
+		t.Fatal(err)
+	}
+	return blob, corrupt
+}
+
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, corrupt := putBlobs(t, d)
+
+	result, err := d.Scrub(ctx, ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Blobs != 2 || result.Bytes != int64(len("original")+len("corrupted")) {
+		t.Errorf("expected both blobs to be scrubbed, got %d blobs of %d bytes", result.Blobs, result.Bytes)
+	}
+	if len(result.Mismatches) != 1 || result.Mismatches[0].Path != corrupt || result.Mismatches[0].Quarantined {
+		t.Fatalf("expected only the corrupted blob to be reported, got: %+v", result.Mismatches)
+	}
+	if _, err := d.Stat(ctx, corrupt); err != nil {
+		t.Errorf("expected the corrupted blob to be kept without quarantine, got: %v", err)
+	}
+
+	result, err = d.Scrub(ctx, ScrubOptions{Quarantine: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Mismatches) != 1 || !result.Mismatches[0].Quarantined {
+		t.Fatalf("expected the corrupted blob to be quarantined, got: %+v", result.Mismatches)
+	}
+	if _, err := d.Stat(ctx, corrupt); !errors.As(detailOf(err), &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected the quarantined blob to be gone, got: %v", err)
+	}
+	if _, err := d.Stat(ctx, blob); err != nil {
+		t.Errorf("expected the intact blob to be kept, got: %v", err)
+	}
+
+	result, err = d.Scrub(ctx, ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Blobs != 1 || len(result.Mismatches) != 0 {
+		t.Errorf("expected only the intact blob to be scrubbed again, got %d blobs and: %+v", result.Blobs, result.Mismatches)
+	}
+}
+
+func TestScrubRate(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putBlobs(t, d)
+
+	// Both blobs hold 17 bytes, which take a quarter of a second at this rate.
+	start := time.Now()
+	if _, err := d.Scrub(ctx, ScrubOptions{Rate: 64}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected the scrub to be paced to its rate, took: %s", elapsed)
+	}
+}
+
+func TestScrubReadOnly(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL(), ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Scrub(ctx, ScrubOptions{Quarantine: true}); !errors.As(err, &ReadOnlyError{}) {
+		t.Errorf("expected quarantining to be rejected while read-only, got: %v", err)
+	}
+	if _, err := d.Scrub(ctx, ScrubOptions{}); err != nil {
+		t.Errorf("expected scrubbing to be allowed while read-only, got: %v", err)
+	}
+}
+
+func TestScrubPeriodically(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:       ns.ClientURL(),
+		BucketPrefix:    "scrubbed",
+		ScrubInterval:   50 * time.Millisecond,
+		ScrubQuarantine: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, corrupt := putBlobs(t, d)
+
+	eventually(t, 5*time.Second, func() error {
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/nats_scrubbed/scrub", nil))
+		if rec.Code != http.StatusOK {
+			return fmt.Errorf("expected the status to be served, got: %d", rec.Code)
+		}
+		var status struct {
+			Last *ScrubResult
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			return err
+		}
+		if status.Last == nil {
+			return errors.New("expected a scrub to have finished")
+		}
+		// Later scrubs no longer find the blob once it was quarantined.
+		if _, err := d.Stat(ctx, corrupt); !errors.As(detailOf(err), &storagedriver.PathNotFoundError{}) {
+			return fmt.Errorf("expected the corrupted blob to be quarantined, got: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestInvalidScrub(t *testing.T) {
+	for name, params := range map[string]*Parameters{
+		"interval": {ScrubInterval: -time.Second},
+		"rate":     {ScrubRate: -1},
+	} {
+		if _, err := New(context.Background(), params); err == nil {
+			t.Errorf("expected a negative scrub %s to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"golang.org/x/sync/semaphore"
+)
+
+// shardStorePrefix is prepended to the names of the stores
+// that paths are sharded into, to tell them apart from the root store.
+const shardStorePrefix = "shard-"
+
+const (
+	uploadsStoreName = "uploads"
+	// uploadsDir is the directory that the registry stages uploads in,
+	// below every repository.
+	uploadsDir = "_uploads"
+	// uploadsKey is the key of the uploads store. It is not a real path,
+	// but it is under the root path, so that deleting everything purges it.
+	uploadsKey = sep + uploadsDir
+)
+
+// errStoreNotFound is returned when the store that a path belongs to
+// was never created, which means that nothing was written to the path.
+var errStoreNotFound = errors.New("store not found")
+
+// stores maps paths to the object stores that they are kept in.
+//
+// Every path under one of the shard prefixes is kept in the store of the
+// prefix's child that it falls under. For example, with the shard prefix
+// /docker/registry/v2/repositories, all paths of the repository namespace
+// library share one store. All other paths are kept in the root store.
+// Each store records the path that it holds in its description.
+//
+// The namespaces of tenants are kept in a store of their own as well, but
+// in the NATS account of the tenant. Their uploads stay in that store too,
+// while the blobs that uploads are moved to are shared by every tenant.
+//
+// When uploads expire, every path under an uploads directory is kept in the
+// uploads store instead, whose objects are deleted by JetStream once they
+// are older than the upload TTL. Uploads are moved to the blobs when they
+// are committed, so their content is copied to the store of the blobs.
+type stores struct {
+	js           jetstream.JetStream
+	root         jetstream.ObjectStore
+	bucketPrefix string
+	replicas     int
+	placement    *jetstream.Placement
+	storage      jetstream.StorageType
+	// shardPrefixes is sorted from long to short, so that
+	// nested prefixes take precedence over their parents.
+	shardPrefixes []string
+	// watch is called for every shard store when it is first opened,
+	// and returns a function that stops watching it.
+	watch func(context.Context, jetstream.ObjectStore) (func(), error)
+	// tenants are the JetStream contexts of the accounts of the tenants,
+	// by the key of their store.
+	tenants map[string]jetstream.JetStream
+	// uploadTTL is how long objects are kept in the uploads store.
+	// Zero means that uploads are kept with everything else.
+	uploadTTL time.Duration
+	// maxBytes and maxAge limit every store, unless they are zero.
+	maxBytes int64
+	maxAge   time.Duration
+
+	// pulls is the budget of the pulls of the stores that are read over
+	// the connection of js, and tenantPulls those of the tenants.
+	pulls       *semaphore.Weighted
+	tenantPulls map[string]*semaphore.Weighted
+
+	mu     sync.RWMutex
+	opened map[string]jetstream.ObjectStore
+}
+
+func newStores(js jetstream.JetStream, root jetstream.ObjectStore, bucketPrefix string, replicas int, placement *jetstream.Placement, storage jetstream.StorageType, shardPrefixes []string) *stores {
+	prefixes := append([]string(nil), shardPrefixes...)
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+
+	return &stores{
+		js:            js,
+		root:          root,
+		bucketPrefix:  bucketPrefix,
+		replicas:      replicas,
+		placement:     placement,
+		storage:       storage,
+		shardPrefixes: prefixes,
+		tenantPulls:   make(map[string]*semaphore.Weighted),
+		opened:        make(map[string]jetstream.ObjectStore),
+	}
+}
+
+// keyOf returns the path held by the store that path is kept in.
+func (s *stores) keyOf(path string) string {
+	if key := s.tenantOf(path); key != "" {
+		return key
+	}
+	if s.uploadTTL > 0 && isUpload(path) {
+		return uploadsKey
+	}
+	if key := childOf(s.shardPrefixes, path); key != "" {
+		return key
+	}
+	return rootPath
+}
+
+// childOf returns the child of the first of prefixes that path is under,
+// or is itself. It is empty when path is not under any of them.
+func childOf(prefixes []string, path string) string {
+	for _, prefix := range prefixes {
+		dir := prefix + sep
+		if prefix == rootPath {
+			dir = rootPath
+		}
+		rest, ok := strings.CutPrefix(path, dir)
+		if !ok || rest == "" {
+			continue
+		}
+		child, _, _ := strings.Cut(rest, sep)
+		return dir + child
+	}
+	return ""
+}
+
+// tenantOf returns the key of the tenant that path belongs to,
+// which is empty when it belongs to none.
+func (s *stores) tenantOf(path string) string {
+	for key := range s.tenants {
+		if path == key || isUnder(path, key) {
+			return key
+		}
+	}
+	return ""
+}
+
+// jsOf returns the JetStream context of the account that the store of key is kept in.
+func (s *stores) jsOf(key string) jetstream.JetStream {
+	if js, ok := s.tenants[key]; ok {
+		return js
+	}
+	return s.js
+}
+
+// isUpload reports whether path is under an uploads directory.
+func isUpload(path string) bool {
+	return strings.Contains(path, sep+uploadsDir+sep)
+}
+
+// storeName returns the name of the store for a key other than the root path.
+func storeName(key string) string {
+	if key == uploadsKey {
+		return uploadsStoreName
+	}
+	return shardStoreName(key)
+}
+
+// shardStoreName returns the name of the store for key. Paths may contain
+// characters that are not allowed in bucket names, so the path is hashed.
+func shardStoreName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return shardStorePrefix + hex.EncodeToString(sum[:16])
+}
+
+// bucketOf returns the name of the bucket that path is kept in.
+func (s *stores) bucketOf(path string) string {
+	key := s.keyOf(path)
+	if key == rootPath {
+		return bucketName(s.bucketPrefix, rootStoreName)
+	}
+	return bucketName(s.bucketPrefix, storeName(key))
+}
+
+// find returns the store that path is kept in,
+// or errStoreNotFound if that store does not exist yet.
+func (s *stores) find(ctx context.Context, path string) (jetstream.ObjectStore, error) {
+	return s.findKey(ctx, s.keyOf(path))
+}
+
+// findKey returns the store of key, or errStoreNotFound if it does not exist yet.
+func (s *stores) findKey(ctx context.Context, key string) (jetstream.ObjectStore, error) {
+	if key == rootPath {
+		return s.root, nil
+	}
+	if obs, ok := s.cached(key); ok {
+		return obs, nil
+	}
+
+	obs, err := s.jsOf(key).ObjectStore(ctx, bucketName(s.bucketPrefix, storeName(key)))
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		return nil, errStoreNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.cache(ctx, key, obs)
+}
+
+// make returns the store that path is kept in, and creates it if needed.
+func (s *stores) make(ctx context.Context, path string) (jetstream.ObjectStore, error) {
+	key := s.keyOf(path)
+	if key == rootPath {
+		return s.root, nil
+	}
+	if obs, ok := s.cached(key); ok {
+		return obs, nil
+	}
+
+	config := storeConfig(s.bucketPrefix, storeName(key), key, s.replicas, s.placement, s.storage)
+	config.MaxBytes = s.maxBytes
+	config.TTL = s.maxAge
+	if key == uploadsKey {
+		config.TTL = s.uploadTTL
+	}
+	obs, err := s.jsOf(key).CreateOrUpdateObjectStore(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return s.cache(ctx, key, obs)
+}
+
+// under returns the stores that may hold path or any of its descendants.
+func (s *stores) under(ctx context.Context, path string) ([]jetstream.ObjectStore, error) {
+	found := []jetstream.ObjectStore{s.root}
+	if s.uploadTTL > 0 {
+		// Uploads may be below any path.
+		obs, err := s.findKey(ctx, uploadsKey)
+		if err != nil && !errors.Is(err, errStoreNotFound) {
+			return nil, err
+		}
+		if obs != nil {
+			found = append(found, obs)
+		}
+	}
+
+	dir := path + sep
+	if path == rootPath {
+		dir = rootPath
+	}
+	related := func(key string) bool {
+		return key == path || strings.HasPrefix(key, dir) || strings.HasPrefix(path, key+sep)
+	}
+	for key := range s.tenants {
+		if !related(key) {
+			continue
+		}
+		obs, err := s.findKey(ctx, key)
+		if errors.Is(err, errStoreNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, obs)
+	}
+	if len(s.shardPrefixes) == 0 {
+		return found, nil
+	}
+
+	lister := s.js.ObjectStores(ctx)
+	for status := range lister.Status() {
+		if !strings.HasPrefix(status.Bucket(), bucketName(s.bucketPrefix, shardStorePrefix)) {
+			continue
+		}
+		key := status.Description()
+		// Tenants are listed from their own account, even when
+		// a store was left behind for them in this one.
+		if _, ok := s.tenants[key]; ok || !related(key) {
+			continue
+		}
+
+		obs, ok := s.cached(key)
+		if !ok {
+			var err error
+			obs, err = s.js.ObjectStore(ctx, status.Bucket())
+			if errors.Is(err, jetstream.ErrBucketNotFound) {
+				// Deleted while listing.
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if obs, err = s.cache(ctx, key, obs); err != nil {
+				return nil, err
+			}
+		}
+		found = append(found, obs)
+	}
+	if err := lister.Error(); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// all returns every store of the driver.
+func (s *stores) all(ctx context.Context) ([]jetstream.ObjectStore, error) {
+	return s.under(ctx, rootPath)
+}
+
+func (s *stores) cached(key string) (jetstream.ObjectStore, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obs, ok := s.opened[key]
+	return obs, ok
+}
+
+func (s *stores) cache(ctx context.Context, key string, obs jetstream.ObjectStore) (jetstream.ObjectStore, error) {
+	s.mu.Lock()
+	if opened, ok := s.opened[key]; ok {
+		s.mu.Unlock()
+		return opened, nil
+	}
+	obs = &pullingStore{ObjectStore: obs, js: s.jsOf(key), pulls: s.pullsOf(key)}
+	s.mu.Unlock()
+
+	// The store is watched without holding the lock, so that looking
+	// up other stores does not wait on the server in the meantime.
+	stop := func() {}
+	if s.watch != nil {
+		var err error
+		if stop, err = s.watch(ctx, obs); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Another lookup may have opened the store while it was watched.
+	if opened, ok := s.opened[key]; ok {
+		stop()
+		return opened, nil
+	}
+	s.opened[key] = obs
+	return obs, nil
+}
+
+// pullsOf returns the budget of the pulls of the store of key, which it
+// shares with the other stores of its account. The caller must hold s.mu.
+func (s *stores) pullsOf(key string) *semaphore.Weighted {
+	if _, ok := s.tenants[key]; !ok {
+		return s.pulls
+	}
+	pulls, ok := s.tenantPulls[key]
+	if !ok {
+		pulls = semaphore.NewWeighted(maxPulledBytes)
+		s.tenantPulls[key] = pulls
+	}
+	return pulls
+}
+
+// statObject returns the info of the object at path, from the store that it is kept in.
+func (d *driver) statObject(ctx context.Context, path string) (*jetstream.ObjectInfo, error) {
+	obs, err := d.stores.find(ctx, path)
+	if errors.Is(err, errStoreNotFound) {
+		return nil, jetstream.ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obs.GetInfo(ctx, d.objectName(path))
+}
+
+// listObjects returns the objects from every store that may hold descendants of path.
+func (d *driver) listObjects(ctx context.Context, path string) ([]*jetstream.ObjectInfo, error) {
+	objects := make([]*jetstream.ObjectInfo, 0)
+	err := d.eachObject(ctx, path, func(info *jetstream.ObjectInfo) error {
+		objects = append(objects, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// errStopListing is returned by the function passed to eachObject
+// to stop listing objects, without eachObject returning an error.
+var errStopListing = errors.New("stop listing")
+
+// eachObject calls f with the objects from every store that may hold
+// descendants of path, one at a time as they are received, followed by
+// the links below path. Unlike with ObjectStore.List, the objects of a
+// store are never all held at once.
+func (d *driver) eachObject(ctx context.Context, path string, f func(*jetstream.ObjectInfo) error) error {
+	stores, err := d.stores.under(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	for _, obs := range stores {
+		err := eachStoreObject(ctx, obs, f)
+		if errors.Is(err, errStopListing) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = d.links.each(ctx, path, f)
+	if errors.Is(err, errStopListing) {
+		return nil
+	}
+	return err
+}
+
+// listIdleTimeout is how long a listing waits for the next object of a
+// store. The watcher that lists a store never gives up on its own, when
+// its connection is lost or the server stops delivering to it. It does
+// create its consumer again when it misses heartbeats, which may take a
+// few attempts of five seconds each on a busy server.
+const listIdleTimeout = time.Minute
+
+// errWatcherStopped is returned by listings whose watcher stopped
+// delivering objects before it delivered every one of them.
+var errWatcherStopped = errors.New("watcher stopped before every object was listed")
+
+// eachStoreObject calls f with every object in obs, like ObjectStore.List
+// does to collect them, and stops at the first error returned by f. It
+// fails when no object is received for listIdleTimeout.
+func eachStoreObject(ctx context.Context, obs jetstream.ObjectStore, f func(*jetstream.ObjectInfo) error) error {
+	watcher, err := obs.Watch(ctx, jetstream.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	updates := watcher.Updates()
+	defer stopWatcher(watcher)
+
+	idle := time.NewTimer(listIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case info, ok := <-updates:
+			if !ok {
+				return errWatcherStopped
+			}
+			// The watcher marks that every object was delivered with nil.
+			if info == nil {
+				return nil
+			}
+			if err := f(info); err != nil {
+				return err
+			}
+			// Only the wait for the watcher counts, not the time taken by f.
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(listIdleTimeout)
+		case <-idle.C:
+			return fmt.Errorf("failed to list objects: none were received for %s", listIdleTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// stopWatcher stops watcher, which may be blocked on delivering an object
+// when it is stopped before it delivered every one. Once it is stopped,
+// it only delivers what it received before, which is at most an object
+// and the nil marker. Emptying its updates makes room for those, so that
+// it never blocks on them.
+func stopWatcher(watcher jetstream.ObjectWatcher) {
+	_ = watcher.Stop()
+	updates := watcher.Updates()
+	for {
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
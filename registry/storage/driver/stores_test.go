@@ -0,0 +1,451 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const testRepositories = "/docker/registry/v2/repositories"
+
+func TestKeyOf(t *testing.T) {
+	s := newStores(nil, nil, defaultBucketPrefix, 1, nil, jetstream.FileStorage, []string{testRepositories, testRepositories + "/library", "/other"})
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", rootPath},
+		{"/docker/registry/v2/blobs/sha256/ab", rootPath},
+		{testRepositories, rootPath},
+		{testRepositories + "/acme", testRepositories + "/acme"},
+		{testRepositories + "/acme/app/_layers/link", testRepositories + "/acme"},
+		// Nested prefixes take precedence over their parents.
+		{testRepositories + "/library", testRepositories + "/library"},
+		{testRepositories + "/library/ubuntu/_manifests", testRepositories + "/library/ubuntu"},
+		{"/other/file", "/other/file"},
+		{"/otherwise/file", rootPath},
+	}
+
+	for _, test := range tests {
+		if got := s.keyOf(test.path); got != test.want {
+			t.Errorf("%s: expected store for %q, got: %q", test.path, test.want, got)
+		}
+	}
+
+	s = newStores(nil, nil, defaultBucketPrefix, 1, nil, jetstream.FileStorage, []string{rootPath})
+	if got := s.keyOf("/a/b"); got != "/a" {
+		t.Errorf("expected the root prefix to shard its children, got: %q", got)
+	}
+
+	// Uploads that expire are kept apart, even under a shard prefix.
+	s.uploadTTL = time.Hour
+	if got := s.keyOf(testRepositories + "/acme/app/_uploads/id/data"); got != uploadsKey {
+		t.Errorf("expected uploads to be kept in the uploads store, got: %q", got)
+	}
+	if got := s.keyOf("/a/_uploads"); got != "/a" {
+		t.Errorf("expected an uploads directory itself to be kept with its parent, got: %q", got)
+	}
+}
+
+func newShardedDriver(t *testing.T, dedup bool) (*Driver, jetstream.JetStream) {
+	ns := newTestServer(t)
+
+	d, err := New(context.Background(), &Parameters{
+		ClientURL:     ns.ClientURL(),
+		Dedup:         dedup,
+		ShardPrefixes: []string{testRepositories},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, d.driver.js
+}
+
+// storeNames returns the names of all buckets on the server, sorted.
+func storeNames(t *testing.T, js jetstream.JetStream) []string {
+	names := make([]string, 0)
+	lister := js.ObjectStoreNames(context.Background())
+	for name := range lister.Name() {
+		names = append(names, name)
+	}
+	if err := lister.Error(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestShardedStores(t *testing.T) {
+	ctx := context.Background()
+	d, js := newShardedDriver(t, false)
+
+	paths := []string{
+		testRepositories + "/acme/app/_manifests/tags/latest",
+		testRepositories + "/library/ubuntu/_manifests/tags/latest",
+		testRepositories + "/library/alpine/_manifests/tags/latest",
+		"/docker/registry/v2/blobs/sha256/ab/data",
+	}
+	for _, path := range paths {
+		if err := d.PutContent(ctx, path, []byte(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := storeNames(t, js); len(got) != 3 {
+		t.Errorf("expected a root store and a store per namespace, got: %v", got)
+	}
+	acme, err := js.ObjectStore(ctx, bucketName(defaultBucketPrefix, shardStoreName(testRepositories+"/acme")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := objectNames(t, acme); len(got) != 1 || got[0] != paths[0] {
+		t.Errorf("expected the namespace store to hold only its own paths, got: %v", got)
+	}
+	if got := objectNames(t, d.driver.root); len(got) != 1 || got[0] != paths[3] {
+		t.Errorf("expected the root store to hold only unsharded paths, got: %v", got)
+	}
+
+	for _, path := range paths {
+		content, err := d.GetContent(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != path {
+			t.Errorf("%s: expected its own content, got: %q", path, content)
+		}
+	}
+
+	files, err := d.List(ctx, testRepositories)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if len(files) != 2 || files[0] != testRepositories+"/acme" || files[1] != testRepositories+"/library" {
+		t.Errorf("expected to list the namespaces across stores, got: %v", files)
+	}
+	files, err = d.List(ctx, testRepositories+"/library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected to list the repositories within a store, got: %v", files)
+	}
+	if fi, err := d.Stat(ctx, "/docker"); err != nil || !fi.IsDir() {
+		t.Errorf("expected a directory spanning stores, got: %v, %v", fi, err)
+	}
+
+	// Moving between stores copies the content.
+	moved := testRepositories + "/acme/app/_manifests/tags/stable"
+	if err := d.Move(ctx, paths[1], moved); err != nil {
+		t.Fatal(err)
+	}
+	content, err := d.GetContent(ctx, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != paths[1] {
+		t.Errorf("expected moved content, got: %q", content)
+	}
+	if _, err := d.Stat(ctx, paths[1]); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected the source to be gone, got: %v", err)
+	}
+
+	if err := d.Delete(ctx, testRepositories); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.List(ctx, testRepositories); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected all namespaces to be deleted, got: %v", err)
+	}
+	if _, err := d.Stat(ctx, paths[3]); err != nil {
+		t.Errorf("expected unsharded paths to be kept, got: %v", err)
+	}
+}
+
+func TestShardedPathNotFound(t *testing.T) {
+	ctx := context.Background()
+	d, js := newShardedDriver(t, false)
+
+	missing := testRepositories + "/missing/app/_manifests/tags/latest"
+	if _, err := d.GetContent(ctx, missing); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected path not found, got: %v", err)
+	}
+	if _, err := d.Stat(ctx, missing); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected path not found, got: %v", err)
+	}
+	if err := d.Move(ctx, missing, missing+"2"); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected path not found, got: %v", err)
+	}
+	if err := d.Delete(ctx, missing); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected path not found, got: %v", err)
+	}
+
+	if got := storeNames(t, js); len(got) != 1 {
+		t.Errorf("expected reading missing paths not to create stores, got: %v", got)
+	}
+}
+
+func TestShardedStoresWatchedConcurrently(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newShardedDriver(t, false)
+
+	// The first store that is opened is watched until it is released.
+	release := make(chan struct{})
+	var watched atomic.Int32
+	d.driver.stores.watch = func(context.Context, jetstream.ObjectStore) (func(), error) {
+		if watched.Add(1) == 1 {
+			<-release
+		}
+		return func() {}, nil
+	}
+
+	slow := testRepositories + "/acme/app/_manifests/tags/latest"
+	done := make(chan error, 1)
+	go func() {
+		done <- d.PutContent(ctx, slow, []byte("slow"))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	fast := testRepositories + "/library/ubuntu/_manifests/tags/latest"
+	stored := make(chan error, 1)
+	go func() {
+		stored <- d.PutContent(ctx, fast, []byte("fast"))
+	}()
+	select {
+	case err := <-stored:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected another store to be opened while the first is watched")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedDedup(t *testing.T) {
+	ctx := context.Background()
+	d, js := newShardedDriver(t, true)
+
+	content := bytes.Repeat([]byte("a"), 64)
+	paths := []string{
+		testRepositories + "/acme/app/_layers/data",
+		testRepositories + "/library/ubuntu/_layers/data",
+	}
+	for _, path := range paths {
+		fw, err := d.Writer(ctx, path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Content is stored once in the root store, and the shards only hold links.
+	if got := dedupObjects(t, d.driver.root); len(got) != 1 {
+		t.Errorf("expected content to be stored once, got: %d", len(got))
+	}
+	for _, path := range paths {
+		obs, err := js.ObjectStore(ctx, bucketName(defaultBucketPrefix, shardStoreName(d.driver.stores.keyOf(path))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := objectNames(t, obs)
+		if len(names) != 1 || names[0] != path {
+			t.Errorf("expected only a link in the shard store, got: %v", names)
+		}
+
+		got, err := d.GetContent(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, got) {
+			t.Errorf("%s: expected deduplicated content", path)
+		}
+	}
+
+	for _, path := range paths {
+		if err := d.Delete(ctx, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := dedupObjects(t, d.driver.root); len(got) != 0 {
+		t.Errorf("expected unreferenced content to be deleted, got: %d", len(got))
+	}
+}
+
+func TestUploadTTL(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL:     ns.ClientURL(),
+		ShardPrefixes: []string{testRepositories},
+		UploadTTL:     2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := d.driver.js
+
+	uploads := testRepositories + "/acme/app/_uploads"
+	abandoned := uploads + "/abandoned/startedat"
+	if err := d.PutContent(ctx, abandoned, []byte("abandoned")); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := d.Writer(ctx, uploads+"/committed/data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	obs, err := js.ObjectStore(ctx, bucketName(defaultBucketPrefix, uploadsStoreName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := obs.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.TTL() != 2*time.Second {
+		t.Errorf("expected the uploads store to expire objects after the upload TTL, got: %s", status.TTL())
+	}
+	// The repository itself has no store yet, only its uploads.
+	if got := storeNames(t, js); len(got) != 2 {
+		t.Errorf("expected a root store and an uploads store, got: %v", got)
+	}
+	files, err := d.List(ctx, uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if len(files) != 2 || files[0] != uploads+"/abandoned" || files[1] != uploads+"/committed" {
+		t.Errorf("expected to list the uploads, got: %v", files)
+	}
+
+	blob := "/docker/registry/v2/blobs/sha256/ab/abcd/data"
+	if err := d.Move(ctx, uploads+"/committed/data", blob); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, 10*time.Second, func() error {
+		if _, err := d.Stat(ctx, abandoned); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			return fmt.Errorf("expected the abandoned upload to expire, got: %v", err)
+		}
+		return nil
+	})
+	if content, err := d.GetContent(ctx, blob); err != nil || string(content) != "layer" {
+		t.Errorf("expected the committed upload to be kept, got: %q, %v", content, err)
+	}
+}
+
+func TestInvalidShardPrefix(t *testing.T) {
+	ns := newTestServer(t)
+
+	_, err := New(context.Background(), &Parameters{
+		ClientURL:     ns.ClientURL(),
+		ShardPrefixes: []string{"docker/registry"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid shard prefix") {
+		t.Errorf("expected invalid shard prefix to be rejected, got: %v", err)
+	}
+}
+
+// watchingStore lists the objects that are sent to its updates.
+type watchingStore struct {
+	jetstream.ObjectStore
+	updates chan *jetstream.ObjectInfo
+}
+
+func (ws *watchingStore) Watch(context.Context, ...jetstream.WatchOpt) (jetstream.ObjectWatcher, error) {
+	return ws, nil
+}
+
+func (ws *watchingStore) Updates() <-chan *jetstream.ObjectInfo {
+	return ws.updates
+}
+
+func (ws *watchingStore) Stop() error {
+	return nil
+}
+
+func TestEachStoreObjectWatcherStopped(t *testing.T) {
+	ctx := context.Background()
+
+	// A watcher that stops before the nil marker lists only some objects.
+	ws := &watchingStore{updates: make(chan *jetstream.ObjectInfo, 1)}
+	ws.updates <- &jetstream.ObjectInfo{ObjectMeta: jetstream.ObjectMeta{Name: "object"}}
+	close(ws.updates)
+	listed := 0
+	err := eachStoreObject(ctx, ws, func(*jetstream.ObjectInfo) error {
+		listed++
+		return nil
+	})
+	if !errors.Is(err, errWatcherStopped) {
+		t.Errorf("expected the listing to fail, got: %v", err)
+	}
+	if listed != 1 {
+		t.Errorf("expected the delivered object to be listed, got %d", listed)
+	}
+
+	// A listing that is stopped early does not leave the watcher blocked.
+	ws = &watchingStore{updates: make(chan *jetstream.ObjectInfo, 32)}
+	for range cap(ws.updates) {
+		ws.updates <- &jetstream.ObjectInfo{}
+	}
+	delivered := make(chan struct{})
+	go func() {
+		ws.updates <- &jetstream.ObjectInfo{}
+		ws.updates <- nil
+		close(delivered)
+	}()
+	err = eachStoreObject(ctx, ws, func(*jetstream.ObjectInfo) error {
+		return errStopListing
+	})
+	if !errors.Is(err, errStopListing) {
+		t.Fatal(err)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the watcher to deliver what it received after it was stopped")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// defaultTenantPrefix is the directory that the registry keeps the
+// repository namespaces in.
+const defaultTenantPrefix = "/docker/registry/v2/repositories"
+
+// TenantParameters are the credentials of the NATS user that the store
+// of a tenant is accessed with, which belongs to the account of the
+// tenant. They are used like the credentials of the driver itself, and
+// only one way of authenticating may be configured.
+type TenantParameters struct {
+	Credentials string
+	JWT         string
+	NKeySeed    string
+	Username    string
+	Password    string
+	Token       string
+}
+
+// tenantParameters returns the parameters to connect to the account of
+// tenant with, which are those of the driver with the credentials of tenant.
+func tenantParameters(params *Parameters, tenant TenantParameters) *Parameters {
+	p := *params
+	p.Credentials = tenant.Credentials
+	p.JWT = tenant.JWT
+	p.NKeySeed = tenant.NKeySeed
+	p.Username = tenant.Username
+	p.Password = tenant.Password
+	p.Token = tenant.Token
+	return &p
+}
+
+// connectTenants connects to the account of every tenant, and returns their
+// JetStream contexts by the path of their namespace under prefix, and their
+// connections, which the caller closes when it fails to use them.
+func connectTenants(ctx context.Context, params *Parameters, prefix string) (map[string]jetstream.JetStream, []*nats.Conn, error) {
+	namespaces := make([]string, 0, len(params.Tenants))
+	for namespace := range params.Tenants {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	tenants := make(map[string]jetstream.JetStream, len(namespaces))
+	conns := make([]*nats.Conn, 0, len(namespaces))
+	fail := func(err error) (map[string]jetstream.JetStream, []*nats.Conn, error) {
+		for _, nc := range conns {
+			nc.Close()
+		}
+		return nil, nil, err
+	}
+	for _, namespace := range namespaces {
+		if namespace == "" || strings.Contains(namespace, sep) || namespace == "." || namespace == ".." {
+			return fail(fmt.Errorf("invalid tenant %q: must be a single repository namespace", namespace))
+		}
+		key := prefix + sep + namespace
+		if prefix == rootPath {
+			key = sep + namespace
+		}
+
+		nc, js, err := newJetStream(tenantParameters(params, params.Tenants[namespace]))
+		if err == nil {
+			// Fail right away when JetStream is not enabled for the account.
+			if _, err = js.AccountInfo(ctx); err != nil {
+				nc.Close()
+			}
+		}
+		if err != nil {
+			return fail(fmt.Errorf("failed to connect to the account of tenant %s: %w", namespace, err))
+		}
+		conns = append(conns, nc)
+		tenants[key] = js
+	}
+	return tenants, conns, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// startTenantServer starts an embedded NATS server with a JetStream-enabled
+// account for the registry, and one for the acme tenant.
+func startTenantServer(t *testing.T) *server.Server {
+	config := filepath.Join(t.TempDir(), "nats.conf")
+	if err := os.WriteFile(config, []byte(`
+accounts {
+	REGISTRY { jetstream: enabled, users: [{user: registry, password: secret}] }
+	ACME { jetstream: enabled, users: [{user: acme, password: secret}] }
+}
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := server.ProcessConfigFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startTestServer(t, opts)
+}
+
+func TestTenants(t *testing.T) {
+	ctx := context.Background()
+	ns := startTenantServer(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL: ns.ClientURL(),
+		Username:  "registry",
+		Password:  "secret",
+		Tenants: map[string]TenantParameters{
+			"acme": {Username: "acme", Password: "secret"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := testRepositories + "/acme/app/_layers/link"
+	other := testRepositories + "/other/app/_layers/link"
+	for _, path := range []string{tenant, other} {
+		if err := d.PutContent(ctx, path, []byte(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, acme, err := newJetStream(&Parameters{ClientURL: ns.ClientURL(), Username: "acme", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs, err := acme.ObjectStore(ctx, bucketName(defaultBucketPrefix, storeName(testRepositories+"/acme")))
+	if err != nil {
+		t.Fatalf("expected the namespace of the tenant to be kept in its account: %v", err)
+	}
+	if names := objectNames(t, obs); !reflect.DeepEqual(names, []string{tenant}) {
+		t.Errorf("expected the store of the tenant to hold %s, got: %v", tenant, names)
+	}
+	if names := objectNames(t, d.driver.root); !reflect.DeepEqual(names, []string{other}) {
+		t.Errorf("expected the root store to hold %s, got: %v", other, names)
+	}
+	if _, err := acme.ObjectStore(ctx, bucketName(defaultBucketPrefix, rootStoreName)); !errors.Is(err, jetstream.ErrBucketNotFound) {
+		t.Errorf("expected the tenant not to see the root store, got: %v", err)
+	}
+
+	if content, err := d.GetContent(ctx, tenant); err != nil || string(content) != tenant {
+		t.Errorf("expected the content of the tenant to be read, got: %q, %v", content, err)
+	}
+	children, err := d.List(ctx, testRepositories)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{testRepositories + "/acme", testRepositories + "/other"}; !reflect.DeepEqual(children, want) {
+		t.Errorf("expected the namespaces of both accounts to be listed, got: %v", children)
+	}
+	var walked []string
+	if err := d.Walk(ctx, testRepositories, func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			walked = append(walked, fi.Path())
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{tenant, other}; !reflect.DeepEqual(walked, want) {
+		t.Errorf("expected the files of both accounts to be walked, got: %v", walked)
+	}
+
+	if err := d.Delete(ctx, testRepositories+"/acme"); err != nil {
+		t.Fatal(err)
+	}
+	if names := objectNames(t, obs); len(names) != 0 {
+		t.Errorf("expected the content of the tenant to be deleted, got: %v", names)
+	}
+}
+
+func TestInvalidTenants(t *testing.T) {
+	ns := startTenantServer(t)
+
+	for name, tenant := range map[string]string{
+		"empty":       "",
+		"nested":      "acme/app",
+		"parent":      "..",
+		"credentials": "acme",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(context.Background(), &Parameters{
+				ClientURL: ns.ClientURL(),
+				Username:  "registry",
+				Password:  "secret",
+				Tenants: map[string]TenantParameters{
+					tenant: {Username: "acme", Password: "wrong"},
+				},
+			})
+			if err == nil {
+				t.Error("expected the tenant to be rejected")
+			}
+		})
+	}
+}
+
+func TestParseTenants(t *testing.T) {
+	tenants, err := parseTenants(map[interface{}]interface{}{
+		"acme": map[interface{}]interface{}{"username": "acme", "password": "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]TenantParameters{"acme": {Username: "acme", Password: "secret"}}; !reflect.DeepEqual(tenants, want) {
+		t.Errorf("expected the tenants to be parsed, got: %#v", tenants)
+	}
+
+	if _, err := parseTenants("acme"); err == nil {
+		t.Error("expected tenants that are not a map to be rejected")
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/robinkb/cascade/registry/storage/driver"
+
+const (
+	attrPath         = attribute.Key("cascade.path")
+	attrDestPath     = attribute.Key("cascade.dest_path")
+	attrStore        = attribute.Key("cascade.store")
+	attrDestStore    = attribute.Key("cascade.dest_store")
+	attrSize         = attribute.Key("cascade.size")
+	attrChunks       = attribute.Key("cascade.chunks")
+	attrParts        = attribute.Key("cascade.parts")
+	attrOffset       = attribute.Key("cascade.offset")
+	attrBytesRead    = attribute.Key("cascade.bytes_read")
+	attrAppend       = attribute.Key("cascade.append")
+	attrDeduplicated = attribute.Key("cascade.deduplicated")
+)
+
+// tracedDriver creates a span for every storage operation, as a child of
+// the span of the registry request that it is part of. The registry sets up
+// the global tracer provider, so the spans end up wherever it exports to.
+//
+// The operations add what they learn about the stored objects to the span,
+// like the amount of chunks that they are stored in.
+type tracedDriver struct {
+	storagedriver.StorageDriver
+	stores *stores
+	tracer trace.Tracer
+}
+
+func newTracedDriver(next storagedriver.StorageDriver, stores *stores) *tracedDriver {
+	return &tracedDriver{
+		StorageDriver: next,
+		stores:        stores,
+		tracer:        otel.Tracer(tracerName),
+	}
+}
+
+func (td *tracedDriver) start(ctx context.Context, op, path string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attrPath.String(path), attrStore.String(td.stores.bucketOf(path)))
+	return td.tracer.Start(ctx, driverName+"."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// endSpan ends span, and marks it as failed if err is set. Paths that are not
+// found are part of normal registry operation, so they are not failures.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (td *tracedDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	ctx, span := td.start(ctx, "GetContent", path)
+	content, err := td.StorageDriver.GetContent(ctx, path)
+	span.SetAttributes(attrSize.Int(len(content)))
+	endSpan(span, err)
+	return content, err
+}
+
+func (td *tracedDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	ctx, span := td.start(ctx, "PutContent", path, attrSize.Int(len(content)))
+	err := td.StorageDriver.PutContent(ctx, path, content)
+	endSpan(span, err)
+	return err
+}
+
+// Reader ends its span when the returned reader is closed,
+// so that the span covers streaming the content as well.
+func (td *tracedDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	ctx, span := td.start(ctx, "Reader", path, attrOffset.Int64(offset))
+	reader, err := td.StorageDriver.Reader(ctx, path, offset)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return &tracedReader{ReadCloser: reader, span: span}, nil
+}
+
+func (td *tracedDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	ctx, span := td.start(ctx, "Writer", path, attrAppend.Bool(append))
+	fw, err := td.StorageDriver.Writer(ctx, path, append)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedFileWriter{FileWriter: fw, driver: td, path: path}, nil
+}
+
+func (td *tracedDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	ctx, span := td.start(ctx, "Stat", path)
+	fi, err := td.StorageDriver.Stat(ctx, path)
+	if err == nil && !fi.IsDir() {
+		span.SetAttributes(attrSize.Int64(fi.Size()))
+	}
+	endSpan(span, err)
+	return fi, err
+}
+
+func (td *tracedDriver) List(ctx context.Context, path string) ([]string, error) {
+	ctx, span := td.start(ctx, "List", path)
+	files, err := td.StorageDriver.List(ctx, path)
+	endSpan(span, err)
+	return files, err
+}
+
+func (td *tracedDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	ctx, span := td.start(ctx, "Move", sourcePath,
+		attrDestPath.String(destPath),
+		attrDestStore.String(td.stores.bucketOf(destPath)),
+	)
+	err := td.StorageDriver.Move(ctx, sourcePath, destPath)
+	endSpan(span, err)
+	return err
+}
+
+func (td *tracedDriver) Delete(ctx context.Context, path string) error {
+	ctx, span := td.start(ctx, "Delete", path)
+	err := td.StorageDriver.Delete(ctx, path)
+	endSpan(span, err)
+	return err
+}
+
+func (td *tracedDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	ctx, span := td.start(ctx, "Walk", path)
+	err := td.StorageDriver.Walk(ctx, path, f, options...)
+	endSpan(span, err)
+	return err
+}
+
+type tracedReader struct {
+	io.ReadCloser
+	span trace.Span
+	read int64
+}
+
+func (tr *tracedReader) Read(p []byte) (int, error) {
+	n, err := tr.ReadCloser.Read(p)
+	tr.read += int64(n)
+	return n, err
+}
+
+func (tr *tracedReader) Seek(offset int64, whence int) (int64, error) {
+	return seek(tr.ReadCloser, offset, whence)
+}
+
+func (tr *tracedReader) Close() error {
+	err := tr.ReadCloser.Close()
+	tr.span.SetAttributes(attrBytesRead.Int64(tr.read))
+	endSpan(tr.span, err)
+	return err
+}
+
+// tracedFileWriter creates spans for finishing the content of a FileWriter,
+// which is when everything that is left in its buffer is stored.
+type tracedFileWriter struct {
+	storagedriver.FileWriter
+	driver *tracedDriver
+	path   string
+}
+
+func (fw *tracedFileWriter) Commit(ctx context.Context) error {
+	ctx, span := fw.driver.start(ctx, "FileWriter.Commit", fw.path)
+	err := fw.FileWriter.Commit(ctx)
+	span.SetAttributes(attrSize.Int64(fw.Size()))
+	endSpan(span, err)
+	return err
+}
+
+func (fw *tracedFileWriter) Cancel(ctx context.Context) error {
+	ctx, span := fw.driver.start(ctx, "FileWriter.Cancel", fw.path)
+	err := fw.FileWriter.Cancel(ctx)
+	endSpan(span, err)
+	return err
+}
+
+// traceObject adds what info says about how content is stored to the span in ctx.
+func traceObject(ctx context.Context, info *jetstream.ObjectInfo) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+
+	switch {
+	case isLink(info):
+		span.SetAttributes(attrDeduplicated.Bool(true))
+	case isMultipart(info):
+		if parts, err := strconv.Atoi(info.Headers.Get(headerMultipartCount)); err == nil {
+			span.SetAttributes(attrParts.Int(parts))
+		}
+	default:
+		span.SetAttributes(attrChunks.Int(int(info.Chunks)))
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTracingRecorder installs a global tracer provider that records all spans.
+func newTracingRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+	recorder := newTracingRecorder(t)
+
+	d, err := New(ctx, &Parameters{
+		ClientURL: ns.ClientURL(),
+		Tracing:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spans are children of the span of the registry request.
+	ctx, parent := otel.Tracer("test").Start(ctx, "request")
+
+	content := make([]byte, 3*defaultChunkSize)
+	if err := d.PutContent(ctx, "/small", content[:4096]); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, d, "/multipart", content, false, true)
+	reader, err := d.Reader(ctx, "/multipart", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, "/missing"); err == nil {
+		t.Fatal("expected path not found")
+	}
+	parent.End()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"nats.PutContent", "nats.Writer", "nats.FileWriter.Commit", "nats.Reader", "nats.Stat"} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("expected a %s span", name)
+		}
+	}
+
+	put := spans["nats.PutContent"]
+	if put.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("expected the span to be a child of the request span")
+	}
+	attrs := spanAttributes(put)
+	if attrs[attrPath].AsString() != "/small" {
+		t.Errorf("expected path /small, got %q", attrs[attrPath].AsString())
+	}
+	if attrs[attrStore].AsString() != bucketName(defaultBucketPrefix, rootStoreName) {
+		t.Errorf("expected the root store, got %q", attrs[attrStore].AsString())
+	}
+	if attrs[attrSize].AsInt64() != 4096 {
+		t.Errorf("expected size 4096, got %d", attrs[attrSize].AsInt64())
+	}
+	if attrs[attrChunks].AsInt64() != 1 {
+		t.Errorf("expected 1 chunk, got %d", attrs[attrChunks].AsInt64())
+	}
+
+	attrs = spanAttributes(spans["nats.Reader"])
+	if attrs[attrParts].AsInt64() == 0 {
+		t.Error("expected the amount of parts to be recorded")
+	}
+	if attrs[attrBytesRead].AsInt64() != int64(len(content)) {
+		t.Errorf("expected %d bytes read, got %d", len(content), attrs[attrBytesRead].AsInt64())
+	}
+
+	if spans["nats.Stat"].Status().Code == codes.Error {
+		t.Error("expected a path that is not found to not fail the span")
+	}
+}
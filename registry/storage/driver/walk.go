@@ -0,0 +1,71 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	pathpkg "path"
+	"sort"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// walkEntries returns the files and directories below from, in the
+// depth-first order that they are walked in.
+func walkEntries(from string, objects []*jetstream.ObjectInfo) ([]storagedriver.FileInfo, error) {
+	files := descendants(from, objects)
+	entries := make(map[string]storagedriver.FileInfo, len(files))
+	for _, info := range files {
+		path := objectPath(info)
+		size, err := fileSize(info)
+		if err != nil {
+			return nil, err
+		}
+		entries[path] = newFileInfo(storagedriver.FileInfoInternal{
+			FileInfoFields: storagedriver.FileInfoFields{
+				Path:    path,
+				Size:    size,
+				ModTime: info.ModTime,
+			},
+		}, info.Metadata)
+
+		for dir := pathpkg.Dir(path); dir != from; dir = pathpkg.Dir(dir) {
+			if _, ok := entries[dir]; ok {
+				break
+			}
+			entries[dir] = storagedriver.FileInfoInternal{
+				FileInfoFields: storagedriver.FileInfoFields{
+					Path:  dir,
+					IsDir: true,
+				},
+			}
+		}
+	}
+
+	sorted := make([]storagedriver.FileInfo, 0, len(entries))
+	for _, fi := range entries {
+		sorted = append(sorted, fi)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return walkKey(sorted[i].Path()) < walkKey(sorted[j].Path())
+	})
+	return sorted, nil
+}
+
+// walkKey returns a key that sorts paths in depth-first order,
+// by making the separator sort before any other character.
+func walkKey(path string) string {
+	return strings.ReplaceAll(path, sep, "\x00")
+}
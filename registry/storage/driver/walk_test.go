@@ -0,0 +1,159 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// walked returns the paths that were walked, with their type and size.
+func walked(walk func(storagedriver.WalkFn) error, f func(storagedriver.FileInfo) error) ([]string, error) {
+	paths := make([]string, 0)
+	err := walk(func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() {
+			paths = append(paths, fi.Path()+"/")
+		} else {
+			paths = append(paths, fmt.Sprintf("%s (%d)", fi.Path(), fi.Size()))
+		}
+		return f(fi)
+	})
+	return paths, err
+}
+
+func TestWalk(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/a/b/c", "/a/b/d", "/a/bc", "/a-b/x", "/e", "/f/g/h/i"} {
+		if err := d.PutContent(ctx, path, []byte(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The parts of this file must not show up as its children.
+	fw, err := d.Writer(ctx, "/a/m", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.(*objectWriter).partSize = 16
+	if _, err := fw.Write(bytes.Repeat([]byte("m"), 40)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	all := []string{
+		"/a/", "/a/b/", "/a/b/c (6)", "/a/b/d (6)", "/a/bc (5)", "/a/m (40)",
+		"/a-b/", "/a-b/x (6)",
+		"/e (2)",
+		"/f/", "/f/g/", "/f/g/h/", "/f/g/h/i (8)",
+	}
+
+	count := 0
+	tests := []struct {
+		name string
+		from string
+		hint string
+		f    func(storagedriver.FileInfo) error
+		want []string
+	}{
+		{name: "everything", from: "/", want: all},
+		{name: "directory", from: "/a", want: all[1:6]},
+		{name: "nested", from: "/f/g", want: all[11:]},
+		{name: "hint equals from", from: "/a", hint: "/a", want: all[1:6]},
+		// Resuming after a directory still walks its contents.
+		{name: "hint directory", from: "/", hint: "/a/b", want: all[2:]},
+		{name: "hint file", from: "/", hint: "/a/b/c", want: all[3:]},
+		{name: "hint missing", from: "/", hint: "/a/b/cc", want: all[3:]},
+		{name: "hint sibling", from: "/", hint: "/a-b", want: all[7:]},
+		{name: "hint before from", from: "/f", hint: "/a", want: all[10:]},
+		{name: "hint after from", from: "/a", hint: "/e", want: []string{}},
+		{name: "skip directory", from: "/", f: func(fi storagedriver.FileInfo) error {
+			if fi.Path() == "/a/b" || fi.Path() == "/e" {
+				return storagedriver.ErrSkipDir
+			}
+			return nil
+		}, want: append(all[:2:2], all[4:]...)},
+		{name: "filled buffer", from: "/", f: func(fi storagedriver.FileInfo) error {
+			count++
+			if count == 4 {
+				return storagedriver.ErrFilledBuffer
+			}
+			return nil
+		}, want: all[:4]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := test.f
+			if f == nil {
+				f = func(storagedriver.FileInfo) error { return nil }
+			}
+
+			count = 0
+			got, err := walked(func(fn storagedriver.WalkFn) error {
+				return d.Walk(ctx, test.from, fn, func(o *storagedriver.WalkOptions) {
+					o.StartAfterHint = test.hint
+				})
+			}, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+				t.Errorf("unexpected walk\nwant: %v\ngot:  %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestWalkErrors(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestServer(t)
+
+	d, err := New(ctx, &Parameters{ClientURL: ns.ClientURL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noop := func(storagedriver.FileInfo) error { return nil }
+	if err := d.Walk(ctx, "/", noop); err != nil {
+		t.Errorf("expected walking an empty store to succeed, got: %v", err)
+	}
+	if err := d.Walk(ctx, "/missing", noop); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected path not found, got: %v", err)
+	}
+
+	if err := d.PutContent(ctx, "/a/b", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	err = d.Walk(ctx, "/", func(storagedriver.FileInfo) error { return errors.New("walk failed") })
+	if err == nil || !strings.Contains(err.Error(), "walk failed") {
+		t.Errorf("expected the walk function's error, got: %v", err)
+	}
+}
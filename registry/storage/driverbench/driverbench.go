@@ -0,0 +1,320 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package driverbench loads a storage driver like a registry does while
+// images are pushed and pulled, and reports how it held up. It is meant to
+// size NATS clusters, and to compare the settings of the driver, like the
+// chunk size, by running it against each of them.
+package driverbench
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+const (
+	defaultPrefix    = "/driverbench"
+	defaultWriteSize = 1024 * 1024
+	// memoryInterval is how often the memory of the process is sampled.
+	memoryInterval = 100 * time.Millisecond
+)
+
+// Options configure a run.
+type Options struct {
+	// Pushers is the amount of layers that are pushed at the same time.
+	Pushers int
+	// Pullers is the amount of layers that are pulled at the same time.
+	Pullers int
+	// Layers is the amount of layers that are pushed, and then pulled.
+	Layers int
+	// LayerSize is the size of every layer in bytes.
+	LayerSize int64
+	// WriteSize is the amount of bytes that layers are written in, like
+	// the chunks of an upload. Zero means 1MiB.
+	WriteSize int
+	// Prefix is the directory that the layers are stored under, which is
+	// deleted after the run. Empty means /driverbench.
+	Prefix string
+}
+
+// Result describes a run.
+type Result struct {
+	Push Stats
+	Pull Stats
+	// PeakHeap is the most memory that the heap of the process used.
+	PeakHeap uint64
+	// Allocated is the amount of memory allocated during the run.
+	Allocated uint64
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("push: %s\npull: %s\nmemory: %s peak heap, %s allocated", r.Push, r.Pull, formatBytes(float64(r.PeakHeap)), formatBytes(float64(r.Allocated)))
+}
+
+// Stats describe the layers that were pushed or pulled.
+type Stats struct {
+	// Layers is the amount of layers that were transferred.
+	Layers int
+	// Errors is the amount of layers whose transfer failed.
+	Errors int
+	// Bytes is the amount of bytes of the layers that were transferred.
+	Bytes int64
+	// Elapsed is how long it took to transfer all of them.
+	Elapsed time.Duration
+	// P50, P99 and Max are the latencies of transferring a single layer.
+	P50 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Throughput returns the transferred bytes per second.
+func (s Stats) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d layers, %d errors, %s in %s, %s/s, p50 %s, p99 %s, max %s",
+		s.Layers, s.Errors, formatBytes(float64(s.Bytes)), s.Elapsed.Round(time.Millisecond), formatBytes(s.Throughput()),
+		s.P50.Round(time.Microsecond), s.P99.Round(time.Microsecond), s.Max.Round(time.Microsecond))
+}
+
+// Run pushes the layers to d, with the pushers at the same time, and then
+// pulls all of them back, with the pullers at the same time. Layers are
+// pushed like the registry does: they are written to an upload, which is
+// committed and moved to where the blob is kept. Every layer has content of
+// its own, so that deduplication does not make pushes look faster. The run
+// only returns an error when it can not be measured, the errors of layers
+// are counted in their stats.
+func Run(ctx context.Context, d storagedriver.StorageDriver, opts Options) (Result, error) {
+	if opts.Pushers < 1 || opts.Pullers < 1 {
+		return Result{}, fmt.Errorf("invalid pushers %d or pullers %d: must be at least 1", opts.Pushers, opts.Pullers)
+	}
+	if opts.Layers < 1 || opts.LayerSize < 0 {
+		return Result{}, fmt.Errorf("invalid layers %d of %d bytes: must be at least one layer", opts.Layers, opts.LayerSize)
+	}
+	if opts.WriteSize == 0 {
+		opts.WriteSize = defaultWriteSize
+	}
+	if opts.WriteSize < 0 {
+		return Result{}, fmt.Errorf("invalid write size %d: must not be negative", opts.WriteSize)
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = defaultPrefix
+	}
+
+	memory := sampleMemory()
+	defer memory.stop()
+	defer d.Delete(context.WithoutCancel(ctx), opts.Prefix)
+
+	pushed := make([]bool, opts.Layers)
+	result := Result{}
+	result.Push = run(ctx, opts.Layers, opts.Pushers, func(ctx context.Context, layer int) (int64, error) {
+		n, err := push(ctx, d, opts, layer)
+		pushed[layer] = err == nil
+		return n, err
+	})
+	result.Pull = run(ctx, opts.Layers, opts.Pullers, func(ctx context.Context, layer int) (int64, error) {
+		if !pushed[layer] {
+			return 0, errors.New("layer was not pushed")
+		}
+		return pull(ctx, d, opts, layer)
+	})
+	result.PeakHeap, result.Allocated = memory.stop()
+	return result, ctx.Err()
+}
+
+// run transfers every layer with f, with workers at the same time.
+func run(ctx context.Context, layers, workers int, f func(ctx context.Context, layer int) (int64, error)) Stats {
+	var (
+		mu        sync.Mutex
+		stats     Stats
+		latencies = make([]time.Duration, 0, layers)
+		next      = make(chan int)
+		wg        sync.WaitGroup
+	)
+
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for layer := range next {
+				began := time.Now()
+				n, err := f(ctx, layer)
+				latency := time.Since(began)
+
+				mu.Lock()
+				stats.Bytes += n
+				if err != nil {
+					stats.Errors++
+				} else {
+					stats.Layers++
+					latencies = append(latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for layer := 0; layer < layers && ctx.Err() == nil; layer++ {
+		next <- layer
+	}
+	close(next)
+	wg.Wait()
+	stats.Elapsed = time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	stats.P50 = percentile(latencies, 50)
+	stats.P99 = percentile(latencies, 99)
+	stats.Max = percentile(latencies, 100)
+	return stats
+}
+
+// percentile returns the latency that p percent of the sorted latencies are at or below.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	return sorted[max(i, 1)-1]
+}
+
+func uploadPath(opts Options, layer int) string {
+	return fmt.Sprintf("%s/uploads/%d/data", opts.Prefix, layer)
+}
+
+func blobPath(opts Options, layer int) string {
+	return fmt.Sprintf("%s/blobs/%d/data", opts.Prefix, layer)
+}
+
+// push writes the content of layer to its upload, and moves it to its blob.
+func push(ctx context.Context, d storagedriver.StorageDriver, opts Options, layer int) (int64, error) {
+	fw, err := d.Writer(ctx, uploadPath(opts, layer), false)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.CopyBuffer(fw, io.LimitReader(newContent(layer), opts.LayerSize), make([]byte, opts.WriteSize))
+	if err == nil {
+		err = fw.Commit(ctx)
+	}
+	if err != nil {
+		_ = fw.Cancel(ctx)
+		_ = fw.Close()
+		return n, err
+	}
+	if err := fw.Close(); err != nil {
+		return n, err
+	}
+	return n, d.Move(ctx, uploadPath(opts, layer), blobPath(opts, layer))
+}
+
+// pull reads the content of the blob of layer.
+func pull(ctx context.Context, d storagedriver.StorageDriver, opts Options, layer int) (int64, error) {
+	r, err := d.Reader(ctx, blobPath(opts, layer), 0)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := io.Copy(io.Discard, r)
+	if err == nil && n != opts.LayerSize {
+		err = fmt.Errorf("read %d bytes of a layer of %d bytes", n, opts.LayerSize)
+	}
+	return n, err
+}
+
+// content is the content of a layer, which does not compress.
+type content struct {
+	rand *rand.PCG
+}
+
+func newContent(layer int) io.Reader {
+	return &content{rand: rand.NewPCG(uint64(layer), 0)}
+}
+
+func (c *content) Read(p []byte) (int, error) {
+	var word [8]byte
+	for i := 0; i < len(p); i += len(word) {
+		binary.LittleEndian.PutUint64(word[:], c.rand.Uint64())
+		copy(p[i:], word[:])
+	}
+	return len(p), nil
+}
+
+// memorySampler keeps track of the memory that the process uses.
+type memorySampler struct {
+	start     uint64
+	peak      uint64
+	once      sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+	allocated uint64
+}
+
+func sampleMemory() *memorySampler {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	ms := &memorySampler{
+		start:   stats.TotalAlloc,
+		peak:    stats.HeapInuse,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(ms.stopped)
+		ticker := time.NewTicker(memoryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				runtime.ReadMemStats(&stats)
+				ms.peak = max(ms.peak, stats.HeapInuse)
+			case <-ms.done:
+				runtime.ReadMemStats(&stats)
+				ms.peak = max(ms.peak, stats.HeapInuse)
+				ms.allocated = stats.TotalAlloc - ms.start
+				return
+			}
+		}
+	}()
+	return ms
+}
+
+// stop stops sampling, and returns the peak heap and the allocated memory.
+func (ms *memorySampler) stop() (uint64, uint64) {
+	ms.once.Do(func() { close(ms.done) })
+	<-ms.stopped
+	return ms.peak, ms.allocated
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
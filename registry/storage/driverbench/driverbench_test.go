@@ -0,0 +1,105 @@
+// Copyright 2024 Robin Ketelbuters
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driverbench
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	result, err := Run(ctx, d, Options{
+		Pushers:   3,
+		Pullers:   2,
+		Layers:    5,
+		LayerSize: 3*1024 + 7,
+		WriteSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, stats := range map[string]Stats{"push": result.Push, "pull": result.Pull} {
+		if stats.Layers != 5 || stats.Errors != 0 || stats.Bytes != 5*(3*1024+7) {
+			t.Errorf("%s: expected every layer to be transferred, got: %s", name, stats)
+		}
+		if stats.P50 <= 0 || stats.P50 > stats.P99 || stats.P99 > stats.Max || stats.Throughput() <= 0 {
+			t.Errorf("%s: expected the latencies to be measured, got: %s", name, stats)
+		}
+	}
+	if result.PeakHeap == 0 {
+		t.Error("expected the memory to be measured")
+	}
+	if _, err := d.Stat(ctx, defaultPrefix); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected the layers to be deleted after the run, got: %v", err)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	result, err := Run(context.Background(), &failingDriver{inmemory.New()}, Options{Pushers: 1, Pullers: 1, Layers: 2, LayerSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Push.Errors != 2 || result.Pull.Errors != 2 {
+		t.Errorf("expected the failed layers to be counted, got: %s", result)
+	}
+
+	if _, err := Run(context.Background(), inmemory.New(), Options{Layers: 1}); err == nil {
+		t.Error("expected a run without pushers to be rejected")
+	}
+}
+
+// failingDriver fails every move.
+type failingDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (fd *failingDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return errors.New("move failed")
+}
+
+func TestContent(t *testing.T) {
+	read := func(layer int) []byte {
+		content, err := io.ReadAll(io.LimitReader(newContent(layer), 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+	if !bytes.Equal(read(1), read(1)) || bytes.Equal(read(1), read(2)) {
+		t.Error("expected every layer to have content of its own")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+	if p50, p99, max := percentile(latencies, 50), percentile(latencies, 99), percentile(latencies, 100); p50 != 50*time.Millisecond || p99 != 99*time.Millisecond || max != 100*time.Millisecond {
+		t.Errorf("expected the percentiles of the latencies, got p50 %s, p99 %s and max %s", p50, p99, max)
+	}
+	if percentile(latencies[:1], 99) != time.Millisecond || percentile(nil, 99) != 0 {
+		t.Error("expected the percentiles of few latencies")
+	}
+}